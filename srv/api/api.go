@@ -1,6 +1,7 @@
 // Package api implements the HTTP server, routing and request handlers for the
 // immotep application. It exposes REST endpoints to query transactions (POIs),
-// cities, departments and regions and serves the UI static assets.
+// cities, IRIS zones, EPCI, departments, regions and user-defined zones and
+// serves the UI static assets.
 //
 // Responsibilities:
 // - Build and configure a Gin router with API routes and static file serving.
@@ -10,16 +11,21 @@ package api
 
 import (
 	"embed"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/fs"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 	"gorm.io/gorm"
+	"jc.org/immotep/loader"
 	"jc.org/immotep/model"
 )
 
@@ -133,6 +139,15 @@ type FilterInfoBody struct {
 	After     string      `form:"after"`
 }
 
+// ZoneBody is the JSON body expected by POST /api/zones.
+//
+// Contour is a GeoJSON Polygon or MultiPolygon (bare geometry, Feature or
+// FeatureCollection).
+type ZoneBody struct {
+	Name    string          `json:"name" binding:"required"`
+	Contour json.RawMessage `json:"contour" binding:"required"`
+}
+
 // POISQuery models query parameters accepted by POI/city endpoints.
 type POISQuery struct {
 	Limit   int    `form:"limit"`
@@ -140,6 +155,172 @@ type POISQuery struct {
 	ZipCode int    `form:"zip"`
 	DepCode string `form:"dep"`
 	After   string `form:"after"`
+	// exclude sales closer than this distance (m) to a power line
+	MinLineDistance float64 `form:"minLineDistance"`
+	// keep sales within these distances (m) of an amenity
+	MaxSchoolDistance      float64 `form:"maxSchoolDistance"`
+	MaxStationDistance     float64 `form:"maxStationDistance"`
+	MaxSupermarketDistance float64 `form:"maxSupermarketDistance"`
+	MaxDoctorDistance      float64 `form:"maxDoctorDistance"`
+}
+
+// RealQuery models the query parameters asking for real prices (deflated
+// by the consumer price index) in euros of Base (default latest index year).
+type RealQuery struct {
+	Real bool `form:"real"`
+	Base int  `form:"base"`
+}
+
+// queryDeflator returns the deflator requested by the real and base query
+// parameters (nil for nominal prices). It answers 400 and returns false when
+// real prices are requested but no index is loaded for the base year.
+func queryDeflator(c *gin.Context) (*model.Deflator, bool) {
+	var param RealQuery
+	if c.ShouldBindQuery(&param) != nil || !param.Real {
+		return nil, true
+	}
+
+	deflator := model.NewDeflator(immotepDB, param.Base)
+	if deflator == nil {
+		c.JSON(400, gin.H{"error": "no consumer price index for base year"})
+		return nil, false
+	}
+
+	return deflator, true
+}
+
+// AffordabilityQuery models query parameters accepted by /api/affordability.
+type AffordabilityQuery struct {
+	Level string `form:"level"`
+	Code  string `form:"code"`
+	Year  int    `form:"year"`
+}
+
+// LiquidityQuery models query parameters accepted by /api/liquidity.
+type LiquidityQuery struct {
+	Level string `form:"level"`
+	Code  string `form:"code"`
+	Year  int    `form:"year"`
+}
+
+// SeriesQuery models query parameters accepted by /api/series.
+type SeriesQuery struct {
+	Level       string `form:"level"`
+	Code        string `form:"code" binding:"required"`
+	Granularity string `form:"granularity"`
+}
+
+// ForecastQuery models query parameters accepted by /api/forecast.
+type ForecastQuery struct {
+	Level       string `form:"level"`
+	Code        string `form:"code" binding:"required"`
+	Granularity string `form:"granularity"`
+}
+
+// RepeatSalesQuery models query parameters accepted by /api/repeatsales.
+type RepeatSalesQuery struct {
+	Level string `form:"level"`
+	Code  string `form:"code"`
+}
+
+// EstimateBody models the JSON body accepted by POST /api/estimate: the
+// house characteristics and its location as lat/lng, commune code or
+// address (geocoded).
+type EstimateBody struct {
+	Address string `json:"address"`
+	model.ValuationInput
+}
+
+// ComparablesQuery models query parameters accepted by /api/comparables.
+type ComparablesQuery struct {
+	Lat      float64 `form:"lat"`
+	Long     float64 `form:"lng"`
+	Area     int     `form:"area"`
+	LandArea int     `form:"land"`
+	NbRoom   int     `form:"rooms"`
+	K        int     `form:"k"`
+	Radius   float64 `form:"radius"`
+	Years    int     `form:"years"`
+}
+
+// SurfaceQuery models query parameters accepted by /api/surface.
+type SurfaceQuery struct {
+	Lat       float64 `form:"lat"`
+	Long      float64 `form:"lng"`
+	City      string  `form:"city"`
+	Year      int     `form:"year"`
+	Bandwidth float64 `form:"bandwidth"`
+}
+
+// SegmentQuery models query parameters accepted by /api/segments. Area,
+// Rooms and Land select the segment of a house (the bucket containing the
+// value) instead of Dimension and Bucket.
+type SegmentQuery struct {
+	Level     string `form:"level"`
+	Code      string `form:"code" binding:"required"`
+	Dimension string `form:"dimension"`
+	Bucket    string `form:"bucket"`
+	Year      int    `form:"year"`
+	Area      *int   `form:"area"`
+	Rooms     *int   `form:"rooms"`
+	Land      *int   `form:"land"`
+}
+
+// HotSpotQuery models query parameters accepted by /api/hotspots.
+type HotSpotQuery struct {
+	DepCode string `form:"dep"`
+	Year    int    `form:"year"`
+	Class   string `form:"class"`
+}
+
+// GridQuery models query parameters accepted by /api/grid. BBox is
+// "minLng,minLat,maxLng,maxLat".
+type GridQuery struct {
+	Res  int    `form:"res"`
+	BBox string `form:"bbox" binding:"required"`
+	Year int    `form:"year"`
+}
+
+// parseBBox parses a "minLng,minLat,maxLng,maxLat" bounding box.
+func parseBBox(bbox string) (model.Bounds, error) {
+	parts := strings.Split(bbox, ",")
+	if len(parts) != 4 {
+		return model.Bounds{}, errors.New("bbox must be minLng,minLat,maxLng,maxLat")
+	}
+
+	values := make([]float64, 4)
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return model.Bounds{}, fmt.Errorf("bad bbox value %q", p)
+		}
+		values[i] = v
+	}
+	if values[0] > values[2] || values[1] > values[3] {
+		return model.Bounds{}, errors.New("bbox min is greater than max")
+	}
+
+	return model.Bounds{MinLong: values[0], MinLat: values[1], MaxLong: values[2], MaxLat: values[3]}, nil
+}
+
+// RiskQuery models query parameters accepted by /api/risks.
+type RiskQuery struct {
+	DepCode string `form:"dep"`
+	City    string `form:"city"`
+}
+
+// OutlierQuery models query parameters accepted by /api/outliers.
+type OutlierQuery struct {
+	DepCode string `form:"dep"`
+	Reason  string `form:"reason"`
+	Limit   int    `form:"limit"`
+}
+
+// OutlierResponse holds the outlier report and the most recent flagged
+// transactions returned by /api/outliers.
+type OutlierResponse struct {
+	Report       *model.OutlierReport   `json:"report"`
+	Transactions []model.TransactionPOI `json:"transactions"`
 }
 
 // addRoutes registers all API endpoints on the provided router group.
@@ -149,8 +330,49 @@ type POISQuery struct {
 //   - POST /api/pois/filter : bounding-box search for POIs
 //   - GET  /api/cities      : list cities (optional department filter)
 //   - POST /api/cities      : bounding-box search for cities
+//   - POST /api/iris        : bounding-box search for IRIS zones
 //   - GET  /api/regions     : list regions
 //   - GET  /api/departments : list departments
+//   - GET  /api/epcis       : list EPCI (optional department filter)
+//   - GET  /api/zones       : list user-defined zones
+//   - POST /api/zones       : create or replace a zone from a GeoJSON polygon
+//   - GET  /api/zones/:code : zone details with yearly stats
+//   - GET  /api/zones/:code/transactions : transactions inside a zone
+//   - DELETE /api/zones/:code : delete a zone
+//   - GET  /api/affordability : yearly affordability of a level (city, iris,
+//     epci, department, region, zone)
+//   - GET  /api/liquidity   : yearly sales count, volume, turnover rate and
+//     weak average flag of a level (optional code and year)
+//   - GET  /api/series      : monthly or quarterly series of a code of a
+//     level with rolling 12-month averages
+//   - GET  /api/forecast    : price forecasts of a code of a level for the
+//     next year with prediction intervals and backtest metrics
+//   - GET  /api/index       : yearly hedonic price index and raw averages
+//     (optional dep)
+//   - GET  /api/repeatsales : yearly repeat-sales index of departments or
+//     regions (optional level and code)
+//   - POST /api/estimate    : estimated price of a house with its prediction
+//     interval and the valuation model used
+//   - GET  /api/comparables : most similar recent sales around a property
+//     with their score breakdown and adjusted price per m²
+//   - GET  /api/segments    : yearly stats of a code of a level by area,
+//     rooms or land segment (optional dimension, bucket, year or the area,
+//     rooms or land of a house)
+//   - GET  /api/hotspots    : hot/cold spot classes of the city price growth
+//     (optional dep, year and class)
+//   - GET  /api/surface     : interpolated price per m² and its uncertainty
+//     at a point or at the center of a commune
+//   - GET  /api/grid        : geohash grid cells of a bounding box as GeoJSON
+//     with count, median price per m² and yearly change (optional year)
+//   - GET  /api/dpe         : price stats by DPE class (optional dep and year)
+//   - GET  /api/risks       : prices inside/outside risk zones per commune
+//   - GET  /api/powerlines  : prices by distance band to power lines
+//   - GET  /api/outliers    : transactions excluded from the statistics by
+//     reason (optional dep, reason and limit)
+//
+// POIs, cities, IRIS, regions, departments, EPCI and zones accept real=true
+// (and optionally base={year}) to return prices deflated by the consumer
+// price index.
 //
 // Handlers lazily ensure immotepDB is connected (reconnect using immotepDSN).
 func addRoutes(rg *gin.RouterGroup) {
@@ -197,6 +419,7 @@ func addRoutes(rg *gin.RouterGroup) {
 
 		limit := -1
 		year := -1
+		var filter model.POIFilter
 
 		// get value from query param
 		var param POISQuery
@@ -207,6 +430,14 @@ func addRoutes(rg *gin.RouterGroup) {
 			if param.Year >= 0 {
 				year = param.Year
 			}
+			filter = model.POIFilter{MinLineDistance: param.MinLineDistance,
+				MaxSchoolDistance: param.MaxSchoolDistance, MaxStationDistance: param.MaxStationDistance,
+				MaxSupermarketDistance: param.MaxSupermarketDistance, MaxDoctorDistance: param.MaxDoctorDistance}
+		}
+
+		deflator, ok := queryDeflator(c)
+		if !ok {
+			return
 		}
 
 		var body FilterInfoBody
@@ -220,7 +451,7 @@ func addRoutes(rg *gin.RouterGroup) {
 		pois := model.GetPOIFromBounds(immotepDB,
 			body.NorthEast.Lat, body.NorthEast.Long,
 			body.SouthWest.Lat, body.SouthWest.Long,
-			limit, body.After, year)
+			limit, body.After, year, filter, deflator)
 
 		if pois == nil {
 			c.JSON(500, model.BoundedTransactionInfo{})
@@ -249,7 +480,12 @@ func addRoutes(rg *gin.RouterGroup) {
 
 		log.Debugf("Get city info for dep %v\n", dep)
 
-		infos := model.GetCityDetails(immotepDB, dep)
+		deflator, ok := queryDeflator(c)
+		if !ok {
+			return
+		}
+
+		infos := model.GetCityDetails(immotepDB, dep, deflator)
 
 		c.JSON(200, infos)
 
@@ -270,6 +506,11 @@ func addRoutes(rg *gin.RouterGroup) {
 			}
 		}
 
+		deflator, ok := queryDeflator(c)
+		if !ok {
+			return
+		}
+
 		var body FilterInfoBody
 		err := c.BindJSON(&body)
 		if err != nil {
@@ -281,7 +522,47 @@ func addRoutes(rg *gin.RouterGroup) {
 		infos := model.GetCitiesFromBounds(immotepDB,
 			body.NorthEast.Lat, body.NorthEast.Long,
 			body.SouthWest.Lat, body.SouthWest.Long,
-			limit)
+			limit, deflator)
+
+		if infos == nil {
+			c.JSON(500, nil)
+			return
+		}
+		c.JSON(200, infos)
+	})
+
+	rg.POST("/iris", func(c *gin.Context) {
+		if immotepDB == nil {
+			immotepDB = model.ConnectToDB(immotepDSN)
+		}
+
+		limit := -1
+
+		// get value from query param
+		var param POISQuery
+		if c.ShouldBindQuery(&param) == nil {
+			if param.Limit >= 0 {
+				limit = param.Limit
+			}
+		}
+
+		deflator, ok := queryDeflator(c)
+		if !ok {
+			return
+		}
+
+		var body FilterInfoBody
+		err := c.BindJSON(&body)
+		if err != nil {
+			log.Printf("Error in POST /iris: %v\n", err)
+			c.JSON(400, nil)
+			return
+		}
+
+		infos := model.GetIrisFromBounds(immotepDB,
+			body.NorthEast.Lat, body.NorthEast.Long,
+			body.SouthWest.Lat, body.SouthWest.Long,
+			limit, deflator)
 
 		if infos == nil {
 			c.JSON(500, nil)
@@ -295,7 +576,12 @@ func addRoutes(rg *gin.RouterGroup) {
 			immotepDB = model.ConnectToDB(immotepDSN)
 		}
 
-		infos := model.GetRegionDetails(immotepDB)
+		deflator, ok := queryDeflator(c)
+		if !ok {
+			return
+		}
+
+		infos := model.GetRegionDetails(immotepDB, deflator)
 
 		c.JSON(200, infos)
 
@@ -306,9 +592,559 @@ func addRoutes(rg *gin.RouterGroup) {
 			immotepDB = model.ConnectToDB(immotepDSN)
 		}
 
-		infos := model.GetDepartmentDetails(immotepDB)
+		deflator, ok := queryDeflator(c)
+		if !ok {
+			return
+		}
+
+		infos := model.GetDepartmentDetails(immotepDB, deflator)
 
 		c.JSON(200, infos)
 
 	})
+
+	/*
+		/epcis?dep={}
+	*/
+	rg.GET("/epcis", func(c *gin.Context) {
+		if immotepDB == nil {
+			immotepDB = model.ConnectToDB(immotepDSN)
+		}
+
+		dep := ""
+
+		// get value from query param
+		var param POISQuery
+		if c.ShouldBindQuery(&param) == nil {
+			if param.DepCode != "" {
+				dep = param.DepCode
+			}
+		}
+
+		deflator, ok := queryDeflator(c)
+		if !ok {
+			return
+		}
+
+		infos := model.GetEpciDetails(immotepDB, dep, deflator)
+		if infos == nil {
+			c.JSON(500, []model.EpciInfo{})
+			return
+		}
+
+		c.JSON(200, infos)
+	})
+
+	rg.GET("/zones", func(c *gin.Context) {
+		if immotepDB == nil {
+			immotepDB = model.ConnectToDB(immotepDSN)
+		}
+
+		deflator, ok := queryDeflator(c)
+		if !ok {
+			return
+		}
+
+		infos := model.GetZones(immotepDB, deflator)
+		if infos == nil {
+			c.JSON(500, []model.ZoneInfo{})
+			return
+		}
+
+		c.JSON(200, infos)
+	})
+
+	rg.POST("/zones", func(c *gin.Context) {
+		if immotepDB == nil {
+			immotepDB = model.ConnectToDB(immotepDSN)
+		}
+
+		var body ZoneBody
+		err := c.BindJSON(&body)
+		if err != nil {
+			log.Printf("Error in POST /zones: %v\n", err)
+			c.JSON(400, nil)
+			return
+		}
+
+		if immotepDB == nil {
+			c.JSON(500, nil)
+			return
+		}
+
+		info, err := model.SaveZone(immotepDB, body.Name, body.Contour)
+		if errors.Is(err, model.ErrInvalidZone) {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(500, nil)
+			return
+		}
+		c.JSON(201, info)
+	})
+
+	rg.GET("/zones/:code", func(c *gin.Context) {
+		if immotepDB == nil {
+			immotepDB = model.ConnectToDB(immotepDSN)
+		}
+
+		deflator, ok := queryDeflator(c)
+		if !ok {
+			return
+		}
+
+		info, err := model.GetZone(immotepDB, c.Param("code"), deflator)
+		if errors.Is(err, model.ErrZoneNotFound) {
+			c.JSON(404, nil)
+			return
+		} else if err != nil {
+			c.JSON(500, nil)
+			return
+		}
+		c.JSON(200, info)
+	})
+
+	/*
+		/zones/:code/transactions?limit={}
+	*/
+	rg.GET("/zones/:code/transactions", func(c *gin.Context) {
+		if immotepDB == nil {
+			immotepDB = model.ConnectToDB(immotepDSN)
+		}
+
+		limit := -1
+
+		// get value from query param
+		var param POISQuery
+		if c.ShouldBindQuery(&param) == nil {
+			if param.Limit >= 0 {
+				limit = param.Limit
+			}
+		}
+
+		pois := model.GetZoneTransactions(immotepDB, c.Param("code"), limit)
+		if pois == nil {
+			c.JSON(500, []model.TransactionPOI{})
+			return
+		}
+		c.JSON(200, pois)
+	})
+
+	rg.DELETE("/zones/:code", func(c *gin.Context) {
+		if immotepDB == nil {
+			immotepDB = model.ConnectToDB(immotepDSN)
+		}
+
+		err := model.DeleteZone(immotepDB, c.Param("code"))
+		if errors.Is(err, model.ErrZoneNotFound) {
+			c.JSON(404, nil)
+			return
+		} else if err != nil {
+			c.JSON(500, nil)
+			return
+		}
+		c.Status(204)
+	})
+
+	/*
+		/affordability?level={}&code={}&year={}
+	*/
+	rg.GET("/affordability", func(c *gin.Context) {
+		if immotepDB == nil {
+			immotepDB = model.ConnectToDB(immotepDSN)
+		}
+
+		param := AffordabilityQuery{Level: "city"}
+		if err := c.ShouldBindQuery(&param); err != nil {
+			c.JSON(400, []model.AffordabilityInfo{})
+			return
+		}
+
+		infos, err := model.GetAffordability(immotepDB, param.Level, param.Code, param.Year)
+		if errors.Is(err, model.ErrUnknownLevel) {
+			c.JSON(400, []model.AffordabilityInfo{})
+			return
+		} else if err != nil {
+			c.JSON(500, []model.AffordabilityInfo{})
+			return
+		}
+		c.JSON(200, infos)
+	})
+
+	/*
+		/liquidity?level={}&code={}&year={}
+	*/
+	rg.GET("/liquidity", func(c *gin.Context) {
+		if immotepDB == nil {
+			immotepDB = model.ConnectToDB(immotepDSN)
+		}
+
+		param := LiquidityQuery{Level: "city"}
+		if err := c.ShouldBindQuery(&param); err != nil {
+			c.JSON(400, []model.LiquidityInfo{})
+			return
+		}
+
+		infos, err := model.GetLiquidity(immotepDB, param.Level, param.Code, param.Year)
+		if errors.Is(err, model.ErrUnknownLevel) {
+			c.JSON(400, []model.LiquidityInfo{})
+			return
+		} else if err != nil {
+			c.JSON(500, []model.LiquidityInfo{})
+			return
+		}
+		c.JSON(200, infos)
+	})
+
+	/*
+		/series?level={}&code={}&granularity={month|quarter}
+	*/
+	rg.GET("/series", func(c *gin.Context) {
+		if immotepDB == nil {
+			immotepDB = model.ConnectToDB(immotepDSN)
+		}
+
+		param := SeriesQuery{Level: "city", Granularity: model.GRANULARITY_MONTH}
+		if err := c.ShouldBindQuery(&param); err != nil {
+			c.JSON(400, []model.PeriodAgg{})
+			return
+		}
+
+		series, err := model.GetSeries(immotepDB, param.Level, param.Code, param.Granularity)
+		if errors.Is(err, model.ErrUnknownLevel) || errors.Is(err, model.ErrUnknownGranularity) {
+			c.JSON(400, []model.PeriodAgg{})
+			return
+		} else if err != nil {
+			c.JSON(500, []model.PeriodAgg{})
+			return
+		}
+		c.JSON(200, series)
+	})
+
+	/*
+		/forecast?level={}&code={}&granularity={month|year}
+	*/
+	rg.GET("/forecast", func(c *gin.Context) {
+		if immotepDB == nil {
+			immotepDB = model.ConnectToDB(immotepDSN)
+		}
+
+		param := ForecastQuery{Level: "city", Granularity: model.GRANULARITY_MONTH}
+		if err := c.ShouldBindQuery(&param); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+
+		info, err := model.GetForecast(immotepDB, param.Level, param.Code, param.Granularity)
+		if errors.Is(err, model.ErrUnknownLevel) || errors.Is(err, model.ErrUnknownGranularity) {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		} else if errors.Is(err, model.ErrNoForecast) {
+			c.JSON(404, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, info)
+	})
+
+	/*
+		/index?dep={}
+	*/
+	rg.GET("/index", func(c *gin.Context) {
+		if immotepDB == nil {
+			immotepDB = model.ConnectToDB(immotepDSN)
+		}
+
+		var param POISQuery
+		c.ShouldBindQuery(&param)
+
+		indices := model.GetHedonicIndex(immotepDB, param.DepCode)
+		if indices == nil {
+			c.JSON(500, []model.HedonicIndex{})
+			return
+		}
+		c.JSON(200, indices)
+	})
+
+	/*
+		/repeatsales?level={department|region}&code={}
+	*/
+	rg.GET("/repeatsales", func(c *gin.Context) {
+		if immotepDB == nil {
+			immotepDB = model.ConnectToDB(immotepDSN)
+		}
+
+		param := RepeatSalesQuery{Level: "department"}
+		c.ShouldBindQuery(&param)
+
+		indices, err := model.GetRepeatSalesIndex(immotepDB, param.Level, param.Code)
+		if errors.Is(err, model.ErrNoRepeatSalesLevel) {
+			c.JSON(400, []model.RepeatSalesIndex{})
+			return
+		} else if err != nil {
+			c.JSON(500, []model.RepeatSalesIndex{})
+			return
+		}
+		c.JSON(200, indices)
+	})
+
+	rg.POST("/estimate", func(c *gin.Context) {
+		if immotepDB == nil {
+			immotepDB = model.ConnectToDB(immotepDSN)
+		}
+
+		var body EstimateBody
+		if err := c.BindJSON(&body); err != nil {
+			log.Printf("Error in POST /estimate: %v\n", err)
+			c.JSON(400, nil)
+			return
+		}
+
+		input := body.ValuationInput
+		if body.Address != "" && input.CityCode == "" && input.Lat == 0 && input.Long == 0 {
+			lat, long, city, err := loader.GeocodeAddress(body.Address)
+			if err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			input.Lat, input.Long, input.CityCode = lat, long, city
+		}
+
+		estimate, err := model.EstimatePrice(immotepDB, input)
+		if errors.Is(err, model.ErrBadValuationInput) || errors.Is(err, model.ErrUnknownLocation) {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		} else if errors.Is(err, model.ErrNoValuationModel) {
+			c.JSON(404, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(500, nil)
+			return
+		}
+		c.JSON(200, estimate)
+	})
+
+	/*
+		/comparables?lat={}&lng={}&area={}&land={}&rooms={}&k={}&radius={}&years={}
+	*/
+	rg.GET("/comparables", func(c *gin.Context) {
+		if immotepDB == nil {
+			immotepDB = model.ConnectToDB(immotepDSN)
+		}
+
+		var param ComparablesQuery
+		if err := c.ShouldBindQuery(&param); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+
+		info, err := model.GetComparables(immotepDB, model.ComparableQuery(param))
+		if errors.Is(err, model.ErrBadComparableQuery) {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(500, nil)
+			return
+		}
+		c.JSON(200, info)
+	})
+
+	/*
+		/segments?level={city|iris|epci|department|region|zone}&code={}&dimension={area|rooms|land}&bucket={}&year={}
+		/segments?level={}&code={}&area={}
+	*/
+	rg.GET("/segments", func(c *gin.Context) {
+		if immotepDB == nil {
+			immotepDB = model.ConnectToDB(immotepDSN)
+		}
+
+		param := SegmentQuery{Level: "city"}
+		if err := c.ShouldBindQuery(&param); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		switch {
+		case param.Area != nil:
+			param.Dimension, param.Bucket = model.SEGMENT_AREA, model.SegmentBucket(model.SEGMENT_AREA, *param.Area)
+		case param.Rooms != nil:
+			param.Dimension, param.Bucket = model.SEGMENT_ROOMS, model.SegmentBucket(model.SEGMENT_ROOMS, *param.Rooms)
+		case param.Land != nil:
+			param.Dimension, param.Bucket = model.SEGMENT_LAND, model.SegmentBucket(model.SEGMENT_LAND, *param.Land)
+		}
+
+		segments, err := model.GetSegments(immotepDB, param.Level, param.Code, param.Dimension, param.Bucket, param.Year)
+		if errors.Is(err, model.ErrUnknownLevel) || errors.Is(err, model.ErrUnknownSegment) {
+			c.JSON(400, []model.SegmentAgg{})
+			return
+		} else if err != nil {
+			c.JSON(500, []model.SegmentAgg{})
+			return
+		}
+		c.JSON(200, segments)
+	})
+
+	/*
+		/hotspots?dep={}&year={}&class={}
+	*/
+	rg.GET("/hotspots", func(c *gin.Context) {
+		if immotepDB == nil {
+			immotepDB = model.ConnectToDB(immotepDSN)
+		}
+
+		var param HotSpotQuery
+		c.ShouldBindQuery(&param)
+
+		spots, err := model.GetHotSpots(immotepDB, param.DepCode, param.Year, param.Class)
+		if err != nil {
+			c.JSON(500, []model.HotSpot{})
+			return
+		}
+		c.JSON(200, spots)
+	})
+
+	/*
+		/surface?lat={}&lng={}&city={}&year={}&bandwidth={}
+	*/
+	rg.GET("/surface", func(c *gin.Context) {
+		if immotepDB == nil {
+			immotepDB = model.ConnectToDB(immotepDSN)
+		}
+
+		var param SurfaceQuery
+		if err := c.ShouldBindQuery(&param); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+
+		estimate, err := model.EstimateSurface(immotepDB, param.Lat, param.Long, param.City, param.Year, param.Bandwidth)
+		if errors.Is(err, model.ErrBadSurfaceQuery) {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		} else if errors.Is(err, model.ErrUnknownLocation) {
+			c.JSON(404, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(500, nil)
+			return
+		}
+		c.JSON(200, estimate)
+	})
+
+	/*
+		/grid?res={4..7}&bbox={minLng,minLat,maxLng,maxLat}&year={}
+	*/
+	rg.GET("/grid", func(c *gin.Context) {
+		if immotepDB == nil {
+			immotepDB = model.ConnectToDB(immotepDSN)
+		}
+
+		param := GridQuery{Res: 5}
+		if err := c.ShouldBindQuery(&param); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		bounds, err := parseBBox(param.BBox)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+
+		cells, err := model.GetGridCells(immotepDB, param.Res, bounds, param.Year)
+		if errors.Is(err, model.ErrUnknownResolution) {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(500, nil)
+			return
+		}
+		c.JSON(200, cells)
+	})
+
+	/*
+		/dpe?dep={}&year={}
+	*/
+	rg.GET("/dpe", func(c *gin.Context) {
+		if immotepDB == nil {
+			immotepDB = model.ConnectToDB(immotepDSN)
+		}
+
+		dep := ""
+		year := -1
+
+		// get value from query param
+		var param POISQuery
+		if c.ShouldBindQuery(&param) == nil {
+			dep = param.DepCode
+			if param.Year > 0 {
+				year = param.Year
+			}
+		}
+
+		stats := model.GetDpeStats(immotepDB, dep, year)
+		if stats == nil {
+			c.JSON(500, []model.DpeYearlyAgg{})
+			return
+		}
+		c.JSON(200, stats)
+	})
+
+	/*
+		/risks?dep={}&city={}
+	*/
+	rg.GET("/risks", func(c *gin.Context) {
+		if immotepDB == nil {
+			immotepDB = model.ConnectToDB(immotepDSN)
+		}
+
+		var param RiskQuery
+		c.ShouldBindQuery(&param)
+
+		stats := model.GetRiskStats(immotepDB, param.DepCode, param.City)
+		if stats == nil {
+			c.JSON(500, []model.RiskCityAgg{})
+			return
+		}
+		c.JSON(200, stats)
+	})
+
+	/*
+		/powerlines?dep={}
+	*/
+	rg.GET("/powerlines", func(c *gin.Context) {
+		if immotepDB == nil {
+			immotepDB = model.ConnectToDB(immotepDSN)
+		}
+
+		var param POISQuery
+		c.ShouldBindQuery(&param)
+
+		stats := model.GetPowerLineStats(immotepDB, param.DepCode)
+		if stats == nil {
+			c.JSON(500, []model.PowerLineAgg{})
+			return
+		}
+		c.JSON(200, stats)
+	})
+
+	/*
+		/outliers?dep={}&reason={}&limit={}
+	*/
+	rg.GET("/outliers", func(c *gin.Context) {
+		if immotepDB == nil {
+			immotepDB = model.ConnectToDB(immotepDSN)
+		}
+
+		var param OutlierQuery
+		c.ShouldBindQuery(&param)
+
+		report := model.GetOutlierReport(immotepDB, param.DepCode)
+		trans := model.GetOutliers(immotepDB, param.DepCode, param.Reason, param.Limit)
+		if report == nil || trans == nil {
+			c.JSON(500, OutlierResponse{Transactions: []model.TransactionPOI{}})
+			return
+		}
+		c.JSON(200, OutlierResponse{Report: report, Transactions: trans})
+	})
 }
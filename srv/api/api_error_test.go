@@ -202,6 +202,32 @@ func TestDepartmentsEndpointError(t *testing.T) {
 	}
 }
 
+func TestEpcisEndpointError(t *testing.T) {
+	router := BuildRouter("memfile", "", true)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/epcis", nil)
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status 500, got %d", w.Code)
+	}
+}
+
+func TestZonesEndpointError(t *testing.T) {
+	router := BuildRouter("memfile", "", true)
+
+	for _, query := range []string{"/api/zones", "/api/zones/centre", "/api/zones/centre/transactions"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", query, nil)
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("%v: expected status 500, got %d", query, w.Code)
+		}
+	}
+}
+
 func TestGetPOIsError(t *testing.T) {
 	router := BuildRouter("memfile", "", true)
 
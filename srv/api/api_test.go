@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -214,6 +215,18 @@ func TestPOIsFilterEndpoint(t *testing.T) {
 			body:       body,
 			wantStatus: http.StatusOK,
 		},
+		{
+			name:       "Filter far from power lines",
+			query:      "/api/pois/filter?minLineDistance=500",
+			body:       body,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "Filter near a station and a school",
+			query:      "/api/pois/filter?maxStationDistance=800&maxSchoolDistance=500",
+			body:       body,
+			wantStatus: http.StatusOK,
+		},
 		{
 			name:       "Invalid body",
 			query:      "/api/pois/filter",
@@ -291,6 +304,45 @@ func TestCitiesPostEndpoint(t *testing.T) {
 	}
 }
 
+func TestIrisPostEndpoint(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	router := BuildRouter(dsn, "", true)
+
+	tests := []struct {
+		name       string
+		body       []byte
+		wantStatus int
+	}{
+		{
+			name: "Basic IRIS request",
+			body: []byte(`{
+				"northEast": {"lat": 48.86, "lng": 2.35},
+				"southWest": {"lat": 48.85, "lng": 2.34}
+			}`),
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "Invalid body",
+			body:       []byte(`{"invalid": "json"`),
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/api/iris?limit=10", bytes.NewBuffer(tt.body))
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, w.Code)
+			}
+		})
+	}
+}
+
 func TestRegionsEndpoint(t *testing.T) {
 	db, dsn := openTestDB(t)
 	seedMinimal(db, t)
@@ -321,6 +373,427 @@ func TestDepartmentsEndpoint(t *testing.T) {
 	}
 }
 
+func TestEpcisEndpoint(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	router := BuildRouter(dsn, "", true)
+
+	for _, query := range []string{"/api/epcis", "/api/epcis?dep=D1"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", query, nil)
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("%v: expected status 200, got %d", query, w.Code)
+		}
+	}
+}
+
+func TestZonesEndpoints(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+	db.Exec("DELETE FROM zones")
+	db.Exec("DELETE FROM zone_transactions")
+
+	router := BuildRouter(dsn, "", true)
+
+	tests := []struct {
+		name       string
+		method     string
+		url        string
+		body       string
+		wantStatus int
+	}{
+		{"Create zone", "POST", "/api/zones", `{"name": "Centre", "contour": {"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,1],[0,0]]]}}`, http.StatusCreated},
+		{"Invalid body", "POST", "/api/zones", `{"name": "Centre"`, http.StatusBadRequest},
+		{"Invalid polygon", "POST", "/api/zones", `{"name": "Point", "contour": {"type":"Point","coordinates":[0,0]}}`, http.StatusBadRequest},
+		{"Empty zone name", "POST", "/api/zones", `{"name": "--", "contour": {"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,1],[0,0]]]}}`, http.StatusBadRequest},
+		{"List zones", "GET", "/api/zones", "", http.StatusOK},
+		{"Zone details", "GET", "/api/zones/centre", "", http.StatusOK},
+		{"Zone transactions", "GET", "/api/zones/centre/transactions?limit=10", "", http.StatusOK},
+		{"Unknown zone", "GET", "/api/zones/unknown", "", http.StatusNotFound},
+		{"Delete zone", "DELETE", "/api/zones/centre", "", http.StatusNoContent},
+		{"Delete unknown zone", "DELETE", "/api/zones/centre", "", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(tt.method, tt.url, bytes.NewBufferString(tt.body))
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, w.Code)
+			}
+			if tt.name == "Zone details" && !strings.Contains(w.Body.String(), `"nbtransaction":2`) {
+				t.Errorf("unexpected zone details %v", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestAffordabilityEndpoint(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+	model.AggregateData(dsn)
+
+	router := BuildRouter(dsn, "", true)
+
+	tests := []struct {
+		url        string
+		wantStatus int
+	}{
+		{"/api/affordability", http.StatusOK},
+		{"/api/affordability?level=department&code=D1&year=2021", http.StatusOK},
+		{"/api/affordability?level=country", http.StatusBadRequest},
+		{"/api/affordability?year=abc", http.StatusBadRequest},
+		{"/api/liquidity", http.StatusOK},
+		{"/api/liquidity?level=region&code=R1&year=2021", http.StatusOK},
+		{"/api/liquidity?level=country", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", tt.url, nil)
+		router.ServeHTTP(w, req)
+
+		if w.Code != tt.wantStatus {
+			t.Errorf("%v: expected status %d, got %d", tt.url, tt.wantStatus, w.Code)
+		}
+	}
+}
+
+func TestDpeEndpoint(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	router := BuildRouter(dsn, "", true)
+
+	for _, query := range []string{"/api/dpe", "/api/dpe?dep=D1&year=2021"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", query, nil)
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("%v: expected status 200, got %d", query, w.Code)
+		}
+	}
+}
+
+func TestRisksEndpoint(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	router := BuildRouter(dsn, "", true)
+
+	for _, query := range []string{"/api/risks", "/api/risks?dep=D1&city=C1"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", query, nil)
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("%v: expected status 200, got %d", query, w.Code)
+		}
+	}
+}
+
+func TestPowerLinesEndpoint(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	router := BuildRouter(dsn, "", true)
+
+	for _, query := range []string{"/api/powerlines", "/api/powerlines?dep=D1"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", query, nil)
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("%v: expected status 200, got %d", query, w.Code)
+		}
+	}
+}
+
+func TestRealPrices(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	router := BuildRouter(dsn, "", true)
+
+	// the in-memory DB is shared by the tests of the package
+	db.Where("1 = 1").Delete(&model.ConsumerPriceIndex{})
+	defer db.Where("1 = 1").Delete(&model.ConsumerPriceIndex{})
+
+	queries := []string{"/api/cities?real=true", "/api/regions?real=true", "/api/departments?real=true&base=2020",
+		"/api/epcis?real=true", "/api/zones?real=true"}
+
+	// no consumer price index loaded
+	for _, query := range queries {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", query, nil)
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%v: expected status 400, got %d", query, w.Code)
+		}
+	}
+
+	model.SaveCpis(db, []model.ConsumerPriceIndex{{Year: 2020, Value: 100}, {Year: 2021, Value: 110}})
+
+	for _, query := range append(queries, "/api/cities?real=false") {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", query, nil)
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("%v: expected status 200, got %d", query, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/departments?real=true&base=1990", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestSeriesEndpoint(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	router := BuildRouter(dsn, "", true)
+
+	tests := map[string]int{
+		"/api/series?code=C1": http.StatusOK,
+		"/api/series?level=department&code=D1&granularity=quarter": http.StatusOK,
+		"/api/series":                          http.StatusBadRequest,
+		"/api/series?level=country&code=C1":    http.StatusBadRequest,
+		"/api/series?code=C1&granularity=week": http.StatusBadRequest,
+	}
+	for query, status := range tests {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", query, nil)
+		router.ServeHTTP(w, req)
+
+		if w.Code != status {
+			t.Errorf("%v: expected status %d, got %d", query, status, w.Code)
+		}
+	}
+}
+
+func TestSegmentsEndpoint(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	router := BuildRouter(dsn, "", true)
+
+	tests := map[string]int{
+		"/api/segments?code=C1":                                 http.StatusOK,
+		"/api/segments?code=C1&area=95":                         http.StatusOK,
+		"/api/segments?level=department&code=D1&dimension=land": http.StatusOK,
+		"/api/segments":                                         http.StatusBadRequest,
+		"/api/segments?code=C1&dimension=floor":                 http.StatusBadRequest,
+		"/api/segments?level=country&code=C1":                   http.StatusBadRequest,
+	}
+	for query, status := range tests {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", query, nil)
+		router.ServeHTTP(w, req)
+
+		if w.Code != status {
+			t.Errorf("%v: expected status %d, got %d", query, status, w.Code)
+		}
+	}
+}
+
+func TestForecastEndpoint(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	db.AutoMigrate(&model.ForecastModel{}, &model.Forecast{})
+	db.Create(&model.ForecastModel{Level: "department", Code: "D1", Granularity: model.GRANULARITY_YEAR, Method: model.FORECAST_HOLT, NbPoint: 4})
+	db.Create(&model.Forecast{Level: "department", Code: "D1", Granularity: model.GRANULARITY_YEAR, Period: "2022", Year: 2022,
+		Value: 2300, Lower: 2100, Upper: 2500})
+
+	router := BuildRouter(dsn, "", true)
+
+	tests := map[string]int{
+		"/api/forecast?level=department&code=D1&granularity=year": http.StatusOK,
+		"/api/forecast?level=department&code=D1":                  http.StatusNotFound,
+		"/api/forecast?code=C9":                                   http.StatusNotFound,
+		"/api/forecast":                                           http.StatusBadRequest,
+		"/api/forecast?code=C1&granularity=week":                  http.StatusBadRequest,
+		"/api/forecast?level=country&code=C1":                     http.StatusBadRequest,
+	}
+	for query, status := range tests {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", query, nil)
+		router.ServeHTTP(w, req)
+
+		if w.Code != status {
+			t.Errorf("%v: expected status %d, got %d", query, status, w.Code)
+		}
+	}
+}
+
+func TestSurfaceEndpoint(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	router := BuildRouter(dsn, "", true)
+
+	tests := map[string]int{
+		"/api/surface?lat=0.5&lng=0.5":   http.StatusOK,
+		"/api/surface?city=C1&year=2021": http.StatusOK,
+		"/api/surface":                   http.StatusBadRequest,
+		"/api/surface?lat=abc":           http.StatusBadRequest,
+		"/api/surface?city=C9":           http.StatusNotFound,
+	}
+	for query, status := range tests {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", query, nil)
+		router.ServeHTTP(w, req)
+
+		if w.Code != status {
+			t.Errorf("%v: expected status %d, got %d", query, status, w.Code)
+		}
+	}
+}
+
+func TestGridEndpoint(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	router := BuildRouter(dsn, "", true)
+
+	tests := map[string]int{
+		"/api/grid?bbox=0,0,1,1":                 http.StatusOK,
+		"/api/grid?res=7&bbox=0,0,1,1&year=2021": http.StatusOK,
+		"/api/grid":                              http.StatusBadRequest,
+		"/api/grid?bbox=0,0,1":                   http.StatusBadRequest,
+		"/api/grid?bbox=1,1,0,0":                 http.StatusBadRequest,
+		"/api/grid?res=12&bbox=0,0,1,1":          http.StatusBadRequest,
+	}
+	for query, status := range tests {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", query, nil)
+		router.ServeHTTP(w, req)
+
+		if w.Code != status {
+			t.Errorf("%v: expected status %d, got %d", query, status, w.Code)
+		}
+	}
+}
+
+func TestIndexEndpoint(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	router := BuildRouter(dsn, "", true)
+
+	for _, query := range []string{"/api/index", "/api/index?dep=D1", "/api/repeatsales", "/api/repeatsales?level=region&code=R1",
+		"/api/hotspots", "/api/hotspots?dep=D1&year=2021&class=hot-95"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", query, nil)
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("%v: expected status 200, got %d", query, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/repeatsales?level=city", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestEstimateEndpoint(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	router := BuildRouter(dsn, "", true)
+
+	// the in-memory DB is shared by the tests of the package
+	db.AutoMigrate(&model.ValuationModel{})
+	db.Where("1 = 1").Delete(&model.ValuationModel{})
+	defer db.Where("1 = 1").Delete(&model.ValuationModel{})
+
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/estimate", strings.NewReader(body))
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusNotFound, post(`{"city": "C1", "area": 80}`).Code)
+
+	for i := 0; i < 30; i++ {
+		area := 60 + 5*(i%10)
+		price := 2000 * float64(area) * (1 + 0.05*float64(i%3-1))
+		db.Create(&model.Transaction{Date: time.Date(2021, time.Month(1+i%12), 1, 0, 0, 0, 0, time.UTC), CityCode: "C1", DepartmentCode: "D1",
+			Price: price, Area: area, NbRoom: 3 + i%3, PricePSQM: price / float64(area), Lat: 0.5, Long: 0.5})
+	}
+	model.TrainValuationModels(dsn)
+
+	w := post(`{"lat": 0.5, "lng": 0.5, "area": 80, "landArea": 0, "rooms": 4}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var estimate model.Estimate
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &estimate))
+	assert.Equal(t, "C1", estimate.CityCode)
+	assert.NotNil(t, estimate.Model)
+	assert.Less(t, estimate.PriceLow, estimate.Price)
+
+	assert.Equal(t, http.StatusBadRequest, post(`{"city": "C1"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, post(`{"lat": 45, "lng": 5, "area": 80}`).Code)
+	assert.Equal(t, http.StatusBadRequest, post(`{"area": 80`).Code)
+}
+
+func TestComparablesEndpoint(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	router := BuildRouter(dsn, "", true)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/comparables?lat=0.5&lng=0.5&area=50&rooms=4&k=5&radius=20000", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var info model.ComparablesInfo
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &info))
+	assert.Equal(t, 2, len(info.Comparables))
+	assert.Greater(t, info.AdjustedPricePSQM, 0.0)
+
+	for _, query := range []string{"/api/comparables?lat=0.5&lng=0.5", "/api/comparables?lat=abc&lng=0.5&area=50"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", query, nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
+
+func TestOutliersEndpoint(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	router := BuildRouter(dsn, "", true)
+
+	for _, query := range []string{"/api/outliers", "/api/outliers?dep=D1&reason=price&limit=10"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", query, nil)
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("%v: expected status 200, got %d", query, w.Code)
+		}
+
+		var resp OutlierResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.NotNil(t, resp.Report)
+	}
+}
+
 func TestGetPOIs(t *testing.T) {
 	db, dsn := openTestDB(t)
 	seedMinimal(db, t)
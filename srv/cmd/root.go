@@ -3,10 +3,11 @@
 //
 // The main commands provided are:
 // - load: Load raw data into the database
-// - loadconf: Load configuration data (regions, departments, cities)
-// - geocode: Geocode addresses in the database
+// - loadconf: Load configuration data (regions, departments, cities, population, income, EPCI, IRIS, DPE, risks)
+// - geocode: Geocode addresses in the database and locate them in IRIS and risk zones
 // - compute: Compute statistics on the data
 // - aggregate: Aggregate data for analysis
+// - zone: Manage user-defined zones (add, list, delete)
 // - serve: Start the REST API server & UI asset server
 //
 // Configuration can be provided via:
@@ -20,8 +21,13 @@
 package cmd
 
 import (
+	"encoding/csv"
 	"fmt"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"jc.org/immotep/api"
@@ -60,7 +66,7 @@ func Execute() {
 // and their bindings to viper configuration. It configures:
 // - Global flags for configuration and debugging
 // - Database connection parameters
-// - All subcommands (load, loadconf, geocode, serve, compute, aggregate)
+// - All subcommands (load, loadconf, geocode, serve, compute, aggregate, zone)
 func init() {
 	cobra.OnInitialize(initConfig)
 
@@ -111,6 +117,30 @@ func init() {
 	viper.BindPFlag("file.city", loadConfCmd.PersistentFlags().Lookup("city"))
 	loadConfCmd.PersistentFlags().String("citygeo", "", "city GEOJSON file")
 	viper.BindPFlag("file.citygeo", loadConfCmd.PersistentFlags().Lookup("citygeo"))
+	loadConfCmd.PersistentFlags().String("epci", "", "EPCI composition CSV file")
+	viper.BindPFlag("file.epci", loadConfCmd.PersistentFlags().Lookup("epci"))
+	loadConfCmd.PersistentFlags().String("iris", "", "IRIS GEOJSON file")
+	viper.BindPFlag("file.iris", loadConfCmd.PersistentFlags().Lookup("iris"))
+	loadConfCmd.PersistentFlags().String("population", "", "INSEE historical population CSV file")
+	viper.BindPFlag("file.population", loadConfCmd.PersistentFlags().Lookup("population"))
+	loadConfCmd.PersistentFlags().StringSlice("income", nil, "INSEE Filosofi median income CSV files (communes and/or IRIS)")
+	viper.BindPFlag("file.income", loadConfCmd.PersistentFlags().Lookup("income"))
+	loadConfCmd.PersistentFlags().StringSlice("dpe", nil, "ADEME DPE CSV files")
+	viper.BindPFlag("file.dpe", loadConfCmd.PersistentFlags().Lookup("dpe"))
+	loadConfCmd.PersistentFlags().Int("dpe-window", 365, "max days between a DPE and a sale")
+	viper.BindPFlag("dpe.window", loadConfCmd.PersistentFlags().Lookup("dpe-window"))
+	loadConfCmd.PersistentFlags().StringSlice("flood", nil, "Géorisques flood zones (PPRI) GEOJSON files")
+	viper.BindPFlag("file.flood", loadConfCmd.PersistentFlags().Lookup("flood"))
+	loadConfCmd.PersistentFlags().StringSlice("clay", nil, "Géorisques clay shrink-swell exposure GEOJSON files")
+	viper.BindPFlag("file.clay", loadConfCmd.PersistentFlags().Lookup("clay"))
+	loadConfCmd.PersistentFlags().String("powerline", "", "RTE overhead power lines GEOJSON file")
+	viper.BindPFlag("file.powerline", loadConfCmd.PersistentFlags().Lookup("powerline"))
+	loadConfCmd.PersistentFlags().StringSlice("bpe", nil, "INSEE BPE equipment CSV files with coordinates")
+	viper.BindPFlag("file.bpe", loadConfCmd.PersistentFlags().Lookup("bpe"))
+	loadConfCmd.PersistentFlags().StringSlice("osm", nil, "OSM amenities GEOJSON extracts")
+	viper.BindPFlag("file.osm", loadConfCmd.PersistentFlags().Lookup("osm"))
+	loadConfCmd.PersistentFlags().String("cpi", "", "INSEE consumer price index CSV file")
+	viper.BindPFlag("file.cpi", loadConfCmd.PersistentFlags().Lookup("cpi"))
 	RootCmd.AddCommand(loadConfCmd)
 
 	serveCmd.PersistentFlags().Int("port", 8080, "api server port")
@@ -119,8 +149,60 @@ func init() {
 	viper.BindPFlag("serve.static", serveCmd.PersistentFlags().Lookup("static"))
 	RootCmd.AddCommand(serveCmd)
 
+	computeCmd.PersistentFlags().Bool("include-outliers", false, "keep the transactions flagged as outliers in the statistics")
+	viper.BindPFlag("compute.outliers", computeCmd.PersistentFlags().Lookup("include-outliers"))
 	RootCmd.AddCommand(computeCmd)
+	aggregateCmd.PersistentFlags().Bool("include-outliers", false, "keep the transactions flagged as outliers in the aggregates")
+	viper.BindPFlag("aggregate.outliers", aggregateCmd.PersistentFlags().Lookup("include-outliers"))
+	aggregateCmd.PersistentFlags().Int("cpi-base", 0, "base year of real prices (default latest consumer price index year)")
+	viper.BindPFlag("cpi.base", aggregateCmd.PersistentFlags().Lookup("cpi-base"))
+	aggregateCmd.PersistentFlags().Float64("bandwidth", model.SURFACE_DEFAULT_BANDWIDTH, "radius (m) of the sales interpolated into the averages of the communes without sales")
+	viper.BindPFlag("aggregate.bandwidth", aggregateCmd.PersistentFlags().Lookup("bandwidth"))
+	aggregateCmd.PersistentFlags().IntSlice("area-buckets", model.SegmentBuckets[model.SEGMENT_AREA], "lower bounds (m²) of the built area segments")
+	viper.BindPFlag("aggregate.segments.area", aggregateCmd.PersistentFlags().Lookup("area-buckets"))
+	aggregateCmd.PersistentFlags().IntSlice("room-buckets", model.SegmentBuckets[model.SEGMENT_ROOMS], "lower bounds of the room count segments")
+	viper.BindPFlag("aggregate.segments.rooms", aggregateCmd.PersistentFlags().Lookup("room-buckets"))
+	aggregateCmd.PersistentFlags().IntSlice("land-buckets", model.SegmentBuckets[model.SEGMENT_LAND], "lower bounds (m²) of the land area segments")
+	viper.BindPFlag("aggregate.segments.land", aggregateCmd.PersistentFlags().Lookup("land-buckets"))
+	aggregateCmd.PersistentFlags().String("since", "", "only aggregate again the codes with transactions since this date (YYYY-MM-DD); interpolations, turnover, population, hot spots, DPE, risk, power line and grid aggregates are always rebuilt fully")
+	viper.BindPFlag("aggregate.since", aggregateCmd.PersistentFlags().Lookup("since"))
 	RootCmd.AddCommand(aggregateCmd)
+	indexCmd.PersistentFlags().Bool("include-outliers", false, "keep the transactions flagged as outliers in the regression")
+	viper.BindPFlag("index.outliers", indexCmd.PersistentFlags().Lookup("include-outliers"))
+	indexExportCmd.PersistentFlags().String("level", "department", "level of the index (department or region)")
+	viper.BindPFlag("index.level", indexExportCmd.PersistentFlags().Lookup("level"))
+	indexExportCmd.PersistentFlags().String("code", "", "department or region code (default all)")
+	viper.BindPFlag("index.code", indexExportCmd.PersistentFlags().Lookup("code"))
+	indexExportCmd.PersistentFlags().StringP("output", "o", "", "CSV output file (default stdout)")
+	viper.BindPFlag("index.output", indexExportCmd.PersistentFlags().Lookup("output"))
+	indexCmd.AddCommand(indexExportCmd)
+	RootCmd.AddCommand(indexCmd)
+	trainCmd.PersistentFlags().Bool("include-outliers", false, "keep the transactions flagged as outliers in the training data")
+	viper.BindPFlag("train.outliers", trainCmd.PersistentFlags().Lookup("include-outliers"))
+	RootCmd.AddCommand(trainCmd)
+	forecastCmd.PersistentFlags().StringSlice("level", []string{"department", "city"}, "levels of the forecasts (city, iris, epci, department, region or zone)")
+	viper.BindPFlag("forecast.levels", forecastCmd.PersistentFlags().Lookup("level"))
+	forecastCmd.PersistentFlags().String("granularity", model.GRANULARITY_MONTH, "aggregates of the forecasts (month or year)")
+	viper.BindPFlag("forecast.granularity", forecastCmd.PersistentFlags().Lookup("granularity"))
+	RootCmd.AddCommand(forecastCmd)
+	estimateCmd.Flags().Float64("lat", 0, "latitude of the house")
+	estimateCmd.Flags().Float64("lng", 0, "longitude of the house")
+	estimateCmd.Flags().String("city", "", "commune code of the house")
+	estimateCmd.Flags().String("address", "", "address of the house (geocoded)")
+	estimateCmd.Flags().Int("area", 0, "built area (m²)")
+	estimateCmd.Flags().Int("land", 0, "land area (m²)")
+	estimateCmd.Flags().Int("rooms", 0, "number of rooms")
+	RootCmd.AddCommand(estimateCmd)
+	outliersCmd.PersistentFlags().String("dep", "", "department of the report (default all)")
+	viper.BindPFlag("outliers.dep", outliersCmd.PersistentFlags().Lookup("dep"))
+	outliersCmd.PersistentFlags().Bool("report", false, "only print the report of the current flags")
+	viper.BindPFlag("outliers.report", outliersCmd.PersistentFlags().Lookup("report"))
+	RootCmd.AddCommand(outliersCmd)
+
+	zoneCmd.AddCommand(zoneAddCmd)
+	zoneCmd.AddCommand(zoneListCmd)
+	zoneCmd.AddCommand(zoneDeleteCmd)
+	RootCmd.AddCommand(zoneCmd)
 }
 
 // initConfig reads in configuration from config files and environment variables.
@@ -206,7 +288,9 @@ var loadCmd = &cobra.Command{
 }
 
 // loadConfCmd represents the command for loading configuration data like regions,
-// departments, and cities into the database.
+// departments, cities, population, income, EPCI, IRIS zones, DPE, risk
+// zones, power lines, amenities and the consumer price index into the
+// database.
 // Usage: immotep loadconf [flags]
 // Flags:
 //
@@ -214,6 +298,18 @@ var loadCmd = &cobra.Command{
 //	--department: department GEOJSON file
 //	--city: city JSON file
 //	--citygeo: city GEOJSON file
+//	--epci: EPCI composition CSV file (needs cities)
+//	--iris: IRIS GEOJSON file
+//	--population: INSEE historical population CSV file (needs cities)
+//	--income: INSEE Filosofi median income CSV files (comma separated list)
+//	--dpe: ADEME DPE CSV files (comma separated list), matched to transactions
+//	--dpe-window: max days between a DPE and a sale (default 365)
+//	--flood: Géorisques flood zones GEOJSON files (comma separated list)
+//	--clay: Géorisques clay exposure GEOJSON files (comma separated list)
+//	--powerline: RTE overhead power lines GEOJSON file
+//	--bpe: INSEE BPE CSV files (comma separated list)
+//	--osm: OSM amenities GEOJSON extracts (comma separated list)
+//	--cpi: INSEE consumer price index CSV file (yearly or monthly values)
 var loadConfCmd = &cobra.Command{
 	Use:   "loadconf",
 	Short: "load config",
@@ -224,6 +320,16 @@ var loadConfCmd = &cobra.Command{
 		department := viper.GetString("file.department")
 		city := viper.GetString("file.city")
 		cityGeo := viper.GetString("file.citygeo")
+		epci := viper.GetString("file.epci")
+		iris := viper.GetString("file.iris")
+		population := viper.GetString("file.population")
+		incomes := viper.GetStringSlice("file.income")
+		dpes := viper.GetStringSlice("file.dpe")
+		risks := map[string][]string{model.RISK_FLOOD: viper.GetStringSlice("file.flood"), model.RISK_CLAY: viper.GetStringSlice("file.clay")}
+		powerline := viper.GetString("file.powerline")
+		bpes := viper.GetStringSlice("file.bpe")
+		osms := viper.GetStringSlice("file.osm")
+		cpi := viper.GetString("file.cpi")
 		// load data
 		dsn := getDSN()
 		log.Infof("load conf to db: %v\n", dsn)
@@ -240,6 +346,59 @@ var loadConfCmd = &cobra.Command{
 			loader.LoadCity(dsn, city, cityGeo)
 		}
 
+		if population != "" {
+			loader.LoadPopulation(dsn, population)
+		}
+
+		for _, income := range incomes {
+			loader.LoadIncome(dsn, income)
+		}
+
+		if epci != "" {
+			loader.LoadEpci(dsn, epci)
+		}
+
+		if iris != "" {
+			loader.LoadIris(dsn, iris)
+		}
+
+		if len(dpes) > 0 {
+			for _, dpe := range dpes {
+				loader.LoadDpe(dsn, dpe)
+			}
+			loader.MatchDpe(dsn, viper.GetInt("dpe.window"))
+		}
+
+		riskLoaded := false
+		for kind, files := range risks {
+			for _, f := range files {
+				loader.LoadRiskZones(dsn, kind, f)
+				riskLoaded = true
+			}
+		}
+		if riskLoaded {
+			loader.TagRisks(dsn)
+		}
+
+		if powerline != "" {
+			loader.LoadPowerLines(dsn, powerline)
+			loader.ComputeLineDistances(dsn)
+		}
+
+		if len(bpes) > 0 || len(osms) > 0 {
+			for _, bpe := range bpes {
+				loader.LoadBpe(dsn, bpe)
+			}
+			for _, osm := range osms {
+				loader.LoadOsmAmenities(dsn, osm)
+			}
+			loader.ComputeAmenityDistances(dsn)
+		}
+
+		if cpi != "" {
+			loader.LoadCpi(dsn, cpi)
+		}
+
 	},
 }
 
@@ -247,6 +406,9 @@ var loadConfCmd = &cobra.Command{
 // Usage: immotep geocode [department...]
 // If no department is specified, it geocodes all entries.
 // If departments are specified, it only geocodes entries in those departments.
+// Geocoded entries are then located in their IRIS zone, tagged with the
+// risk zones they fall in and get their distances to the nearest power line
+// and amenities.
 var geocodeCmd = &cobra.Command{
 	Use:   "geocode",
 	Short: "geocode db",
@@ -263,12 +425,20 @@ var geocodeCmd = &cobra.Command{
 		} else {
 			loader.GeocodeDB(dsn, true, "")
 		}
+		loader.LocateIris(dsn, true)
+		loader.TagRisks(dsn)
+		loader.ComputeLineDistances(dsn)
+		loader.ComputeAmenityDistances(dsn)
 	},
 }
 
 // computeCmd represents the command for computing statistics on the data.
 // Usage: immotep compute
-// It processes the data and generates statistical computations stored in the database.
+// It flags outliers, processes the data and generates statistical
+// computations stored in the database.
+// Flags:
+//
+//	--include-outliers: keep the outlier transactions in the statistics
 var computeCmd = &cobra.Command{
 	Use:   "compute",
 	Short: "compute db",
@@ -277,22 +447,278 @@ var computeCmd = &cobra.Command{
 		// geo code address
 		dsn := getDSN()
 		log.Infof("compute db: %v\n", dsn)
+		model.IncludeOutliers = viper.GetBool("compute.outliers")
 		model.ComputeStat(dsn)
 	},
 }
 
 // aggregateCmd represents the command for aggregating data for analysis.
-// Usage: immotep aggregate
+// Usage: immotep aggregate [--since <YYYY-MM-DD>]
 // It processes the data and creates aggregate views for analysis purposes.
+// Flags:
+//
+//	--cpi-base: base year of the real prices (default latest year of the
+//	consumer price index)
+//	--include-outliers: keep the outlier transactions in the aggregates
+//	--bandwidth: radius (m) of the price surface filling the averages of the
+//	communes without sales
+//	--area-buckets, --room-buckets, --land-buckets: lower bounds of the
+//	segments of built area, room count and land area (e.g. 60,90,120,160)
+//	--since: only aggregate again the codes with transactions since the date,
+//	for the years from its year (default everything); the interpolated
+//	averages, turnover rates, population indicators, hot spots and the DPE,
+//	risk, power line and grid aggregates are always rebuilt fully
 var aggregateCmd = &cobra.Command{
 	Use:   "aggregate",
 	Short: "aggregate db",
 	Long:  `aggregate db`,
-	Run: func(cmd *cobra.Command, args []string) {
-		// geo code address
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var since time.Time
+		if s := viper.GetString("aggregate.since"); s != "" {
+			var err error
+			if since, err = time.Parse("2006-01-02", s); err != nil {
+				return fmt.Errorf("invalid --since date %q: %w", s, err)
+			}
+		}
+
 		dsn := getDSN()
 		log.Infof("aggregate db: %v\n", dsn)
-		model.AggregateData(dsn)
+		model.CpiBaseYear = viper.GetInt("cpi.base")
+		model.IncludeOutliers = viper.GetBool("aggregate.outliers")
+		model.SurfaceBandwidth = viper.GetFloat64("aggregate.bandwidth")
+		for _, dimension := range []string{model.SEGMENT_AREA, model.SEGMENT_ROOMS, model.SEGMENT_LAND} {
+			buckets := viper.GetIntSlice("aggregate.segments." + dimension)
+			sort.Ints(buckets)
+			model.SegmentBuckets[dimension] = buckets
+		}
+		return model.AggregateDataSince(dsn, since)
+	},
+}
+
+// indexCmd represents the command computing the price indices: hedonic
+// index of every department and repeat-sales index of every department and
+// region.
+// Usage: immotep index
+// Flags:
+//
+//	--include-outliers: keep the outlier transactions in the regressions
+var indexCmd = &cobra.Command{
+	Use:   "index",
+	Short: "compute price indices",
+	Long:  `compute the hedonic price index of every department and the repeat-sales index of every department and region`,
+	Run: func(cmd *cobra.Command, args []string) {
+		dsn := getDSN()
+		log.Infof("compute price indices: %v\n", dsn)
+		model.IncludeOutliers = viper.GetBool("index.outliers")
+		model.ComputeHedonicIndex(dsn)
+		model.ComputeRepeatSalesIndex(dsn)
+	},
+}
+
+// indexExportCmd exports the repeat-sales index as CSV
+// (level,code,year,index,pairs).
+// Usage: immotep index export [--level department|region] [--code <code>] [-o file.csv]
+var indexExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "export repeat-sales index",
+	Long:  `export the repeat-sales index of departments or regions as CSV`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		db := model.ConnectToDB(getDSN())
+		indices, err := model.GetRepeatSalesIndex(db, viper.GetString("index.level"), viper.GetString("index.code"))
+		if err != nil {
+			return err
+		}
+
+		out := os.Stdout
+		if filename := viper.GetString("index.output"); filename != "" {
+			f, err := os.Create(filename)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			out = f
+		}
+
+		w := csv.NewWriter(out)
+		w.Write([]string{"level", "code", "year", "index", "pairs"})
+		for _, idx := range indices {
+			w.Write([]string{idx.Level, idx.Code, strconv.Itoa(idx.Year), strconv.FormatFloat(idx.Index, 'f', 2, 64), strconv.Itoa(idx.NbPair)})
+		}
+		w.Flush()
+
+		return w.Error()
+	},
+}
+
+// trainCmd represents the command training the valuation model of every
+// department from the transactions.
+// Usage: immotep train
+// Flags:
+//
+//	--include-outliers: keep the outlier transactions in the training data
+var trainCmd = &cobra.Command{
+	Use:   "train",
+	Short: "train valuation models",
+	Long:  `train the automated valuation model of every department and store it in the db`,
+	Run: func(cmd *cobra.Command, args []string) {
+		dsn := getDSN()
+		log.Infof("train valuation models: %v\n", dsn)
+		model.IncludeOutliers = viper.GetBool("train.outliers")
+		model.TrainValuationModels(dsn)
+	},
+}
+
+// forecastCmd represents the command forecasting the average price per m²
+// of the aggregates for the next year.
+// Usage: immotep forecast [--level <level>,...] [--granularity month|year]
+// Flags:
+//
+//	--level: levels of the forecasts (default department,city)
+//	--granularity: monthly or yearly aggregates (default month)
+var forecastCmd = &cobra.Command{
+	Use:   "forecast",
+	Short: "forecast prices",
+	Long:  `fit an exponential smoothing model on the aggregates of every code, backtest it and store its forecasts in the db`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dsn := getDSN()
+		log.Infof("forecast prices: %v\n", dsn)
+		return model.ComputeForecasts(dsn, viper.GetStringSlice("forecast.levels"), viper.GetString("forecast.granularity"))
+	},
+}
+
+// estimateCmd estimates the price of a house with the trained valuation
+// models.
+// Usage: immotep estimate (--lat <lat> --lng <lng> | --city <code> | --address <address>) --area <m²> [--land <m²>] [--rooms <n>]
+var estimateCmd = &cobra.Command{
+	Use:   "estimate",
+	Short: "estimate a house price",
+	Long:  `estimate the price of a house from its location, built area, land area and number of rooms`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		var input model.ValuationInput
+		input.Lat, _ = flags.GetFloat64("lat")
+		input.Long, _ = flags.GetFloat64("lng")
+		input.CityCode, _ = flags.GetString("city")
+		input.Area, _ = flags.GetInt("area")
+		input.LandArea, _ = flags.GetInt("land")
+		input.NbRoom, _ = flags.GetInt("rooms")
+
+		if address, _ := flags.GetString("address"); address != "" && input.CityCode == "" && input.Lat == 0 && input.Long == 0 {
+			lat, long, city, err := loader.GeocodeAddress(address)
+			if err != nil {
+				return err
+			}
+			input.Lat, input.Long, input.CityCode = lat, long, city
+		}
+
+		estimate, err := model.EstimatePrice(model.ConnectToDB(getDSN()), input)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%v (%v)\t%.0f€ [%.0f€ - %.0f€]\t%.0f€/m² [%.0f€/m² - %.0f€/m²]\t%.0f%% prediction interval\n",
+			estimate.CityCode, estimate.DepartmentCode, estimate.Price, estimate.PriceLow, estimate.PriceHigh,
+			estimate.PricePSQM, estimate.PricePSQMLow, estimate.PricePSQMHigh, estimate.PredictionLevel*100)
+		fmt.Printf("model: %v, %v, trained %v on %v sales, R² %.2f\n", estimate.Model.Kind, estimate.Model.Year,
+			estimate.Model.TrainedAt.Format("2006-01-02"), estimate.Model.NbTransaction, estimate.Model.R2)
+		return nil
+	},
+}
+
+// outliersCmd flags the outlier transactions and prints the report of the
+// excluded transactions by reason.
+// Usage: immotep outliers [--dep <code>] [--report]
+// Flags:
+//
+//	--dep: department of the report (default all)
+//	--report: only print the report, do not flag again
+var outliersCmd = &cobra.Command{
+	Use:   "outliers",
+	Short: "flag outliers",
+	Long:  `flag outlier transactions and report the excluded ones`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		db := model.ConnectToDB(getDSN())
+		if !viper.GetBool("outliers.report") {
+			model.FlagOutliers(db)
+		}
+
+		report := model.GetOutlierReport(db, viper.GetString("outliers.dep"))
+		if report == nil {
+			return fmt.Errorf("cannot build outlier report")
+		}
+
+		fmt.Printf("%v transactions, %v excluded\n", report.Total, report.Excluded)
+		for _, r := range report.Reasons {
+			fmt.Printf("%v\t%v\t%.0f€/m²\n", r.Reason, r.Count, r.AvgPricePSQM)
+		}
+		return nil
+	},
+}
+
+// zoneCmd groups the commands managing user-defined zones.
+// Usage: immotep zone [add|list|delete]
+var zoneCmd = &cobra.Command{
+	Use:   "zone",
+	Short: "manage user-defined zones",
+	Long:  `manage user-defined zones (named GeoJSON polygons).`,
+}
+
+// zoneAddCmd creates or replaces a zone from a GeoJSON file.
+// Usage: immotep zone add <name> <file.geojson>
+// The file holds a Polygon or MultiPolygon (geometry, Feature or
+// FeatureCollection). Transactions inside the zone are located and its
+// statistics computed.
+var zoneAddCmd = &cobra.Command{
+	Use:   "add <name> <file.geojson>",
+	Short: "add zone",
+	Long:  `add or replace a zone from a GeoJSON polygon file`,
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		data, err := os.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+
+		dsn := getDSN()
+		info, err := model.SaveZone(model.ConnectToDB(dsn), args[0], data)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%v\t%v\t%v transactions\t%.0f€/m²\n", info.Code, info.Name, info.NbTransaction, info.AvgPriceSQM)
+		return nil
+	},
+}
+
+// zoneListCmd lists the zones with their average price.
+// Usage: immotep zone list
+var zoneListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list zones",
+	Long:  `list zones`,
+	Run: func(cmd *cobra.Command, args []string) {
+		dsn := getDSN()
+		for _, z := range model.GetZones(model.ConnectToDB(dsn), nil) {
+			fmt.Printf("%v\t%v\t%v transactions\t%.0f€/m²\n", z.Code, z.Name, z.NbTransaction, z.AvgPriceSQM)
+		}
+	},
+}
+
+// zoneDeleteCmd deletes zones.
+// Usage: immotep zone delete <code>...
+var zoneDeleteCmd = &cobra.Command{
+	Use:   "delete <code>...",
+	Short: "delete zones",
+	Long:  `delete zones`,
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		db := model.ConnectToDB(getDSN())
+		for _, code := range args {
+			if err := model.DeleteZone(db, code); err != nil {
+				return fmt.Errorf("zone %v: %w", code, err)
+			}
+		}
+		return nil
 	},
 }
 
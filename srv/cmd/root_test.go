@@ -16,7 +16,7 @@ func TestInit(t *testing.T) {
 		t.Errorf("Expected root command name to be 'immotep', got %s", RootCmd.Use)
 	}
 
-	commands := []string{"load", "loadconf", "geocode", "serve", "compute", "aggregate"}
+	commands := []string{"load", "loadconf", "geocode", "serve", "compute", "aggregate", "zone", "outliers", "index", "train", "estimate", "forecast"}
 	for _, searchCmd := range commands {
 		var found = false
 		for _, cmd := range RootCmd.Commands() {
@@ -0,0 +1,404 @@
+// Package loader implements data-loading helpers used by the immotep
+// application. This file imports amenities (schools, train stations,
+// supermarkets, doctors) from an INSEE BPE CSV or an OSM GeoJSON extract and
+// computes the distance from geocoded transactions to the nearest amenity of
+// each kind.
+package loader
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cheggaaa/pb/v3"
+	geojson "github.com/paulmach/go.geojson"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"jc.org/immotep/model"
+)
+
+// bpeKinds maps BPE equipment types (TYPEQU) to amenity kinds. Several codes
+// are kept for the same kind as the nomenclature changed over the years.
+var bpeKinds = map[string]string{
+	"C101": model.AMENITY_SCHOOL, "C102": model.AMENITY_SCHOOL, "C104": model.AMENITY_SCHOOL,
+	"C105": model.AMENITY_SCHOOL, "C201": model.AMENITY_SCHOOL, "C301": model.AMENITY_SCHOOL,
+	"C302": model.AMENITY_SCHOOL, "C303": model.AMENITY_SCHOOL,
+	"E107": model.AMENITY_STATION, "E108": model.AMENITY_STATION, "E109": model.AMENITY_STATION,
+	"B101": model.AMENITY_SUPERMARKET, "B102": model.AMENITY_SUPERMARKET,
+	"B104": model.AMENITY_SUPERMARKET, "B105": model.AMENITY_SUPERMARKET,
+	"D201": model.AMENITY_DOCTOR, "D265": model.AMENITY_DOCTOR,
+}
+
+// osmKinds maps OSM tags (key=value) to amenity kinds.
+var osmKinds = map[string]string{
+	"amenity=school": model.AMENITY_SCHOOL, "amenity=kindergarten": model.AMENITY_SCHOOL,
+	"amenity=college": model.AMENITY_SCHOOL,
+	"railway=station": model.AMENITY_STATION, "railway=halt": model.AMENITY_STATION,
+	"shop=supermarket": model.AMENITY_SUPERMARKET,
+	"amenity=doctors":  model.AMENITY_DOCTOR, "healthcare=doctor": model.AMENITY_DOCTOR,
+}
+
+// Lambert 93 (EPSG:2154) projection constants.
+const (
+	lambert93N      = 0.7256077650
+	lambert93C      = 11754255.426
+	lambert93Xs     = 700000.0
+	lambert93Ys     = 12655612.050
+	lambert93E      = 0.08181919106
+	lambert93Lambda = 3.0 * math.Pi / 180
+)
+
+// lambert93ToWGS84 converts Lambert 93 coordinates (m) to latitude and
+// longitude (degrees). RGF93 and WGS84 are considered equal.
+func lambert93ToWGS84(x, y float64) (float64, float64) {
+	dx := x - lambert93Xs
+	dy := lambert93Ys - y
+	r := math.Sqrt(dx*dx + dy*dy)
+	gamma := math.Atan(dx / dy)
+
+	long := lambert93Lambda + gamma/lambert93N
+	latIso := -math.Log(math.Abs(r/lambert93C)) / lambert93N
+
+	// isometric latitude to geographic latitude
+	lat := 2*math.Atan(math.Exp(latIso)) - math.Pi/2
+	for i := 0; i < 20; i++ {
+		es := lambert93E * math.Sin(lat)
+		next := 2*math.Atan(math.Pow((1+es)/(1-es), lambert93E/2)*math.Exp(latIso)) - math.Pi/2
+		if math.Abs(next-lat) < 1e-11 {
+			lat = next
+			break
+		}
+		lat = next
+	}
+
+	return lat * 180 / math.Pi, long * 180 / math.Pi
+}
+
+// amenitiesLoaded returns true if amenities were already loaded from the
+// source file.
+func amenitiesLoaded(db *gorm.DB, source string) bool {
+	var count int64
+	db.Model(&model.Amenity{}).Where("source = ?", source).Count(&count)
+
+	return count > 0
+}
+
+/*
+LoadBpe imports schools, train stations, supermarkets and doctors from an
+INSEE BPE (Base Permanente des Équipements) CSV with coordinates.
+
+Columns used:
+
+	TYPEQU, DEPCOM, LATITUDE and LONGITUDE (or LAMBERT_X and LAMBERT_Y)
+
+Parameters:
+  - dsn: DB connection string
+  - filename: path to the BPE CSV file
+
+Behavior:
+  - Skips import if the file was already loaded.
+  - Other equipment types and rows without coordinates are ignored.
+*/
+func LoadBpe(dsn string, filename string) error {
+	db := model.ConnectToDB(dsn)
+	source := filepath.Base(filename)
+	if amenitiesLoaded(db, source) {
+		log.Infof("LoadBpe: %v already loaded.\n", source)
+		return nil
+	}
+
+	// open CSV file
+	f, err := os.Open(filename)
+	if err != nil {
+		log.Errorf("LoadBpe cannot open %v: %v\n", filename, err)
+		return err
+	}
+	defer f.Close()
+	log.Infof("Load BPE from: %v...\n", filename)
+
+	reader, columns, err := openHeaderCSV(f, "TYPEQU")
+	if err != nil {
+		log.Errorf("LoadBpe cannot read header of %v: %v\n", filename, err)
+		return err
+	}
+
+	amenities := make([]model.Amenity, 0, 10000)
+	nbError := 0
+
+	for {
+		row, err := reader.Read()
+		// Stop at EOF.
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Errorf("LoadBpe cannot read row: %v\n", err)
+			continue
+		}
+
+		code := csvValue(row, columns, "TYPEQU")
+		kind, ok := bpeKinds[code]
+		if !ok {
+			continue
+		}
+
+		a := model.Amenity{Kind: kind, Code: code, CityCode: csvValue(row, columns, "DEPCOM"), Source: source}
+
+		lat, errLat := strconv.ParseFloat(csvValue(row, columns, "LATITUDE"), 64)
+		long, errLong := strconv.ParseFloat(csvValue(row, columns, "LONGITUDE"), 64)
+		if errLat == nil && errLong == nil {
+			a.Lat, a.Long = lat, long
+		} else {
+			x, errX := strconv.ParseFloat(csvValue(row, columns, "LAMBERT_X"), 64)
+			y, errY := strconv.ParseFloat(csvValue(row, columns, "LAMBERT_Y"), 64)
+			if errX != nil || errY != nil {
+				nbError++
+				continue
+			}
+			a.Lat, a.Long = lambert93ToWGS84(x, y)
+		}
+
+		amenities = append(amenities, a)
+	}
+
+	if len(amenities) == 0 {
+		log.Errorf("LoadBpe no amenity found in %v\n", filename)
+		return errors.New("no amenity found")
+	}
+
+	result := db.CreateInBatches(&amenities, 500)
+	if result.Error != nil {
+		log.Errorf("LoadBpe Error: %v\n", result.Error)
+		return result.Error
+	}
+
+	log.Infof("...%v amenities loaded, %v rejected.\n", len(amenities), nbError)
+
+	return nil
+}
+
+// osmKind returns the amenity kind and OSM tag of a feature or "".
+func osmKind(feature *geojson.Feature) (string, string) {
+	for _, key := range []string{"amenity", "railway", "shop", "healthcare"} {
+		tag := key + "=" + strings.ToLower(featureProperty(feature, key))
+		if kind, ok := osmKinds[tag]; ok {
+			return kind, tag
+		}
+	}
+
+	return "", ""
+}
+
+/*
+LoadOsmAmenities imports schools, train stations, supermarkets and doctors
+from an OSM GeoJSON extract with tags as properties, for example:
+
+	osmium tags-filter region.osm.pbf nwr/amenity=school,doctors nwr/shop=supermarket nwr/railway=station -o extract.osm.pbf
+	osmium export extract.osm.pbf -o extract.geojson
+
+Parameters:
+  - dsn: DB connection string
+  - filename: path to the GeoJSON file
+
+Behavior:
+  - Skips import if the file was already loaded.
+  - Ways and relations are located at the center of their bounding box.
+*/
+func LoadOsmAmenities(dsn string, filename string) error {
+	db := model.ConnectToDB(dsn)
+	source := filepath.Base(filename)
+	if amenitiesLoaded(db, source) {
+		log.Infof("LoadOsmAmenities: %v already loaded.\n", source)
+		return nil
+	}
+
+	// Open our jsonFile
+	jsonFile, err := os.Open(filename)
+	if err != nil {
+		log.Errorf("LoadOsmAmenities cannot open %v: %v\n", filename, err)
+		return err
+	}
+	defer jsonFile.Close()
+	log.Infof("Load OSM amenities from: %v...\n", filename)
+
+	byteValue, _ := io.ReadAll(jsonFile)
+
+	var fc geojson.FeatureCollection
+	err = json.Unmarshal(byteValue, &fc)
+	if err != nil {
+		log.Errorf("LoadOsmAmenities cannot decode JSON file %v: %v\n", filename, err)
+		return err
+	}
+
+	amenities := make([]model.Amenity, 0, len(fc.Features))
+	for _, feature := range fc.Features {
+		if feature.Geometry == nil {
+			continue
+		}
+
+		kind, tag := osmKind(feature)
+		if kind == "" {
+			continue
+		}
+
+		a := model.Amenity{Kind: kind, Code: tag, Name: featureProperty(feature, "name"), Source: source}
+		if feature.Geometry.IsPoint() {
+			a.Lat, a.Long = feature.Geometry.Point[1], feature.Geometry.Point[0]
+		} else {
+			b := model.GeometryBounds(feature.Geometry)
+			a.Lat, a.Long = (b.MinLat+b.MaxLat)/2, (b.MinLong+b.MaxLong)/2
+		}
+
+		amenities = append(amenities, a)
+	}
+
+	if len(amenities) == 0 {
+		log.Errorf("LoadOsmAmenities no amenity found in %v\n", filename)
+		return errors.New("no amenity found")
+	}
+
+	result := db.CreateInBatches(&amenities, 500)
+	if result.Error != nil {
+		log.Errorf("LoadOsmAmenities Error: %v\n", result.Error)
+		return result.Error
+	}
+
+	log.Infof("...%v amenities loaded.\n", len(amenities))
+
+	return nil
+}
+
+// amenityLayer is the spatial index of the amenities of one kind: each
+// amenity is indexed on the cells within model.AMENITY_SEARCH_RADIUS.
+type amenityLayer struct {
+	points []model.Amenity
+	index  *model.GridIndex
+}
+
+// nearest returns the distance (m) to the nearest amenity within
+// model.AMENITY_SEARCH_RADIUS, or nil when there is none.
+func (l *amenityLayer) nearest(lat, long float64) *float64 {
+	var best *float64
+
+	for _, id := range l.index.Query(lat, long) {
+		p := l.points[id]
+		d := model.DistanceMeters(lat, long, p.Lat, p.Long)
+		if d > model.AMENITY_SEARCH_RADIUS || (best != nil && d >= *best) {
+			continue
+		}
+		best = &d
+	}
+
+	return best
+}
+
+// loadAmenityLayers reads the amenities and indexes them by kind on a 0.05°
+// grid.
+func loadAmenityLayers(db *gorm.DB) map[string]*amenityLayer {
+	var amenities []model.Amenity
+
+	result := db.Find(&amenities)
+	if result.Error != nil {
+		log.Errorf("loadAmenityLayers err: %v\n", result.Error)
+		return nil
+	}
+
+	dLat := model.AMENITY_SEARCH_RADIUS / model.EARTH_RADIUS * 180 / math.Pi
+	layers := make(map[string]*amenityLayer)
+	for _, a := range amenities {
+		layer, ok := layers[a.Kind]
+		if !ok {
+			layer = &amenityLayer{index: model.NewGridIndex(0.05)}
+			layers[a.Kind] = layer
+		}
+
+		dLong := dLat / math.Max(math.Cos(a.Lat*math.Pi/180), 0.01)
+		layer.index.Add(len(layer.points), model.Bounds{MinLat: a.Lat - dLat, MaxLat: a.Lat + dLat,
+			MinLong: a.Long - dLong, MaxLong: a.Long + dLong})
+		layer.points = append(layer.points, a)
+	}
+
+	return layers
+}
+
+/*
+ComputeAmenityDistances sets the distance columns (school_distance,
+station_distance, supermarket_distance, doctor_distance) of every geocoded
+transaction from the loaded amenities.
+
+Behavior:
+  - A column is cleared when no amenity of its kind is within
+    model.AMENITY_SEARCH_RADIUS.
+  - Kinds without loaded amenities are left untouched.
+*/
+func ComputeAmenityDistances(dsn string) {
+	db := model.ConnectToDB(dsn)
+	if db == nil {
+		log.Errorf("ComputeAmenityDistances err: cannot connect to DB: %v\n", dsn)
+		return
+	}
+
+	layers := loadAmenityLayers(db)
+	if len(layers) == 0 {
+		log.Infof("ComputeAmenityDistances: no amenity loaded.\n")
+		return
+	}
+
+	columns := make([]string, 0, len(layers))
+	for kind := range layers {
+		columns = append(columns, model.AMENITY_COLUMNS[kind])
+	}
+
+	query := db.Model(&model.Transaction{}).Where("lat <> 0").Session(&gorm.Session{})
+
+	var count int64
+	query.Count(&count)
+	if count <= 0 {
+		log.Infof("No transactions to compute amenity distances.\n")
+		return
+	}
+
+	bar := pb.Default.Start(int(count))
+
+	var trans []model.Transaction
+	result := query.Select("tr_id, lat, long").FindInBatches(&trans, 5000, func(tx *gorm.DB, batch int) error {
+		var tr2update = make([]map[string]interface{}, 0, len(trans))
+
+		for _, item := range trans {
+			bar.Increment()
+
+			upd := map[string]interface{}{"tr_id": item.TrId}
+			for kind, layer := range layers {
+				upd[model.AMENITY_COLUMNS[kind]] = layer.nearest(item.Lat, item.Long)
+			}
+
+			tr2update = append(tr2update, upd)
+		}
+
+		updresult := db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "tr_id"}},
+			DoUpdates: clause.AssignmentColumns(columns),
+		}).Table("transactions").Create(&tr2update)
+
+		if updresult.Error != nil {
+			log.Errorf("Error ComputeAmenityDistances update: %v\n", updresult.Error)
+		}
+
+		return nil
+	})
+
+	if result.Error != nil {
+		log.Errorf("Error ComputeAmenityDistances: %v\n", result.Error)
+		return
+	}
+
+	bar.Add(int(bar.Total() - bar.Current()))
+	bar.Finish()
+	log.Infof("ComputeAmenityDistances: %v elt.\n", count)
+}
@@ -0,0 +1,88 @@
+package loader
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"jc.org/immotep/model"
+)
+
+func TestLambert93ToWGS84(t *testing.T) {
+	lat, long := lambert93ToWGS84(700000, 6600000)
+	assert.InDelta(t, 46.5, lat, 1e-6)
+	assert.InDelta(t, 3.0, long, 1e-6)
+
+	// Paris center
+	lat, long = lambert93ToWGS84(652470, 6861670)
+	assert.InDelta(t, 48.85, lat, 0.01)
+	assert.InDelta(t, 2.35, long, 0.01)
+}
+
+func TestLoadAmenitiesAndComputeDistances(t *testing.T) {
+	dsn := "file:amenity?mode=memory&cache=shared"
+	db := model.ConnectToDB(dsn)
+
+	date := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	far := 10.0
+	trans := []model.Transaction{
+		{Date: date, CityCode: "03001", Lat: 46.5, Long: 3.0},
+		{Date: date, CityCode: "91001", Lat: 48.0, Long: 2.0, SchoolDistance: &far},
+		{Date: date, CityCode: "91001"},
+	}
+	if err := db.Create(&trans).Error; err != nil {
+		t.Fatalf("create transactions: %v", err)
+	}
+
+	if err := LoadBpe(dsn, "unknown.csv"); err == nil {
+		t.Errorf("LoadBpe() expected error on missing file")
+	}
+	if err := LoadBpe(dsn, "income.csv"); err == nil {
+		t.Errorf("LoadBpe() expected error on bad header")
+	}
+	if err := LoadBpe(dsn, "bpe.csv"); err != nil {
+		t.Errorf("LoadBpe() error = %v", err)
+	}
+	if err := LoadBpe(dsn, "bpe.csv"); err != nil {
+		t.Errorf("LoadBpe() reload error = %v", err)
+	}
+	if err := LoadOsmAmenities(dsn, "epci.csv"); err == nil {
+		t.Errorf("LoadOsmAmenities() expected error on bad format")
+	}
+	if err := LoadOsmAmenities(dsn, "flood.geojson"); err == nil {
+		t.Errorf("LoadOsmAmenities() expected error without amenity")
+	}
+	if err := LoadOsmAmenities(dsn, "osm.geojson"); err != nil {
+		t.Errorf("LoadOsmAmenities() error = %v", err)
+	}
+
+	var amenities []model.Amenity
+	db.Order("id").Find(&amenities)
+	assert.Len(t, amenities, 4)
+	assert.Equal(t, model.AMENITY_STATION, amenities[0].Kind)
+	assert.InDelta(t, 46.5, amenities[0].Lat, 1e-6)
+	assert.Equal(t, model.AMENITY_SCHOOL, amenities[1].Kind)
+	assert.Equal(t, "Super U", amenities[2].Name)
+	assert.Equal(t, model.AMENITY_DOCTOR, amenities[3].Kind)
+	assert.InDelta(t, 46.502, amenities[3].Lat, 1e-6)
+
+	ComputeAmenityDistances(dsn)
+
+	var computed []model.Transaction
+	db.Order("tr_id").Find(&computed)
+	if assert.NotNil(t, computed[0].StationDistance) {
+		assert.InDelta(t, 0, *computed[0].StationDistance, 1)
+	}
+	if assert.NotNil(t, computed[0].SchoolDistance) {
+		assert.InDelta(t, 1112, *computed[0].SchoolDistance, 5)
+	}
+	if assert.NotNil(t, computed[0].SupermarketDistance) {
+		assert.InDelta(t, 765, *computed[0].SupermarketDistance, 5)
+	}
+	if assert.NotNil(t, computed[0].DoctorDistance) {
+		assert.InDelta(t, 222, *computed[0].DoctorDistance, 2)
+	}
+	assert.Nil(t, computed[1].SchoolDistance)
+	assert.Nil(t, computed[1].StationDistance)
+	assert.Nil(t, computed[2].SchoolDistance)
+}
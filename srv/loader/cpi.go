@@ -0,0 +1,117 @@
+// Package loader implements data-loading helpers used by the immotep
+// application. This file imports the INSEE consumer price index used to
+// compute real prices.
+package loader
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"jc.org/immotep/model"
+)
+
+// cpiPeriod matches the period of an INSEE series row: "2023" for yearly
+// values or "2023-05" for monthly values.
+var cpiPeriod = regexp.MustCompile(`^(\d{4})(-(\d{2}))?$`)
+
+/*
+LoadCpi imports the consumer price index from an INSEE series CSV
+(valeurs_annuelles.csv or valeurs_mensuelles.csv of a BDM series such as
+001759970 "Indice des prix à la consommation - Ensemble des ménages"):
+
+	"Libellé";"Indice des prix à la consommation - Base 2015 ..."
+	"idBank";"001759970"
+	"Période";""
+	"2023-12";"117.92";"A"
+
+Parameters:
+  - dsn: DB connection string
+  - filename: path to the CSV file
+
+Behavior:
+  - Header rows are skipped; rows are "period;value".
+  - Monthly values are averaged by year; a yearly value takes precedence.
+  - Upserts values, so a newer file updates the index.
+*/
+func LoadCpi(dsn string, filename string) error {
+	db := model.ConnectToDB(dsn)
+
+	// open CSV file
+	f, err := os.Open(filename)
+	if err != nil {
+		log.Errorf("LoadCpi cannot open %v: %v\n", filename, err)
+		return err
+	}
+	defer f.Close()
+	log.Infof("Load consumer price index from: %v...\n", filename)
+
+	reader := csv.NewReader(f)
+	reader.Comma = ';'
+	reader.LazyQuotes = true
+	reader.FieldsPerRecord = -1
+
+	yearly := make(map[int]float64)
+	monthly := make(map[int][]float64)
+
+	for {
+		row, err := reader.Read()
+		// Stop at EOF.
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Errorf("LoadCpi cannot read row: %v\n", err)
+			continue
+		}
+		if len(row) < 2 {
+			continue
+		}
+
+		m := cpiPeriod.FindStringSubmatch(strings.TrimSpace(row[0]))
+		value, errValue := strconv.ParseFloat(strings.TrimSpace(row[1]), 64)
+		if m == nil || errValue != nil || value <= 0 {
+			continue
+		}
+
+		year, _ := strconv.Atoi(m[1])
+		if m[3] == "" {
+			yearly[year] = value
+		} else {
+			monthly[year] = append(monthly[year], value)
+		}
+	}
+
+	for year, values := range monthly {
+		if _, ok := yearly[year]; !ok {
+			sum := 0.0
+			for _, v := range values {
+				sum += v
+			}
+			yearly[year] = sum / float64(len(values))
+		}
+	}
+
+	if len(yearly) == 0 {
+		log.Errorf("LoadCpi no index value found in %v\n", filename)
+		return errors.New("no index value found")
+	}
+
+	cpis := make([]model.ConsumerPriceIndex, 0, len(yearly))
+	for year, value := range yearly {
+		cpis = append(cpis, model.ConsumerPriceIndex{Year: year, Value: value})
+	}
+
+	if err := model.SaveCpis(db, cpis); err != nil {
+		return err
+	}
+
+	log.Infof("...%v years of consumer price index loaded.\n", len(cpis))
+
+	return nil
+}
@@ -0,0 +1,40 @@
+package loader
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"jc.org/immotep/model"
+)
+
+func TestLoadCpi(t *testing.T) {
+	dsn := "file:cpi?mode=memory&cache=shared"
+	db := model.ConnectToDB(dsn)
+
+	tests := []struct {
+		name     string
+		filename string
+		wantErr  bool
+	}{
+		{"no_file", "unknown.csv", true},
+		{"no_value", "epci.csv", true},
+		{"cpi", "cpi.csv", false},
+		{"reload", "cpi.csv", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := LoadCpi(dsn, tt.filename); (err != nil) != tt.wantErr {
+				t.Errorf("LoadCpi() case[%v] error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+		})
+	}
+
+	var cpis []model.ConsumerPriceIndex
+	db.Order("year").Find(&cpis)
+	if assert.Len(t, cpis, 3) {
+		// yearly value wins over monthly ones
+		assert.Equal(t, 104.0, cpis[0].Value)
+		assert.Equal(t, 106.0, cpis[1].Value)
+		assert.Equal(t, 110.5, cpis[2].Value)
+	}
+}
@@ -0,0 +1,319 @@
+// Package loader implements data-loading helpers used by the immotep
+// application. This file imports ADEME energy performance diagnostics (DPE)
+// and matches them with transactions by parcel or address and date window.
+package loader
+
+import (
+	"errors"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/cheggaaa/pb/v3"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+	"gorm.io/gorm/clause"
+	"jc.org/immotep/model"
+)
+
+// DPE_AFTER_SALE_DAYS is the number of days a DPE can be dated after the
+// sale and still be matched (diagnostics are sometimes registered late).
+const DPE_AFTER_SALE_DAYS = 30
+
+// DPE CSV column names: the first existing name is used (open data export
+// names, then API field names).
+var dpeIdColumns = []string{"N°DPE", "NUMERO_DPE"}
+var dpeDateColumns = []string{"DATE_ÉTABLISSEMENT_DPE", "DATE_ETABLISSEMENT_DPE"}
+var dpeEnergyColumns = []string{"ETIQUETTE_DPE"}
+var dpeGhgColumns = []string{"ETIQUETTE_GES"}
+var dpeCityColumns = []string{"CODE_INSEE_(BAN)", "CODE_INSEE_BAN"}
+var dpeNumberColumns = []string{"N°_VOIE_(BAN)", "NUMERO_VOIE_BAN"}
+var dpeStreetColumns = []string{"NOM__RUE_(BAN)", "NOM_RUE_BAN"}
+var dpeAddressColumns = []string{"ADRESSE_(BAN)", "ADRESSE_BAN", "ADRESSE_BRUTE"}
+var dpeParcelColumns = []string{"NUMÉRO_PARCELLE", "NUMERO_PARCELLE", "PARCELLE"}
+
+// streetTypes expands DVF street type abbreviations.
+var streetTypes = map[string]string{
+	"all": "allee", "av": "avenue", "bd": "boulevard", "che": "chemin", "chem": "chemin",
+	"crs": "cours", "fg": "faubourg", "ham": "hameau", "imp": "impasse", "lot": "lotissement",
+	"pl": "place", "qua": "quai", "res": "residence", "rte": "route", "sq": "square", "sen": "sente",
+}
+
+var nonAlnum = regexp.MustCompile(`[^a-z0-9]+`)
+var zipAndCity = regexp.MustCompile(`\s\d{5}(\s.*)?$`)
+
+// normalizeAddress builds an address key: lower case ASCII words with
+// expanded street types and without zip code and city name.
+func normalizeAddress(address string) string {
+	address = zipAndCity.ReplaceAllString(strings.TrimSpace(address), "")
+
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	ascii, _, _ := transform.String(t, strings.ToLower(address))
+
+	words := strings.Fields(nonAlnum.ReplaceAllString(ascii, " "))
+	for i, w := range words {
+		if full, ok := streetTypes[w]; ok {
+			words[i] = full
+		}
+	}
+
+	return strings.Join(words, " ")
+}
+
+var dvfParcel = regexp.MustCompile(`^\d{1,3}(0?[A-Z]{1,2}|0?\d[A-Z]?)(\d+)$`)
+
+// transactionParcel returns the parcel key (city code, section, number) of a
+// DVF cadastre reference (commune number + section + plan number).
+func transactionParcel(cityCode, cadastre string) string {
+	m := dvfParcel.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(cadastre)))
+	if m == nil || cityCode == "" {
+		return ""
+	}
+
+	return parcelKey(cityCode, m[1], m[2])
+}
+
+// dpeParcel returns the parcel key of a 14 characters cadastral reference
+// (city code + prefix + section + number).
+func dpeParcel(ref string) string {
+	ref = strings.ToUpper(strings.ReplaceAll(ref, " ", ""))
+	if len(ref) != 14 {
+		return ""
+	}
+
+	return parcelKey(ref[0:5], ref[8:10], ref[10:14])
+}
+
+// parcelKey normalizes a parcel reference without leading zeros.
+func parcelKey(cityCode, section, number string) string {
+	section = strings.TrimLeft(section, "0")
+	number = strings.TrimLeft(number, "0")
+	if section == "" || number == "" {
+		return ""
+	}
+
+	return cityCode + "|" + section + "|" + number
+}
+
+// firstColumn returns the first of names present in columns or "".
+func firstColumn(columns map[string]int, names []string) string {
+	for _, n := range names {
+		if _, ok := columns[n]; ok {
+			return n
+		}
+	}
+
+	return ""
+}
+
+/*
+LoadDpe imports energy performance diagnostics from an ADEME DPE export
+("DPE Logements existants (depuis juillet 2021)") in CSV.
+
+Columns used (open data export names or API field names):
+
+	N°DPE, Date_établissement_DPE, Etiquette_DPE, Etiquette_GES,
+	Code_INSEE_(BAN), N°_voie_(BAN), Nom__rue_(BAN), Adresse_(BAN),
+	Numéro_parcelle (optional)
+
+Parameters:
+  - dsn: DB connection string
+  - filename: path to the DPE CSV file
+
+Behavior:
+  - Upserts diagnostics by DPE number, so a file can be loaded again.
+  - Stores normalized address and parcel keys used by MatchDpe.
+*/
+func LoadDpe(dsn string, filename string) error {
+	db := model.ConnectToDB(dsn)
+
+	// open CSV file
+	f, err := os.Open(filename)
+	if err != nil {
+		log.Errorf("LoadDpe cannot open %v: %v\n", filename, err)
+		return err
+	}
+	defer f.Close()
+	log.Infof("Load DPE from: %v...\n", filename)
+
+	reader, columns, err := openHeaderCSV(f, "ETIQUETTE_DPE")
+	if err != nil {
+		log.Errorf("LoadDpe cannot read header of %v: %v\n", filename, err)
+		return err
+	}
+
+	idCol := firstColumn(columns, dpeIdColumns)
+	dateCol := firstColumn(columns, dpeDateColumns)
+	cityCol := firstColumn(columns, dpeCityColumns)
+	if idCol == "" || dateCol == "" || cityCol == "" {
+		log.Errorf("LoadDpe missing DPE number, date or city column in %v\n", filename)
+		return errors.New("missing DPE columns")
+	}
+	energyCol := firstColumn(columns, dpeEnergyColumns)
+	ghgCol := firstColumn(columns, dpeGhgColumns)
+	numberCol := firstColumn(columns, dpeNumberColumns)
+	streetCol := firstColumn(columns, dpeStreetColumns)
+	addressCol := firstColumn(columns, dpeAddressColumns)
+	parcelCol := firstColumn(columns, dpeParcelColumns)
+
+	dpes := make([]model.Dpe, 0, 10000)
+	nbError := 0
+
+	for {
+		row, err := reader.Read()
+		// Stop at EOF.
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Errorf("LoadDpe cannot read row: %v\n", err)
+			continue
+		}
+
+		d := model.Dpe{Id: csvValue(row, columns, idCol), CityCode: csvValue(row, columns, cityCol),
+			EnergyClass: strings.ToUpper(csvValue(row, columns, energyCol)),
+			GhgClass:    strings.ToUpper(csvValue(row, columns, ghgCol))}
+
+		d.Date, err = time.Parse("2006-01-02", csvValue(row, columns, dateCol))
+		if err != nil || d.Id == "" || d.CityCode == "" || len(d.EnergyClass) != 1 {
+			nbError++
+			continue
+		}
+
+		if street := csvValue(row, columns, streetCol); street != "" {
+			d.Address = normalizeAddress(csvValue(row, columns, numberCol) + " " + street)
+		} else {
+			d.Address = normalizeAddress(csvValue(row, columns, addressCol))
+		}
+		d.Parcel = dpeParcel(csvValue(row, columns, parcelCol))
+
+		dpes = append(dpes, d)
+	}
+
+	if len(dpes) == 0 {
+		log.Errorf("LoadDpe no DPE found in %v\n", filename)
+		return errors.New("no DPE found")
+	}
+
+	result := db.Clauses(clause.OnConflict{UpdateAll: true}).CreateInBatches(&dpes, 500)
+	if result.Error != nil {
+		log.Errorf("LoadDpe Error: %v\n", result.Error)
+		return result.Error
+	}
+
+	log.Infof("...%v DPE loaded, %v rejected.\n", len(dpes), nbError)
+
+	return nil
+}
+
+/*
+MatchDpe sets the DPE class of transactions from the loaded diagnostics.
+
+Parameters:
+  - dsn: DB connection string
+  - windowDays: maximum number of days between the DPE and the sale (the DPE
+    may also be dated up to DPE_AFTER_SALE_DAYS after the sale)
+
+Behavior:
+  - Works city by city on cities having diagnostics.
+  - A diagnostic on the same parcel is preferred, else one at the same
+    normalized address; the one closest to the sale date wins.
+  - Returns the number of transactions with a DPE class.
+*/
+func MatchDpe(dsn string, windowDays int) int {
+	db := model.ConnectToDB(dsn)
+	if db == nil {
+		log.Errorf("MatchDpe err: cannot connect to DB: %v\n", dsn)
+		return 0
+	}
+
+	var cityCodes []string
+	db.Model(&model.Dpe{}).Distinct("city_code").Pluck("city_code", &cityCodes)
+	if len(cityCodes) == 0 {
+		log.Infof("MatchDpe: no DPE loaded.\n")
+		return 0
+	}
+
+	before := time.Duration(windowDays) * 24 * time.Hour
+	after := time.Duration(DPE_AFTER_SALE_DAYS) * 24 * time.Hour
+	nbMatched := 0
+
+	bar := pb.Default.Start(len(cityCodes))
+	for _, cityCode := range cityCodes {
+		bar.Increment()
+
+		var dpes []model.Dpe
+		db.Where("city_code = ?", cityCode).Find(&dpes)
+
+		byParcel := make(map[string][]model.Dpe)
+		byAddress := make(map[string][]model.Dpe)
+		for _, d := range dpes {
+			if d.Parcel != "" {
+				byParcel[d.Parcel] = append(byParcel[d.Parcel], d)
+			}
+			if d.Address != "" {
+				byAddress[d.Address] = append(byAddress[d.Address], d)
+			}
+		}
+
+		var trans []model.Transaction
+		db.Select("tr_id, date, address, cadastre, city_code").Where("city_code = ?", cityCode).Find(&trans)
+
+		tr2update := make([]map[string]interface{}, 0, len(trans))
+		for _, t := range trans {
+			d := closestDpe(byParcel[transactionParcel(t.CityCode, t.Cadastre)], t.Date, before, after)
+			if d == nil {
+				d = closestDpe(byAddress[normalizeAddress(t.Address)], t.Date, before, after)
+			}
+			if d != nil {
+				tr2update = append(tr2update, map[string]interface{}{"tr_id": t.TrId, "dpe_class": d.EnergyClass})
+			}
+		}
+
+		if len(tr2update) > 0 {
+			updresult := db.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "tr_id"}},
+				DoUpdates: clause.AssignmentColumns([]string{"dpe_class"}),
+			}).Table("transactions").CreateInBatches(&tr2update, 1000)
+
+			if updresult.Error != nil {
+				log.Errorf("Error MatchDpe update: %v\n", updresult.Error)
+			} else {
+				nbMatched += len(tr2update)
+			}
+		}
+	}
+	bar.Finish()
+
+	log.Infof("MatchDpe: %v transactions with a DPE class.\n", nbMatched)
+
+	return nbMatched
+}
+
+// closestDpe returns the diagnostic of candidates closest to date within
+// [date - before, date + after], or nil.
+func closestDpe(candidates []model.Dpe, date time.Time, before, after time.Duration) *model.Dpe {
+	var best *model.Dpe
+	var bestGap time.Duration
+
+	for i, d := range candidates {
+		gap := date.Sub(d.Date)
+		if gap > before || -gap > after {
+			continue
+		}
+		if gap < 0 {
+			gap = -gap
+		}
+		if best == nil || gap < bestGap {
+			best = &candidates[i]
+			bestGap = gap
+		}
+	}
+
+	return best
+}
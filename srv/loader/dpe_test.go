@@ -0,0 +1,70 @@
+package loader
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"jc.org/immotep/model"
+)
+
+func TestLoadAndMatchDpe(t *testing.T) {
+	dsn := "file:dpe?mode=memory&cache=shared"
+	db := model.ConnectToDB(dsn)
+
+	trans := []model.Transaction{
+		{Date: time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC), Address: "12  RUE DE LA PAIX", CityCode: "75102", Cadastre: "102AB12", PricePSQM: 10000},
+		{Date: time.Date(2022, 4, 20, 0, 0, 0, 0, time.UTC), Address: "5  AV FOCH", CityCode: "75102", Cadastre: "102AC7", PricePSQM: 12000},
+		{Date: time.Date(2022, 4, 20, 0, 0, 0, 0, time.UTC), Address: "1  RUE NEUVE", CityCode: "75102", Cadastre: "102AD1", PricePSQM: 9000},
+	}
+	if err := db.Create(&trans).Error; err != nil {
+		t.Fatalf("create transactions: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		filename string
+		wantErr  bool
+	}{
+		{"no_file", "unknown.csv", true},
+		{"bad_format", "epci.csv", true},
+		{"normal", "dpe.csv", false},
+		{"reload", "dpe.csv", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := LoadDpe(dsn, tt.filename); (err != nil) != tt.wantErr {
+				t.Errorf("LoadDpe() case[%v] error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+		})
+	}
+
+	var count int64
+	db.Model(&model.Dpe{}).Count(&count)
+	assert.Equal(t, int64(3), count)
+
+	assert.Equal(t, 2, MatchDpe(dsn, 365))
+
+	var matched []model.Transaction
+	db.Order("tr_id").Find(&matched)
+	assert.Equal(t, "C", matched[0].DpeClass)
+	assert.Equal(t, "A", matched[1].DpeClass)
+	assert.Equal(t, "", matched[2].DpeClass)
+
+	// a larger window does not replace the closest DPE
+	assert.Equal(t, 2, MatchDpe(dsn, 3650))
+	db.First(&matched[0], matched[0].TrId)
+	assert.Equal(t, "C", matched[0].DpeClass)
+}
+
+func TestNormalizeAddressAndParcel(t *testing.T) {
+	assert.Equal(t, "12 rue de la paix", normalizeAddress("12  RUE DE LA PAIX"))
+	assert.Equal(t, "5 avenue foch", normalizeAddress("5 Av Foch 75016 Paris"))
+	assert.Equal(t, "3 allee des pres", normalizeAddress("3 Allée des Prés"))
+
+	assert.Equal(t, "75102|AC|7", transactionParcel("75102", "102AC7"))
+	assert.Equal(t, "75102|A|70", transactionParcel("75102", "1020A0070"))
+	assert.Equal(t, "", transactionParcel("75102", ""))
+	assert.Equal(t, "75102|AC|7", dpeParcel("75102000AC0007"))
+	assert.Equal(t, "", dpeParcel("AC0007"))
+}
@@ -0,0 +1,201 @@
+// Package loader implements data-loading helpers used by the immotep
+// application. This file imports EPCI (intercommunalités) from the official
+// INSEE composition file, links member cities to their EPCI and builds the
+// EPCI contours by dissolving the contours of their member cities.
+package loader
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+
+	geojson "github.com/paulmach/go.geojson"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"jc.org/immotep/model"
+)
+
+// NO_EPCI_CODE is the EPCI code used by INSEE for cities without EPCI.
+const NO_EPCI_CODE = "ZZZZZZZZZ"
+
+/*
+LoadEpci imports EPCI from the INSEE composition file exported as CSV
+("Composition_communale" sheet of Intercommunalite-Metropole_au_01-01-YYYY).
+
+Expected columns (any order, ';' or ',' separated, title lines allowed before
+the header):
+
+	CODGEO;LIBGEO;EPCI;LIBEPCI;NATURE_EPCI;DEP;REG
+
+NATURE_EPCI is optional. Any grouping of cities using the same layout (for
+example a custom set of bassins de vie) can be loaded the same way.
+
+Parameters:
+  - dsn: DB connection string
+  - filename: path to the composition CSV file
+
+Behavior:
+  - Skips import if epcis table already contains rows.
+  - Creates one EPCI per distinct EPCI code and sets cities.code_epci.
+  - Builds EPCI contours by dissolving the contours of the member cities:
+    their shared boundaries are removed (see model.DissolvePolygons), with
+    ST_Union on PostgreSQL.
+*/
+func LoadEpci(dsn string, filename string) error {
+	// check if epci already loaded
+	db := model.ConnectToDB(dsn)
+	var count int64
+	db.Table("epcis").Count(&count)
+	if count > 0 {
+		log.Infof("LoadEpci: EPCI already loaded.\n")
+		return nil
+	}
+
+	// open CSV file
+	f, err := os.Open(filename)
+	if err != nil {
+		log.Errorf("LoadEpci cannot open %v: %v\n", filename, err)
+		return err
+	}
+	defer f.Close()
+	log.Infof("Load EPCI from: %v...\n", filename)
+
+	reader, columns, err := openHeaderCSV(f, "CODGEO", "EPCI")
+	if err != nil {
+		log.Errorf("LoadEpci cannot read header of %v: %v\n", filename, err)
+		return err
+	}
+
+	epcis := make(map[string]*model.Epci)
+	members := make(map[string][]string)
+	order := make([]string, 0, 1300)
+
+	for {
+		row, err := reader.Read()
+		// Stop at EOF.
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Errorf("LoadEpci cannot read row: %v\n", err)
+			continue
+		}
+
+		cityCode := csvValue(row, columns, "CODGEO")
+		code := csvValue(row, columns, "EPCI")
+		if cityCode == "" || code == "" || code == NO_EPCI_CODE {
+			continue
+		}
+
+		e, ok := epcis[code]
+		if !ok {
+			e = &model.Epci{Code: code, Name: csvValue(row, columns, "LIBEPCI"), Nature: csvValue(row, columns, "NATURE_EPCI")}
+			epcis[code] = e
+			order = append(order, code)
+		}
+		members[code] = append(members[code], cityCode)
+	}
+
+	if len(epcis) == 0 {
+		log.Errorf("LoadEpci no EPCI found in %v\n", filename)
+		return errors.New("no EPCI found")
+	}
+
+	list := make([]model.Epci, 0, len(epcis))
+	for _, code := range order {
+		list = append(list, *epcis[code])
+	}
+
+	result := db.CreateInBatches(&list, 200)
+	if result.Error != nil {
+		log.Errorf("LoadEpci Error: %v\n", result.Error)
+		return result.Error
+	}
+
+	// link cities to their EPCI
+	for _, code := range order {
+		updresult := db.Model(&model.City{}).Where("code IN ?", members[code]).Update("code_epci", code)
+		if updresult.Error != nil {
+			log.Errorf("LoadEpci cannot update cities of %v: %v\n", code, updresult.Error)
+		}
+	}
+
+	buildEpciContours(db)
+
+	log.Infof("...%v EPCI loaded.\n", len(list))
+
+	return nil
+}
+
+/*
+buildEpciContours sets the contour of each EPCI from the contours of its
+member cities.
+
+Behavior:
+  - Dissolves the member polygons in Go by removing the edges shared by
+    neighbouring cities (works on any DB) and stores a MultiPolygon feature.
+  - On Postgres, dissolves the member geometries again with ST_Union, which
+    also merges neighbours whose boundaries do not share their vertices.
+*/
+func buildEpciContours(db *gorm.DB) {
+	var cities []model.City
+
+	result := db.Select("code, code_epci, contour").Where("code_epci <> ''").Find(&cities)
+	if result.Error != nil {
+		log.Errorf("buildEpciContours err: %v\n", result.Error)
+		return
+	}
+
+	polygons := make(map[string][][][][]float64)
+	for _, c := range cities {
+		g, err := model.ParseContour(c.Contour)
+		if err != nil {
+			log.Debugf("buildEpciContours no contour for city %v: %v\n", c.Code, err)
+			continue
+		}
+
+		switch {
+		case g.IsPolygon():
+			polygons[c.CodeEpci] = append(polygons[c.CodeEpci], g.Polygon)
+		case g.IsMultiPolygon():
+			polygons[c.CodeEpci] = append(polygons[c.CodeEpci], g.MultiPolygon...)
+		}
+	}
+
+	var epcis []model.Epci
+	db.Select("code, name").Find(&epcis)
+
+	for _, e := range epcis {
+		polys, ok := polygons[e.Code]
+		if !ok {
+			continue
+		}
+
+		feature := geojson.NewMultiPolygonFeature(model.DissolvePolygons(polys)...)
+		feature.SetProperty("code", e.Code)
+		feature.SetProperty("nom", e.Name)
+
+		data, err := json.Marshal(feature)
+		if err != nil {
+			log.Errorf("buildEpciContours cannot marshall contour: %v\n", err)
+			continue
+		}
+
+		updresult := db.Model(&model.Epci{}).Where("code = ?", e.Code).Update("contour", string(data))
+		if updresult.Error != nil {
+			log.Errorf("buildEpciContours update error: %v\n", updresult.Error)
+		}
+	}
+
+	if db.Dialector.Name() == "postgres" {
+		log.Infof("Dissolve EPCI contours...\n")
+		text := "WITH esubquery AS (SELECT code_epci as code, ST_AsGeoJSON(ST_Union(geom)) as geo FROM cities WHERE code_epci <> '' GROUP BY code_epci) " +
+			"UPDATE epcis SET contour=json_build_object('type', 'Feature', 'properties', json_build_object('code', epcis.code, 'nom', epcis.name), 'geometry', esubquery.geo::json)::text " +
+			"FROM esubquery WHERE epcis.code=esubquery.code;"
+		res := db.Exec(text)
+		if res.Error != nil {
+			log.Errorf("Dissolve EPCI contours error: %v\n", res.Error)
+		}
+	}
+}
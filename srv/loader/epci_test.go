@@ -0,0 +1,84 @@
+package loader
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	geojson "github.com/paulmach/go.geojson"
+	"github.com/stretchr/testify/assert"
+	"jc.org/immotep/model"
+)
+
+func TestLoadEpci(t *testing.T) {
+	dsn := "file:epci?mode=memory&cache=shared"
+	db := model.ConnectToDB(dsn)
+
+	square := func(x, y float64) string {
+		return fmt.Sprintf(`{"type":"Feature","geometry":{"type":"Polygon","coordinates":[[[%v,%v],[%v,%v],[%v,%v],[%v,%v],[%v,%v]]]},"properties":{}}`,
+			x, y, x+1, y, x+1, y+1, x, y+1, x, y)
+	}
+
+	cities := []model.City{
+		{Code: "01001", Name: "L'Abergement-Clémenciat", CodeDepartment: "01", CodeRegion: "84", Contour: square(0, 0)},
+		{Code: "01002", Name: "L'Abergement-de-Varey", CodeDepartment: "01", CodeRegion: "84", Contour: square(1, 0)},
+		{Code: "01004", Name: "Ambérieu-en-Bugey", CodeDepartment: "01", CodeRegion: "84", Contour: square(2, 0)},
+	}
+	if err := db.Omit("Geom").Create(&cities).Error; err != nil {
+		t.Fatalf("create cities: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		filename string
+		wantErr  bool
+	}{
+		{"no_file", "unknown.csv", true},
+		{"bad_format", "regions.geojson", true},
+		{"normal", "epci.csv", false},
+		{"reload", "epci.csv", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := LoadEpci(dsn, tt.filename); (err != nil) != tt.wantErr {
+				t.Errorf("LoadEpci() case[%v] error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+		})
+	}
+
+	var epcis []model.Epci
+	db.Order("code").Find(&epcis)
+	assert.Len(t, epcis, 2)
+	assert.Equal(t, "CC de la Dombes", epcis[0].Name)
+	assert.Equal(t, "CC", epcis[0].Nature)
+
+	var c model.City
+	db.First(&c, "code = ?", "01004")
+	assert.Equal(t, "240100883", c.CodeEpci)
+
+	feat, err := geojson.UnmarshalFeature([]byte(epcis[1].Contour))
+	assert.NoError(t, err)
+	assert.True(t, feat.Geometry.IsMultiPolygon())
+	assert.True(t, model.PointInGeometry(feat.Geometry, 0.5, 2.5))
+	assert.False(t, model.PointInGeometry(feat.Geometry, 0.5, 0.5))
+	// the two member communes are dissolved: no boundary between them
+	if assert.Len(t, feat.Geometry.MultiPolygon, 1) && assert.Len(t, feat.Geometry.MultiPolygon[0], 1) {
+		ring := feat.Geometry.MultiPolygon[0][0]
+		assert.Len(t, ring, 7)
+		for i := 1; i < len(ring); i++ {
+			assert.False(t, ring[i-1][0] == 2 && ring[i][0] == 2, "inner boundary kept in %v", ring)
+		}
+	}
+}
+
+func TestOpenHeaderCSV(t *testing.T) {
+	_, _, err := openHeaderCSV(strings.NewReader("a,b\n1,2\n"), "CODGEO")
+	assert.Error(t, err)
+
+	reader, columns, err := openHeaderCSV(strings.NewReader("title\n\"CODGEO\",\"P21_POP\"\n01001,767\n"), "CODGEO")
+	assert.NoError(t, err)
+	row, err := reader.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, "767", csvValue(row, columns, "P21_POP"))
+	assert.Equal(t, "", csvValue(row, columns, "UNKNOWN"))
+}
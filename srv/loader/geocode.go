@@ -70,7 +70,8 @@ const STATUS_INDEX = 20
 //   - Processes results in batches, creates an in-memory CSV containing tr_id,
 //     Address and ZipCode fields, posts it to the geocoding service and parses
 //     the returned CSV.
-//   - Performs bulk updates using ON CONFLICT ... DO UPDATE on tr_id.
+//   - Performs bulk updates using ON CONFLICT ... DO UPDATE on tr_id. The
+//     IRIS of updated rows is reset so that LocateIris assigns it again.
 func GeocodeDB(dsn string, incremental bool, depcode string) {
 
 	db := model.ConnectToDB(dsn)
@@ -163,7 +164,7 @@ func GeocodeDB(dsn string, incremental bool, depcode string) {
 					nbError++
 				} else {
 					tr2update = append(tr2update, map[string]interface{}{"tr_id": trid, "address": row[ADDRESS_INDEX],
-						"zip_code": row[ZIPCODE_INDEX], "city": row[CITYNAME_INDEX], "city_code": row[CITYCODE_INDEX], "lat": lat, "long": long})
+						"zip_code": row[ZIPCODE_INDEX], "city": row[CITYNAME_INDEX], "city_code": row[CITYCODE_INDEX], "lat": lat, "long": long, "iris_code": ""})
 				}
 			} else {
 				log.Debugf("Cannot geocode: %v\n", row)
@@ -175,7 +176,7 @@ func GeocodeDB(dsn string, incremental bool, depcode string) {
 			// bulk update
 			updresult := db.Clauses(clause.OnConflict{
 				Columns:   []clause.Column{{Name: "tr_id"}},
-				DoUpdates: clause.AssignmentColumns([]string{"address", "city", "zip_code", "lat", "long"}),
+				DoUpdates: clause.AssignmentColumns([]string{"address", "city", "zip_code", "lat", "long", "iris_code"}),
 			}).Table("transactions").Create(&tr2update)
 
 			if updresult.Error != nil {
@@ -248,3 +249,39 @@ func getGPSCoord(csvdata string) (*csv.Reader, error) {
 
 	return reader, nil
 }
+
+// GeocodeAddress returns the coordinates and commune code of one address
+// using the geocoding service.
+func GeocodeAddress(address string) (float64, float64, string, error) {
+	b := new(strings.Builder)
+	w := csv.NewWriter(b)
+	// same columns as GeocodeDB so that the response indexes match
+	w.Write([]string{"trid", "Address", "ZipCode"})
+	w.Write([]string{"1", address, ""})
+	w.Flush()
+
+	csvread, err := getGPSCoord(b.String())
+	if err != nil {
+		return 0, 0, "", err
+	}
+
+	// skip header
+	if _, err := csvread.Read(); err != nil {
+		log.Errorf("GeocodeAddress cannot read response: %v\n", err)
+		return 0, 0, "", err
+	}
+
+	row, err := csvread.Read()
+	if err != nil || len(row) <= CITYCODE_INDEX {
+		log.Errorf("GeocodeAddress no result for %v\n", address)
+		return 0, 0, "", fmt.Errorf("cannot geocode %v", address)
+	}
+
+	lat, errlat := strconv.ParseFloat(row[LAT_INDEX], 64)
+	long, errlong := strconv.ParseFloat(row[LONG_INDEX], 64)
+	if errlat != nil || errlong != nil || (lat == 0 && long == 0) {
+		return 0, 0, "", fmt.Errorf("cannot geocode %v", address)
+	}
+
+	return lat, long, row[CITYCODE_INDEX], nil
+}
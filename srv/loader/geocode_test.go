@@ -179,3 +179,34 @@ func TestGeocodeDBEmpty(t *testing.T) {
 		t.Fatalf("expected 0 rows, got %d", cnt)
 	}
 }
+
+// TestGeocodeAddress checks the coordinates and commune of one address are
+// read from the geocoding response.
+func TestGeocodeAddress(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw := csv.NewWriter(w)
+		cols := make([]string, STATUS_INDEX+1)
+		cw.Write(cols)
+		cols[0] = "1"
+		cols[LAT_INDEX] = "44.837789"
+		cols[LONG_INDEX] = "-0.57918"
+		cols[CITYCODE_INDEX] = "33063"
+		cw.Write(cols)
+		cw.Flush()
+	}))
+	defer ts.Close()
+
+	origBase := geocodeBaseURL
+	geocodeBaseURL = ts.URL
+	defer func() { geocodeBaseURL = origBase }()
+
+	lat, long, city, err := GeocodeAddress("1 place de la Bourse, Bordeaux")
+	if err != nil || lat != 44.837789 || long != -0.57918 || city != "33063" {
+		t.Fatalf("unexpected geocoding %v %v %v %v", lat, long, city, err)
+	}
+
+	geocodeBaseURL = "http://127.0.0.1:1"
+	if _, _, _, err := GeocodeAddress("nowhere"); err == nil {
+		t.Fatalf("expected an error without geocoding service")
+	}
+}
@@ -0,0 +1,129 @@
+// Package loader implements data-loading helpers used by the immotep
+// application. This file imports INSEE Filosofi median disposable income by
+// commune or IRIS.
+package loader
+
+import (
+	"errors"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"jc.org/immotep/model"
+)
+
+// incomeColumn matches Filosofi median income columns: MED21, DISP_MED21,
+// DEC_MED21...
+var incomeColumn = regexp.MustCompile(`^(?:DISP_|DEC_)?MED(\d{2}|\d{4})$`)
+
+/*
+LoadIncome imports median disposable income from an INSEE Filosofi file
+exported as CSV (FILO20YY_DISP_COM or BASE_TD_FILO_DISP_IRIS_20YY).
+
+Expected columns (any order, ';' or ',' separated, title lines allowed before
+the header):
+
+	CODGEO;...;MED21;...      (communes)
+	IRIS;...;DISP_MED21;...   (IRIS)
+
+The year comes from the median column name. Codes of 9 characters are
+IRIS codes, codes of 5 characters are city codes, other codes are ignored.
+Secret or missing values ("s", "nd") are skipped.
+
+Parameters:
+  - dsn: DB connection string
+  - filename: path to the Filosofi CSV file
+
+Behavior:
+  - Upserts one median_incomes row per code and year.
+*/
+func LoadIncome(dsn string, filename string) error {
+	db := model.ConnectToDB(dsn)
+
+	// open CSV file
+	f, err := os.Open(filename)
+	if err != nil {
+		log.Errorf("LoadIncome cannot open %v: %v\n", filename, err)
+		return err
+	}
+	defer f.Close()
+	log.Infof("Load income from: %v...\n", filename)
+
+	reader, columns, err := openHeaderCSV(f, "MED")
+	if err != nil {
+		log.Errorf("LoadIncome cannot read header of %v: %v\n", filename, err)
+		return err
+	}
+
+	codeColumn := "CODGEO"
+	if _, ok := columns["IRIS"]; ok {
+		codeColumn = "IRIS"
+	}
+
+	medColumn := ""
+	year := 0
+	for name := range columns {
+		if m := incomeColumn.FindStringSubmatch(name); m != nil {
+			medColumn = name
+			year, _ = strconv.Atoi(m[1])
+			if year < 100 {
+				year += 2000
+			}
+			break
+		}
+	}
+
+	if _, ok := columns[codeColumn]; !ok || medColumn == "" {
+		log.Errorf("LoadIncome no code or median column in %v\n", filename)
+		return errors.New("no median income column found")
+	}
+
+	incomes := make([]model.MedianIncome, 0, 35000)
+
+	for {
+		row, err := reader.Read()
+		// Stop at EOF.
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Errorf("LoadIncome cannot read row: %v\n", err)
+			continue
+		}
+
+		code := csvValue(row, columns, codeColumn)
+		level := ""
+		switch len(code) {
+		case 5:
+			level = model.INCOME_LEVEL_CITY
+		case 9:
+			level = model.INCOME_LEVEL_IRIS
+		default:
+			continue
+		}
+
+		value := strings.Replace(strings.ReplaceAll(csvValue(row, columns, medColumn), " ", ""), ",", ".", 1)
+		med, err := strconv.ParseFloat(value, 64)
+		if err != nil || med <= 0 {
+			continue
+		}
+
+		incomes = append(incomes, model.MedianIncome{Level: level, Code: code, Year: year, Median: med})
+	}
+
+	if len(incomes) == 0 {
+		log.Errorf("LoadIncome no income found in %v\n", filename)
+		return errors.New("no income found")
+	}
+
+	if err := model.SaveMedianIncomes(db, incomes); err != nil {
+		return err
+	}
+
+	log.Infof("...%v median incomes loaded for %v.\n", len(incomes), year)
+
+	return nil
+}
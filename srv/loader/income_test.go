@@ -0,0 +1,38 @@
+package loader
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"jc.org/immotep/model"
+)
+
+func TestLoadIncome(t *testing.T) {
+	dsn := "file:income?mode=memory&cache=shared"
+	db := model.ConnectToDB(dsn)
+
+	tests := []struct {
+		name     string
+		filename string
+		wantErr  bool
+	}{
+		{"no_file", "unknown.csv", true},
+		{"bad_format", "epci.csv", true},
+		{"communes", "income.csv", false},
+		{"iris", "income_iris.csv", false},
+		{"reload", "income.csv", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := LoadIncome(dsn, tt.filename); (err != nil) != tt.wantErr {
+				t.Errorf("LoadIncome() case[%v] error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+		})
+	}
+
+	var incomes []model.MedianIncome
+	db.Order("code").Find(&incomes)
+	assert.Len(t, incomes, 2)
+	assert.Equal(t, model.MedianIncome{Level: model.INCOME_LEVEL_CITY, Code: "01001", Year: 2021, Median: 24870}, incomes[0])
+	assert.Equal(t, model.MedianIncome{Level: model.INCOME_LEVEL_IRIS, Code: "010040101", Year: 2021, Median: 19870.5}, incomes[1])
+}
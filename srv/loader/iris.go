@@ -0,0 +1,259 @@
+// Package loader implements data-loading helpers used by the immotep
+// application. This file imports INSEE IRIS contours (sub-commune statistical
+// zones) and assigns each geocoded transaction to the IRIS it belongs to.
+package loader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/cheggaaa/pb/v3"
+	geojson "github.com/paulmach/go.geojson"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"jc.org/immotep/model"
+)
+
+/*
+LoadIris imports IRIS zones from a GeoJSON file (IGN "CONTOURS-IRIS" converted
+to WGS84) into the iris table.
+
+Parameters:
+  - dsn: DB connection string
+  - filename: path to the IRIS geojson file
+
+Behavior:
+  - Skips import if iris table already contains rows.
+  - Reads code_iris, nom_iris, insee_com and typ_iris properties (any case).
+  - Only imports metropolitan IRIS.
+  - Stores the feature JSON in the contour column with its bounding box.
+*/
+func LoadIris(dsn string, filename string) error {
+	// check if iris already loaded
+	db := model.ConnectToDB(dsn)
+	var count int64
+	db.Table("iris").Count(&count)
+	if count > 0 {
+		log.Infof("LoadIris: IRIS already loaded.\n")
+		return nil
+	}
+
+	// Open our jsonFile
+	jsonFile, err := os.Open(filename)
+
+	if err != nil {
+		log.Errorf("LoadIris cannot open %v: %v\n", filename, err)
+		return err
+	}
+	defer jsonFile.Close()
+	log.Infof("Load IRIS from: %v...\n", filename)
+
+	byteValue, _ := io.ReadAll(jsonFile)
+
+	var irisgeo geojson.FeatureCollection
+	err = json.Unmarshal(byteValue, &irisgeo)
+	if err != nil {
+		log.Errorf("LoadIris cannot decode JSON file %v: %v\n", filename, err)
+		return err
+	}
+
+	nb := len(irisgeo.Features)
+	iris := make([]model.Iris, 0, nb)
+	for _, feature := range irisgeo.Features {
+		var z model.Iris
+		z.Code = featureProperty(feature, "code_iris")
+		z.Name = featureProperty(feature, "nom_iris")
+		z.CityCode = featureProperty(feature, "insee_com", "depcom")
+		z.Type = featureProperty(feature, "typ_iris")
+
+		// only metropolitan IRIS
+		if z.Code == "" || z.CityCode == "" || strings.HasPrefix(z.CityCode, "97") || feature.Geometry == nil {
+			log.Debugf("LoadIris skip feature: %v\n", feature.Properties)
+			continue
+		}
+
+		b := model.GeometryBounds(feature.Geometry)
+		z.MinLat, z.MaxLat, z.MinLong, z.MaxLong = b.MinLat, b.MaxLat, b.MinLong, b.MaxLong
+
+		data, err := json.Marshal(feature)
+		if err != nil {
+			log.Errorf("LoadIris cannot marshall contour: %v\n", err)
+			continue
+		}
+		z.Contour = string(data)
+
+		iris = append(iris, z)
+	}
+
+	result := db.CreateInBatches(&iris, 200)
+	if result.Error != nil {
+		log.Errorf("LoadIris Error: %v\n", result.Error)
+	}
+
+	log.Infof("...%v IRIS loaded.\n", len(iris))
+
+	return nil
+}
+
+/*
+featureProperty returns the first non empty string property among names.
+Property names are matched case-insensitively because the IGN and INSEE
+datasets change case between editions. Numeric properties are formatted.
+*/
+func featureProperty(feature *geojson.Feature, names ...string) string {
+	for _, name := range names {
+		for key, value := range feature.Properties {
+			if !strings.EqualFold(key, name) || value == nil {
+				continue
+			}
+			switch v := value.(type) {
+			case string:
+				if v != "" {
+					return v
+				}
+			case float64:
+				return fmt.Sprintf("%v", v)
+			}
+		}
+	}
+
+	return ""
+}
+
+// irisShape is an IRIS contour decoded for point in polygon tests.
+type irisShape struct {
+	code   string
+	bounds model.Bounds
+	geom   *geojson.Geometry
+}
+
+/*
+LocateIris assigns each geocoded transaction to the IRIS zone containing its
+coordinates.
+
+Parameters:
+  - dsn: DB connection string
+  - incremental: when true only rows without IRIS are processed
+
+Behavior:
+  - Loads IRIS contours grouped by city code.
+  - Tests each transaction against the IRIS of its city. When the point
+    falls outside every contour (imprecise geocoding) and the city has a
+    single IRIS, this IRIS is used.
+  - Performs bulk updates using ON CONFLICT ... DO UPDATE on tr_id.
+*/
+func LocateIris(dsn string, incremental bool) {
+	db := model.ConnectToDB(dsn)
+	if db == nil {
+		log.Errorf("LocateIris err: cannot connect to DB: %v\n", dsn)
+		return
+	}
+
+	shapes := loadIrisShapes(db)
+	if len(shapes) == 0 {
+		log.Infof("LocateIris: no IRIS loaded.\n")
+		return
+	}
+
+	query := db.Model(&model.Transaction{}).Where("lat <> 0")
+	if incremental {
+		query = query.Where("(iris_code IS NULL OR iris_code = '')")
+	}
+	query = query.Session(&gorm.Session{})
+
+	var count int64
+	query.Count(&count)
+	if count <= 0 {
+		log.Infof("No transactions to locate in IRIS.\n")
+		return
+	}
+
+	bar := pb.Default.Start(int(count))
+	nbprocessed := 0
+	nbNotFound := 0
+
+	var trans []model.Transaction
+	result := query.Select("tr_id, city_code, lat, long").FindInBatches(&trans, 5000, func(tx *gorm.DB, batch int) error {
+		var tr2update = make([]map[string]interface{}, 0, len(trans))
+
+		for _, item := range trans {
+			bar.Increment()
+
+			code := findIris(shapes[item.CityCode], item.Lat, item.Long)
+			if code == "" {
+				nbNotFound++
+				continue
+			}
+
+			tr2update = append(tr2update, map[string]interface{}{"tr_id": item.TrId, "iris_code": code})
+		}
+
+		if len(tr2update) > 0 {
+			updresult := db.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "tr_id"}},
+				DoUpdates: clause.AssignmentColumns([]string{"iris_code"}),
+			}).Table("transactions").Create(&tr2update)
+
+			if updresult.Error != nil {
+				log.Errorf("Error LocateIris update: %v\n", updresult.Error)
+			} else {
+				nbprocessed += int(updresult.RowsAffected)
+			}
+		}
+
+		return nil
+	})
+
+	if result.Error != nil {
+		log.Errorf("Error LocateIris: %v\n", result.Error)
+		return
+	}
+
+	bar.Add(int(bar.Total() - bar.Current()))
+	bar.Finish()
+	log.Infof("LocateIris: %v elt %v located %v without IRIS.\n", count, nbprocessed, nbNotFound)
+}
+
+// loadIrisShapes reads all IRIS contours and groups them by city code.
+func loadIrisShapes(db *gorm.DB) map[string][]irisShape {
+	var iris []model.Iris
+
+	result := db.Select("code, city_code, contour").Find(&iris)
+	if result.Error != nil {
+		log.Errorf("loadIrisShapes err: %v\n", result.Error)
+		return nil
+	}
+
+	shapes := make(map[string][]irisShape)
+	for _, z := range iris {
+		g, err := model.ParseContour(z.Contour)
+		if err != nil {
+			log.Errorf("loadIrisShapes cannot decode contour of %v: %v\n", z.Code, err)
+			continue
+		}
+		shapes[z.CityCode] = append(shapes[z.CityCode], irisShape{code: z.Code, bounds: model.GeometryBounds(g), geom: g})
+	}
+
+	return shapes
+}
+
+// findIris returns the code of the IRIS containing (lat, long) among the
+// IRIS of a city or "" when none matches.
+func findIris(shapes []irisShape, lat, long float64) string {
+	for _, s := range shapes {
+		if s.bounds.Contains(lat, long) && model.PointInGeometry(s.geom, lat, long) {
+			return s.code
+		}
+	}
+
+	// city not split into IRIS: the only IRIS is the whole city
+	if len(shapes) == 1 {
+		return shapes[0].code
+	}
+
+	return ""
+}
@@ -0,0 +1,83 @@
+package loader
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"jc.org/immotep/model"
+)
+
+func TestLoadIris(t *testing.T) {
+	type args struct {
+		dsn      string
+		filename string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		wantErr bool
+	}{
+		{"no_file", args{"file:iris?mode=memory&cache=shared", "unknown.json"}, true},
+		{"bad_format", args{"file:iris?mode=memory&cache=shared", "bad_region.geojson"}, true},
+		{"normal", args{"file:iris?mode=memory&cache=shared", "iris.geojson"}, false},
+		{"reload", args{"file:iris?mode=memory&cache=shared", "iris.geojson"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := LoadIris(tt.args.dsn, tt.args.filename); (err != nil) != tt.wantErr {
+				t.Errorf("LoadIris() case[%v] error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+		})
+	}
+
+	db := model.ConnectToDB("file:iris?mode=memory&cache=shared")
+	var count int64
+	db.Table("iris").Count(&count)
+	// overseas IRIS are skipped
+	assert.Equal(t, int64(3), count)
+
+	var z model.Iris
+	db.First(&z, "code = ?", "010010102")
+	assert.Equal(t, "Gare", z.Name)
+	assert.Equal(t, "01001", z.CityCode)
+	assert.Equal(t, 46.5, z.MaxLat)
+	assert.Equal(t, 4.5, z.MinLong)
+}
+
+func TestLocateIris(t *testing.T) {
+	dsn := "file:locateiris?mode=memory&cache=shared"
+
+	// call without IRIS
+	LocateIris(dsn, true)
+
+	if err := LoadIris(dsn, "iris.geojson"); err != nil {
+		t.Fatalf("LoadIris: %v", err)
+	}
+
+	db := model.ConnectToDB(dsn)
+	trans := []model.Transaction{
+		{Date: time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC), CityCode: "01001", Lat: 46.2, Long: 4.2},
+		{Date: time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC), CityCode: "01001", Lat: 46.2, Long: 4.7},
+		// outside every contour of a city split in several IRIS
+		{Date: time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC), CityCode: "01001", Lat: 47.2, Long: 4.7},
+		// outside the single IRIS of a city
+		{Date: time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC), CityCode: "01002", Lat: 47.2, Long: 4.7},
+		// not geocoded
+		{Date: time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC), CityCode: "01001"},
+	}
+	if err := db.Create(&trans).Error; err != nil {
+		t.Fatalf("create transactions: %v", err)
+	}
+
+	LocateIris(dsn, true)
+
+	var located []model.Transaction
+	db.Order("tr_id").Find(&located)
+	assert.Len(t, located, 5)
+	assert.Equal(t, "010010101", located[0].IrisCode)
+	assert.Equal(t, "010010102", located[1].IrisCode)
+	assert.Equal(t, "", located[2].IrisCode)
+	assert.Equal(t, "010020000", located[3].IrisCode)
+	assert.Equal(t, "", located[4].IrisCode)
+}
@@ -784,3 +784,66 @@ func getZipCodeFromCityCode(dsn string, codeCity string, uppername string) int {
 	log.Errorf("getZipCodeFromCityCode no zip for: %v\n", codeCity)
 	return -1
 }
+
+/*
+openHeaderCSV returns a CSV reader positioned after the header line of an
+INSEE style file and a map column name -> index.
+
+INSEE exports start with a few title lines: lines are skipped until one
+contains all required column names. The separator (';' or ',') is detected
+on the header line.
+*/
+func openHeaderCSV(f io.Reader, required ...string) (*csv.Reader, map[string]int, error) {
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lines := strings.SplitAfter(string(data), "\n")
+	for i, line := range lines {
+		upper := strings.ToUpper(line)
+
+		found := true
+		for _, r := range required {
+			if !strings.Contains(upper, r) {
+				found = false
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+
+		reader := csv.NewReader(strings.NewReader(strings.Join(lines[i:], "")))
+		if strings.Count(line, ";") >= strings.Count(line, ",") {
+			reader.Comma = ';'
+		}
+		reader.LazyQuotes = true
+		reader.FieldsPerRecord = -1
+
+		header, err := reader.Read()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		columns := make(map[string]int)
+		for idx, name := range header {
+			columns[strings.ToUpper(strings.Trim(strings.TrimSpace(name), "\ufeff\""))] = idx
+		}
+
+		return reader, columns, nil
+	}
+
+	return nil, nil, errors.New("header not found")
+}
+
+// csvValue returns the trimmed value of the named column or "" when the
+// column is missing.
+func csvValue(row []string, columns map[string]int, name string) string {
+	idx, ok := columns[name]
+	if !ok || idx >= len(row) {
+		return ""
+	}
+
+	return strings.TrimSpace(row[idx])
+}
@@ -0,0 +1,147 @@
+// Package loader implements data-loading helpers used by the immotep
+// application. This file imports the INSEE historical population tables
+// (population by commune and census year).
+package loader
+
+import (
+	"errors"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm/clause"
+	"jc.org/immotep/model"
+)
+
+// populationColumn matches INSEE population columns: PMUN21, PSDC99, P21_POP,
+// PMUN2021...
+var populationColumn = regexp.MustCompile(`^(?:PMUN|PSDC|PTOT|P)(\d{2}|\d{4})(?:_POP)?$`)
+
+// populationYear returns the census year of an INSEE population column or 0.
+func populationYear(column string) int {
+	m := populationColumn.FindStringSubmatch(column)
+	if m == nil {
+		return 0
+	}
+
+	year, _ := strconv.Atoi(m[1])
+	if len(m[1]) == 2 {
+		if year > 50 {
+			year += 1900
+		} else {
+			year += 2000
+		}
+	}
+
+	return year
+}
+
+/*
+LoadPopulation imports the population of cities by census year from the
+INSEE historical population file exported as CSV (base-pop-historiques,
+"COM" sheet).
+
+Expected columns (any order, ';' or ',' separated, title lines allowed before
+the header):
+
+	CODGEO;REG;DEP;LIBGEO;PMUN2021;PMUN2020;...;PSDC1999;PSDC1990;...
+
+Every column named PMUNyyyy, PSDCyyyy, PTOTyyyy (or with a 2 digit year, or
+Pyy_POP) is read as the population of census year yyyy.
+
+Parameters:
+  - dsn: DB connection string
+  - filename: path to the population CSV file
+
+Behavior:
+  - Upserts one city_populations row per city and census year.
+  - Sets cities.population to the population of the latest census year.
+*/
+func LoadPopulation(dsn string, filename string) error {
+	db := model.ConnectToDB(dsn)
+
+	// open CSV file
+	f, err := os.Open(filename)
+	if err != nil {
+		log.Errorf("LoadPopulation cannot open %v: %v\n", filename, err)
+		return err
+	}
+	defer f.Close()
+	log.Infof("Load population from: %v...\n", filename)
+
+	reader, columns, err := openHeaderCSV(f, "CODGEO")
+	if err != nil {
+		log.Errorf("LoadPopulation cannot read header of %v: %v\n", filename, err)
+		return err
+	}
+
+	years := make(map[string]int)
+	for name := range columns {
+		if year := populationYear(name); year > 0 {
+			years[name] = year
+		}
+	}
+	if len(years) == 0 {
+		log.Errorf("LoadPopulation no population column in %v\n", filename)
+		return errors.New("no population column found")
+	}
+
+	pops := make([]model.CityPopulation, 0, 35000*len(years))
+	latest := make(map[string]model.CityPopulation)
+
+	for {
+		row, err := reader.Read()
+		// Stop at EOF.
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Errorf("LoadPopulation cannot read row: %v\n", err)
+			continue
+		}
+
+		code := csvValue(row, columns, "CODGEO")
+		if code == "" {
+			continue
+		}
+
+		for name, year := range years {
+			value := strings.ReplaceAll(csvValue(row, columns, name), " ", "")
+			pop, err := strconv.ParseFloat(strings.Replace(value, ",", ".", 1), 64)
+			if err != nil {
+				continue
+			}
+
+			p := model.CityPopulation{Code: code, Year: year, Population: int(pop)}
+			pops = append(pops, p)
+			if p.Year > latest[code].Year {
+				latest[code] = p
+			}
+		}
+	}
+
+	if len(pops) == 0 {
+		log.Errorf("LoadPopulation no population found in %v\n", filename)
+		return errors.New("no population found")
+	}
+
+	result := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "code"}, {Name: "year"}},
+		DoUpdates: clause.AssignmentColumns([]string{"population"}),
+	}).CreateInBatches(&pops, 1000)
+	if result.Error != nil {
+		log.Errorf("LoadPopulation Error: %v\n", result.Error)
+		return result.Error
+	}
+
+	for code, p := range latest {
+		db.Model(&model.City{}).Where("code = ?", code).Update("population", p.Population)
+	}
+
+	log.Infof("...%v populations loaded for %v cities.\n", len(pops), len(latest))
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package loader
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"jc.org/immotep/model"
+)
+
+func TestLoadPopulation(t *testing.T) {
+	dsn := "file:population?mode=memory&cache=shared"
+	db := model.ConnectToDB(dsn)
+
+	cities := []model.City{
+		{Code: "01001", Name: "L'Abergement-Clémenciat", CodeDepartment: "01", CodeRegion: "84", Population: 100},
+		{Code: "01004", Name: "Ambérieu-en-Bugey", CodeDepartment: "01", CodeRegion: "84", Population: 100},
+	}
+	if err := db.Omit("Geom").Create(&cities).Error; err != nil {
+		t.Fatalf("create cities: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		filename string
+		wantErr  bool
+	}{
+		{"no_file", "unknown.csv", true},
+		{"bad_format", "epci.csv", true},
+		{"normal", "population.csv", false},
+		{"reload", "population.csv", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := LoadPopulation(dsn, tt.filename); (err != nil) != tt.wantErr {
+				t.Errorf("LoadPopulation() case[%v] error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+		})
+	}
+
+	var pops []model.CityPopulation
+	db.Where("code = ?", "01004").Order("year").Find(&pops)
+	assert.Len(t, pops, 4)
+	assert.Equal(t, 1990, pops[0].Year)
+	assert.Equal(t, 14514, pops[3].Population)
+
+	var count int64
+	db.Model(&model.CityPopulation{}).Count(&count)
+	assert.Equal(t, int64(12), count)
+
+	var c model.City
+	db.First(&c, "code = ?", "01004")
+	assert.Equal(t, 14514, c.Population)
+}
+
+func TestPopulationYear(t *testing.T) {
+	assert.Equal(t, 2021, populationYear("PMUN2021"))
+	assert.Equal(t, 1999, populationYear("PSDC99"))
+	assert.Equal(t, 2015, populationYear("P15_POP"))
+	assert.Equal(t, 0, populationYear("CODGEO"))
+	assert.Equal(t, 0, populationYear("POPULATION"))
+}
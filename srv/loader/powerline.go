@@ -0,0 +1,256 @@
+// Package loader implements data-loading helpers used by the immotep
+// application. This file imports RTE overhead power lines and computes the
+// distance from geocoded transactions to the nearest line.
+package loader
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+
+	"github.com/cheggaaa/pb/v3"
+	geojson "github.com/paulmach/go.geojson"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"jc.org/immotep/model"
+)
+
+var voltagePattern = regexp.MustCompile(`(\d+)\s*[kK][vV]`)
+
+// lineVoltage returns the voltage in kV of an RTE "tension" attribute
+// ("400kV", "63 kV", 225...) or 0 when the line is not energized.
+func lineVoltage(tension string) int {
+	if m := voltagePattern.FindStringSubmatch(tension); m != nil {
+		v, _ := strconv.Atoi(m[1])
+		return v
+	}
+
+	v, _ := strconv.Atoi(tension)
+	return v
+}
+
+/*
+LoadPowerLines imports overhead power lines from the RTE open data GeoJSON
+export ("Lignes aériennes RTE").
+
+Parameters:
+  - dsn: DB connection string
+  - filename: path to the GeoJSON file
+
+Behavior:
+  - Skips import if power lines are already loaded.
+  - Reads the line code from code_ligne and the voltage from tension; lines
+    out of service ("HORS TENSION") are skipped.
+*/
+func LoadPowerLines(dsn string, filename string) error {
+	// check if lines already loaded
+	db := model.ConnectToDB(dsn)
+	var count int64
+	db.Model(&model.PowerLine{}).Count(&count)
+	if count > 0 {
+		log.Infof("LoadPowerLines: power lines already loaded.\n")
+		return nil
+	}
+
+	// Open our jsonFile
+	jsonFile, err := os.Open(filename)
+	if err != nil {
+		log.Errorf("LoadPowerLines cannot open %v: %v\n", filename, err)
+		return err
+	}
+	defer jsonFile.Close()
+	log.Infof("Load power lines from: %v...\n", filename)
+
+	byteValue, _ := io.ReadAll(jsonFile)
+
+	var fc geojson.FeatureCollection
+	err = json.Unmarshal(byteValue, &fc)
+	if err != nil {
+		log.Errorf("LoadPowerLines cannot decode JSON file %v: %v\n", filename, err)
+		return err
+	}
+
+	lines := make([]model.PowerLine, 0, len(fc.Features))
+	for _, feature := range fc.Features {
+		if feature.Geometry == nil || !(feature.Geometry.IsLineString() || feature.Geometry.IsMultiLineString()) {
+			continue
+		}
+
+		l := model.PowerLine{Code: featureProperty(feature, "code_ligne", "code"),
+			Voltage: lineVoltage(featureProperty(feature, "tension", "voltage"))}
+		if l.Voltage <= 0 {
+			continue
+		}
+
+		b := model.GeometryBounds(feature.Geometry)
+		l.MinLat, l.MaxLat, l.MinLong, l.MaxLong = b.MinLat, b.MaxLat, b.MinLong, b.MaxLong
+
+		data, err := json.Marshal(feature.Geometry)
+		if err != nil {
+			log.Errorf("LoadPowerLines cannot marshall contour: %v\n", err)
+			continue
+		}
+		l.Contour = string(data)
+
+		lines = append(lines, l)
+	}
+
+	if len(lines) == 0 {
+		log.Errorf("LoadPowerLines no power line found in %v\n", filename)
+		return errors.New("no power line found")
+	}
+
+	result := db.CreateInBatches(&lines, 200)
+	if result.Error != nil {
+		log.Errorf("LoadPowerLines Error: %v\n", result.Error)
+		return result.Error
+	}
+
+	log.Infof("...%v power lines loaded.\n", len(lines))
+
+	return nil
+}
+
+// lineShape is a power line decoded for distance computations.
+type lineShape struct {
+	voltage int
+	geom    *geojson.Geometry
+}
+
+// lineLayer is the spatial index of the power lines: line bounds are
+// expanded by model.POWERLINE_SEARCH_RADIUS so that a point query returns
+// every line possibly within the radius.
+type lineLayer struct {
+	shapes []lineShape
+	index  *model.GridIndex
+}
+
+// nearest returns the distance (m) and voltage of the nearest line within
+// model.POWERLINE_SEARCH_RADIUS, or nil when there is none.
+func (l *lineLayer) nearest(lat, long float64) (*float64, int) {
+	var best *float64
+	voltage := 0
+
+	for _, id := range l.index.Query(lat, long) {
+		s := l.shapes[id]
+		d := model.DistanceToGeometry(s.geom, lat, long)
+		if d > model.POWERLINE_SEARCH_RADIUS || (best != nil && d >= *best) {
+			continue
+		}
+		best = &d
+		voltage = s.voltage
+	}
+
+	return best, voltage
+}
+
+// loadLineLayer reads the power lines and indexes them on a 0.02° grid.
+func loadLineLayer(db *gorm.DB) *lineLayer {
+	var lines []model.PowerLine
+
+	result := db.Find(&lines)
+	if result.Error != nil {
+		log.Errorf("loadLineLayer err: %v\n", result.Error)
+		return nil
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+
+	layer := &lineLayer{shapes: make([]lineShape, 0, len(lines)), index: model.NewGridIndex(0.02)}
+	for _, l := range lines {
+		g, err := model.ParseContour(l.Contour)
+		if err != nil {
+			log.Errorf("loadLineLayer cannot decode contour of line %v: %v\n", l.Id, err)
+			continue
+		}
+
+		// expand bounds by the search radius
+		dLat := model.POWERLINE_SEARCH_RADIUS / model.EARTH_RADIUS * 180 / math.Pi
+		dLong := dLat / math.Max(math.Cos(math.Max(math.Abs(l.MinLat), math.Abs(l.MaxLat))*math.Pi/180), 0.01)
+		b := model.Bounds{MinLat: l.MinLat - dLat, MaxLat: l.MaxLat + dLat, MinLong: l.MinLong - dLong, MaxLong: l.MaxLong + dLong}
+
+		layer.index.Add(len(layer.shapes), b)
+		layer.shapes = append(layer.shapes, lineShape{voltage: l.Voltage, geom: g})
+	}
+
+	return layer
+}
+
+/*
+ComputeLineDistances sets the line_distance and line_voltage columns of
+every geocoded transaction from the loaded power lines.
+
+Behavior:
+  - line_distance is the distance (m) to the nearest line and line_voltage
+    its voltage (kV); both are cleared when no line is within
+    model.POWERLINE_SEARCH_RADIUS.
+  - Does nothing when no power line is loaded.
+*/
+func ComputeLineDistances(dsn string) {
+	db := model.ConnectToDB(dsn)
+	if db == nil {
+		log.Errorf("ComputeLineDistances err: cannot connect to DB: %v\n", dsn)
+		return
+	}
+
+	layer := loadLineLayer(db)
+	if layer == nil {
+		log.Infof("ComputeLineDistances: no power line loaded.\n")
+		return
+	}
+
+	query := db.Model(&model.Transaction{}).Where("lat <> 0").Session(&gorm.Session{})
+
+	var count int64
+	query.Count(&count)
+	if count <= 0 {
+		log.Infof("No transactions to compute line distance.\n")
+		return
+	}
+
+	bar := pb.Default.Start(int(count))
+	nbNear := 0
+
+	var trans []model.Transaction
+	result := query.Select("tr_id, lat, long").FindInBatches(&trans, 5000, func(tx *gorm.DB, batch int) error {
+		var tr2update = make([]map[string]interface{}, 0, len(trans))
+
+		for _, item := range trans {
+			bar.Increment()
+
+			distance, voltage := layer.nearest(item.Lat, item.Long)
+			if distance != nil {
+				nbNear++
+			}
+
+			tr2update = append(tr2update, map[string]interface{}{"tr_id": item.TrId,
+				"line_distance": distance, "line_voltage": voltage})
+		}
+
+		updresult := db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "tr_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"line_distance", "line_voltage"}),
+		}).Table("transactions").Create(&tr2update)
+
+		if updresult.Error != nil {
+			log.Errorf("Error ComputeLineDistances update: %v\n", updresult.Error)
+		}
+
+		return nil
+	})
+
+	if result.Error != nil {
+		log.Errorf("Error ComputeLineDistances: %v\n", result.Error)
+		return
+	}
+
+	bar.Add(int(bar.Total() - bar.Current()))
+	bar.Finish()
+	log.Infof("ComputeLineDistances: %v elt %v near a power line.\n", count, nbNear)
+}
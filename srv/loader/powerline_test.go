@@ -0,0 +1,78 @@
+package loader
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"jc.org/immotep/model"
+)
+
+func TestLineVoltage(t *testing.T) {
+	assert.Equal(t, 400, lineVoltage("400kV"))
+	assert.Equal(t, 63, lineVoltage("63 kV"))
+	assert.Equal(t, 225, lineVoltage("225"))
+	assert.Equal(t, 0, lineVoltage("HORS TENSION"))
+}
+
+func TestLoadPowerLinesAndComputeLineDistances(t *testing.T) {
+	dsn := "file:powerline?mode=memory&cache=shared"
+	db := model.ConnectToDB(dsn)
+
+	date := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	far := 10.0
+	trans := []model.Transaction{
+		{Date: date, CityCode: "91001", Lat: 48.0009, Long: 2.1},
+		{Date: date, CityCode: "91001", Lat: 48.01, Long: 2.1},
+		{Date: date, CityCode: "91001", Lat: 48.05, Long: 2.1, LineDistance: &far},
+		{Date: date, CityCode: "91001", Lat: 48.05, Long: 3.001},
+		{Date: date, CityCode: "91001"},
+	}
+	if err := db.Create(&trans).Error; err != nil {
+		t.Fatalf("create transactions: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		filename string
+		wantErr  bool
+	}{
+		{"no_file", "unknown.geojson", true},
+		{"bad_format", "epci.csv", true},
+		{"no_line", "flood.geojson", true},
+		{"lines", "powerlines.geojson", false},
+		{"reload", "powerlines.geojson", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := LoadPowerLines(dsn, tt.filename); (err != nil) != tt.wantErr {
+				t.Errorf("LoadPowerLines() case[%v] error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+		})
+	}
+
+	var lines []model.PowerLine
+	db.Order("id").Find(&lines)
+	assert.Len(t, lines, 2)
+	assert.Equal(t, 400, lines[0].Voltage)
+	assert.Equal(t, "BRETIL61CHAMP", lines[1].Code)
+
+	ComputeLineDistances(dsn)
+
+	var computed []model.Transaction
+	db.Order("tr_id").Find(&computed)
+	if assert.NotNil(t, computed[0].LineDistance) {
+		assert.InDelta(t, 100, *computed[0].LineDistance, 2)
+		assert.Equal(t, 400, computed[0].LineVoltage)
+	}
+	if assert.NotNil(t, computed[1].LineDistance) {
+		assert.InDelta(t, 1112, *computed[1].LineDistance, 5)
+	}
+	assert.Nil(t, computed[2].LineDistance)
+	assert.Equal(t, 0, computed[2].LineVoltage)
+	if assert.NotNil(t, computed[3].LineDistance) {
+		assert.InDelta(t, 74, *computed[3].LineDistance, 2)
+		assert.Equal(t, 63, computed[3].LineVoltage)
+	}
+	assert.Nil(t, computed[4].LineDistance)
+}
@@ -0,0 +1,274 @@
+// Package loader implements data-loading helpers used by the immotep
+// application. This file imports risk zone polygons from Géorisques extracts
+// (PPRI flood zones, clay shrink-swell exposure) and tags geocoded
+// transactions with the risk zones they fall in.
+package loader
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/cheggaaa/pb/v3"
+	geojson "github.com/paulmach/go.geojson"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"jc.org/immotep/model"
+)
+
+// Properties holding the zone level in Géorisques extracts.
+var riskLevelProperties = map[string][]string{
+	model.RISK_FLOOD: {"typezone", "codezone", "typ_zone", "zone", "libelle"},
+	model.RISK_CLAY:  {"niveau", "alea", "niv_alea", "exposition"},
+}
+
+// clayLevels maps numeric clay exposure levels to their label.
+var clayLevels = map[string]string{"1": "faible", "2": "moyen", "3": "fort"}
+
+// riskSeverity orders levels so that the most severe zone wins when a
+// transaction falls in several zones of the same kind.
+var riskSeverity = map[string]int{"faible": 1, "moyen": 2, "fort": 3}
+
+/*
+LoadRiskZones imports risk zone polygons of one kind from a GeoJSON
+FeatureCollection. Géorisques shapefiles can be converted with:
+
+	ogr2ogr -f GeoJSON -t_srs EPSG:4326 zones.geojson zones.shp
+
+Parameters:
+  - dsn: DB connection string
+  - kind: model.RISK_FLOOD or model.RISK_CLAY
+  - filename: path to the GeoJSON file
+
+Behavior:
+  - Skips import if zones of this kind are already loaded.
+  - The level is read from the usual attributes (typezone, codezone... for
+    flood, niveau or alea for clay); numeric clay levels become faible, moyen
+    or fort. Flood zones without level are tagged "inondable".
+*/
+func LoadRiskZones(dsn string, kind string, filename string) error {
+	levelProps, ok := riskLevelProperties[kind]
+	if !ok {
+		log.Errorf("LoadRiskZones unknown risk kind: %v\n", kind)
+		return errors.New("unknown risk kind")
+	}
+
+	// check if zones already loaded
+	db := model.ConnectToDB(dsn)
+	var count int64
+	db.Model(&model.RiskZone{}).Where("kind = ?", kind).Count(&count)
+	if count > 0 {
+		log.Infof("LoadRiskZones: %v zones already loaded.\n", kind)
+		return nil
+	}
+
+	// Open our jsonFile
+	jsonFile, err := os.Open(filename)
+	if err != nil {
+		log.Errorf("LoadRiskZones cannot open %v: %v\n", filename, err)
+		return err
+	}
+	defer jsonFile.Close()
+	log.Infof("Load %v zones from: %v...\n", kind, filename)
+
+	byteValue, _ := io.ReadAll(jsonFile)
+
+	var fc geojson.FeatureCollection
+	err = json.Unmarshal(byteValue, &fc)
+	if err != nil {
+		log.Errorf("LoadRiskZones cannot decode JSON file %v: %v\n", filename, err)
+		return err
+	}
+
+	zones := make([]model.RiskZone, 0, len(fc.Features))
+	for _, feature := range fc.Features {
+		if feature.Geometry == nil || !(feature.Geometry.IsPolygon() || feature.Geometry.IsMultiPolygon()) {
+			continue
+		}
+
+		z := model.RiskZone{Kind: kind, Name: featureProperty(feature, "nom", "libelle", "name")}
+		z.Level = strings.ToLower(featureProperty(feature, levelProps...))
+		if label, ok := clayLevels[z.Level]; ok && kind == model.RISK_CLAY {
+			z.Level = label
+		}
+		if z.Level == "" {
+			if kind == model.RISK_CLAY {
+				continue
+			}
+			z.Level = "inondable"
+		}
+
+		b := model.GeometryBounds(feature.Geometry)
+		z.MinLat, z.MaxLat, z.MinLong, z.MaxLong = b.MinLat, b.MaxLat, b.MinLong, b.MaxLong
+
+		data, err := json.Marshal(feature.Geometry)
+		if err != nil {
+			log.Errorf("LoadRiskZones cannot marshall contour: %v\n", err)
+			continue
+		}
+		z.Contour = string(data)
+
+		zones = append(zones, z)
+	}
+
+	if len(zones) == 0 {
+		log.Errorf("LoadRiskZones no zone found in %v\n", filename)
+		return errors.New("no risk zone found")
+	}
+
+	result := db.CreateInBatches(&zones, 200)
+	if result.Error != nil {
+		log.Errorf("LoadRiskZones Error: %v\n", result.Error)
+		return result.Error
+	}
+
+	log.Infof("...%v %v zones loaded.\n", len(zones), kind)
+
+	return nil
+}
+
+// riskShape is a risk zone decoded for point in polygon tests.
+type riskShape struct {
+	level  string
+	bounds model.Bounds
+	geom   *geojson.Geometry
+}
+
+// riskLayer is the spatial index of the zones of one kind.
+type riskLayer struct {
+	shapes []riskShape
+	index  *model.GridIndex
+}
+
+// level returns the most severe level of the zones containing the point or
+// "" when the point is outside every zone.
+func (l *riskLayer) level(lat, long float64) string {
+	level := ""
+	for _, id := range l.index.Query(lat, long) {
+		s := l.shapes[id]
+		if !s.bounds.Contains(lat, long) || !model.PointInGeometry(s.geom, lat, long) {
+			continue
+		}
+		if level == "" || riskSeverity[s.level] > riskSeverity[level] {
+			level = s.level
+		}
+	}
+
+	return level
+}
+
+// loadRiskLayer reads the zones of one kind and indexes them on a 0.05°
+// grid.
+func loadRiskLayer(db *gorm.DB, kind string) *riskLayer {
+	var zones []model.RiskZone
+
+	result := db.Where("kind = ?", kind).Find(&zones)
+	if result.Error != nil {
+		log.Errorf("loadRiskLayer err: %v\n", result.Error)
+		return nil
+	}
+	if len(zones) == 0 {
+		return nil
+	}
+
+	layer := &riskLayer{shapes: make([]riskShape, 0, len(zones)), index: model.NewGridIndex(0.05)}
+	for _, z := range zones {
+		g, err := model.ParseContour(z.Contour)
+		if err != nil {
+			log.Errorf("loadRiskLayer cannot decode contour of zone %v: %v\n", z.Id, err)
+			continue
+		}
+		b := model.Bounds{MinLat: z.MinLat, MaxLat: z.MaxLat, MinLong: z.MinLong, MaxLong: z.MaxLong}
+		layer.index.Add(len(layer.shapes), b)
+		layer.shapes = append(layer.shapes, riskShape{level: z.Level, bounds: b, geom: g})
+	}
+
+	return layer
+}
+
+/*
+TagRisks sets the flood_risk and clay_risk columns of every geocoded
+transaction from the loaded risk zones.
+
+Behavior:
+  - A column is set to the level of the most severe zone containing the
+    transaction, or "" when it is outside every zone.
+  - Kinds without loaded zones are left untouched.
+*/
+func TagRisks(dsn string) {
+	db := model.ConnectToDB(dsn)
+	if db == nil {
+		log.Errorf("TagRisks err: cannot connect to DB: %v\n", dsn)
+		return
+	}
+
+	layers := make(map[string]*riskLayer)
+	columns := make([]string, 0, 2)
+	for _, kind := range []string{model.RISK_FLOOD, model.RISK_CLAY} {
+		if layer := loadRiskLayer(db, kind); layer != nil {
+			layers[kind] = layer
+			columns = append(columns, kind+"_risk")
+		}
+	}
+	if len(layers) == 0 {
+		log.Infof("TagRisks: no risk zone loaded.\n")
+		return
+	}
+
+	query := db.Model(&model.Transaction{}).Where("lat <> 0").Session(&gorm.Session{})
+
+	var count int64
+	query.Count(&count)
+	if count <= 0 {
+		log.Infof("No transactions to tag with risks.\n")
+		return
+	}
+
+	bar := pb.Default.Start(int(count))
+	nbInside := 0
+
+	var trans []model.Transaction
+	result := query.Select("tr_id, lat, long").FindInBatches(&trans, 5000, func(tx *gorm.DB, batch int) error {
+		var tr2update = make([]map[string]interface{}, 0, len(trans))
+
+		for _, item := range trans {
+			bar.Increment()
+
+			upd := map[string]interface{}{"tr_id": item.TrId}
+			inside := false
+			for kind, layer := range layers {
+				level := layer.level(item.Lat, item.Long)
+				upd[kind+"_risk"] = level
+				inside = inside || level != ""
+			}
+			if inside {
+				nbInside++
+			}
+
+			tr2update = append(tr2update, upd)
+		}
+
+		updresult := db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "tr_id"}},
+			DoUpdates: clause.AssignmentColumns(columns),
+		}).Table("transactions").Create(&tr2update)
+
+		if updresult.Error != nil {
+			log.Errorf("Error TagRisks update: %v\n", updresult.Error)
+		}
+
+		return nil
+	})
+
+	if result.Error != nil {
+		log.Errorf("Error TagRisks: %v\n", result.Error)
+		return
+	}
+
+	bar.Add(int(bar.Total() - bar.Current()))
+	bar.Finish()
+	log.Infof("TagRisks: %v elt %v in a risk zone.\n", count, nbInside)
+}
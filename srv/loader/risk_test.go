@@ -0,0 +1,68 @@
+package loader
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"jc.org/immotep/model"
+)
+
+func TestLoadRiskZonesAndTagRisks(t *testing.T) {
+	dsn := "file:risk?mode=memory&cache=shared"
+	db := model.ConnectToDB(dsn)
+
+	date := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	trans := []model.Transaction{
+		{Date: date, CityCode: "91001", Lat: 48.05, Long: 2.05},
+		{Date: date, CityCode: "91001", Lat: 48.05, Long: 2.25},
+		{Date: date, CityCode: "91001", Lat: 48.15, Long: 2.35},
+		{Date: date, CityCode: "91001", Lat: 46.0, Long: 1.0},
+		{Date: date, CityCode: "91001"},
+	}
+	if err := db.Create(&trans).Error; err != nil {
+		t.Fatalf("create transactions: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		kind     string
+		filename string
+		wantErr  bool
+	}{
+		{"unknown_kind", "fire", "flood.geojson", true},
+		{"no_file", model.RISK_FLOOD, "unknown.geojson", true},
+		{"bad_format", model.RISK_FLOOD, "epci.csv", true},
+		{"flood", model.RISK_FLOOD, "flood.geojson", false},
+		{"clay", model.RISK_CLAY, "clay.geojson", false},
+		{"reload", model.RISK_CLAY, "clay.geojson", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := LoadRiskZones(dsn, tt.kind, tt.filename); (err != nil) != tt.wantErr {
+				t.Errorf("LoadRiskZones() case[%v] error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+		})
+	}
+
+	var zones []model.RiskZone
+	db.Order("id").Find(&zones)
+	assert.Len(t, zones, 4)
+	assert.Equal(t, "rouge", zones[0].Level)
+	assert.Equal(t, "inondable", zones[1].Level)
+	assert.Equal(t, "faible", zones[2].Level)
+	assert.Equal(t, "fort", zones[3].Level)
+
+	TagRisks(dsn)
+
+	var tagged []model.Transaction
+	db.Order("tr_id").Find(&tagged)
+	assert.Equal(t, "rouge", tagged[0].FloodRisk)
+	assert.Equal(t, "fort", tagged[0].ClayRisk)
+	assert.Equal(t, "inondable", tagged[1].FloodRisk)
+	assert.Equal(t, "faible", tagged[1].ClayRisk)
+	assert.Equal(t, "", tagged[2].FloodRisk)
+	assert.Equal(t, "faible", tagged[2].ClayRisk)
+	assert.Equal(t, "", tagged[3].FloodRisk)
+	assert.Equal(t, "", tagged[3].ClayRisk)
+}
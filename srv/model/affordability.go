@@ -0,0 +1,273 @@
+// Package model provides data models and helpers for the immotep application.
+// This file joins household income data (INSEE Filosofi median disposable
+// income) to transactions and computes affordability metrics stored in the
+// yearly aggregate tables of every level.
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Levels of median income data.
+const INCOME_LEVEL_CITY = "city"
+const INCOME_LEVEL_IRIS = "iris"
+
+// STANDARD_SURFACE is the surface (m²) used to express prices in years of
+// income.
+const STANDARD_SURFACE = 70.0
+
+// MedianIncome stores the median annual disposable income (per consumption
+// unit) of a city or IRIS for one year.
+// Primary key is (Level, Code, Year).
+type MedianIncome struct {
+	Level  string  `gorm:"primaryKey" json:"level"`
+	Code   string  `gorm:"primaryKey" json:"code"`
+	Year   int     `gorm:"primaryKey" json:"year"`
+	Median float64 `json:"median"`
+}
+
+// Affordability holds affordability metrics embedded in the yearly aggregate
+// tables.
+//
+//   - MedianPrice: median transaction price
+//   - MedianIncome: median annual income of the area
+//   - AffordabilityRatio: MedianPrice / MedianIncome
+//   - YearsOfIncome: years of income needed to buy STANDARD_SURFACE m² at the
+//     median price per m²
+type Affordability struct {
+	MedianPrice        float64 `json:"median_price"`
+	MedianIncome       float64 `json:"median_income"`
+	AffordabilityRatio float64 `json:"affordability_ratio"`
+	YearsOfIncome      float64 `json:"years_of_income"`
+}
+
+// AffordabilityInfo is one yearly affordability row returned by
+// GetAffordability.
+type AffordabilityInfo struct {
+	Code string `json:"code"`
+	Name string `json:"name"`
+	Year int    `json:"year"`
+	Affordability
+}
+
+// ErrUnknownLevel is returned when an aggregation level name is unknown.
+var ErrUnknownLevel = errors.New("unknown level")
+
+// incomeSeries maps a code to its yearly income points sorted by year.
+type incomeSeries map[string][]MedianIncome
+
+// at returns the income of code for year: the latest value available at or
+// before year, else the first value (0 when the code has no income).
+func (s incomeSeries) at(code string, year int) float64 {
+	points := s[code]
+	if len(points) == 0 {
+		return 0
+	}
+
+	value := points[0].Median
+	for _, p := range points {
+		if p.Year > year {
+			break
+		}
+		value = p.Median
+	}
+
+	return value
+}
+
+// loadIncomeSeries reads the median incomes of one level.
+func loadIncomeSeries(db *gorm.DB, level string) incomeSeries {
+	series := make(incomeSeries)
+
+	var incomes []MedianIncome
+	result := db.Where("level = ?", level).Find(&incomes)
+	if result.Error != nil {
+		log.Errorf("loadIncomeSeries err: %v\n", result.Error)
+		return series
+	}
+
+	for _, i := range incomes {
+		series[i.Code] = append(series[i.Code], i)
+	}
+	for _, points := range series {
+		sort.Slice(points, func(i, j int) bool { return points[i].Year < points[j].Year })
+	}
+
+	return series
+}
+
+/*
+aggregateAffordability computes the affordability metrics of each code and
+year of level and updates the level table.
+
+Behavior:
+  - Median price and median price per m² are computed in Go from the
+    transactions of the group.
+  - Income is the IRIS (resp. city) income for the IRIS (resp. city) level;
+    for other levels it is the mean of the city incomes of the transactions
+    of the group.
+  - Nothing is done when no income is loaded.
+*/
+func aggregateAffordability(db *gorm.DB, level aggLevel) error {
+	cityIncomes := loadIncomeSeries(db, INCOME_LEVEL_CITY)
+	irisIncomes := loadIncomeSeries(db, INCOME_LEVEL_IRIS)
+	if len(cityIncomes) == 0 && len(irisIncomes) == 0 {
+		log.Infof("No income data for %v.\n", level.label)
+		return nil
+	}
+
+	colList := fmt.Sprintf("%s as year, %s as code, transactions.price, transactions.price_psqm, transactions.city_code, transactions.iris_code",
+		yearExtract(db), level.code)
+
+	query := db.Select(colList).Table("transactions").Scopes(withoutOutliers)
+	for _, j := range level.joins {
+		query = query.Joins(j)
+	}
+	if level.where != "" {
+		query = query.Where(level.where, level.args...)
+	}
+
+	rows, err := query.Order("code").Order("year").Rows()
+	if err != nil {
+		log.Errorf("aggregateAffordability %v err: %v\n", level.label, err)
+		return err
+	}
+
+	type group struct {
+		code    string
+		year    int
+		prices  []float64
+		psqms   []float64
+		incomes []float64
+	}
+
+	// read all groups before updating: SQLite cannot write while rows are open
+	groups := make([]*group, 0, 1000)
+	var current *group
+
+	for rows.Next() {
+		var code, cityCode, irisCode sql.NullString
+		var price, psqm float64
+		var year int
+
+		rows.Scan(&year, &code, &price, &psqm, &cityCode, &irisCode)
+
+		if current == nil || code.String != current.code || year != current.year {
+			current = &group{code: code.String, year: year}
+			groups = append(groups, current)
+		}
+
+		current.prices = append(current.prices, price)
+		current.psqms = append(current.psqms, psqm)
+		if income := cityIncomes.at(cityCode.String, year); income > 0 {
+			current.incomes = append(current.incomes, income)
+		}
+	}
+	rows.Close()
+
+	for _, g := range groups {
+		if g.code == "" {
+			continue
+		}
+
+		var a Affordability
+		a.MedianPrice = median(g.prices)
+		switch level.income {
+		case INCOME_LEVEL_IRIS:
+			a.MedianIncome = irisIncomes.at(g.code, g.year)
+		case INCOME_LEVEL_CITY:
+			a.MedianIncome = cityIncomes.at(g.code, g.year)
+		default:
+			a.MedianIncome = mean(g.incomes)
+		}
+		if a.MedianIncome > 0 {
+			a.AffordabilityRatio = a.MedianPrice / a.MedianIncome
+			a.YearsOfIncome = median(g.psqms) * STANDARD_SURFACE / a.MedianIncome
+		}
+
+		updresult := db.Table(level.table).Where("code = ? AND year = ?", g.code, g.year).Updates(map[string]interface{}{
+			"median_price": a.MedianPrice, "median_income": a.MedianIncome,
+			"affordability_ratio": a.AffordabilityRatio, "years_of_income": a.YearsOfIncome})
+		if updresult.Error != nil {
+			log.Errorf("Error aggregateAffordability update: %v\n", updresult.Error)
+			return updresult.Error
+		}
+	}
+
+	return nil
+}
+
+// mean returns the arithmetic mean of values (0 for an empty slice).
+func mean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+
+	return sum / float64(len(values))
+}
+
+// SaveMedianIncomes upserts median incomes.
+func SaveMedianIncomes(db *gorm.DB, incomes []MedianIncome) error {
+	result := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "level"}, {Name: "code"}, {Name: "year"}},
+		DoUpdates: clause.AssignmentColumns([]string{"median"}),
+	}).CreateInBatches(&incomes, 1000)
+
+	if result.Error != nil {
+		log.Errorf("SaveMedianIncomes err: %v\n", result.Error)
+	}
+
+	return result.Error
+}
+
+/*
+GetAffordability returns the yearly affordability rows of an aggregation
+level (city, iris, epci, department, region or zone).
+
+Parameters:
+  - level: aggregation level name
+  - code: optional code filter (empty means all codes)
+  - year: optional year filter (<= 0 means all years)
+
+Returns ErrUnknownLevel when level is not a known level.
+*/
+func GetAffordability(db *gorm.DB, level string, code string, year int) ([]AffordabilityInfo, error) {
+	if db == nil {
+		return nil, errors.New("no database")
+	}
+
+	l, ok := aggLevels[level]
+	if !ok {
+		return nil, ErrUnknownLevel
+	}
+
+	infos := make([]AffordabilityInfo, 0)
+
+	query := db.Table(l.table).Select("code, name, year, median_price, median_income, affordability_ratio, years_of_income")
+	if code != "" {
+		query = query.Where("code = ?", code)
+	}
+	if year > 0 {
+		query = query.Where("year = ?", year)
+	}
+
+	result := query.Order("code").Order("year").Limit(10000).Find(&infos)
+	if result.Error != nil {
+		log.Errorf("GetAffordability err: %v\n", result.Error)
+		return nil, result.Error
+	}
+
+	return infos, nil
+}
@@ -1,15 +1,41 @@
 // Package model provides data models and aggregation routines for the immotep
 // application. This file defines yearly aggregate types and functions that
 // compute average price-per-square-meter and year-over-year increase for
-// cities, departments and regions.
+// cities, IRIS zones, EPCI, departments, regions and user-defined zones.
 //
 // Aggregation strategy:
-//   - Use DB SQL to compute average price_psqm grouped by year and geographic
-//     unit (city_code, department_code, code_region).
+//   - Read transactions with their geographic unit (city_code, iris_code,
+//     code_epci, department_code, code_region, zone_code) and compute average,
+//     median, percentiles and standard deviation of price_psqm by year and
+//     unit in Go (SQLite has no percentile function).
 //   - Compute a simple relative increase compared to the previous year for the
-//     same geographic code.
-//   - Persist results into tables: city_yearly_aggs, department_yearly_aggs,
-//     region_yearly_aggs.
+//     same geographic code (null when that year has no aggregate), the
+//     compound annual growth since the previous aggregated year and the
+//     changes over 3, 5 and 10 years (see Growth).
+//   - Complete rows with affordability metrics (see aggregateAffordability).
+//   - Store the volume of sales, its yearly change, the turnover rate and a
+//     flag on the statistically weak averages (see Liquidity).
+//   - Store the average sale price and real (CPI deflated) prices in euros of
+//     CpiBaseYear when a consumer price index is loaded.
+//   - Fill the missing averages of the communes without sales by inverse-distance
+//     weighting of the nearby sales (see interpolateCities).
+//   - Compute monthly and quarterly aggregates with rolling 12-month averages
+//     (see aggregatePeriods) stored in monthly_aggs and quarterly_aggs.
+//   - Break the yearly statistics of every level down by buckets of area,
+//     rooms and land area (see aggregateSegments) stored in segment_aggs.
+//   - Find the communes whose price growth is significantly higher or lower
+//     than in their neighbours (see aggregateHotSpots) stored in hot_spots.
+//   - Bin geocoded transactions into a geohash grid at several resolutions
+//     (see aggregateGrid) stored in grid_cell_aggs.
+//   - Aggregate either everything again or, incrementally, only the codes
+//     with transactions since a date (see AggregateDataSince), upserting the
+//     rows in a single transaction; the global steps are always rebuilt from
+//     all the transactions.
+//   - Persist results into tables: city_yearly_aggs, iris_yearly_aggs,
+//     epci_yearly_aggs, department_yearly_aggs, region_yearly_aggs,
+//     zone_yearly_aggs, dpe_yearly_aggs (by department, year and DPE class)
+//     risk_city_aggs (by commune, risk kind and level) and power_line_aggs (by
+//     department and distance band to the nearest power line).
 //
 // Notes:
 //   - Aggregation reads from the transactions and geo tables (cities, regions,
@@ -19,7 +45,12 @@
 package model
 
 import (
+	"database/sql"
 	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"time"
 
 	"github.com/cheggaaa/pb/v3"
 	log "github.com/sirupsen/logrus"
@@ -27,188 +58,509 @@ import (
 	"gorm.io/gorm/clause"
 )
 
-// CityYearlyAgg stores yearly aggregated statistics for a city.
+// Growth holds the price changes of a yearly aggregate compared to the
+// previous years of the same code. Cagr is the compound annual growth rate
+// since the previous aggregated year, whatever the gap; Change3Y, Change5Y
+// and Change10Y are the relative changes over 3, 5 and 10 years. They are
+// nil when the compared year has no aggregate or a zero average, like the
+// Increase (one year change) of the aggregates.
+type Growth struct {
+	Cagr      *float64 `json:"cagr"`
+	Change3Y  *float64 `gorm:"column:change_3y" json:"change_3y"`
+	Change5Y  *float64 `gorm:"column:change_5y" json:"change_5y"`
+	Change10Y *float64 `gorm:"column:change_10y" json:"change_10y"`
+}
+
+// growthSpans maps the spans (years) of the changes of Growth to their
+// columns.
+var growthSpans = map[int]string{1: "increase", 3: "change_3y", 5: "change_5y", 10: "change_10y"}
+
+// growthColumns returns the increase and Growth columns of the average of a
+// year given the averages of the previous years of the same code.
+func growthColumns(year int, average float64, previous map[int]float64) map[string]interface{} {
+	columns := make(map[string]interface{}, len(growthSpans)+1)
+	for span, column := range growthSpans {
+		var change *float64
+		if prev := previous[year-span]; prev != 0 {
+			c := (average - prev) / prev
+			change = &c
+		}
+		columns[column] = change
+	}
+
+	var cagr *float64
+	last := 0
+	for y := range previous {
+		if y < year && y > last {
+			last = y
+		}
+	}
+	if prev := previous[last]; last > 0 && prev > 0 && average > 0 {
+		c := math.Pow(average/prev, 1/float64(year-last)) - 1
+		cagr = &c
+	}
+	columns["cagr"] = cagr
+
+	return columns
+}
+
+// CityYearlyAgg stores yearly aggregated statistics for a city, including
+// population indicators (see aggregateCityPopulation) and affordability.
+// Interpolated is set when AvgPrice comes from the price surface because the
+// city had no sale that year (see interpolateCities); Uncertainty is then its
+// standard error.
 // Primary key is (Code, Year).
 type CityYearlyAgg struct {
-	Code     string  `gorm:"primaryKey" json:"code"`
-	Year     int     `gorm:"primaryKey" json:"year"`
-	Name     string  `json:"nom"`
-	AvgPrice float64 `json:"avg_price"`
-	Increase float64 `json:"increase"`
+	Code             string   `gorm:"primaryKey" json:"code"`
+	Year             int      `gorm:"primaryKey" json:"year"`
+	Name             string   `json:"nom"`
+	AvgPrice         float64  `json:"avg_price"`
+	Increase         *float64 `json:"increase"`
+	Population       int      `json:"population"`
+	SalesPer1000     float64  `gorm:"column:sales_per1000" json:"sales_per_1000"`
+	PopulationGrowth float64  `json:"population_growth"`
+	Interpolated     bool     `gorm:"default:false" json:"interpolated"`
+	Uncertainty      float64  `json:"uncertainty"`
+	PriceDistribution
+	Affordability
+	RealPrice
+	Liquidity
+	Growth
 }
 
 // DepartmentYearlyAgg stores yearly aggregated statistics for a department.
 // Primary key is (Code, Year).
 type DepartmentYearlyAgg struct {
-	Code     string  `gorm:"primaryKey" json:"code"`
-	Year     int     `gorm:"primaryKey" json:"year"`
-	Name     string  `json:"nom"`
-	AvgPrice float64 `json:"avg_price"`
-	Increase float64 `json:"increase"`
+	Code     string   `gorm:"primaryKey" json:"code"`
+	Year     int      `gorm:"primaryKey" json:"year"`
+	Name     string   `json:"nom"`
+	AvgPrice float64  `json:"avg_price"`
+	Increase *float64 `json:"increase"`
+	PriceDistribution
+	Affordability
+	RealPrice
+	Liquidity
+	Growth
 }
 
 // RegionYearlyAgg stores yearly aggregated statistics for a region.
 // Primary key is (Code, Year).
 type RegionYearlyAgg struct {
-	Code     string  `gorm:"primaryKey" json:"code"`
-	Year     int     `gorm:"primaryKey" json:"year"`
-	Name     string  `json:"nom"`
-	AvgPrice float64 `json:"avg_price"`
-	Increase float64 `json:"increase"`
+	Code     string   `gorm:"primaryKey" json:"code"`
+	Year     int      `gorm:"primaryKey" json:"year"`
+	Name     string   `json:"nom"`
+	AvgPrice float64  `json:"avg_price"`
+	Increase *float64 `json:"increase"`
+	PriceDistribution
+	Affordability
+	RealPrice
+	Liquidity
+	Growth
+}
+
+// IrisYearlyAgg stores yearly aggregated statistics for an IRIS zone.
+// Primary key is (Code, Year).
+type IrisYearlyAgg struct {
+	Code     string   `gorm:"primaryKey" json:"code"`
+	Year     int      `gorm:"primaryKey" json:"year"`
+	Name     string   `json:"nom"`
+	AvgPrice float64  `json:"avg_price"`
+	Increase *float64 `json:"increase"`
+	PriceDistribution
+	Affordability
+	RealPrice
+	Liquidity
+	Growth
+}
+
+// EpciYearlyAgg stores yearly aggregated statistics for an EPCI.
+// Primary key is (Code, Year).
+type EpciYearlyAgg struct {
+	Code     string   `gorm:"primaryKey" json:"code"`
+	Year     int      `gorm:"primaryKey" json:"year"`
+	Name     string   `json:"nom"`
+	AvgPrice float64  `json:"avg_price"`
+	Increase *float64 `json:"increase"`
+	PriceDistribution
+	Affordability
+	RealPrice
+	Liquidity
+	Growth
+}
+
+// ZoneYearlyAgg stores yearly aggregated statistics for a user-defined zone.
+// Primary key is (Code, Year).
+type ZoneYearlyAgg struct {
+	Code     string   `gorm:"primaryKey" json:"code"`
+	Year     int      `gorm:"primaryKey" json:"year"`
+	Name     string   `json:"nom"`
+	AvgPrice float64  `json:"avg_price"`
+	Increase *float64 `json:"increase"`
+	PriceDistribution
+	Affordability
+	RealPrice
+	Liquidity
+	Growth
 }
 
-// AggregateData orchestrates the full aggregation process.
+// AggregateData orchestrates the full aggregation process (see
+// AggregateDataSince).
+func AggregateData(dsn string) error {
+	return AggregateDataSince(dsn, time.Time{})
+}
+
+// AggregateDataSince orchestrates the aggregation process. When since is
+// zero every aggregate is computed again; otherwise only the codes with
+// transactions on or after since are aggregated again, for the years from
+// the year of since, and their rows are upserted.
+//
+// The yearly, period and segment aggregates of the levels and their
+// affordability are the only incremental steps: the zone locations, the
+// interpolated commune averages, the turnover rates, the population
+// indicators, the hot spots and the DPE, risk, power line and grid
+// aggregates are always rebuilt from all the transactions.
 //
 // It:
 // - Ensures aggregate tables exist (AutoMigrate).
-// - Clears any existing aggregate rows.
-// - Runs per-entity aggregation routines for cities, departments and regions.
-func AggregateData(dsn string) {
+// - Runs the following steps in a single transaction, rolled back on the first error.
+// - Clears the existing aggregate rows (see cleanAggregate).
+// - Refreshes the transactions located inside user-defined zones.
+// - Runs per-entity aggregation routines for cities, IRIS, EPCI, departments, regions, zones.
+// - Fills the missing averages of the cities without sales from the price surface.
+// - Computes the monthly and quarterly series of every level.
+// - Computes the statistics of every level by area, rooms and land segment.
+// - Completes every level with its turnover rate (sales per 1,000 inhabitants).
+// - Completes city aggregates with population indicators.
+// - Finds the hot and cold spots of the city price growth.
+// - Completes every level with affordability metrics (median price vs income).
+// - Computes price statistics by DPE class per department and year.
+// - Compares prices inside and outside risk zones per commune.
+// - Computes price statistics by distance band to power lines per department.
+// - Computes the statistics of the geohash grid cells.
+func AggregateDataSince(dsn string, since time.Time) error {
 	db := ConnectToDB(dsn)
 
 	db.AutoMigrate(&CityYearlyAgg{})
 	db.AutoMigrate(&DepartmentYearlyAgg{})
 	db.AutoMigrate(&RegionYearlyAgg{})
+	db.AutoMigrate(&IrisYearlyAgg{})
+	db.AutoMigrate(&EpciYearlyAgg{})
+	db.AutoMigrate(&ZoneYearlyAgg{})
+	db.AutoMigrate(&DpeYearlyAgg{})
+	db.AutoMigrate(&RiskCityAgg{})
+	db.AutoMigrate(&PowerLineAgg{})
+	db.AutoMigrate(&MonthlyAgg{})
+	db.AutoMigrate(&QuarterlyAgg{})
+	db.AutoMigrate(&GridCellAgg{})
+	db.AutoMigrate(&HotSpot{})
+	db.AutoMigrate(&SegmentAgg{})
+
+	if !since.IsZero() {
+		log.Infof("Aggregate Data since %v...\n", since.Format("2006-01-02"))
+	}
 
-	cleanAggregate(db)
-	log.Infof("Aggregate Data for Cities...\n")
-	aggregateCities(db)
-	log.Infof("Aggregate Data for Departments...\n")
-	aggregateDepartments(db)
-	log.Infof("Aggregate Data for Regions...\n")
-	aggregateRegions(db)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return aggregateAll(tx, since)
+	})
+	if err != nil {
+		log.Errorf("AggregateData err: %v\n", err)
+		return err
+	}
 	log.Infof("All computation done.\n")
+	return nil
 }
 
-// cleanAggregate truncates the aggregate tables to remove any previous results.
-//
-// This ensures a fresh computation when AggregateData is called.
-func cleanAggregate(db *gorm.DB) {
-	db.Exec("TRUNCATE city_yearly_aggs;")
-	db.Exec("TRUNCATE region_yearly_aggs;")
-	db.Exec("TRUNCATE department_yearly_aggs;")
+// aggregateAll runs the aggregation steps of AggregateDataSince in order and
+// stops at the first failure, returning its error.
+func aggregateAll(db *gorm.DB, since time.Time) error {
+	steps := []func() error{
+		func() error { return cleanAggregate(db, since) },
+		func() error { return LocateZones(db) },
+	}
+	for _, key := range []string{"city", "iris", "epci", "department", "region", "zone"} {
+		level := aggLevels[key].since(db, since)
+		steps = append(steps, func() error {
+			log.Infof("Aggregate Data for %v...\n", level.label)
+			return aggregateLevel(db, level)
+		})
+		if key == "city" {
+			// before the turnover, so that the interpolated averages get one
+			steps = append(steps, func() error { return interpolateCities(db) })
+		}
+		steps = append(steps,
+			func() error { return aggregateTurnover(db, level) },
+			func() error { return aggregateAffordability(db, level) },
+			func() error { return aggregatePeriods(db, key, level) },
+			func() error { return aggregateSegments(db, key, level) },
+		)
+		if key == "city" {
+			steps = append(steps,
+				func() error { return aggregateCityPopulation(db) },
+				func() error { return aggregateHotSpots(db) },
+			)
+		}
+	}
+	steps = append(steps,
+		func() error {
+			log.Infof("Aggregate Data for DPE classes...\n")
+			return aggregateDpe(db)
+		},
+		func() error {
+			log.Infof("Aggregate Data for risk zones...\n")
+			return aggregateRisks(db)
+		},
+		func() error {
+			log.Infof("Aggregate Data for power lines...\n")
+			return aggregatePowerLines(db)
+		},
+		func() error {
+			log.Infof("Aggregate Data for the geohash grid...\n")
+			return aggregateGrid(db)
+		},
+	)
+
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-// aggregateCities computes yearly average price per sqm for each city and
-// inserts the results into the city_yearly_aggs table.
-//
-// Behavior:
-//   - Uses a SQL query joining transactions and cities, grouped by year and city.
-//   - Computes a simple year-over-year relative increase using the previous
-//     row's average for the same city code (as rows are ordered by code,year).
-//   - Inserts results in batches and shows a progress bar.
-func aggregateCities(db *gorm.DB) {
-	colList := fmt.Sprintf("%s as year, transactions.city_code as code, MIN(cities.name) as name, AVG(transactions.price_psqm) as avgPricePSQM",
-		func() string {
-			if db.Dialector.Name() == "sqlite" {
-				log.Debugf("Using SQLITE year extract syntax.\n")
-				return SQLITE_QUERY_YEAR_EXTRACT
-			} else {
-				log.Debugf("Using POSTGRES year extract syntax.\n")
-				return POSTGRES_QUERY_YEAR_EXTRACT
-			}
-		}())
+// levelTables are the aggregate tables computed by code, aggregated again
+// incrementally.
+var levelTables = []string{"city_yearly_aggs", "region_yearly_aggs", "department_yearly_aggs", "iris_yearly_aggs",
+	"epci_yearly_aggs", "zone_yearly_aggs", "monthly_aggs", "quarterly_aggs", "segment_aggs"}
 
-	rows, err := db.Select(colList).
-		Table("transactions").
-		Joins("LEFT JOIN cities on cities.code = transactions.city_code").
-		Group("year").Group("transactions.city_code").
-		Order(clause.OrderBy{Columns: []clause.OrderByColumn{
-			{Column: clause.Column{Name: "code"}, Desc: false},
-			{Column: clause.Column{Name: "year"}, Desc: false},
-		}}).
-		Rows()
+// globalTables are the aggregate tables always computed from all the
+// transactions.
+var globalTables = []string{"dpe_yearly_aggs", "risk_city_aggs", "power_line_aggs", "grid_cell_aggs"}
 
-	if err != nil {
-		log.Errorf("aggregateCities err: %v\n", err)
-		return
+// cleanAggregate deletes the previous results before an aggregation: the
+// global tables are always emptied, the level tables only when since is
+// zero (an incremental aggregation deletes only the rows it writes again,
+// see clearSince).
+//
+// DELETE is used as SQLite has no TRUNCATE.
+func cleanAggregate(db *gorm.DB, since time.Time) error {
+	tables := globalTables
+	if since.IsZero() {
+		tables = append(slices.Clone(levelTables), globalTables...)
 	}
-	defer rows.Close()
 
-	batchSize := 200
-	var city2update = make([]map[string]interface{}, 0, batchSize)
+	for _, table := range tables {
+		if result := db.Exec("DELETE FROM " + table); result.Error != nil {
+			log.Errorf("cleanAggregate %v err: %v\n", table, result.Error)
+			return result.Error
+		}
+	}
 
-	prevAverage := 0.0
-	prevCode := ""
+	return nil
+}
 
-	for rows.Next() {
-		var code string
-		var name string
-		var avgPricePSQM float64
-		var year int
-		increase := 0.0
+// aggLevel describes how transactions are grouped and where the yearly
+// aggregates of one geographic level are stored.
+type aggLevel struct {
+	label string        // level name used in logs
+	table string        // destination table
+	code  string        // SQL expression of the grouping code
+	name  string        // SQL expression of the level name
+	joins []string      // joins needed to resolve code and name
+	where string        // optional filter on transactions
+	args  []interface{} // arguments of the where filter
+	// income data used for affordability: INCOME_LEVEL_CITY or
+	// INCOME_LEVEL_IRIS, empty for the mean of the city incomes
+	income string
+	// cities column holding the level code, used to sum the population of
+	// the turnover rate (empty when the level has no population)
+	population string
+	// first year written by an incremental aggregation (0 for all years);
+	// the previous years are still read for the increases
+	fromYear int
+	// subquery of the codes aggregated again by an incremental aggregation
+	codes *gorm.DB
+}
 
-		rows.Scan(&year, &code, &name, &avgPricePSQM)
+var cityLevel = aggLevel{
+	label:      "cities",
+	population: "code",
+	table:      "city_yearly_aggs",
+	code:       "transactions.city_code",
+	name:       "cities.name",
+	income:     INCOME_LEVEL_CITY,
+	joins:      []string{"LEFT JOIN cities on cities.code = transactions.city_code"},
+}
 
-		if code == prevCode {
-			increase = (avgPricePSQM - prevAverage) / prevAverage
-		}
-		prevCode = code
-		prevAverage = avgPricePSQM
+var irisLevel = aggLevel{
+	label:  "IRIS",
+	table:  "iris_yearly_aggs",
+	code:   "transactions.iris_code",
+	name:   "iris.name",
+	income: INCOME_LEVEL_IRIS,
+	joins:  []string{"JOIN iris on iris.code = transactions.iris_code"},
+}
 
-		city2update = append(city2update, map[string]interface{}{"year": year, "code": code, "name": name, "avg_price": avgPricePSQM, "increase": increase})
+var epciLevel = aggLevel{
+	label:      "EPCI",
+	population: "code_epci",
+	table:      "epci_yearly_aggs",
+	code:       "cities.code_epci",
+	name:       "epcis.name",
+	joins: []string{
+		"JOIN cities on cities.code = transactions.city_code",
+		"JOIN epcis on epcis.code = cities.code_epci",
+	},
+}
 
-		log.Debugf("City (%v) year %v avg psqm: %.0f€\n", code, year, avgPricePSQM)
-	}
+var departmentLevel = aggLevel{
+	label:      "departments",
+	population: "code_department",
+	table:      "department_yearly_aggs",
+	code:       "transactions.department_code",
+	name:       "departments.name",
+	joins:      []string{"LEFT JOIN departments on departments.code = transactions.department_code"},
+}
 
-	if len(city2update) <= 0 {
-		log.Infof("Nothing to aggregate for cities.\n")
-		return
-	}
-	bar := pb.Default.Start(len(city2update))
+var regionLevel = aggLevel{
+	label:      "regions",
+	population: "code_region",
+	table:      "region_yearly_aggs",
+	code:       "cities.code_region",
+	name:       "regions.name",
+	joins: []string{
+		"LEFT JOIN cities on cities.code = transactions.city_code",
+		"LEFT JOIN regions on cities.code_region = regions.code",
+	},
+}
 
-	for {
+var zoneLevel = aggLevel{
+	label: "zones",
+	table: "zone_yearly_aggs",
+	code:  "zone_transactions.zone_code",
+	name:  "zones.name",
+	joins: []string{
+		"JOIN zone_transactions on zone_transactions.tr_id = transactions.tr_id",
+		"JOIN zones on zones.code = zone_transactions.zone_code",
+	},
+}
 
-		l := len(city2update)
-		b := l - 1
-		if l > batchSize {
-			b = batchSize
-		}
+// aggLevels maps level names used by the API to aggregation levels.
+var aggLevels = map[string]aggLevel{
+	"city":       cityLevel,
+	"iris":       irisLevel,
+	"epci":       epciLevel,
+	"department": departmentLevel,
+	"region":     regionLevel,
+	"zone":       zoneLevel,
+}
 
-		batch := city2update[0:b]
+// forCode returns a copy of the level restricted to a single code.
+func (level aggLevel) forCode(code string) aggLevel {
+	level.where = level.code + " = ?"
+	level.args = []interface{}{code}
+	return level
+}
 
-		updresult := db.Table("city_yearly_aggs").Create(&batch)
+// since returns a copy of the level restricted to the codes with
+// transactions on or after since, writing the years from the year of since.
+// It returns the level unchanged when since is zero.
+func (level aggLevel) since(db *gorm.DB, since time.Time) aggLevel {
+	if since.IsZero() {
+		return level
+	}
 
-		if updresult.Error != nil {
-			log.Errorf("Error aggregateCities update: %.0f\n", updresult.Error)
-		}
+	codes := db.Table("transactions").Select(level.code)
+	for _, j := range level.joins {
+		codes = codes.Joins(j)
+	}
+	codes = codes.Where("transactions.date >= ?", since)
 
-		bar.Add(b)
-		if l-1 == b {
-			break
-		}
-		city2update = city2update[b+1:]
+	level.where = level.code + " IN (?)"
+	level.args = []interface{}{codes}
+	level.fromYear = since.Year()
+	level.codes = codes
+	return level
+}
+
+// clearSince deletes the rows of table written again by an incremental
+// aggregation (the codes of level.codes from level.fromYear), so that no
+// stale row is left for a year without sales anymore. filter and args
+// optionally restrict the rows further. Nothing is done for a full
+// aggregation.
+func (level aggLevel) clearSince(db *gorm.DB, table string, filter string, args ...interface{}) error {
+	if level.codes == nil {
+		return nil
 	}
 
-	bar.Add(int(bar.Total() - bar.Current()))
-	bar.Finish()
+	where := "code IN (?) AND year >= ?"
+	if filter != "" {
+		where += " AND " + filter
+	}
+	result := db.Exec("DELETE FROM "+table+" WHERE "+where, append([]interface{}{level.codes, level.fromYear}, args...)...)
+	if result.Error != nil {
+		log.Errorf("clearSince %v err: %v\n", table, result.Error)
+		return result.Error
+	}
+
+	return nil
 }
 
 const SQLITE_QUERY_YEAR_EXTRACT = "strftime('%Y', transactions.date)"
 const POSTGRES_QUERY_YEAR_EXTRACT = "EXTRACT(year FROM transactions.date)"
 
-// aggregateDepartments computes yearly average price per sqm for each department
-// and inserts the results into department_yearly_aggs.
+// yearExtract returns the SQL expression extracting the year of a
+// transaction for the current DB dialect.
+func yearExtract(db *gorm.DB) string {
+	if db.Dialector.Name() == "sqlite" {
+		log.Debugf("Using SQLITE year extract syntax.\n")
+		return SQLITE_QUERY_YEAR_EXTRACT
+	}
+
+	log.Debugf("Using POSTGRES year extract syntax.\n")
+	return POSTGRES_QUERY_YEAR_EXTRACT
+}
+
+// aggregateLevel computes yearly price statistics for each code of the level
+// and inserts the results into the level table.
 //
-// Implementation mirrors aggregateCities but joins on departments and uses
-// transactions.department_code as the grouping key.
-func aggregateDepartments(db *gorm.DB) {
-
-	colList := fmt.Sprintf("%s as year, transactions.department_code as code, MIN(departments.name) as name, AVG(transactions.price_psqm) as avgPricePSQM",
-		func() string {
-			if db.Dialector.Name() == "sqlite" {
-				log.Debugf("Using SQLITE year extract syntax.\n")
-				return SQLITE_QUERY_YEAR_EXTRACT
-			} else {
-				log.Debugf("Using POSTGRES year extract syntax.\n")
-				return POSTGRES_QUERY_YEAR_EXTRACT
-			}
-		}())
+// Behavior:
+//   - Reads the transactions of the level ordered by code and year and
+//     groups them in Go, so that median, percentiles and standard deviation
+//     of the price per sqm are available on every database.
+//   - Computes the year-over-year relative increase of the average, its
+//     compound annual growth and multi-year changes from the previous
+//     groups of the same code (see growthColumns).
+//   - Writes only the years from level.fromYear, after deleting the previous
+//     rows of the codes aggregated again (see clearSince).
+//   - Deflates the averages with the consumer price index if loaded.
+//   - Computes the volume of sales, its change compared to the previous year
+//     and flags the weak averages (see weakAverage).
+//   - Upserts results in batches and shows a progress bar.
+func aggregateLevel(db *gorm.DB, level aggLevel) error {
+	if err := level.clearSince(db, level.table, ""); err != nil {
+		return err
+	}
+
+	colList := fmt.Sprintf("%s as year, %s as code, %s as name, transactions.price_psqm, transactions.price",
+		yearExtract(db), level.code, level.name)
+
+	// before reading the rows: a transaction cannot query while rows are open
+	deflator := NewDeflator(db, CpiBaseYear)
+	cpiBase := 0
+	if deflator != nil {
+		cpiBase = deflator.Base
+	}
+
+	query := db.Select(colList).Table("transactions").Scopes(withoutOutliers)
+	for _, j := range level.joins {
+		query = query.Joins(j)
+	}
+	if level.where != "" {
+		query = query.Where(level.where, level.args...)
+	}
 
-	rows, err := db.Select(colList).
-		Table("transactions").
-		Joins("LEFT JOIN departments on departments.code = transactions.department_code").
-		Group("year").Group("transactions.department_code").
+	rows, err := query.
 		Order(clause.OrderBy{Columns: []clause.OrderByColumn{
 			{Column: clause.Column{Name: "code"}, Desc: false},
 			{Column: clause.Column{Name: "year"}, Desc: false},
@@ -216,159 +568,203 @@ func aggregateDepartments(db *gorm.DB) {
 		Rows()
 
 	if err != nil {
-		log.Errorf("aggregateDepartments err: %v\n", err)
-		return
+		log.Errorf("aggregate %v err: %v\n", level.label, err)
+		return err
 	}
-	defer rows.Close()
 
-	batchSize := 200
-	var dep2update = make([]map[string]interface{}, 0, batchSize)
+	type group struct {
+		code   string
+		name   string
+		year   int
+		psqms  []float64
+		prices []float64
+	}
 
-	prevAverage := 0.0
-	prevCode := ""
+	var agg2update = make([]map[string]interface{}, 0, 200)
 
-	for rows.Next() {
-		var code string
-		var name string
-		var avgPricePSQM float64
-		var year int
-		increase := 0.0
+	averages := make(map[int]float64) // previous averages of prevCode
+	prevCode := ""
+	prevYear, prevCount, prevVolume := 0, 0, 0.0
 
-		rows.Scan(&year, &code, &name, &avgPricePSQM)
+	// flush computes the statistics of a complete group
+	flush := func(g *group) {
+		if g == nil {
+			return
+		}
 
-		if code == prevCode {
-			increase = (avgPricePSQM - prevAverage) / prevAverage
+		avgPricePSQM := mean(g.psqms)
+		avgPrice := mean(g.prices)
+		if g.code != prevCode {
+			averages = make(map[int]float64)
+		}
+		growth := growthColumns(g.year, avgPricePSQM, averages)
+		averages[g.year] = avgPricePSQM
+		volume := avgPrice * float64(len(g.prices))
+		var volumeIncrease, countIncrease *float64
+		if g.code == prevCode && g.year == prevYear+1 {
+			volumeIncrease = relativeChange(volume, prevVolume)
+			countIncrease = relativeChange(float64(len(g.prices)), float64(prevCount))
+		}
+		prevCode = g.code
+		prevYear, prevCount, prevVolume = g.year, len(g.prices), volume
+		if g.year < level.fromYear {
+			return
 		}
-		prevCode = code
-		prevAverage = avgPricePSQM
 
-		dep2update = append(dep2update, map[string]interface{}{"year": year, "code": code, "name": name, "avg_price": avgPricePSQM, "increase": increase})
+		agg := newPriceDistribution(g.psqms).columns()
+		agg["year"], agg["code"], agg["name"] = g.year, g.code, g.name
+		agg["avg_price"], agg["avg_total_price"] = avgPricePSQM, avgPrice
+		for column, value := range growth {
+			agg[column] = value
+		}
+		agg["cpi_base"], agg["real_avg_price"], agg["real_avg_total_price"] = cpiBase, 0.0, 0.0
+		agg["volume"], agg["volume_increase"], agg["count_increase"] = volume, volumeIncrease, countIncrease
+		agg["turnover_rate"], agg["weak"] = 0.0, weakAverage(g.psqms)
+		if deflator != nil {
+			agg["real_avg_price"] = deflator.Deflate(avgPricePSQM, g.year)
+			agg["real_avg_total_price"] = deflator.Deflate(avgPrice, g.year)
+		}
+		agg2update = append(agg2update, agg)
 
-		log.Debugf("Dep (%v) year %v avg psqm: %.0f€\n", code, year, avgPricePSQM)
+		log.Debugf("%v (%v) year %v avg psqm: %.0f€\n", level.label, g.code, g.year, avgPricePSQM)
 	}
 
-	if len(dep2update) <= 0 {
-		log.Infof("Nothing to aggregate for departments.\n")
-		return
-	}
-	bar := pb.Default.Start(len(dep2update))
+	var current *group
+	for rows.Next() {
+		var code sql.NullString
+		var name sql.NullString
+		var psqm, price float64
+		var year int
 
-	for {
+		rows.Scan(&year, &code, &name, &psqm, &price)
 
-		l := len(dep2update)
-		b := l - 1
-		if l > batchSize {
-			b = batchSize
+		if current == nil || code.String != current.code || year != current.year {
+			flush(current)
+			current = &group{code: code.String, name: name.String, year: year}
 		}
-
-		batch := dep2update[0:b]
-
-		updresult := db.Table("department_yearly_aggs").Create(&batch)
-
-		if updresult.Error != nil {
-			log.Errorf("Error aggregateDepartments update: %.0f\n", updresult.Error)
+		if current.name == "" {
+			current.name = name.String
 		}
+		current.psqms = append(current.psqms, psqm)
+		current.prices = append(current.prices, price)
+	}
+	flush(current)
+	rows.Close()
 
-		bar.Add(b)
-		if l-1 == b {
-			break
-		}
-		dep2update = dep2update[b+1:]
+	if len(agg2update) <= 0 {
+		log.Infof("Nothing to aggregate for %v.\n", level.label)
+		return nil
 	}
 
-	bar.Add(int(bar.Total() - bar.Current()))
-	bar.Finish()
+	return insertAggregates(db, level.table, []string{"code", "year"}, agg2update)
 }
 
-// aggregateRegions computes yearly average price per sqm for regions and writes
-// results into region_yearly_aggs.
-//
-// It joins transactions -> cities -> regions to obtain the region code and name.
-func aggregateRegions(db *gorm.DB) {
-
-	colList := fmt.Sprintf("%s as year, cities.code_region as code, MIN(regions.name) as name, AVG(transactions.price_psqm) as avgPricePSQM",
-		func() string {
-			if db.Dialector.Name() == "sqlite" {
-				log.Debugf("Using SQLITE year extract syntax.\n")
-				return SQLITE_QUERY_YEAR_EXTRACT
-			} else {
-				log.Debugf("Using POSTGRES year extract syntax.\n")
-				return POSTGRES_QUERY_YEAR_EXTRACT
-			}
-		}())
-
-	rows, err := db.Select(colList).
-		Table("transactions").
-		Joins("LEFT JOIN cities on cities.code = transactions.city_code").
-		Joins("LEFT JOIN regions on cities.code_region = regions.code").
-		Group("year").Group("cities.code_region").
-		Order(clause.OrderBy{Columns: []clause.OrderByColumn{
-			{Column: clause.Column{Name: "code"}, Desc: false},
-			{Column: clause.Column{Name: "year"}, Desc: false},
-		}}).
-		Rows()
+/*
+computeDistribution stores the price per sqm distribution (median,
+percentiles, standard deviation and count) of each code of the level in an
+entity table (regions, departments, cities...).
+
+The transactions of the level are read ordered by code and the statistics
+are computed in Go, so that it works on SQLite and PostgreSQL. The
+distribution of every code of the table (or of the code of a level
+restricted by forCode) is reset first, so that a code without sales anymore
+keeps no stale statistics.
+*/
+func computeDistribution(db *gorm.DB, level aggLevel, table string) {
+	query := db.Select(level.code + " as code, transactions.price_psqm").Table("transactions").Scopes(withoutOutliers)
+	for _, j := range level.joins {
+		query = query.Joins(j)
+	}
+	if level.where != "" {
+		query = query.Where(level.where, level.args...)
+	}
 
+	rows, err := query.Order("code").Rows()
 	if err != nil {
-		log.Errorf("aggregateRegions err: %v\n", err)
+		log.Errorf("computeDistribution %v err: %v\n", level.label, err)
 		return
 	}
-	defer rows.Close()
-
-	batchSize := 200
-	var region2update = make([]map[string]interface{}, 0, batchSize)
 
-	prevAverage := 0.0
-	prevCode := ""
+	// read all codes before updating: SQLite cannot write while rows are open
+	distributions := make(map[string]PriceDistribution)
+	code := ""
+	psqms := make([]float64, 0, 1000)
 
 	for rows.Next() {
-		var code string
-		var name string
-		var avgPricePSQM float64
-		var year int
-		increase := 0.0
-
-		rows.Scan(&year, &code, &name, &avgPricePSQM)
+		var c sql.NullString
+		var psqm float64
 
-		if code == prevCode {
-			increase = (avgPricePSQM - prevAverage) / prevAverage
+		rows.Scan(&c, &psqm)
+		if c.String != code {
+			if code != "" {
+				distributions[code] = newPriceDistribution(psqms)
+			}
+			code = c.String
+			psqms = psqms[:0]
 		}
-		prevCode = code
-		prevAverage = avgPricePSQM
-
-		region2update = append(region2update, map[string]interface{}{"year": year, "code": code, "name": name, "avg_price": avgPricePSQM, "increase": increase})
-
-		log.Debugf("Dep (%v) year %v avg psqm: %.0f€\n", code, year, avgPricePSQM)
+		psqms = append(psqms, psqm)
 	}
+	if code != "" {
+		distributions[code] = newPriceDistribution(psqms)
+	}
+	rows.Close()
 
-	if len(region2update) <= 0 {
-		log.Infof("Nothing to aggregate for region.\n")
+	reset := db.Table(table).Where("1 = 1")
+	if level.where != "" {
+		reset = db.Table(table).Where("code = ?", level.args...)
+	}
+	if result := reset.Updates(PriceDistribution{}.columns()); result.Error != nil {
+		log.Errorf("Error computeDistribution %v reset: %v\n", table, result.Error)
 		return
 	}
-	bar := pb.Default.Start(len(region2update))
 
-	for {
+	for c, d := range distributions {
+		updresult := db.Table(table).Where("code = ?", c).Updates(d.columns())
+		if updresult.Error != nil {
+			log.Errorf("Error computeDistribution %v update: %v\n", table, updresult.Error)
+		}
+	}
+}
+
+// insertAggregates upserts aggregate rows into table in batches and shows a
+// progress bar: the rows with the same keys (the primary key of the table)
+// are updated. It stops at the first failed batch.
+func insertAggregates(db *gorm.DB, table string, keys []string, aggs []map[string]interface{}) error {
+	if len(aggs) == 0 {
+		return nil
+	}
 
-		l := len(region2update)
-		b := l - 1
-		if l > batchSize {
-			b = batchSize
+	conflict := clause.OnConflict{}
+	for _, k := range keys {
+		conflict.Columns = append(conflict.Columns, clause.Column{Name: k})
+	}
+	columns := make([]string, 0, len(aggs[0]))
+	for c := range aggs[0] {
+		if !slices.Contains(keys, c) {
+			columns = append(columns, c)
 		}
+	}
+	sort.Strings(columns)
+	conflict.DoUpdates = clause.AssignmentColumns(columns)
+
+	batchSize := 200
+	bar := pb.Default.Start(len(aggs))
 
-		batch := region2update[0:b]
+	for start := 0; start < len(aggs); start += batchSize {
+		end := min(start+batchSize, len(aggs))
+		batch := aggs[start:end]
 
-		updresult := db.Table("region_yearly_aggs").Create(&batch)
+		updresult := db.Clauses(conflict).Table(table).Create(&batch)
 
 		if updresult.Error != nil {
-			log.Errorf("Error aggregateRegions update: %.0f\n", updresult.Error)
+			log.Errorf("Error insert %v: %v\n", table, updresult.Error)
+			bar.Finish()
+			return updresult.Error
 		}
 
-		bar.Add(b)
-		if l-1 == b {
-			break
-		}
-		region2update = region2update[b+1:]
+		bar.Add(len(batch))
 	}
 
-	bar.Add(int(bar.Total() - bar.Current()))
 	bar.Finish()
+	return nil
 }
@@ -0,0 +1,36 @@
+// Package model provides data models and helpers for the immotep application.
+// This file stores amenities (schools, train stations, supermarkets,
+// doctors) loaded from INSEE BPE or OSM extracts, used to compute the
+// distance from each transaction to the nearest amenity of each kind.
+package model
+
+// Kinds of amenities.
+const AMENITY_SCHOOL = "school"
+const AMENITY_STATION = "station"
+const AMENITY_SUPERMARKET = "supermarket"
+const AMENITY_DOCTOR = "doctor"
+
+// AMENITY_SEARCH_RADIUS is the max distance (m) at which amenities are
+// searched around a transaction; farther amenities give no distance.
+const AMENITY_SEARCH_RADIUS = 5000.0
+
+// AMENITY_COLUMNS maps amenity kinds to their transactions distance column.
+var AMENITY_COLUMNS = map[string]string{
+	AMENITY_SCHOOL:      "school_distance",
+	AMENITY_STATION:     "station_distance",
+	AMENITY_SUPERMARKET: "supermarket_distance",
+	AMENITY_DOCTOR:      "doctor_distance",
+}
+
+// Amenity stores the location of one amenity. Source is the name of the file
+// it was loaded from and Code the BPE equipment type or the OSM tag.
+type Amenity struct {
+	Id       uint64  `gorm:"primaryKey;autoIncrement" json:"id"`
+	Kind     string  `gorm:"index" json:"kind"`
+	Code     string  `json:"code"`
+	Name     string  `json:"name"`
+	CityCode string  `json:"city"`
+	Source   string  `gorm:"index" json:"source"`
+	Lat      float64 `json:"lat"`
+	Long     float64 `json:"long"`
+}
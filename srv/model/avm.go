@@ -0,0 +1,381 @@
+// Package model provides data models and helpers for the immotep application.
+// This file implements the automated valuation model (AVM): a log-linear
+// regression per department trained from the transactions and stored in the
+// valuation_models table, used to estimate the price of a house from its
+// location, built area, land area and number of rooms.
+//
+// The model regresses log(price) on log(area), log(1 + land area), rooms,
+// year dummies and commune dummies. The dummies get a ridge penalty so that
+// communes with few sales are shrunk towards the department level, and the
+// estimate is given for the latest year of the training data.
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cheggaaa/pb/v3"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// AVM_KIND names the model stored by TrainValuationModels.
+const AVM_KIND = "log-linear ridge regression by department"
+
+// AVM_MIN_SALES is the min number of sales to train the model of a
+// department.
+const AVM_MIN_SALES = 30
+
+// AVM_RIDGE is the ridge penalty of the year and commune coefficients (a
+// commune with n sales keeps about n / (n + AVM_RIDGE) of its own effect).
+const AVM_RIDGE = 2.0
+
+// AVM_MIN_RIDGE is the negligible penalty of the other coefficients, keeping
+// the regression solvable when a feature is constant.
+const AVM_MIN_RIDGE = 1e-6
+
+// AVM_PREDICTION_LEVEL is the level of the prediction intervals of the
+// estimates and AVM_Z the matching quantile of the normal distribution.
+const AVM_PREDICTION_LEVEL = 0.9
+const AVM_Z = 1.645
+
+// AVM_LOCATE_RADIUS is the half size (degrees) of the box searched for
+// geocoded sales to find the commune of a location.
+const AVM_LOCATE_RADIUS = 0.05
+
+// ErrNoValuationModel is returned when no model is trained for the
+// department of a location.
+var ErrNoValuationModel = errors.New("no valuation model for this department")
+
+// ErrUnknownLocation is returned when the commune of a location is unknown.
+var ErrUnknownLocation = errors.New("unknown location")
+
+// ErrBadValuationInput is returned when the area or the location is missing.
+var ErrBadValuationInput = errors.New("area and location (lat/lng or city) are required")
+
+// ValuationModel stores the trained model of a department. Coefficients is
+// the JSON object of the coefficients by name ("intercept", "log_area",
+// "log_land", "rooms", "year:2023", "city:33063"). Sigma is the residual
+// standard deviation of log(price) and Year the year of the estimates.
+// Primary key is DepartmentCode.
+type ValuationModel struct {
+	DepartmentCode string    `gorm:"primaryKey" json:"dep"`
+	Kind           string    `json:"kind"`
+	Year           int       `json:"year"`
+	NbTransaction  int       `json:"nb_transaction"`
+	R2             float64   `gorm:"column:r2" json:"r2"`
+	Sigma          float64   `json:"sigma"`
+	Coefficients   string    `json:"-"`
+	TrainedAt      time.Time `json:"trained_at"`
+}
+
+// ValuationInput describes the house to value. The location is either
+// Lat/Long or a commune code.
+type ValuationInput struct {
+	Lat      float64 `json:"lat"`
+	Long     float64 `json:"lng"`
+	CityCode string  `json:"city"`
+	Area     int     `json:"area"`
+	LandArea int     `json:"landArea"`
+	NbRoom   int     `json:"rooms"`
+}
+
+// Estimate holds the estimated price and price per m² of a house with their
+// AVM_PREDICTION_LEVEL prediction intervals and the model used. The
+// intervals come from the residual spread of the model (±AVM_Z·Sigma on
+// log(price)) and ignore the uncertainty of the coefficients, larger for
+// communes with few sales.
+type Estimate struct {
+	CityCode        string          `json:"city"`
+	DepartmentCode  string          `json:"dep"`
+	Price           float64         `json:"price"`
+	PriceLow        float64         `json:"priceLow"`
+	PriceHigh       float64         `json:"priceHigh"`
+	PricePSQM       float64         `json:"pricepsqm"`
+	PricePSQMLow    float64         `json:"pricepsqmLow"`
+	PricePSQMHigh   float64         `json:"pricepsqmHigh"`
+	PredictionLevel float64         `json:"predictionLevel"`
+	Model           *ValuationModel `json:"model"`
+}
+
+// valuationFeatures returns the names and values of the non zero features
+// of a house sold (or valued) in year.
+func valuationFeatures(city string, year int, area int, landArea int, nbRoom int) ([]string, []float64) {
+	return []string{"intercept", "log_area", "log_land", "rooms", fmt.Sprintf("year:%d", year), "city:" + city},
+		[]float64{1, math.Log(float64(area)), math.Log(1 + float64(landArea)), float64(nbRoom), 1, 1}
+}
+
+/*
+TrainValuationModels trains the valuation model of every department with at
+least AVM_MIN_SALES sales and stores it in valuation_models.
+
+Outliers are excluded unless IncludeOutliers is set.
+*/
+func TrainValuationModels(dsn string) {
+	db := ConnectToDB(dsn)
+	db.AutoMigrate(&ValuationModel{})
+
+	var deps []string
+	db.Model(&Transaction{}).Distinct("department_code").Order("department_code").Pluck("department_code", &deps)
+
+	if len(deps) == 0 {
+		log.Infof("Nothing to train.\n")
+		return
+	}
+
+	nbModel := 0
+	bar := pb.Default.Start(len(deps))
+	for _, dep := range deps {
+		bar.Increment()
+
+		m := trainValuationModel(db, dep)
+		if m == nil {
+			continue
+		}
+
+		if result := db.Save(m); result.Error != nil {
+			log.Errorf("Error TrainValuationModels save: %v\n", result.Error)
+			continue
+		}
+		nbModel++
+	}
+	bar.Finish()
+
+	log.Infof("%v valuation models trained.\n", nbModel)
+}
+
+// trainValuationModel fits the model of one department (nil when there are
+// not enough sales).
+func trainValuationModel(db *gorm.DB, dep string) *ValuationModel {
+	rows, err := db.Select(yearExtract(db)+" as year, city_code, price, area, full_area, nb_room, price_psqm").
+		Table("transactions").
+		Scopes(withoutOutliers).
+		Where("department_code = ? AND price > 0 AND area > 0", dep).
+		Rows()
+	if err != nil {
+		log.Errorf("trainValuationModel err: %v\n", err)
+		return nil
+	}
+
+	sales := make([]hedonicSale, 0, 1000)
+	for rows.Next() {
+		var s hedonicSale
+
+		rows.Scan(&s.year, &s.city, &s.price, &s.area, &s.fullArea, &s.nbRoom, &s.psqm)
+		sales = append(sales, s)
+	}
+	rows.Close()
+
+	if len(sales) < AVM_MIN_SALES {
+		log.Debugf("Department %v: not enough sales to train a valuation model\n", dep)
+		return nil
+	}
+
+	// column of each feature name, the intercept is column 0
+	columns := map[string]int{"intercept": 0, "log_area": 1, "log_land": 2, "rooms": 3}
+	lastYear := 0
+	for _, s := range sales {
+		names, _ := valuationFeatures(s.city, s.year, s.area, s.fullArea, s.nbRoom)
+		for _, n := range names {
+			if _, ok := columns[n]; !ok {
+				columns[n] = len(columns)
+			}
+		}
+		if s.year > lastYear {
+			lastYear = s.year
+		}
+	}
+
+	features := func(s hedonicSale) ([]int, []float64) {
+		names, values := valuationFeatures(s.city, s.year, s.area, s.fullArea, s.nbRoom)
+		cols := make([]int, len(names))
+		for i, n := range names {
+			cols[i] = columns[n]
+		}
+		return cols, values
+	}
+
+	ne := newNormalEquations(len(columns))
+	for _, s := range sales {
+		cols, values := features(s)
+		ne.add(cols, values, math.Log(s.price))
+	}
+
+	// only the year and commune dummies are shrunk, the size and room
+	// coefficients just get a negligible penalty keeping the system solvable
+	// (e.g. without land area in the department)
+	ridge := make([]float64, len(columns))
+	for n, c := range columns {
+		switch {
+		case strings.HasPrefix(n, "year:") || strings.HasPrefix(n, "city:"):
+			ridge[c] = AVM_RIDGE
+		case c > 0:
+			ridge[c] = AVM_MIN_RIDGE
+		}
+	}
+	beta, ok := ne.solve(ridge)
+	if !ok {
+		log.Errorf("Department %v: valuation regression is singular\n", dep)
+		return nil
+	}
+
+	logPrices := make([]float64, len(sales))
+	for i, s := range sales {
+		logPrices[i] = math.Log(s.price)
+	}
+	avgLog := mean(logPrices)
+	ssr, sst := 0.0, 0.0
+	for i, s := range sales {
+		cols, values := features(s)
+		predicted := 0.0
+		for j, c := range cols {
+			predicted += beta[c] * values[j]
+		}
+		ssr += (logPrices[i] - predicted) * (logPrices[i] - predicted)
+		sst += (logPrices[i] - avgLog) * (logPrices[i] - avgLog)
+	}
+
+	coefficients := make(map[string]float64, len(columns))
+	for n, c := range columns {
+		coefficients[n] = beta[c]
+	}
+	data, err := json.Marshal(coefficients)
+	if err != nil {
+		log.Errorf("trainValuationModel cannot encode coefficients: %v\n", err)
+		return nil
+	}
+
+	m := &ValuationModel{DepartmentCode: dep, Kind: AVM_KIND, Year: lastYear, NbTransaction: len(sales),
+		Sigma: math.Sqrt(ssr / float64(len(sales))), Coefficients: string(data), TrainedAt: time.Now()}
+	if sst > 0 {
+		m.R2 = 1 - ssr/sst
+	}
+
+	return m
+}
+
+/*
+locateCity returns the commune and department of a location.
+
+The communes of the geocoded sales around the location are candidates: the
+first one whose contour contains the location wins, else the commune of the
+nearest sale.
+*/
+func locateCity(db *gorm.DB, lat, long float64) (string, string, error) {
+	var trans []Transaction
+
+	result := db.Select("city_code, department_code, lat, long").
+		Where("lat <> 0 AND lat >= ? AND lat <= ? AND long >= ? AND long <= ?",
+			lat-AVM_LOCATE_RADIUS, lat+AVM_LOCATE_RADIUS, long-AVM_LOCATE_RADIUS, long+AVM_LOCATE_RADIUS).
+		Find(&trans)
+	if result.Error != nil {
+		log.Errorf("locateCity err: %v\n", result.Error)
+		return "", "", result.Error
+	}
+	if len(trans) == 0 {
+		return "", "", ErrUnknownLocation
+	}
+
+	sort.Slice(trans, func(i, j int) bool {
+		return DistanceMeters(lat, long, trans[i].Lat, trans[i].Long) < DistanceMeters(lat, long, trans[j].Lat, trans[j].Long)
+	})
+
+	deps := make(map[string]string)
+	codes := make([]string, 0)
+	for _, t := range trans {
+		if _, ok := deps[t.CityCode]; !ok {
+			deps[t.CityCode] = t.DepartmentCode
+			codes = append(codes, t.CityCode)
+		}
+	}
+
+	var cities []City
+	db.Select("code, contour").Where("code IN ?", codes).Find(&cities)
+	contours := make(map[string]string, len(cities))
+	for _, c := range cities {
+		contours[c.Code] = c.Contour
+	}
+
+	for _, code := range codes {
+		if geom, err := ParseContour(contours[code]); err == nil && PointInGeometry(geom, lat, long) {
+			return code, deps[code], nil
+		}
+	}
+
+	return trans[0].CityCode, trans[0].DepartmentCode, nil
+}
+
+/*
+EstimatePrice values a house with the model of its department.
+
+Returns ErrBadValuationInput when the area or the location is missing,
+ErrUnknownLocation when its commune cannot be found and ErrNoValuationModel
+when the department has no trained model.
+*/
+func EstimatePrice(db *gorm.DB, input ValuationInput) (*Estimate, error) {
+	if db == nil {
+		return nil, errors.New("no database")
+	}
+	if input.Area <= 0 || (input.CityCode == "" && input.Lat == 0 && input.Long == 0) {
+		return nil, ErrBadValuationInput
+	}
+
+	city, dep := input.CityCode, ""
+	if city == "" {
+		var err error
+		if city, dep, err = locateCity(db, input.Lat, input.Long); err != nil {
+			return nil, err
+		}
+	} else {
+		var cities []City
+		db.Select("code, code_department").Where("code = ?", city).Find(&cities)
+		if len(cities) == 0 {
+			return nil, ErrUnknownLocation
+		}
+		dep = cities[0].CodeDepartment
+	}
+
+	if !db.Migrator().HasTable(&ValuationModel{}) {
+		return nil, ErrNoValuationModel
+	}
+
+	var models []ValuationModel
+	result := db.Where("department_code = ?", dep).Find(&models)
+	if result.Error != nil {
+		log.Errorf("EstimatePrice err: %v\n", result.Error)
+		return nil, result.Error
+	}
+	if len(models) == 0 {
+		return nil, ErrNoValuationModel
+	}
+	m := models[0]
+
+	coefficients := make(map[string]float64)
+	if err := json.NewDecoder(strings.NewReader(m.Coefficients)).Decode(&coefficients); err != nil {
+		log.Errorf("EstimatePrice cannot decode coefficients of %v: %v\n", dep, err)
+		return nil, err
+	}
+
+	// unknown communes get no commune effect (department level)
+	names, values := valuationFeatures(city, m.Year, input.Area, input.LandArea, input.NbRoom)
+	logPrice := 0.0
+	for i, n := range names {
+		logPrice += coefficients[n] * values[i]
+	}
+
+	area := float64(input.Area)
+	estimate := Estimate{CityCode: city, DepartmentCode: dep, PredictionLevel: AVM_PREDICTION_LEVEL, Model: &m,
+		Price:     math.Exp(logPrice),
+		PriceLow:  math.Exp(logPrice - AVM_Z*m.Sigma),
+		PriceHigh: math.Exp(logPrice + AVM_Z*m.Sigma)}
+	estimate.PricePSQM = estimate.Price / area
+	estimate.PricePSQMLow = estimate.PriceLow / area
+	estimate.PricePSQMHigh = estimate.PriceHigh / area
+
+	return &estimate, nil
+}
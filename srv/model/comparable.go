@@ -0,0 +1,221 @@
+// Package model provides data models and helpers for the immotep application.
+// This file selects the comparable sales of a property: the recent sales
+// around it ranked by a weighted similarity of distance, area, land area,
+// rooms and recency, and the adjusted price per m² derived from them.
+package model
+
+import (
+	"errors"
+	"math"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Weights of the similarity components (sum 1).
+const COMPARABLE_WEIGHT_DISTANCE = 0.35
+const COMPARABLE_WEIGHT_AREA = 0.25
+const COMPARABLE_WEIGHT_LAND = 0.15
+const COMPARABLE_WEIGHT_ROOMS = 0.10
+const COMPARABLE_WEIGHT_RECENCY = 0.15
+
+// Defaults and bounds of the comparable search.
+const COMPARABLE_DEFAULT_K = 10
+const COMPARABLE_MAX_K = 50
+const COMPARABLE_DEFAULT_RADIUS = 2000.0
+const COMPARABLE_MAX_RADIUS = 20000.0
+const COMPARABLE_DEFAULT_YEARS = 3
+
+// COMPARABLE_MAX_CANDIDATES is the max number of nearest sales scored.
+const COMPARABLE_MAX_CANDIDATES = 500
+
+// ErrBadComparableQuery is returned when the location or the area is
+// missing.
+var ErrBadComparableQuery = errors.New("lat, lng and area are required")
+
+// ComparableQuery describes the property to compare and the search: K
+// comparables within Radius meters sold during the last Years years
+// (counted from the most recent sale found).
+type ComparableQuery struct {
+	Lat      float64
+	Long     float64
+	Area     int
+	LandArea int
+	NbRoom   int
+	K        int
+	Radius   float64
+	Years    int
+}
+
+// ComparableScore is the similarity breakdown of a comparable: each
+// component is between 0 (dissimilar) and 1 (identical) and Total is their
+// weighted sum.
+type ComparableScore struct {
+	Distance float64 `json:"distance"`
+	Area     float64 `json:"area"`
+	Land     float64 `json:"land"`
+	Rooms    float64 `json:"rooms"`
+	Recency  float64 `json:"recency"`
+	Total    float64 `json:"total"`
+}
+
+// Comparable holds a comparable sale, its distance (m) to the property, its
+// similarity and its price per m² adjusted to the date of the most recent
+// sale with the hedonic index of its department (when computed).
+type Comparable struct {
+	Transaction       TransactionPOI  `json:"transaction"`
+	Distance          float64         `json:"distance"`
+	AdjustedPricePSQM float64         `json:"adjustedPricePSQM"`
+	Score             ComparableScore `json:"score"`
+}
+
+// ComparablesInfo holds the comparables ranked by similarity and the
+// similarity weighted average of their adjusted prices per m².
+type ComparablesInfo struct {
+	Comparables       []Comparable `json:"comparables"`
+	NbCandidate       int          `json:"nbCandidate"`
+	AdjustedPricePSQM float64      `json:"adjustedPricePSQM"`
+	AdjustedPrice     float64      `json:"adjustedPrice"`
+}
+
+// comparableCandidate is a sale of the search area with its department.
+type comparableCandidate struct {
+	TransactionPOI
+	DepartmentCode string
+}
+
+// similarity returns the similarity of a candidate at distance (m) and age
+// (days) to the property of q.
+func (q ComparableQuery) similarity(c TransactionPOI, distance float64, age float64) ComparableScore {
+	landScale := math.Max(float64(q.LandArea), 100)
+
+	s := ComparableScore{
+		Distance: 1 - math.Min(1, distance/q.Radius),
+		Area:     1 - math.Min(1, math.Abs(float64(c.Area-q.Area))/float64(q.Area)),
+		Land:     1 - math.Min(1, math.Abs(float64(c.FullArea-q.LandArea))/landScale),
+		Rooms:    1 - math.Min(1, math.Abs(float64(c.NbRoom-q.NbRoom))/3),
+		Recency:  1 - math.Min(1, age/(365*float64(q.Years))),
+	}
+	s.Total = COMPARABLE_WEIGHT_DISTANCE*s.Distance + COMPARABLE_WEIGHT_AREA*s.Area + COMPARABLE_WEIGHT_LAND*s.Land +
+		COMPARABLE_WEIGHT_ROOMS*s.Rooms + COMPARABLE_WEIGHT_RECENCY*s.Recency
+
+	return s
+}
+
+/*
+GetComparables returns the K sales most similar to the property of q.
+
+Behavior:
+  - Candidates are the geocoded sales (outliers excluded) within Radius
+    meters sold during the Years years before the most recent of them,
+    limited to the COMPARABLE_MAX_CANDIDATES nearest ones.
+  - Candidates are ranked by the weighted similarity (see ComparableScore).
+  - The price per m² of each comparable is adjusted to the most recent year
+    with the hedonic index of its department when it is computed.
+
+Returns ErrBadComparableQuery when the location or the area is missing.
+*/
+func GetComparables(db *gorm.DB, q ComparableQuery) (*ComparablesInfo, error) {
+	if db == nil {
+		return nil, errors.New("no database")
+	}
+	if q.Area <= 0 || (q.Lat == 0 && q.Long == 0) {
+		return nil, ErrBadComparableQuery
+	}
+
+	if q.K <= 0 {
+		q.K = COMPARABLE_DEFAULT_K
+	} else if q.K > COMPARABLE_MAX_K {
+		q.K = COMPARABLE_MAX_K
+	}
+	if q.Radius <= 0 {
+		q.Radius = COMPARABLE_DEFAULT_RADIUS
+	} else if q.Radius > COMPARABLE_MAX_RADIUS {
+		q.Radius = COMPARABLE_MAX_RADIUS
+	}
+	if q.Years <= 0 {
+		q.Years = COMPARABLE_DEFAULT_YEARS
+	}
+
+	// bounding box of the radius (1° of latitude is about 111 km)
+	dLat := q.Radius / 111000
+	dLong := dLat / math.Max(math.Cos(q.Lat*math.Pi/180), 0.1)
+
+	box := func() *gorm.DB {
+		return db.Model(&Transaction{}).Scopes(withoutOutliers).
+			Where("lat <> 0 AND lat >= ? AND lat <= ? AND long >= ? AND long <= ? AND area > 0",
+				q.Lat-dLat, q.Lat+dLat, q.Long-dLong, q.Long+dLong)
+	}
+
+	info := ComparablesInfo{Comparables: make([]Comparable, 0, q.K)}
+
+	var last []Transaction
+	if result := box().Select("date").Order("date DESC").Limit(1).Find(&last); result.Error != nil {
+		log.Errorf("GetComparables err: %v\n", result.Error)
+		return nil, result.Error
+	}
+	if len(last) == 0 {
+		return &info, nil
+	}
+	latest := last[0].Date
+	oldest := latest.AddDate(-q.Years, 0, 0)
+
+	// nearest sales first (longitude degrees scaled to latitude ones)
+	scale := dLat / dLong
+	var candidates []comparableCandidate
+	result := box().Where("date >= ?", oldest).
+		Order(clause.Expr{SQL: "(lat - ?) * (lat - ?) + (long - ?) * (long - ?) * ?",
+			Vars: []interface{}{q.Lat, q.Lat, q.Long, q.Long, scale * scale}}).
+		Limit(COMPARABLE_MAX_CANDIDATES).
+		Find(&candidates)
+	if result.Error != nil {
+		log.Errorf("GetComparables err: %v\n", result.Error)
+		return nil, result.Error
+	}
+
+	indices := make(map[string]map[int]float64)
+	for _, c := range candidates {
+		distance := DistanceMeters(q.Lat, q.Long, c.Lat, c.Long)
+		if distance > q.Radius || c.Date.Before(oldest) {
+			continue
+		}
+		info.NbCandidate++
+
+		if _, ok := indices[c.DepartmentCode]; !ok {
+			indices[c.DepartmentCode] = make(map[int]float64)
+			for _, idx := range GetHedonicIndex(db, c.DepartmentCode) {
+				indices[c.DepartmentCode][idx.Year] = idx.Index
+			}
+		}
+
+		adjusted := c.PricePSQM
+		index := indices[c.DepartmentCode]
+		if index[c.Date.Year()] > 0 && index[latest.Year()] > 0 {
+			adjusted *= index[latest.Year()] / index[c.Date.Year()]
+		}
+
+		info.Comparables = append(info.Comparables, Comparable{Transaction: c.TransactionPOI, Distance: distance,
+			AdjustedPricePSQM: adjusted, Score: q.similarity(c.TransactionPOI, distance, latest.Sub(c.Date).Hours()/24)})
+	}
+
+	sort.SliceStable(info.Comparables, func(i, j int) bool {
+		return info.Comparables[i].Score.Total > info.Comparables[j].Score.Total
+	})
+	if len(info.Comparables) > q.K {
+		info.Comparables = info.Comparables[:q.K]
+	}
+
+	sum, weights := 0.0, 0.0
+	for _, c := range info.Comparables {
+		sum += c.Score.Total * c.AdjustedPricePSQM
+		weights += c.Score.Total
+	}
+	if weights > 0 {
+		info.AdjustedPricePSQM = sum / weights
+		info.AdjustedPrice = info.AdjustedPricePSQM * float64(q.Area)
+	}
+
+	return &info, nil
+}
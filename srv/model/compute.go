@@ -7,10 +7,15 @@
 // - ComputeRegions: compute and update avg_price on regions
 // - ComputeDepartments: compute and update avg_price on departments
 // - ComputeCities: compute and upsert avg_price on cities in batches
-// - ComputeStat: orchestrate the three computations using a DB connection
+// - ComputeEpcis: compute and update avg_price on EPCI
+// - ComputeIris: compute and update avg_price on IRIS zones
+// - ComputeZones: locate transactions and update avg_price on user zones
+// - ComputeStat: orchestrate the computations using a DB connection
 package model
 
 import (
+	"database/sql"
+
 	"github.com/cheggaaa/pb/v3"
 	log "github.com/sirupsen/logrus"
 	"gorm.io/gorm"
@@ -23,11 +28,13 @@ import (
 // Behavior:
 // - Joins transactions -> cities -> regions and groups by region code.
 // - Updates the regions.avg_price column with the computed average.
+// - Stores the price per sqm distribution (see computeDistribution).
 func ComputeRegions(db *gorm.DB) {
 	rows, err := db.Select("regions.name as name, regions.code as code, AVG(transactions.price_psqm) as avg_price_psqm").
 		Joins("LEFT JOIN cities ON cities.code = transactions.city_code").
 		Joins("LEFT JOIN regions ON regions.code = cities.code_region").
 		Table("transactions").
+		Scopes(withoutOutliers).
 		Group("regions.code").
 		Rows()
 
@@ -60,6 +67,8 @@ func ComputeRegions(db *gorm.DB) {
 			log.Errorf("Error ComputeRegions update: %v\n", updresult.Error)
 		}
 	}
+
+	computeDistribution(db, regionLevel, "regions")
 }
 
 // ComputeDepartments calculates the average price per square meter for each
@@ -68,11 +77,13 @@ func ComputeRegions(db *gorm.DB) {
 // Behavior:
 // - Joins transactions -> departments and groups by department code.
 // - Updates the departments.avg_price column with the computed average.
+// - Stores the price per sqm distribution (see computeDistribution).
 func ComputeDepartments(db *gorm.DB) {
 
 	rows, err := db.Select("departments.code as code, AVG(transactions.price_psqm) as avg_price_psqm").
 		Joins("LEFT JOIN departments ON departments.code = transactions.department_code").
 		Table("transactions").
+		Scopes(withoutOutliers).
 		Group("departments.code").
 		Rows()
 
@@ -105,6 +116,8 @@ func ComputeDepartments(db *gorm.DB) {
 			log.Errorf("Error ComputeDepartments update: %v\n", updresult.Error)
 		}
 	}
+
+	computeDistribution(db, departmentLevel, "departments")
 }
 
 // ComputeCities computes average price per square meter for each city and
@@ -113,10 +126,12 @@ func ComputeDepartments(db *gorm.DB) {
 // Behavior:
 // - Aggregates transactions by city_code.
 // - Performs batched upserts into cities.avg_price using ON CONFLICT.
+// - Stores the price per sqm distribution (see computeDistribution).
 func ComputeCities(db *gorm.DB) {
 
 	rows, err := db.Select("transactions.city_code as code, AVG(transactions.price_psqm) as avg_price_psqm").
 		Table("transactions").
+		Scopes(withoutOutliers).
 		Group("city_code").
 		Rows()
 
@@ -174,20 +189,181 @@ func ComputeCities(db *gorm.DB) {
 
 	bar.Add(int(bar.Total() - bar.Current()))
 	bar.Finish()
+
+	computeDistribution(db, cityLevel, "cities")
+}
+
+// ComputeEpcis calculates the average price per square meter for each EPCI
+// and updates the epcis table.
+//
+// Behavior:
+// - Joins transactions -> cities -> epcis and groups by EPCI code.
+// - Updates the epcis.avg_price column with the computed average.
+// - Stores the price per sqm distribution (see computeDistribution).
+func ComputeEpcis(db *gorm.DB) {
+
+	rows, err := db.Select("epcis.code as code, AVG(transactions.price_psqm) as avg_price_psqm").
+		Joins("JOIN cities ON cities.code = transactions.city_code").
+		Joins("JOIN epcis ON epcis.code = cities.code_epci").
+		Table("transactions").
+		Scopes(withoutOutliers).
+		Group("epcis.code").
+		Rows()
+
+	if err != nil {
+		log.Errorf("ComputeEpcis err: %v\n", err)
+		return
+	}
+	defer rows.Close()
+
+	var epciinfos []EpciInfo = make([]EpciInfo, 0, 1000)
+
+	for rows.Next() {
+		var code string
+		var avgPricePSQM float64
+
+		rows.Scan(&code, &avgPricePSQM)
+		epciinfos = append(epciinfos, EpciInfo{Code: code, AvgPriceSQM: avgPricePSQM})
+		log.Debugf("EPCI avg psqm %v: %.0f€\n", code, avgPricePSQM)
+	}
+
+	if len(epciinfos) <= 0 {
+		log.Infof("Nothing to compute for EPCI.\n")
+		return
+	}
+
+	for _, info := range epciinfos {
+
+		updresult := db.Model(Epci{}).Where("code = ?", info.Code).Updates(map[string]interface{}{"avg_price": info.AvgPriceSQM})
+		if updresult.Error != nil {
+			log.Errorf("Error ComputeEpcis update: %v\n", updresult.Error)
+		}
+	}
+
+	computeDistribution(db, epciLevel, "epcis")
+}
+
+// ComputeIris computes average price per square meter for each IRIS zone
+// and updates the iris table.
+//
+// Behavior:
+// - Aggregates transactions by iris_code (only rows assigned to a known IRIS).
+// - Performs batched upserts into iris.avg_price using ON CONFLICT.
+// - Stores the price per sqm distribution (see computeDistribution).
+func ComputeIris(db *gorm.DB) {
+
+	rows, err := db.Select("transactions.iris_code as code, AVG(transactions.price_psqm) as avg_price_psqm").
+		Joins("JOIN iris ON iris.code = transactions.iris_code").
+		Table("transactions").
+		Scopes(withoutOutliers).
+		Group("transactions.iris_code").
+		Rows()
+
+	if err != nil {
+		log.Errorf("ComputeIris err: %v\n", err)
+		return
+	}
+	defer rows.Close()
+
+	var iris2update = make([]map[string]interface{}, 0, 1000)
+
+	for rows.Next() {
+		var code string
+		var avgPricePSQM float64
+
+		rows.Scan(&code, &avgPricePSQM)
+
+		iris2update = append(iris2update, map[string]interface{}{"code": code, "avg_price": avgPricePSQM})
+
+		log.Debugf("IRIS (%v) avg psqm: %.0f€\n", code, avgPricePSQM)
+	}
+
+	if len(iris2update) <= 0 {
+		log.Infof("Nothing to compute for IRIS.\n")
+		return
+	}
+
+	updresult := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "code"}},
+		DoUpdates: clause.AssignmentColumns([]string{"avg_price"}),
+	}).Table("iris").CreateInBatches(&iris2update, 1000)
+
+	if updresult.Error != nil {
+		log.Errorf("Error ComputeIris update: %v\n", updresult.Error)
+	}
+
+	computeDistribution(db, irisLevel, "iris")
+}
+
+// ComputeZones refreshes the transactions located inside each user-defined
+// zone and updates the zones table with their average price per square meter.
+func ComputeZones(db *gorm.DB) {
+	LocateZones(db)
+
+	var codes []string
+	db.Model(&Zone{}).Pluck("code", &codes)
+
+	if len(codes) <= 0 {
+		log.Infof("Nothing to compute for zones.\n")
+		return
+	}
+
+	for _, code := range codes {
+		computeZone(db, code)
+	}
+}
+
+// computeZone updates zones.avg_price and the price per sqm distribution of
+// one zone from the transactions linked to it in zone_transactions.
+func computeZone(db *gorm.DB, code string) {
+	var avgPricePSQM sql.NullFloat64
+
+	row := db.Select("AVG(transactions.price_psqm)").
+		Joins("JOIN zone_transactions ON zone_transactions.tr_id = transactions.tr_id").
+		Table("transactions").
+		Scopes(withoutOutliers).
+		Where("zone_transactions.zone_code = ?", code).
+		Row()
+
+	if err := row.Scan(&avgPricePSQM); err != nil {
+		log.Errorf("computeZone err: %v\n", err)
+		return
+	}
+
+	log.Debugf("Zone (%v) avg psqm: %.0f€\n", code, avgPricePSQM.Float64)
+
+	updresult := db.Model(Zone{}).Where("code = ?", code).Updates(map[string]interface{}{"avg_price": avgPricePSQM.Float64})
+	if updresult.Error != nil {
+		log.Errorf("Error computeZone update: %v\n", updresult.Error)
+	}
+
+	computeDistribution(db, zoneLevel.forCode(code), "zones")
 }
 
 // ComputeStat orchestrates the computation of average price-per-sqm statistics
-// for regions, departments and cities using the provided DB connection.
+// for regions, departments, EPCI, cities, IRIS and user zones using the
+// provided DB connection.
 //
 // Behavior:
-// - Calls ComputeRegions, ComputeDepartments and ComputeCities in sequence.
+//   - Flags the outlier transactions (see FlagOutliers); they are excluded
+//     from the statistics unless IncludeOutliers is set.
+//   - Calls ComputeRegions, ComputeDepartments, ComputeEpcis, ComputeCities,
+//     ComputeIris and ComputeZones in sequence.
 func ComputeStat(dsn string) {
 	db := ConnectToDB(dsn)
+	log.Infof("Flag outliers...\n")
+	FlagOutliers(db)
 	log.Infof("Compute Stat for Regions...\n")
 	ComputeRegions(db)
 	log.Infof("Compute Stat for Departments...\n")
 	ComputeDepartments(db)
+	log.Infof("Compute Stat for EPCI...\n")
+	ComputeEpcis(db)
 	log.Infof("Compute Stat for Cities...\n")
 	ComputeCities(db)
+	log.Infof("Compute Stat for IRIS...\n")
+	ComputeIris(db)
+	log.Infof("Compute Stat for Zones...\n")
+	ComputeZones(db)
 	log.Infof("All Stat computed.\n")
 }
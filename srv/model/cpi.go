@@ -0,0 +1,170 @@
+// Package model provides data models and helpers for the immotep application.
+// This file stores the INSEE consumer price index (CPI) and converts nominal
+// prices into real prices (euros of a base year).
+package model
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// CpiBaseYear is the base year of the real price columns of the yearly
+// aggregates; 0 uses the latest year of the loaded index.
+var CpiBaseYear = 0
+
+// ConsumerPriceIndex stores the yearly average of the INSEE consumer price
+// index. Primary key is Year.
+type ConsumerPriceIndex struct {
+	Year  int     `gorm:"primaryKey" json:"year"`
+	Value float64 `json:"value"`
+}
+
+// RealPrice holds the average sale price and the deflated prices of a yearly
+// aggregate row, in euros of CpiBase (0 when no index is loaded).
+type RealPrice struct {
+	AvgTotalPrice     float64 `json:"avg_total_price"`
+	RealAvgPrice      float64 `json:"real_avg_price"`
+	RealAvgTotalPrice float64 `json:"real_avg_total_price"`
+	CpiBase           int     `json:"cpi_base"`
+}
+
+// Deflator converts nominal euros of a year into euros of the Base year. A
+// nil Deflator keeps nominal values.
+type Deflator struct {
+	Base  int
+	index map[int]float64
+	years []int
+}
+
+/*
+NewDeflator loads the consumer price index and returns a deflator to euros
+of base (0 for the latest year of the index).
+
+Returns nil when no index is loaded or when base is outside the index.
+*/
+func NewDeflator(db *gorm.DB, base int) *Deflator {
+	if db == nil || !db.Migrator().HasTable(&ConsumerPriceIndex{}) {
+		return nil
+	}
+
+	var cpis []ConsumerPriceIndex
+	result := db.Order("year").Find(&cpis)
+	if result.Error != nil {
+		log.Errorf("NewDeflator err: %v\n", result.Error)
+		return nil
+	}
+	if len(cpis) == 0 {
+		return nil
+	}
+
+	d := &Deflator{index: make(map[int]float64, len(cpis)), years: make([]int, 0, len(cpis))}
+	for _, c := range cpis {
+		if c.Value > 0 {
+			d.index[c.Year] = c.Value
+			d.years = append(d.years, c.Year)
+		}
+	}
+	if len(d.years) == 0 {
+		return nil
+	}
+
+	d.Base = base
+	if base == 0 {
+		d.Base = d.years[len(d.years)-1]
+	}
+	if _, ok := d.index[d.Base]; !ok {
+		log.Errorf("NewDeflator no index for base year %v\n", d.Base)
+		return nil
+	}
+
+	return d
+}
+
+// at returns the index of year or of the nearest loaded year (the current
+// year is usually not published yet).
+func (d *Deflator) at(year int) float64 {
+	if v, ok := d.index[year]; ok {
+		return v
+	}
+
+	i := sort.SearchInts(d.years, year)
+	if i >= len(d.years) {
+		i = len(d.years) - 1
+	}
+
+	return d.index[d.years[i]]
+}
+
+// Factor returns the multiplier converting euros of year into euros of the
+// base year (1 for a nil deflator).
+func (d *Deflator) Factor(year int) float64 {
+	if d == nil {
+		return 1
+	}
+
+	return d.at(d.Base) / d.at(year)
+}
+
+// Deflate converts a nominal value of year into euros of the base year.
+func (d *Deflator) Deflate(value float64, year int) float64 {
+	return value * d.Factor(year)
+}
+
+// Increase converts a nominal increase between year-1 and year into a real
+// increase.
+func (d *Deflator) Increase(increase float64, year int) float64 {
+	if d == nil {
+		return increase
+	}
+
+	return (1+increase)*d.Factor(year)/d.Factor(year-1) - 1
+}
+
+// sqlFactor returns an SQL expression of the factor of each transaction
+// according to its year.
+func (d *Deflator) sqlFactor(db *gorm.DB) string {
+	if d == nil {
+		return "1"
+	}
+
+	first, last := d.years[0], d.years[len(d.years)-1]
+	cases := make([]string, 0, last-first+1)
+	cases = append(cases, fmt.Sprintf("WHEN CAST(%s AS INTEGER) <= %d THEN %v", yearExtract(db), first, d.Factor(first)))
+	for y := first + 1; y < last; y++ {
+		cases = append(cases, fmt.Sprintf("WHEN CAST(%s AS INTEGER) = %d THEN %v", yearExtract(db), y, d.Factor(y)))
+	}
+
+	return fmt.Sprintf("(CASE %s ELSE %v END)", strings.Join(cases, " "), d.Factor(last))
+}
+
+// stat formats a yearly average price and increase, deflated by d:
+//
+//	"2500€/m² (3.2%)"
+//
+// The increase is omitted when it is nil ("2500€/m²").
+func (d *Deflator) stat(year int, avgPrice float64, increase *float64) string {
+	if increase == nil {
+		return fmt.Sprintf("%.0f€/m²", d.Deflate(avgPrice, year))
+	}
+	return fmt.Sprintf("%.0f€/m² (%.1f%%)", d.Deflate(avgPrice, year), d.Increase(*increase, year)*100)
+}
+
+// SaveCpis upserts yearly consumer price index values.
+func SaveCpis(db *gorm.DB, cpis []ConsumerPriceIndex) error {
+	if len(cpis) == 0 {
+		return nil
+	}
+
+	result := db.Clauses(clause.OnConflict{UpdateAll: true}).CreateInBatches(&cpis, 200)
+	if result.Error != nil {
+		log.Errorf("SaveCpis err: %v\n", result.Error)
+		return result.Error
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+// Package model provides data models and helpers for the immotep application.
+// This file stores energy performance diagnostics (DPE, published by ADEME)
+// and computes price statistics by DPE class per department and year (the
+// "green value": price difference compared to class D).
+package model
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// DPE_CLASSES lists the energy classes from the best to the worst.
+var DPE_CLASSES = []string{"A", "B", "C", "D", "E", "F", "G"}
+
+// DPE_REFERENCE_CLASS is the class used as reference for the green value.
+const DPE_REFERENCE_CLASS = "D"
+
+// Dpe stores one energy performance diagnostic. Address and Parcel are
+// normalized keys used to match diagnostics with transactions.
+type Dpe struct {
+	Id          string    `gorm:"primaryKey" json:"id"`
+	Date        time.Time `json:"date"`
+	CityCode    string    `gorm:"index" json:"cityCode"`
+	Address     string    `json:"address"`
+	Parcel      string    `json:"parcel"`
+	EnergyClass string    `json:"energyClass"`
+	GhgClass    string    `json:"ghgClass"`
+}
+
+// DpeYearlyAgg stores price statistics of one DPE class for a department
+// and year. GreenValue is the relative difference between the median price
+// per m² of the class and the one of DPE_REFERENCE_CLASS.
+// Primary key is (DepartmentCode, Year, DpeClass).
+type DpeYearlyAgg struct {
+	DepartmentCode string  `gorm:"primaryKey" json:"dep"`
+	Year           int     `gorm:"primaryKey" json:"year"`
+	DpeClass       string  `gorm:"primaryKey" json:"dpe"`
+	NbTransaction  int     `json:"nb_transaction"`
+	AvgPrice       float64 `json:"avg_price"`
+	MedianPrice    float64 `json:"median_price"`
+	GreenValue     float64 `json:"green_value"`
+}
+
+/*
+aggregateDpe computes the price per m² statistics by DPE class for each
+department and year and stores them in dpe_yearly_aggs.
+
+Behavior:
+  - Only transactions with a DPE class are used.
+  - Median and average are computed in Go.
+  - GreenValue is 0 when the reference class has no transaction.
+*/
+func aggregateDpe(db *gorm.DB) error {
+	rows, err := db.Select(fmt.Sprintf("%s as year, department_code, dpe_class, price_psqm", yearExtract(db))).
+		Table("transactions").
+		Scopes(withoutOutliers).
+		Where("dpe_class <> ''").
+		Rows()
+	if err != nil {
+		log.Errorf("aggregateDpe err: %v\n", err)
+		return err
+	}
+
+	type key struct {
+		dep   string
+		year  int
+		class string
+	}
+
+	prices := make(map[key][]float64)
+	for rows.Next() {
+		var k key
+		var psqm float64
+
+		rows.Scan(&k.year, &k.dep, &k.class, &psqm)
+		prices[k] = append(prices[k], psqm)
+	}
+	rows.Close()
+
+	if len(prices) == 0 {
+		log.Infof("Nothing to aggregate for DPE.\n")
+		return nil
+	}
+
+	aggs := make([]DpeYearlyAgg, 0, len(prices))
+	for k, values := range prices {
+		agg := DpeYearlyAgg{DepartmentCode: k.dep, Year: k.year, DpeClass: k.class,
+			NbTransaction: len(values), AvgPrice: mean(values), MedianPrice: median(values)}
+
+		if ref, ok := prices[key{k.dep, k.year, DPE_REFERENCE_CLASS}]; ok {
+			if refMedian := median(ref); refMedian > 0 {
+				agg.GreenValue = agg.MedianPrice/refMedian - 1
+			}
+		}
+
+		aggs = append(aggs, agg)
+	}
+
+	result := db.CreateInBatches(&aggs, 200)
+	if result.Error != nil {
+		log.Errorf("Error insert dpe_yearly_aggs: %v\n", result.Error)
+		return result.Error
+	}
+
+	return nil
+}
+
+// GetDpeStats returns the DPE class statistics, optionally filtered by
+// department (dep != "") and year (year > 0).
+func GetDpeStats(db *gorm.DB, dep string, year int) []DpeYearlyAgg {
+	if db == nil {
+		return nil
+	}
+
+	stats := make([]DpeYearlyAgg, 0)
+	if !db.Migrator().HasTable(&DpeYearlyAgg{}) {
+		return stats
+	}
+
+	query := db.Model(&DpeYearlyAgg{})
+	if dep != "" {
+		query = query.Where("department_code = ?", dep)
+	}
+	if year > 0 {
+		query = query.Where("year = ?", year)
+	}
+
+	result := query.Order("department_code, year, dpe_class").Find(&stats)
+	if result.Error != nil {
+		log.Errorf("GetDpeStats err: %v\n", result.Error)
+		return nil
+	}
+
+	return stats
+}
@@ -0,0 +1,459 @@
+// Package model provides data models and helpers for the immotep application.
+// This file forecasts the average price per m² of the aggregates with
+// exponential smoothing: Holt-Winters (level, trend and additive monthly
+// seasonality) on the monthly aggregates and Holt (level and trend) on the
+// yearly ones. The smoothing parameters are chosen on a small grid to
+// minimize the one-step errors, so that a forecast is explained by three
+// numbers.
+//
+// Each model is backtested: it is fitted again without the last periods and
+// its forecasts of these periods are compared to the actual averages.
+package model
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/cheggaaa/pb/v3"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Forecast methods.
+const FORECAST_HOLT_WINTERS = "holt-winters additive"
+const FORECAST_HOLT = "holt linear trend"
+
+// FORECAST_SEASON is the number of months of a season.
+const FORECAST_SEASON = 12
+
+// FORECAST_CONFIDENCE is the level of the prediction intervals and
+// FORECAST_Z the matching quantile of the normal distribution.
+const FORECAST_CONFIDENCE = 0.95
+const FORECAST_Z = 1.96
+
+// forecastSmoothing is the grid of the smoothing parameters.
+var forecastSmoothing = []float64{0.1, 0.3, 0.5, 0.7, 0.9}
+
+// forecastGranularity describes the forecast of a granularity: the number
+// of periods forecast (one year), of periods held out for the backtest and
+// the min number of periods of a series.
+type forecastGranularity struct {
+	horizon   int
+	backtest  int
+	minPoints int
+}
+
+var forecastGranularities = map[string]forecastGranularity{
+	GRANULARITY_MONTH: {horizon: 12, backtest: 12, minPoints: 24},
+	GRANULARITY_YEAR:  {horizon: 1, backtest: 2, minPoints: 4},
+}
+
+// ErrNoForecast is returned when no forecast is computed for a code.
+var ErrNoForecast = errors.New("no forecast for this code")
+
+// ForecastModel stores the smoothing model of a code of a level and its
+// backtest. Trend is the expected relative change of the average price over
+// the next Horizon periods compared to the last ones. MAPE (mean absolute
+// percentage error), RMSE and Coverage (share of the actual values inside
+// the prediction intervals) are measured on the NbBacktest last periods,
+// all 0 when the series is too short to be backtested.
+// Primary key is (Level, Code, Granularity).
+type ForecastModel struct {
+	Level       string    `gorm:"primaryKey" json:"level"`
+	Code        string    `gorm:"primaryKey" json:"code"`
+	Granularity string    `gorm:"primaryKey" json:"granularity"`
+	Name        string    `json:"nom"`
+	Method      string    `json:"method"`
+	Alpha       float64   `json:"alpha"`
+	Beta        float64   `json:"beta"`
+	Gamma       float64   `json:"gamma"`
+	NbPoint     int       `json:"nb_point"`
+	LastPeriod  string    `json:"last_period"`
+	Horizon     int       `json:"horizon"`
+	Trend       float64   `json:"trend"`
+	NbBacktest  int       `json:"nb_backtest"`
+	MAPE        float64   `gorm:"column:mape" json:"mape"`
+	RMSE        float64   `gorm:"column:rmse" json:"rmse"`
+	Coverage    float64   `json:"coverage"`
+	FittedAt    time.Time `json:"fitted_at"`
+}
+
+// Forecast stores the forecast average price per m² of a period with its
+// FORECAST_CONFIDENCE prediction interval. Number is the month of Year (0
+// for yearly forecasts). Primary key is (Level, Code, Granularity, Period).
+type Forecast struct {
+	Level       string  `gorm:"primaryKey" json:"level"`
+	Code        string  `gorm:"primaryKey" json:"code"`
+	Granularity string  `gorm:"primaryKey" json:"granularity"`
+	Period      string  `gorm:"primaryKey" json:"period"`
+	Year        int     `json:"year"`
+	Number      int     `json:"number"`
+	Value       float64 `json:"value"`
+	Lower       float64 `json:"lower"`
+	Upper       float64 `json:"upper"`
+}
+
+// ForecastInfo holds the model of a code and its forecasts.
+type ForecastInfo struct {
+	Model     ForecastModel `json:"model"`
+	Forecasts []Forecast    `json:"forecasts"`
+}
+
+// smoothingFit is an exponential smoothing model fitted on n values: the
+// final level, trend and seasonal components and the RMSE of the one-step
+// errors.
+type smoothingFit struct {
+	alpha, beta, gamma float64
+	season             int
+	n                  int
+	level, trend       float64
+	seasonals          []float64
+	rmse               float64
+}
+
+// smooth fits the exponential smoothing of values with the given parameters.
+// season is 0 for Holt, the season length for Holt-Winters (values must then
+// cover two seasons).
+func smooth(values []float64, season int, alpha, beta, gamma float64) smoothingFit {
+	f := smoothingFit{alpha: alpha, beta: beta, gamma: gamma, season: season, n: len(values)}
+
+	start := 1
+	if season > 0 {
+		// the first season gives the level at its middle and, detrended,
+		// the seasonal components; the second one the trend
+		first, second := mean(values[:season]), mean(values[season:2*season])
+		f.trend = (second - first) / float64(season)
+		middle := float64(season-1) / 2
+		f.seasonals = make([]float64, season)
+		for i := range f.seasonals {
+			f.seasonals[i] = values[i] - (first + (float64(i)-middle)*f.trend)
+		}
+		f.level = first + middle*f.trend
+		start = season
+	} else {
+		f.level, f.trend = values[0], values[1]-values[0]
+	}
+
+	sse := 0.0
+	for t := start; t < len(values); t++ {
+		s := 0.0
+		if season > 0 {
+			s = f.seasonals[t%season]
+		}
+		e := values[t] - (f.level + f.trend + s)
+		sse += e * e
+
+		level := alpha*(values[t]-s) + (1-alpha)*(f.level+f.trend)
+		f.trend = beta*(level-f.level) + (1-beta)*f.trend
+		f.level = level
+		if season > 0 {
+			f.seasonals[t%season] = gamma*(values[t]-level) + (1-gamma)*s
+		}
+	}
+	f.rmse = math.Sqrt(sse / float64(len(values)-start))
+
+	return f
+}
+
+// fitSmoothing returns the smoothing of values with the smallest one-step
+// RMSE on the parameter grid. Holt-Winters is used when values cover two
+// seasons (season > 0), Holt otherwise.
+func fitSmoothing(values []float64, season int) smoothingFit {
+	if len(values) < 2*season {
+		season = 0
+	}
+	gammas := forecastSmoothing
+	if season == 0 {
+		gammas = []float64{0}
+	}
+
+	var best smoothingFit
+	for _, a := range forecastSmoothing {
+		for _, b := range forecastSmoothing {
+			for _, g := range gammas {
+				f := smooth(values, season, a, b, g)
+				if best.n == 0 || f.rmse < best.rmse {
+					best = f
+				}
+			}
+		}
+	}
+
+	return best
+}
+
+// predict returns the forecasts of the h next periods with their
+// prediction intervals (the one-step error grows with the square root of
+// the horizon).
+func (f smoothingFit) predict(h int) (values, lower, upper []float64) {
+	values, lower, upper = make([]float64, h), make([]float64, h), make([]float64, h)
+	for k := 1; k <= h; k++ {
+		v := f.level + float64(k)*f.trend
+		if f.season > 0 {
+			v += f.seasonals[(f.n-1+k)%f.season]
+		}
+		margin := FORECAST_Z * f.rmse * math.Sqrt(float64(k))
+		values[k-1], lower[k-1], upper[k-1] = v, v-margin, v+margin
+	}
+
+	return values, lower, upper
+}
+
+// method returns the name of the smoothing method.
+func (f smoothingFit) method() string {
+	if f.season > 0 {
+		return FORECAST_HOLT_WINTERS
+	}
+	return FORECAST_HOLT
+}
+
+// backtestSmoothing fits values without their last n periods and returns
+// the MAPE, RMSE and interval coverage of the forecasts of these periods.
+func backtestSmoothing(values []float64, season int, n int) (mape, rmse, coverage float64) {
+	train, actual := values[:len(values)-n], values[len(values)-n:]
+	predicted, lower, upper := fitSmoothing(train, season).predict(n)
+
+	nbMape := 0
+	for i, a := range actual {
+		if a != 0 {
+			mape += math.Abs(a-predicted[i]) / a
+			nbMape++
+		}
+		rmse += (a - predicted[i]) * (a - predicted[i])
+		if a >= lower[i] && a <= upper[i] {
+			coverage++
+		}
+	}
+	if nbMape > 0 {
+		mape /= float64(nbMape)
+	}
+
+	return mape, math.Sqrt(rmse / float64(n)), coverage / float64(n)
+}
+
+// forecastSeries holds the average prices of a code by period index (year
+// or year * 12 + month - 1).
+type forecastSeries struct {
+	name   string
+	values map[int]float64
+}
+
+// loadForecastSeries reads the average price of every code of a level by
+// period from the monthly or the yearly aggregates.
+func loadForecastSeries(db *gorm.DB, level string, granularity string) map[string]*forecastSeries {
+	type point struct {
+		Code     string
+		Name     string
+		Year     int
+		Number   int
+		AvgPrice float64
+	}
+	var points []point
+
+	var result *gorm.DB
+	if granularity == GRANULARITY_MONTH {
+		result = db.Table(periodGranularities[GRANULARITY_MONTH].table).Select("code, name, year, number, avg_price").
+			Where("level = ?", level).Find(&points)
+	} else {
+		result = db.Table(aggLevels[level].table).Select("code, name, year, avg_price").Find(&points)
+	}
+	if result.Error != nil {
+		log.Errorf("loadForecastSeries err: %v\n", result.Error)
+		return nil
+	}
+
+	series := make(map[string]*forecastSeries)
+	for _, p := range points {
+		s, ok := series[p.Code]
+		if !ok {
+			s = &forecastSeries{name: p.Name, values: make(map[int]float64)}
+			series[p.Code] = s
+		}
+		index := p.Year
+		if granularity == GRANULARITY_MONTH {
+			index = p.Year*12 + p.Number - 1
+		}
+		s.values[index] = p.AvgPrice
+	}
+
+	return series
+}
+
+// forecastPeriod returns the label, year and number of a period index.
+func forecastPeriod(granularity string, index int) (string, int, int) {
+	if granularity == GRANULARITY_MONTH {
+		year, month := index/12, index%12+1
+		return periodGranularities[GRANULARITY_MONTH].label(year, month), year, month
+	}
+
+	return fmt.Sprint(index), index, 0
+}
+
+/*
+forecastCode fits and backtests the model of one series and returns it
+with its forecasts (nil when the series is too short).
+
+Periods without sales between the first and the last ones get the average
+of the previous period.
+*/
+func forecastCode(level string, code string, granularity string, s *forecastSeries) (*ForecastModel, []Forecast) {
+	g := forecastGranularities[granularity]
+
+	first, last := math.MaxInt, math.MinInt
+	for i := range s.values {
+		first, last = min(first, i), max(last, i)
+	}
+	if last-first+1 < g.minPoints {
+		return nil, nil
+	}
+
+	values := make([]float64, 0, last-first+1)
+	for i := first; i <= last; i++ {
+		v, ok := s.values[i]
+		if !ok {
+			v = values[len(values)-1]
+		}
+		values = append(values, v)
+	}
+
+	season := 0
+	if granularity == GRANULARITY_MONTH {
+		season = FORECAST_SEASON
+	}
+
+	fit := fitSmoothing(values, season)
+	predicted, lower, upper := fit.predict(g.horizon)
+
+	lastPeriod, _, _ := forecastPeriod(granularity, last)
+	m := ForecastModel{Level: level, Code: code, Granularity: granularity, Name: s.name, Method: fit.method(),
+		Alpha: fit.alpha, Beta: fit.beta, Gamma: fit.gamma, NbPoint: len(values), LastPeriod: lastPeriod,
+		Horizon: g.horizon, FittedAt: time.Now()}
+	if trend := relativeChange(mean(predicted), mean(values[len(values)-g.horizon:])); trend != nil {
+		m.Trend = *trend
+	}
+
+	if len(values)-g.backtest >= g.minPoints {
+		m.NbBacktest = g.backtest
+		m.MAPE, m.RMSE, m.Coverage = backtestSmoothing(values, season, g.backtest)
+	}
+
+	forecasts := make([]Forecast, 0, g.horizon)
+	for k := range predicted {
+		period, year, number := forecastPeriod(granularity, last+k+1)
+		forecasts = append(forecasts, Forecast{Level: level, Code: code, Granularity: granularity, Period: period,
+			Year: year, Number: number, Value: predicted[k], Lower: lower[k], Upper: upper[k]})
+	}
+
+	return &m, forecasts
+}
+
+/*
+ComputeForecasts fits the forecast model of every code of the levels on
+the monthly or yearly aggregates and replaces their models and forecasts.
+
+Behavior:
+  - The aggregates must be computed first (immotep aggregate).
+  - Series shorter than the min number of periods of the granularity are
+    skipped.
+
+Returns ErrUnknownLevel or ErrUnknownGranularity for unknown names.
+*/
+func ComputeForecasts(dsn string, levels []string, granularity string) error {
+	if _, ok := forecastGranularities[granularity]; !ok {
+		return ErrUnknownGranularity
+	}
+	for _, level := range levels {
+		if _, ok := aggLevels[level]; !ok {
+			return ErrUnknownLevel
+		}
+	}
+
+	db := ConnectToDB(dsn)
+	db.AutoMigrate(&ForecastModel{}, &Forecast{})
+
+	for _, level := range levels {
+		log.Infof("Forecast %v by %v...\n", level, granularity)
+		series := loadForecastSeries(db, level, granularity)
+
+		models := make([]ForecastModel, 0, len(series))
+		forecasts := make([]Forecast, 0, len(series))
+		bar := pb.Default.Start(len(series))
+		for code, s := range series {
+			bar.Increment()
+			if m, f := forecastCode(level, code, granularity, s); m != nil {
+				models = append(models, *m)
+				forecasts = append(forecasts, f...)
+			}
+		}
+		bar.Finish()
+
+		db.Where("level = ? AND granularity = ?", level, granularity).Delete(&ForecastModel{})
+		db.Where("level = ? AND granularity = ?", level, granularity).Delete(&Forecast{})
+		if len(models) > 0 {
+			if result := db.CreateInBatches(&models, 200); result.Error != nil {
+				log.Errorf("Error ComputeForecasts insert: %v\n", result.Error)
+				continue
+			}
+			if result := db.CreateInBatches(&forecasts, 500); result.Error != nil {
+				log.Errorf("Error ComputeForecasts insert: %v\n", result.Error)
+				continue
+			}
+		}
+
+		log.Infof("%v %v forecasts computed.\n", len(models), level)
+	}
+
+	return nil
+}
+
+/*
+GetForecast returns the forecast model of a code of a level and its
+forecasts ordered by period.
+
+Returns ErrUnknownLevel or ErrUnknownGranularity for unknown names and
+ErrNoForecast when no forecast is computed for the code.
+*/
+func GetForecast(db *gorm.DB, level string, code string, granularity string) (*ForecastInfo, error) {
+	if db == nil {
+		return nil, errors.New("no database")
+	}
+
+	if _, ok := aggLevels[level]; !ok {
+		return nil, ErrUnknownLevel
+	}
+	if _, ok := forecastGranularities[granularity]; !ok {
+		return nil, ErrUnknownGranularity
+	}
+	if !db.Migrator().HasTable(&ForecastModel{}) {
+		return nil, ErrNoForecast
+	}
+
+	info := ForecastInfo{Forecasts: make([]Forecast, 0)}
+	result := db.Where("level = ? AND code = ? AND granularity = ?", level, code, granularity).Limit(1).Find(&info.Model)
+	if result.Error != nil {
+		log.Errorf("GetForecast err: %v\n", result.Error)
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrNoForecast
+	}
+
+	result = db.Where("level = ? AND code = ? AND granularity = ?", level, code, granularity).
+		Order("year").Order("number").Find(&info.Forecasts)
+	if result.Error != nil {
+		log.Errorf("GetForecast err: %v\n", result.Error)
+		return nil, result.Error
+	}
+
+	return &info, nil
+}
+
+// deleteForecasts removes the forecast models and forecasts of a code.
+func deleteForecasts(db *gorm.DB, level string, code string) {
+	if db.Migrator().HasTable(&ForecastModel{}) {
+		db.Where("level = ? AND code = ?", level, code).Delete(&ForecastModel{})
+		db.Where("level = ? AND code = ?", level, code).Delete(&Forecast{})
+	}
+}
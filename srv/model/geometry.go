@@ -0,0 +1,393 @@
+// Package model provides data models and helpers for the immotep application.
+// This file contains small planar geometry helpers working on the GeoJSON
+// contours stored in the database. They are used when PostGIS is not
+// available (SQLite) or when a spatial test must run in the application.
+//
+// Coordinates follow the GeoJSON convention: [longitude, latitude].
+package model
+
+import (
+	"errors"
+	"math"
+	"slices"
+
+	geojson "github.com/paulmach/go.geojson"
+)
+
+// Bounds is a lat/long bounding box.
+type Bounds struct {
+	MinLat  float64
+	MaxLat  float64
+	MinLong float64
+	MaxLong float64
+}
+
+// ParseContour decodes a contour stored as a GeoJSON Feature (or a bare
+// GeoJSON geometry) and returns its geometry.
+func ParseContour(contour string) (*geojson.Geometry, error) {
+	feat, err := geojson.UnmarshalFeature([]byte(contour))
+	if err == nil && feat.Geometry != nil {
+		return feat.Geometry, nil
+	}
+
+	geom, err := geojson.UnmarshalGeometry([]byte(contour))
+	if err != nil {
+		return nil, err
+	}
+	if geom.Type == "" {
+		return nil, errors.New("no geometry in contour")
+	}
+
+	return geom, nil
+}
+
+// GeometryBounds returns the bounding box of a Polygon, MultiPolygon,
+// LineString or MultiLineString geometry.
+func GeometryBounds(g *geojson.Geometry) Bounds {
+	b := Bounds{MinLat: 90, MaxLat: -90, MinLong: 180, MaxLong: -180}
+
+	extend := func(pts [][]float64) {
+		for _, p := range pts {
+			if len(p) < 2 {
+				continue
+			}
+			if p[0] < b.MinLong {
+				b.MinLong = p[0]
+			}
+			if p[0] > b.MaxLong {
+				b.MaxLong = p[0]
+			}
+			if p[1] < b.MinLat {
+				b.MinLat = p[1]
+			}
+			if p[1] > b.MaxLat {
+				b.MaxLat = p[1]
+			}
+		}
+	}
+
+	if g == nil {
+		return b
+	}
+
+	switch {
+	case g.IsPolygon():
+		for _, ring := range g.Polygon {
+			extend(ring)
+		}
+	case g.IsMultiPolygon():
+		for _, poly := range g.MultiPolygon {
+			for _, ring := range poly {
+				extend(ring)
+			}
+		}
+	case g.IsLineString():
+		extend(g.LineString)
+	case g.IsMultiLineString():
+		for _, line := range g.MultiLineString {
+			extend(line)
+		}
+	case g.IsPoint():
+		extend([][]float64{g.Point})
+	}
+
+	return b
+}
+
+// Contains returns true if the point (lat, long) is inside the bounding box.
+func (b Bounds) Contains(lat, long float64) bool {
+	return lat >= b.MinLat && lat <= b.MaxLat && long >= b.MinLong && long <= b.MaxLong
+}
+
+// PointInGeometry returns true if the point (lat, long) lies inside the
+// Polygon or MultiPolygon geometry g. Holes are taken into account.
+func PointInGeometry(g *geojson.Geometry, lat, long float64) bool {
+	if g == nil {
+		return false
+	}
+
+	switch {
+	case g.IsPolygon():
+		return pointInPolygon(g.Polygon, lat, long)
+	case g.IsMultiPolygon():
+		for _, poly := range g.MultiPolygon {
+			if pointInPolygon(poly, lat, long) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// pointInPolygon tests a point against a polygon made of an outer ring
+// followed by optional holes.
+func pointInPolygon(poly [][][]float64, lat, long float64) bool {
+	if len(poly) == 0 || !pointInRing(poly[0], lat, long) {
+		return false
+	}
+
+	for _, hole := range poly[1:] {
+		if pointInRing(hole, lat, long) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// pointInRing implements the even-odd ray casting rule.
+func pointInRing(ring [][]float64, lat, long float64) bool {
+	inside := false
+
+	n := len(ring)
+	for i, j := 0, n-1; i < n; j, i = i, i+1 {
+		if len(ring[i]) < 2 || len(ring[j]) < 2 {
+			continue
+		}
+		xi, yi := ring[i][0], ring[i][1]
+		xj, yj := ring[j][0], ring[j][1]
+
+		if (yi > lat) != (yj > lat) && long < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+
+	return inside
+}
+
+// DissolvePolygons merges adjacent polygons into their union by removing the
+// edges they share. It expects a tessellation where neighbours share their
+// boundary vertices, like the IGN commune contours: overlapping polygons or
+// neighbours with different vertices are not merged.
+//
+// The returned polygons have a counterclockwise outer ring followed by their
+// clockwise holes.
+func DissolvePolygons(polygons [][][][]float64) [][][][]float64 {
+	type point [2]float64
+	type edge [2]point
+
+	counts := make(map[edge]int)
+	order := make([]edge, 0, 1000)
+	for _, poly := range polygons {
+		for i, ring := range poly {
+			pts := make([]point, 0, len(ring))
+			for _, c := range ring {
+				if len(c) < 2 {
+					continue
+				}
+				p := point{c[0], c[1]}
+				if len(pts) == 0 || pts[len(pts)-1] != p {
+					pts = append(pts, p)
+				}
+			}
+			if len(pts) > 1 && pts[0] == pts[len(pts)-1] {
+				pts = pts[:len(pts)-1]
+			}
+			if len(pts) < 3 {
+				continue
+			}
+			// outer rings counterclockwise, holes clockwise: a shared
+			// boundary is then walked in opposite directions
+			ccw := ringArea(ring) > 0
+			if ccw != (i == 0) {
+				slices.Reverse(pts)
+			}
+
+			for j, a := range pts {
+				e := edge{a, pts[(j+1)%len(pts)]}
+				if reverse := (edge{e[1], e[0]}); counts[reverse] > 0 {
+					counts[reverse]--
+					continue
+				}
+				counts[e]++
+				order = append(order, e)
+			}
+		}
+	}
+
+	next := make(map[point][]point)
+	for _, e := range order {
+		if counts[e] > 0 {
+			counts[e]--
+			next[e[0]] = append(next[e[0]], e[1])
+		}
+	}
+
+	var outers, holes [][][]float64
+	for _, e := range order {
+		start := e[0]
+		if len(next[start]) == 0 {
+			continue
+		}
+
+		ring := [][]float64{{start[0], start[1]}}
+		for current := start; ; {
+			ends := next[current]
+			if len(ends) == 0 {
+				break
+			}
+			current, next[current] = ends[len(ends)-1], ends[:len(ends)-1]
+			ring = append(ring, []float64{current[0], current[1]})
+			if current == start {
+				break
+			}
+		}
+		if len(ring) < 4 {
+			continue
+		}
+
+		if ringArea(ring) > 0 {
+			outers = append(outers, ring)
+		} else {
+			holes = append(holes, ring)
+		}
+	}
+
+	dissolved := make([][][][]float64, len(outers))
+	for i, outer := range outers {
+		dissolved[i] = [][][]float64{outer}
+	}
+	// a hole belongs to the smallest outer ring containing it
+	for _, hole := range holes {
+		best, bestArea := -1, 0.0
+		for i, outer := range outers {
+			area := ringArea(outer)
+			if pointInRing(outer, hole[0][1], hole[0][0]) && (best < 0 || area < bestArea) {
+				best, bestArea = i, area
+			}
+		}
+		if best >= 0 {
+			dissolved[best] = append(dissolved[best], hole)
+		}
+	}
+
+	return dissolved
+}
+
+// ringArea returns the signed area of a ring (shoelace formula), positive
+// when the ring is counterclockwise.
+func ringArea(ring [][]float64) float64 {
+	area := 0.0
+
+	n := len(ring)
+	for i, j := 0, n-1; i < n; j, i = i, i+1 {
+		if len(ring[i]) < 2 || len(ring[j]) < 2 {
+			continue
+		}
+		area += ring[j][0]*ring[i][1] - ring[i][0]*ring[j][1]
+	}
+
+	return area / 2
+}
+
+// GridIndex is a simple spatial index of bounding boxes on a regular
+// lat/long grid. It returns candidate ids whose bounds may contain a point;
+// an exact test (PointInGeometry) is still needed.
+type GridIndex struct {
+	cell  float64
+	cells map[[2]int][]int
+}
+
+// NewGridIndex returns an empty index with cells of cell degrees.
+func NewGridIndex(cell float64) *GridIndex {
+	return &GridIndex{cell: cell, cells: make(map[[2]int][]int)}
+}
+
+// cellOf returns the grid cell of a point.
+func (g *GridIndex) cellOf(lat, long float64) [2]int {
+	return [2]int{int(math.Floor(lat / g.cell)), int(math.Floor(long / g.cell))}
+}
+
+// Add registers id in every cell covered by b.
+func (g *GridIndex) Add(id int, b Bounds) {
+	min := g.cellOf(b.MinLat, b.MinLong)
+	max := g.cellOf(b.MaxLat, b.MaxLong)
+
+	for i := min[0]; i <= max[0]; i++ {
+		for j := min[1]; j <= max[1]; j++ {
+			g.cells[[2]int{i, j}] = append(g.cells[[2]int{i, j}], id)
+		}
+	}
+}
+
+// Query returns the ids registered in the cell of a point.
+func (g *GridIndex) Query(lat, long float64) []int {
+	return g.cells[g.cellOf(lat, long)]
+}
+
+// EARTH_RADIUS is the mean Earth radius in meters.
+const EARTH_RADIUS = 6371000.0
+
+// DistanceMeters returns the great-circle distance in meters between two
+// points (haversine formula).
+func DistanceMeters(lat1, long1, lat2, long2 float64) float64 {
+	rad := math.Pi / 180
+	dlat := (lat2 - lat1) * rad
+	dlong := (long2 - long1) * rad
+
+	a := math.Sin(dlat/2)*math.Sin(dlat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dlong/2)*math.Sin(dlong/2)
+
+	return 2 * EARTH_RADIUS * math.Asin(math.Sqrt(a))
+}
+
+// DistanceToGeometry returns the distance in meters from a point to the
+// nearest segment of a LineString, MultiLineString, Polygon or MultiPolygon
+// geometry (or to a Point). Coordinates are projected on a local plane
+// around the point, which is accurate for distances up to a few km.
+func DistanceToGeometry(g *geojson.Geometry, lat, long float64) float64 {
+	kx := math.Cos(lat*math.Pi/180) * EARTH_RADIUS * math.Pi / 180
+	ky := EARTH_RADIUS * math.Pi / 180
+
+	best := math.Inf(1)
+	lines := func(pts [][]float64) {
+		for i := range pts {
+			if len(pts[i]) < 2 {
+				continue
+			}
+			ax, ay := (pts[i][0]-long)*kx, (pts[i][1]-lat)*ky
+			bx, by := ax, ay
+			if i+1 < len(pts) && len(pts[i+1]) >= 2 {
+				bx, by = (pts[i+1][0]-long)*kx, (pts[i+1][1]-lat)*ky
+			}
+			if d := distanceToSegment(ax, ay, bx, by); d < best {
+				best = d
+			}
+		}
+	}
+
+	switch {
+	case g.IsPoint():
+		lines([][]float64{g.Point})
+	case g.IsLineString():
+		lines(g.LineString)
+	case g.IsMultiLineString():
+		for _, l := range g.MultiLineString {
+			lines(l)
+		}
+	case g.IsPolygon():
+		for _, r := range g.Polygon {
+			lines(r)
+		}
+	case g.IsMultiPolygon():
+		for _, p := range g.MultiPolygon {
+			for _, r := range p {
+				lines(r)
+			}
+		}
+	}
+
+	return best
+}
+
+// distanceToSegment returns the distance from the origin to segment [a, b].
+func distanceToSegment(ax, ay, bx, by float64) float64 {
+	dx, dy := bx-ax, by-ay
+	t := 0.0
+	if l := dx*dx + dy*dy; l > 0 {
+		t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/l))
+	}
+
+	return math.Hypot(ax+t*dx, ay+t*dy)
+}
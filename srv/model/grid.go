@@ -0,0 +1,252 @@
+// Package model provides data models and helpers for the immotep application.
+// This file bins the geocoded transactions into a geohash grid at several
+// resolutions for heatmaps: each cell stores the number of sales, the median
+// price per m² and the yearly change of the median.
+//
+// A geohash cell is a rectangle identified by a base-32 string; the cells of
+// a resolution (string length) are split into 32 cells of the next one, so
+// the cell of a sale at a coarse resolution is a prefix of its finer cells.
+package model
+
+import (
+	"errors"
+	"strings"
+
+	geojson "github.com/paulmach/go.geojson"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// GRID_RESOLUTIONS are the geohash lengths aggregated (about 39 km, 4.9 km,
+// 1.2 km and 150 m wide cells).
+var GRID_RESOLUTIONS = []int{4, 5, 6, 7}
+
+// GRID_MAX_CELLS is the max number of cells returned by GetGridCells.
+const GRID_MAX_CELLS = 10000
+
+const geohashBase32 = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// ErrUnknownResolution is returned when a grid resolution is not aggregated.
+var ErrUnknownResolution = errors.New("unknown grid resolution")
+
+// GridCellAgg stores the statistics of a geohash cell for a year. Increase
+// is the relative change of the median price per m² compared to the
+// previous year (nil when the cell has no sale the previous year). The
+// bounds of the cell are stored to select the cells of a bounding box.
+// Primary key is (Cell, Year).
+type GridCellAgg struct {
+	Cell            string   `gorm:"primaryKey" json:"cell"`
+	Year            int      `gorm:"primaryKey" json:"year"`
+	Resolution      int      `gorm:"index" json:"resolution"`
+	MinLat          float64  `json:"-"`
+	MaxLat          float64  `json:"-"`
+	MinLong         float64  `json:"-"`
+	MaxLong         float64  `json:"-"`
+	NbTransaction   int      `json:"nb_transaction"`
+	MedianPricePSQM float64  `json:"median_price_psqm"`
+	Increase        *float64 `json:"increase"`
+}
+
+// GeohashEncode returns the geohash of the point (lat, long) with precision
+// characters.
+func GeohashEncode(lat, long float64, precision int) string {
+	minLat, maxLat, minLong, maxLong := -90.0, 90.0, -180.0, 180.0
+
+	var hash strings.Builder
+	bit, ch, even := 0, 0, true
+	for hash.Len() < precision {
+		// even bits split the longitude, odd bits the latitude
+		if even {
+			mid := (minLong + maxLong) / 2
+			if long >= mid {
+				ch |= 1 << (4 - bit)
+				minLong = mid
+			} else {
+				maxLong = mid
+			}
+		} else {
+			mid := (minLat + maxLat) / 2
+			if lat >= mid {
+				ch |= 1 << (4 - bit)
+				minLat = mid
+			} else {
+				maxLat = mid
+			}
+		}
+		even = !even
+
+		if bit < 4 {
+			bit++
+		} else {
+			hash.WriteByte(geohashBase32[ch])
+			bit, ch = 0, 0
+		}
+	}
+
+	return hash.String()
+}
+
+// GeohashBounds returns the bounding box of a geohash cell. ok is false when
+// hash contains a character outside of the geohash alphabet.
+func GeohashBounds(hash string) (b Bounds, ok bool) {
+	b = Bounds{MinLat: -90, MaxLat: 90, MinLong: -180, MaxLong: 180}
+
+	even := true
+	for _, c := range hash {
+		idx := strings.IndexRune(geohashBase32, c)
+		if idx < 0 {
+			return b, false
+		}
+		for bit := 4; bit >= 0; bit-- {
+			set := idx&(1<<bit) != 0
+			if even {
+				mid := (b.MinLong + b.MaxLong) / 2
+				if set {
+					b.MinLong = mid
+				} else {
+					b.MaxLong = mid
+				}
+			} else {
+				mid := (b.MinLat + b.MaxLat) / 2
+				if set {
+					b.MinLat = mid
+				} else {
+					b.MaxLat = mid
+				}
+			}
+			even = !even
+		}
+	}
+
+	return b, true
+}
+
+/*
+aggregateGrid computes the statistics of the geohash cells of every
+resolution of GRID_RESOLUTIONS and inserts them into grid_cell_aggs.
+
+Behavior:
+  - Only geocoded transactions are read (outliers excluded unless
+    IncludeOutliers is set).
+  - The finest geohash of a sale is computed once, coarser cells are its
+    prefixes.
+  - The median price per m² is computed in Go by cell and year.
+*/
+func aggregateGrid(db *gorm.DB) error {
+	rows, err := db.Select(yearExtract(db) + " as year, transactions.lat, transactions.long, transactions.price_psqm").
+		Table("transactions").
+		Scopes(withoutOutliers).
+		Where("transactions.lat <> 0 AND transactions.price_psqm > 0").
+		Rows()
+	if err != nil {
+		log.Errorf("aggregateGrid err: %v\n", err)
+		return err
+	}
+
+	type cellYear struct {
+		cell string
+		year int
+	}
+
+	finest := GRID_RESOLUTIONS[len(GRID_RESOLUTIONS)-1]
+	psqms := make(map[cellYear][]float64)
+	for rows.Next() {
+		var year int
+		var lat, long, psqm float64
+
+		rows.Scan(&year, &lat, &long, &psqm)
+		hash := GeohashEncode(lat, long, finest)
+		for _, res := range GRID_RESOLUTIONS {
+			key := cellYear{hash[:res], year}
+			psqms[key] = append(psqms[key], psqm)
+		}
+	}
+	rows.Close()
+
+	medians := make(map[cellYear]float64, len(psqms))
+	for key, values := range psqms {
+		medians[key] = median(values)
+	}
+
+	var agg2update = make([]map[string]interface{}, 0, len(psqms))
+	for key, values := range psqms {
+		b, _ := GeohashBounds(key.cell)
+		increase := relativeChange(medians[key], medians[cellYear{key.cell, key.year - 1}])
+		agg2update = append(agg2update, map[string]interface{}{
+			"cell": key.cell, "year": key.year, "resolution": len(key.cell),
+			"min_lat": b.MinLat, "max_lat": b.MaxLat, "min_long": b.MinLong, "max_long": b.MaxLong,
+			"nb_transaction": len(values), "median_price_psqm": medians[key], "increase": increase,
+		})
+	}
+
+	if len(agg2update) <= 0 {
+		log.Infof("Nothing to aggregate for the grid.\n")
+		return nil
+	}
+
+	return insertAggregates(db, "grid_cell_aggs", []string{"cell", "year"}, agg2update)
+}
+
+/*
+GetGridCells returns the cells of a resolution intersecting the bounding box
+b as a GeoJSON FeatureCollection of polygons. The properties of a feature
+are the columns of GridCellAgg.
+
+Behavior:
+  - year 0 selects the most recent year of the resolution.
+  - At most GRID_MAX_CELLS cells are returned (the ones with most sales).
+
+Returns ErrUnknownResolution when res is not in GRID_RESOLUTIONS.
+*/
+func GetGridCells(db *gorm.DB, res int, b Bounds, year int) (*geojson.FeatureCollection, error) {
+	if db == nil {
+		return nil, errors.New("no database")
+	}
+
+	known := false
+	for _, r := range GRID_RESOLUTIONS {
+		known = known || r == res
+	}
+	if !known {
+		return nil, ErrUnknownResolution
+	}
+
+	fc := geojson.NewFeatureCollection()
+	if !db.Migrator().HasTable(&GridCellAgg{}) {
+		return fc, nil
+	}
+
+	if year == 0 {
+		var latest *int
+		db.Model(&GridCellAgg{}).Where("resolution = ?", res).Select("MAX(year)").Scan(&latest)
+		if latest == nil {
+			return fc, nil
+		}
+		year = *latest
+	}
+
+	var cells []GridCellAgg
+	result := db.Where("resolution = ? AND year = ?", res, year).
+		Where("max_lat >= ? AND min_lat <= ? AND max_long >= ? AND min_long <= ?", b.MinLat, b.MaxLat, b.MinLong, b.MaxLong).
+		Order("nb_transaction DESC").Limit(GRID_MAX_CELLS).
+		Find(&cells)
+	if result.Error != nil {
+		log.Errorf("GetGridCells err: %v\n", result.Error)
+		return nil, result.Error
+	}
+
+	for _, c := range cells {
+		f := geojson.NewPolygonFeature([][][]float64{{
+			{c.MinLong, c.MinLat}, {c.MaxLong, c.MinLat}, {c.MaxLong, c.MaxLat}, {c.MinLong, c.MaxLat}, {c.MinLong, c.MinLat},
+		}})
+		f.SetProperty("cell", c.Cell)
+		f.SetProperty("year", c.Year)
+		f.SetProperty("resolution", c.Resolution)
+		f.SetProperty("nb_transaction", c.NbTransaction)
+		f.SetProperty("median_price_psqm", c.MedianPricePSQM)
+		f.SetProperty("increase", c.Increase)
+		fc.AddFeature(f)
+	}
+
+	return fc, nil
+}
@@ -0,0 +1,280 @@
+// Package model provides data models and helpers for the immotep application.
+// This file computes a quality-adjusted (hedonic) price index per department:
+// the average price per m² moves when the mix of houses sold changes, the
+// hedonic index only moves when the price of a same house changes.
+//
+// The index is the time-dummy method: log(price) is regressed on log(area),
+// log(1 + land area), number of rooms, commune and year dummies, and the
+// index of a year is 100 * exp(year coefficient) (first year = 100).
+package model
+
+import (
+	"math"
+	"sort"
+
+	"github.com/cheggaaa/pb/v3"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// HEDONIC_MIN_COMMUNE_SALES is the min number of sales of a commune to be
+// part of the regression (communes with fewer sales are ignored).
+const HEDONIC_MIN_COMMUNE_SALES = 5
+
+// HEDONIC_RIDGE is the small ridge penalty of the year and commune dummies
+// keeping the regression solvable when a commune or a year has almost no
+// sales. The area, land and rooms coefficients are not penalized.
+const HEDONIC_RIDGE = 1e-6
+
+// HedonicIndex stores the yearly hedonic index of a department with the raw
+// average price per m² and the raw index (average relative to the first
+// year) for comparison. R2 is the fit of the department regression.
+// Primary key is (DepartmentCode, Year).
+type HedonicIndex struct {
+	DepartmentCode string  `gorm:"primaryKey" json:"dep"`
+	Year           int     `gorm:"primaryKey" json:"year"`
+	Index          float64 `gorm:"column:hedonic_index" json:"index"`
+	AvgPrice       float64 `json:"avg_price"`
+	RawIndex       float64 `json:"raw_index"`
+	NbTransaction  int     `json:"nb_transaction"`
+	R2             float64 `gorm:"column:r2" json:"r2"`
+}
+
+// hedonicSale holds the characteristics of a sale used by the regression.
+type hedonicSale struct {
+	city     string
+	year     int
+	price    float64
+	area     int
+	fullArea int
+	nbRoom   int
+	psqm     float64
+}
+
+/*
+ComputeHedonicIndex computes the hedonic index of every department and
+replaces the hedonic_indices table.
+
+Behavior:
+  - Outliers are excluded unless IncludeOutliers is set.
+  - Departments with less than two years of sales get no index.
+*/
+func ComputeHedonicIndex(dsn string) {
+	db := ConnectToDB(dsn)
+	db.AutoMigrate(&HedonicIndex{})
+
+	var deps []string
+	db.Model(&Transaction{}).Distinct("department_code").Order("department_code").Pluck("department_code", &deps)
+
+	if len(deps) == 0 {
+		log.Infof("Nothing to compute for hedonic index.\n")
+		return
+	}
+
+	bar := pb.Default.Start(len(deps))
+	for _, dep := range deps {
+		bar.Increment()
+
+		indices := computeHedonicIndex(db, dep)
+
+		db.Where("department_code = ?", dep).Delete(&HedonicIndex{})
+		if len(indices) > 0 {
+			if result := db.Create(&indices); result.Error != nil {
+				log.Errorf("Error ComputeHedonicIndex insert: %v\n", result.Error)
+			}
+		}
+	}
+	bar.Finish()
+
+	log.Infof("Hedonic index computed for %v departments.\n", len(deps))
+}
+
+// computeHedonicIndex fits the regression of one department and returns its
+// yearly index (nil when it cannot be computed).
+func computeHedonicIndex(db *gorm.DB, dep string) []HedonicIndex {
+	rows, err := db.Select(yearExtract(db)+" as year, city_code, price, area, full_area, nb_room, price_psqm").
+		Table("transactions").
+		Scopes(withoutOutliers).
+		Where("department_code = ? AND price > 0 AND area > 0", dep).
+		Rows()
+	if err != nil {
+		log.Errorf("computeHedonicIndex err: %v\n", err)
+		return nil
+	}
+
+	sales := make([]hedonicSale, 0, 1000)
+	communeSales := make(map[string]int)
+	for rows.Next() {
+		var s hedonicSale
+
+		rows.Scan(&s.year, &s.city, &s.price, &s.area, &s.fullArea, &s.nbRoom, &s.psqm)
+		sales = append(sales, s)
+		communeSales[s.city]++
+	}
+	rows.Close()
+
+	return fitHedonicIndex(dep, sales, communeSales)
+}
+
+// fitHedonicIndex solves the time-dummy regression of the sales of a
+// department. The first year and the first commune are the references.
+func fitHedonicIndex(dep string, sales []hedonicSale, communeSales map[string]int) []HedonicIndex {
+	communes := make([]string, 0, len(communeSales))
+	for c, n := range communeSales {
+		if n >= HEDONIC_MIN_COMMUNE_SALES {
+			communes = append(communes, c)
+		}
+	}
+	sort.Strings(communes)
+
+	yearSet := make(map[int]bool)
+	kept := sales[:0]
+	communeCol := make(map[string]int)
+	for i, c := range communes {
+		if i > 0 {
+			communeCol[c] = i
+		}
+	}
+	for _, s := range sales {
+		if communeSales[s.city] >= HEDONIC_MIN_COMMUNE_SALES {
+			kept = append(kept, s)
+			yearSet[s.year] = true
+		}
+	}
+
+	years := make([]int, 0, len(yearSet))
+	for y := range yearSet {
+		years = append(years, y)
+	}
+	sort.Ints(years)
+	if len(years) < 2 {
+		log.Debugf("Department %v: less than two years of sales for a hedonic index\n", dep)
+		return nil
+	}
+
+	// columns: intercept, log area, log land area, rooms, years, communes
+	const nbVars = 4
+	yearCol := make(map[int]int)
+	for i, y := range years[1:] {
+		yearCol[y] = nbVars + i
+	}
+	firstCommune := nbVars + len(years) - 1
+	k := firstCommune + len(communes) - 1
+
+	if len(kept) <= k {
+		log.Debugf("Department %v: not enough sales for a hedonic index\n", dep)
+		return nil
+	}
+
+	features := func(s hedonicSale) ([]int, []float64) {
+		cols := []int{0, 1, 2, 3}
+		values := []float64{1, math.Log(float64(s.area)), math.Log(1 + float64(s.fullArea)), float64(s.nbRoom)}
+		if c, ok := yearCol[s.year]; ok {
+			cols = append(cols, c)
+			values = append(values, 1)
+		}
+		if c, ok := communeCol[s.city]; ok {
+			cols = append(cols, firstCommune+c-1)
+			values = append(values, 1)
+		}
+		return cols, values
+	}
+
+	ne := newNormalEquations(k)
+	for _, s := range kept {
+		cols, values := features(s)
+		ne.add(cols, values, math.Log(s.price))
+	}
+
+	// only the year and commune dummies are penalized, as in the AVM, and
+	// the constant features (e.g. no land area in the department) that
+	// would make the regression singular
+	ridge := make([]float64, k)
+	for i := nbVars; i < k; i++ {
+		ridge[i] = HEDONIC_RIDGE
+	}
+	_, first := features(kept[0])
+	for i := 1; i < nbVars; i++ {
+		constant := true
+		for _, s := range kept[1:] {
+			if _, values := features(s); values[i] != first[i] {
+				constant = false
+				break
+			}
+		}
+		if constant {
+			ridge[i] = HEDONIC_RIDGE
+		}
+	}
+	beta, ok := ne.solve(ridge)
+	if !ok {
+		log.Errorf("Department %v: hedonic regression is singular\n", dep)
+		return nil
+	}
+
+	// fit quality and raw averages by year
+	logPrices := make([]float64, len(kept))
+	for i, s := range kept {
+		logPrices[i] = math.Log(s.price)
+	}
+	avgLog := mean(logPrices)
+	ssr, sst := 0.0, 0.0
+	sums := make(map[int]periodSum)
+	for i, s := range kept {
+		cols, values := features(s)
+		predicted := 0.0
+		for j, c := range cols {
+			predicted += beta[c] * values[j]
+		}
+		ssr += (logPrices[i] - predicted) * (logPrices[i] - predicted)
+		sst += (logPrices[i] - avgLog) * (logPrices[i] - avgLog)
+
+		sum := sums[s.year]
+		sums[s.year] = periodSum{sum.sum + s.psqm, sum.count + 1, sum.volume + s.price}
+	}
+	r2 := 0.0
+	if sst > 0 {
+		r2 = 1 - ssr/sst
+	}
+
+	baseAvg := sums[years[0]].sum / float64(sums[years[0]].count)
+	indices := make([]HedonicIndex, 0, len(years))
+	for _, y := range years {
+		index := 100.0
+		if c, ok := yearCol[y]; ok {
+			index = 100 * math.Exp(beta[c])
+		}
+		avg := sums[y].sum / float64(sums[y].count)
+
+		indices = append(indices, HedonicIndex{DepartmentCode: dep, Year: y, Index: index,
+			AvgPrice: avg, RawIndex: 100 * avg / baseAvg, NbTransaction: sums[y].count, R2: r2})
+	}
+
+	return indices
+}
+
+// GetHedonicIndex returns the yearly hedonic index of a department (all
+// departments when dep is empty) ordered by department and year.
+func GetHedonicIndex(db *gorm.DB, dep string) []HedonicIndex {
+	if db == nil {
+		return nil
+	}
+
+	indices := make([]HedonicIndex, 0)
+	if !db.Migrator().HasTable(&HedonicIndex{}) {
+		return indices
+	}
+
+	query := db.Model(&HedonicIndex{})
+	if dep != "" {
+		query = query.Where("department_code = ?", dep)
+	}
+
+	result := query.Order("department_code").Order("year").Find(&indices)
+	if result.Error != nil {
+		log.Errorf("GetHedonicIndex err: %v\n", result.Error)
+		return nil
+	}
+
+	return indices
+}
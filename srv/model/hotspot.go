@@ -0,0 +1,312 @@
+// Package model provides data models and helpers for the immotep application.
+// This file finds where prices rise faster (or slower) than in the
+// neighbouring communes: the yearly price growth of the communes
+// (city_yearly_aggs.increase) is tested for local spatial autocorrelation
+// with the local Moran's I and the Getis-Ord Gi* statistics.
+//
+// Two communes are neighbours when their contours share a vertex (queen
+// contiguity); IGN contours of adjacent communes share their border points.
+package model
+
+import (
+	"errors"
+	"math"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// HOTSPOT_MIN_SALES is the min number of sales of a commune in a year for
+// its price growth to be part of the analysis.
+const HOTSPOT_MIN_SALES = 5
+
+// HOTSPOT_VERTEX_PRECISION is the rounding (in degrees, about 1 m) used to
+// match the shared vertices of two contours.
+const HOTSPOT_VERTEX_PRECISION = 1e-5
+
+// Hot and cold spot classes, by confidence level of the Gi* z-score.
+const HOTSPOT_HOT_99 = "hot-99"
+const HOTSPOT_HOT_95 = "hot-95"
+const HOTSPOT_HOT_90 = "hot-90"
+const HOTSPOT_COLD_99 = "cold-99"
+const HOTSPOT_COLD_95 = "cold-95"
+const HOTSPOT_COLD_90 = "cold-90"
+const HOTSPOT_NONE = "none"
+
+// hotSpotThresholds are the Gi* z-scores of the classes (two-sided 99%, 95%
+// and 90% confidence).
+var hotSpotThresholds = []struct {
+	z         float64
+	hot, cold string
+}{
+	{2.576, HOTSPOT_HOT_99, HOTSPOT_COLD_99},
+	{1.960, HOTSPOT_HOT_95, HOTSPOT_COLD_95},
+	{1.645, HOTSPOT_HOT_90, HOTSPOT_COLD_90},
+}
+
+// HotSpot stores the local statistics of the price growth of a commune for a
+// year. Quadrant is the Moran scatterplot quadrant: HH (growth above the
+// mean among neighbours above the mean), LL, HL or LH. GiZScore is the
+// Getis-Ord Gi* z-score and Class its hot/cold spot class.
+// Primary key is (Code, Year).
+type HotSpot struct {
+	Code           string  `gorm:"primaryKey" json:"code"`
+	Year           int     `gorm:"primaryKey" json:"year"`
+	Name           string  `json:"nom"`
+	DepartmentCode string  `gorm:"index" json:"dep"`
+	Growth         float64 `json:"growth"`
+	NbNeighbour    int     `json:"nb_neighbour"`
+	MoranI         float64 `json:"moran_i"`
+	Quadrant       string  `json:"quadrant"`
+	GiZScore       float64 `json:"gi_zscore"`
+	Class          string  `json:"class"`
+}
+
+// hotSpotClass returns the class of a Gi* z-score.
+func hotSpotClass(z float64) string {
+	for _, t := range hotSpotThresholds {
+		if z >= t.z {
+			return t.hot
+		}
+		if z <= -t.z {
+			return t.cold
+		}
+	}
+
+	return HOTSPOT_NONE
+}
+
+// cityAdjacency returns the neighbours of each commune: the communes whose
+// contours share at least one vertex.
+func cityAdjacency(cities []City) map[string][]string {
+	vertices := make(map[[2]int64][]int)
+
+	for i, c := range cities {
+		geom, err := ParseContour(c.Contour)
+		if err != nil {
+			continue
+		}
+
+		var polygons [][][][]float64
+		if geom.IsPolygon() {
+			polygons = [][][][]float64{geom.Polygon}
+		} else if geom.IsMultiPolygon() {
+			polygons = geom.MultiPolygon
+		}
+
+		seen := make(map[[2]int64]bool)
+		for _, poly := range polygons {
+			for _, ring := range poly {
+				for _, p := range ring {
+					if len(p) < 2 {
+						continue
+					}
+					key := [2]int64{int64(math.Round(p[0] / HOTSPOT_VERTEX_PRECISION)), int64(math.Round(p[1] / HOTSPOT_VERTEX_PRECISION))}
+					if !seen[key] {
+						seen[key] = true
+						vertices[key] = append(vertices[key], i)
+					}
+				}
+			}
+		}
+	}
+
+	links := make(map[[2]int]bool)
+	for _, ids := range vertices {
+		for a := 0; a < len(ids); a++ {
+			for b := a + 1; b < len(ids); b++ {
+				links[[2]int{ids[a], ids[b]}] = true
+			}
+		}
+	}
+
+	neighbours := make(map[string][]string)
+	for l := range links {
+		neighbours[cities[l[0]].Code] = append(neighbours[cities[l[0]].Code], cities[l[1]].Code)
+		neighbours[cities[l[1]].Code] = append(neighbours[cities[l[1]].Code], cities[l[0]].Code)
+	}
+	for _, n := range neighbours {
+		sort.Strings(n)
+	}
+
+	return neighbours
+}
+
+/*
+localStatistics computes the local Moran's I and the Gi* z-score of every
+commune of growths (one year) given the adjacency graph.
+
+Behavior:
+  - Neighbours without growth are ignored; communes without neighbour get
+    no statistics.
+  - Moran's I uses row-standardized weights, Gi* binary weights including
+    the commune itself.
+*/
+func localStatistics(year int, growths map[string]float64, neighbours map[string][]string) []HotSpot {
+	n := float64(len(growths))
+	if n < 3 {
+		return nil
+	}
+
+	values := make([]float64, 0, len(growths))
+	sumSq := 0.0
+	for _, g := range growths {
+		values = append(values, g)
+		sumSq += g * g
+	}
+	avg := mean(values)
+	m2 := sumSq/n - avg*avg
+	if m2 <= 0 {
+		return nil
+	}
+	s := math.Sqrt(m2)
+
+	spots := make([]HotSpot, 0, len(growths))
+	for code, x := range growths {
+		lag, nb := 0.0, 0
+		for _, j := range neighbours[code] {
+			if g, ok := growths[j]; ok {
+				lag += g
+				nb++
+			}
+		}
+		if nb == 0 {
+			continue
+		}
+
+		// local Moran's I with row-standardized weights
+		z := x - avg
+		zLag := lag/float64(nb) - avg
+		moran := z / m2 * zLag
+
+		quadrant := "L"
+		if z >= 0 {
+			quadrant = "H"
+		}
+		if zLag >= 0 {
+			quadrant += "H"
+		} else {
+			quadrant += "L"
+		}
+
+		// Gi*: binary weights over the commune and its neighbours
+		w := float64(nb + 1)
+		gi := 0.0
+		if d := (n*w - w*w) / (n - 1); d > 0 {
+			gi = (lag + x - avg*w) / (s * math.Sqrt(d))
+		}
+
+		spots = append(spots, HotSpot{Code: code, Year: year, Growth: x, NbNeighbour: nb, MoranI: moran,
+			Quadrant: quadrant, GiZScore: gi, Class: hotSpotClass(gi)})
+	}
+
+	return spots
+}
+
+/*
+aggregateHotSpots computes the hot spots of the price growth of the
+communes for every year and replaces the hot_spots table.
+
+Behavior:
+  - The growth of a commune is its increase in city_yearly_aggs when it has
+    at least HOTSPOT_MIN_SALES sales (the increase is null without aggregate
+    the previous year);
+    growths computed from interpolated averages are ignored.
+  - Statistics are computed over all the communes of a year.
+*/
+func aggregateHotSpots(db *gorm.DB) error {
+	var cities []City
+	if result := db.Select("code, name, contour, code_department").Find(&cities); result.Error != nil {
+		log.Errorf("aggregateHotSpots err: %v\n", result.Error)
+		return result.Error
+	}
+	neighbours := cityAdjacency(cities)
+
+	names := make(map[string]City, len(cities))
+	for _, c := range cities {
+		names[c.Code] = c
+	}
+
+	var aggs []CityYearlyAgg
+	if result := db.Select("code, year, increase, nb_transaction, interpolated").Order("code, year").Find(&aggs); result.Error != nil {
+		log.Errorf("aggregateHotSpots err: %v\n", result.Error)
+		return result.Error
+	}
+
+	growths := make(map[int]map[string]float64)
+	var prev CityYearlyAgg
+	for _, a := range aggs {
+		if a.Code == prev.Code && a.Increase != nil && a.NbTransaction >= HOTSPOT_MIN_SALES && !a.Interpolated && !prev.Interpolated {
+			if growths[a.Year] == nil {
+				growths[a.Year] = make(map[string]float64)
+			}
+			growths[a.Year][a.Code] = *a.Increase
+		}
+		prev = a
+	}
+
+	spots := make([]HotSpot, 0, 1000)
+	for year, g := range growths {
+		for _, s := range localStatistics(year, g, neighbours) {
+			s.Name, s.DepartmentCode = names[s.Code].Name, names[s.Code].CodeDepartment
+			spots = append(spots, s)
+		}
+	}
+
+	if result := db.Where("1 = 1").Delete(&HotSpot{}); result.Error != nil {
+		log.Errorf("aggregateHotSpots err: %v\n", result.Error)
+		return result.Error
+	}
+	if len(spots) <= 0 {
+		log.Infof("Nothing to aggregate for hot spots.\n")
+		return nil
+	}
+
+	if result := db.CreateInBatches(&spots, 500); result.Error != nil {
+		log.Errorf("Error aggregateHotSpots insert: %v\n", result.Error)
+		return result.Error
+	}
+
+	log.Infof("Hot spots computed: %v rows.\n", len(spots))
+
+	return nil
+}
+
+// GetHotSpots returns the hot spots of a year (most recent when year is 0),
+// optionally restricted to a department and a class, ordered by commune.
+func GetHotSpots(db *gorm.DB, dep string, year int, class string) ([]HotSpot, error) {
+	if db == nil {
+		return nil, errors.New("no database")
+	}
+
+	spots := make([]HotSpot, 0)
+	if !db.Migrator().HasTable(&HotSpot{}) {
+		return spots, nil
+	}
+
+	if year == 0 {
+		var latest *int
+		db.Model(&HotSpot{}).Select("MAX(year)").Scan(&latest)
+		if latest == nil {
+			return spots, nil
+		}
+		year = *latest
+	}
+
+	query := db.Where("year = ?", year)
+	if dep != "" {
+		query = query.Where("department_code = ?", dep)
+	}
+	if class != "" {
+		query = query.Where("class = ?", class)
+	}
+
+	result := query.Order("code").Find(&spots)
+	if result.Error != nil {
+		log.Errorf("GetHotSpots err: %v\n", result.Error)
+		return nil, result.Error
+	}
+
+	return spots, nil
+}
@@ -0,0 +1,190 @@
+// Package model provides data models and helpers for the immotep application.
+// This file computes the market activity indicators of the aggregates: the
+// volume of sales in euros, its yearly change, the turnover rate (sales per
+// 1,000 inhabitants) and a flag marking the averages computed from too few
+// or too dispersed sales to be reliable.
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// LIQUIDITY_MIN_SALES is the number of sales under which an average is
+// flagged as weak.
+const LIQUIDITY_MIN_SALES = 10
+
+// LIQUIDITY_MAX_RELATIVE_ERROR is the max standard error of the average
+// price per m² relative to the average; beyond it the average is weak.
+const LIQUIDITY_MAX_RELATIVE_ERROR = 0.1
+
+// Liquidity holds the market activity indicators of an aggregate. Volume is
+// the sum of the sale prices; VolumeIncrease and CountIncrease are the
+// relative changes of the volume and of the number of sales compared to the
+// previous year (nil without sales the previous year). TurnoverRate is the
+// number of sales per 1,000 inhabitants (0 when the population is unknown).
+// Weak is set when the average is statistically unreliable (see
+// weakAverage).
+type Liquidity struct {
+	Volume         float64  `json:"volume"`
+	VolumeIncrease *float64 `json:"volume_increase"`
+	CountIncrease  *float64 `json:"count_increase"`
+	TurnoverRate   float64  `json:"turnover_rate"`
+	Weak           bool     `gorm:"default:false" json:"weak"`
+}
+
+// LiquidityInfo is one yearly liquidity row returned by GetLiquidity.
+type LiquidityInfo struct {
+	Code          string  `json:"code"`
+	Name          string  `json:"name"`
+	Year          int     `json:"year"`
+	AvgPrice      float64 `json:"avg_price"`
+	NbTransaction int     `json:"nb_transaction"`
+	Liquidity
+}
+
+// weakAverage returns true when the average of psqms is unreliable: less
+// than LIQUIDITY_MIN_SALES values or a standard error above
+// LIQUIDITY_MAX_RELATIVE_ERROR of the average.
+func weakAverage(psqms []float64) bool {
+	n := len(psqms)
+	if n < LIQUIDITY_MIN_SALES {
+		return true
+	}
+
+	avg := mean(psqms)
+	return avg <= 0 || stddev(psqms)/math.Sqrt(float64(n))/avg > LIQUIDITY_MAX_RELATIVE_ERROR
+}
+
+// relativeChange returns (value - previous) / previous, nil when previous is 0.
+func relativeChange(value, previous float64) *float64 {
+	if previous == 0 {
+		return nil
+	}
+
+	change := (value - previous) / previous
+	return &change
+}
+
+/*
+aggregateTurnover sets the turnover rate (sales per 1,000 inhabitants) of
+each code and year of the level table.
+
+Behavior:
+  - The population of a code is the sum of the populations of its cities
+    (interpolated from census years).
+  - Levels without city column (IRIS, zones) and databases without
+    population data are skipped.
+*/
+func aggregateTurnover(db *gorm.DB, level aggLevel) error {
+	if level.population == "" {
+		return nil
+	}
+	series := loadPopulationSeries(db)
+	if len(series) == 0 {
+		log.Infof("No population data for the turnover of %v.\n", level.label)
+		return nil
+	}
+
+	rows, err := db.Table("cities").Select("code, " + level.population).Rows()
+	if err != nil {
+		log.Errorf("aggregateTurnover %v err: %v\n", level.label, err)
+		return err
+	}
+	members := make(map[string][]string)
+	for rows.Next() {
+		var city string
+		var code sql.NullString
+
+		rows.Scan(&city, &code)
+		if code.String != "" {
+			members[code.String] = append(members[code.String], city)
+		}
+	}
+	rows.Close()
+
+	type yearlyCount struct {
+		Code          string
+		Year          int
+		NbTransaction int
+	}
+	var counts []yearlyCount
+	if result := db.Table(level.table).Select("code, year, nb_transaction").Find(&counts); result.Error != nil {
+		log.Errorf("aggregateTurnover %v err: %v\n", level.label, result.Error)
+		return result.Error
+	}
+
+	var agg2update = make([]map[string]interface{}, 0, len(counts))
+	for _, c := range counts {
+		population := 0.0
+		for _, city := range members[c.Code] {
+			population += series[city].at(c.Year)
+		}
+		if population > 0 {
+			agg2update = append(agg2update, map[string]interface{}{"code": c.Code, "year": c.Year,
+				"turnover_rate": float64(c.NbTransaction) * 1000 / population})
+		}
+	}
+
+	for start := 0; start < len(agg2update); start += 200 {
+		end := min(start+200, len(agg2update))
+		batch := agg2update[start:end]
+
+		result := db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "code"}, {Name: "year"}},
+			DoUpdates: clause.AssignmentColumns([]string{"turnover_rate"}),
+		}).Table(level.table).Create(&batch)
+		if result.Error != nil {
+			log.Errorf("Error aggregateTurnover %v: %v\n", level.label, result.Error)
+			return result.Error
+		}
+	}
+
+	return nil
+}
+
+/*
+GetLiquidity returns the yearly market activity indicators of an
+aggregation level (city, iris, epci, department, region or zone), ordered by
+code and year.
+
+Parameters:
+  - level: aggregation level name
+  - code: optional code filter (empty means all codes)
+  - year: optional year filter (<= 0 means all years)
+
+Returns ErrUnknownLevel when level is not a known level.
+*/
+func GetLiquidity(db *gorm.DB, level string, code string, year int) ([]LiquidityInfo, error) {
+	if db == nil {
+		return nil, errors.New("no database")
+	}
+
+	l, ok := aggLevels[level]
+	if !ok {
+		return nil, ErrUnknownLevel
+	}
+
+	infos := make([]LiquidityInfo, 0)
+
+	query := db.Table(l.table).Select("code, name, year, avg_price, nb_transaction, volume, volume_increase, count_increase, turnover_rate, weak")
+	if code != "" {
+		query = query.Where("code = ?", code)
+	}
+	if year > 0 {
+		query = query.Where("year = ?", year)
+	}
+
+	result := query.Order("code").Order("year").Limit(10000).Find(&infos)
+	if result.Error != nil {
+		log.Errorf("GetLiquidity err: %v\n", result.Error)
+		return nil, result.Error
+	}
+
+	return infos, nil
+}
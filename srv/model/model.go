@@ -2,7 +2,8 @@
 // helpers used by the immotep application.
 //
 // Responsibilities:
-//   - Define GORM models for transactions, cities, departments and regions.
+//   - Define GORM models for transactions, cities, departments, regions,
+//     EPCI (intercommunalités) and IRIS zones.
 //   - Provide a ConnectToDB helper to open and migrate the DB (Postgres/SQLite).
 //   - Provide data access helpers to fetch transactions and aggregated
 //     information used by the REST API and CLI commands.
@@ -10,6 +11,7 @@
 package model
 
 import (
+	"database/sql"
 	"fmt"
 	"strings"
 	"time"
@@ -49,39 +51,100 @@ type Transaction struct {
 	TypeCulture    string
 	Lat            float64 `gorm:"index"`
 	Long           float64 `gorm:"index"`
+	IrisCode       string  `gorm:"index"`
+	DpeClass       string  `gorm:"index"`
+	FloodRisk      string
+	ClayRisk       string
+	// distance (m) to the nearest power line and its voltage (kV); nil when
+	// no line is within POWERLINE_SEARCH_RADIUS
+	LineDistance *float64
+	LineVoltage  int
+	// distances (m) to the nearest amenities; nil when none is within
+	// AMENITY_SEARCH_RADIUS
+	SchoolDistance      *float64
+	StationDistance     *float64
+	SupermarketDistance *float64
+	DoctorDistance      *float64
+	// set by FlagOutliers; flagged transactions are excluded from the
+	// statistics
+	Outlier       bool `gorm:"default:false;index"`
+	OutlierReason string
 }
 
-// Region stores region metadata and contour GeoJSON.
+// Region stores region metadata, contour GeoJSON and the price per m²
+// average and distribution computed by ComputeStat.
 type Region struct {
 	Code     string  `gorm:"primaryKey" json:"code"`
 	Name     string  `json:"nom"`
 	Contour  string  `json:"contour"`
 	AvgPrice float64 `json:"avgPrice"`
 	City     []City  `gorm:"foreignKey:CodeRegion;references:Code"`
+	PriceDistribution
 }
 
-// Department stores department metadata and contour GeoJSON.
+// Department stores department metadata, contour GeoJSON and the price per
+// m² average and distribution computed by ComputeStat.
 type Department struct {
 	Code     string  `gorm:"primaryKey" json:"code"`
 	Name     string  `json:"nom"`
 	Contour  string  `json:"contour"`
 	AvgPrice float64 `json:"avgPrice"`
 	City     []City  `gorm:"foreignKey:CodeDepartment;references:Code"`
+	PriceDistribution
 }
 
 // City stores city metadata, zipcode, aggregated avg price and contour.
+// PopPriceCorrelation is the correlation between yearly price increase and
+// population growth computed by AggregateData.
 type City struct {
-	Code           string `gorm:"primaryKey" json:"code"`
-	Name           string `json:"nom"`
-	NameUpper      string
-	ZipCode        int
-	Population     int      `json:"population"`
-	Contour        string   `json:"contour"`
-	CodeDepartment string   `json:"codeDepartement"`
-	CodeRegion     string   `json:"codeRegion"`
-	AvgPrice       float64  `json:"avgPrice"`
-	CodesPostaux   []string `gorm:"-" json:"codesPostaux"`
-	Geom           wkb.Geom `gorm:"type:geometry"`
+	Code                string `gorm:"primaryKey" json:"code"`
+	Name                string `json:"nom"`
+	NameUpper           string
+	ZipCode             int
+	Population          int      `json:"population"`
+	Contour             string   `json:"contour"`
+	CodeDepartment      string   `json:"codeDepartement"`
+	CodeRegion          string   `json:"codeRegion"`
+	CodeEpci            string   `gorm:"index" json:"codeEpci"`
+	AvgPrice            float64  `json:"avgPrice"`
+	PopPriceCorrelation float64  `json:"popPriceCorrelation"`
+	CodesPostaux        []string `gorm:"-" json:"codesPostaux"`
+	Geom                wkb.Geom `gorm:"type:geometry"`
+	PriceDistribution
+}
+
+// Epci stores an EPCI (intercommunalité: métropole, communauté urbaine,
+// d'agglomération or de communes) and its contour GeoJSON built from the
+// contours of its member cities (cities.code_epci).
+type Epci struct {
+	Code     string  `gorm:"primaryKey" json:"code"`
+	Name     string  `json:"nom"`
+	Nature   string  `json:"nature"`
+	Contour  string  `json:"contour"`
+	AvgPrice float64 `json:"avgPrice"`
+	PriceDistribution
+}
+
+// Iris stores an INSEE IRIS zone (sub-commune statistical unit of about
+// 2,000 inhabitants), its contour GeoJSON and the bounding box of the
+// contour used for spatial lookups on any database.
+type Iris struct {
+	Code     string  `gorm:"primaryKey" json:"code"`
+	Name     string  `json:"nom"`
+	CityCode string  `gorm:"index" json:"codeCommune"`
+	Type     string  `json:"type"`
+	Contour  string  `json:"contour"`
+	AvgPrice float64 `json:"avgPrice"`
+	MinLat   float64 `gorm:"index"`
+	MaxLat   float64
+	MinLong  float64 `gorm:"index"`
+	MaxLong  float64
+	PriceDistribution
+}
+
+// TableName keeps the IRIS table name singular ("iris" is already plural).
+func (Iris) TableName() string {
+	return "iris"
 }
 
 // ConnectToDB opens a database connection using the provided DSN and performs
@@ -105,7 +168,7 @@ func ConnectToDB(dsn string) *gorm.DB {
 			return nil
 		}
 
-		err = db.AutoMigrate(&Transaction{}, &Region{}, &Department{}, &City{})
+		err = db.AutoMigrate(&Transaction{}, &Region{}, &Department{}, &City{}, &Epci{}, &Iris{}, &Zone{}, &ZoneTransaction{}, &CityPopulation{}, &MedianIncome{}, &Dpe{}, &RiskZone{}, &PowerLine{}, &Amenity{}, &ConsumerPriceIndex{})
 		if err != nil {
 			log.Errorf("AutoMigrate DB error: %v\n", err.Error())
 			return nil
@@ -130,7 +193,7 @@ func ConnectToDB(dsn string) *gorm.DB {
 			return nil
 		}
 
-		db.AutoMigrate(&Transaction{}, &Region{}, &Department{}, &City{})
+		db.AutoMigrate(&Transaction{}, &Region{}, &Department{}, &City{}, &Epci{}, &Iris{}, &Zone{}, &ZoneTransaction{}, &CityPopulation{}, &MedianIncome{}, &Dpe{}, &RiskZone{}, &PowerLine{}, &Amenity{}, &ConsumerPriceIndex{})
 
 		return db
 	}
@@ -153,6 +216,19 @@ type TransactionPOI struct {
 	FullArea  int       `json:"fullarea"`
 	NbRoom    int       `json:"nbroom"`
 	Cadastre  string    `json:"cadastre"`
+	DpeClass  string    `json:"dpe"`
+	FloodRisk string    `json:"floodRisk"`
+	ClayRisk  string    `json:"clayRisk"`
+	// distance (m) to the nearest power line and its voltage (kV)
+	LineDistance *float64 `json:"lineDistance"`
+	LineVoltage  int      `json:"lineVoltage"`
+	// distances (m) to the nearest amenities
+	SchoolDistance      *float64 `json:"schoolDistance"`
+	StationDistance     *float64 `json:"stationDistance"`
+	SupermarketDistance *float64 `json:"supermarketDistance"`
+	DoctorDistance      *float64 `json:"doctorDistance"`
+	// reason of the outlier flag (see FlagOutliers), empty if none
+	OutlierReason string `json:"outlierReason,omitempty"`
 }
 
 // TableName specifies the underlying table name for TransactionPOI.
@@ -216,20 +292,56 @@ type BoundedTransactionInfo struct {
 	AvgPriceSQM float64          `json:"avgprice_sqm"`
 }
 
+// POIFilter holds optional transaction attribute filters applied on top of
+// the bounding box (zero values disable a filter).
+type POIFilter struct {
+	// exclude transactions closer than this distance (m) to a power line
+	MinLineDistance float64
+	// keep transactions within these distances (m) of an amenity
+	MaxSchoolDistance      float64
+	MaxStationDistance     float64
+	MaxSupermarketDistance float64
+	MaxDoctorDistance      float64
+}
+
+// apply adds the filter conditions to query.
+func (f POIFilter) apply(query *gorm.DB) *gorm.DB {
+	if f.MinLineDistance > 0 {
+		query = query.Where("(line_distance IS NULL OR line_distance >= ?)", f.MinLineDistance)
+	}
+
+	maxDistances := map[string]float64{
+		AMENITY_SCHOOL:      f.MaxSchoolDistance,
+		AMENITY_STATION:     f.MaxStationDistance,
+		AMENITY_SUPERMARKET: f.MaxSupermarketDistance,
+		AMENITY_DOCTOR:      f.MaxDoctorDistance,
+	}
+	for kind, distance := range maxDistances {
+		if distance > 0 {
+			query = query.Where(AMENITY_COLUMNS[kind]+" <= ?", distance)
+		}
+	}
+
+	return query
+}
+
 // GetPOIFromBounds returns transactions within a geographic bounding box and
 // some aggregate statistics.
 //
 // Parameters:
-// - db: GORM DB connection
-// - NElat, NELong, SWlat, SWLong: coordinates defining the bounding box
-// - limit: maximum number of transactions to return (bounded 1..500)
-// - after: optional date filter (rows after this date)
-// - year: optional year filter; if provided it overrides 'after'
+//   - db: GORM DB connection
+//   - NElat, NELong, SWlat, SWLong: coordinates defining the bounding box
+//   - limit: maximum number of transactions to return (bounded 1..500)
+//   - after: optional date filter (rows after this date)
+//   - year: optional year filter; if provided it overrides 'after'
+//   - filter: optional attribute filters
+//   - deflator: optional, returns prices in euros of its base year (nil for
+//     nominal prices)
 //
 // Returns:
 //   - *BoundedTransactionInfo containing the matching transactions and averages,
 //     or nil on DB error.
-func GetPOIFromBounds(db *gorm.DB, NElat, NELong, SWlat, SWLong float64, limit int, after string, year int) *BoundedTransactionInfo {
+func GetPOIFromBounds(db *gorm.DB, NElat, NELong, SWlat, SWLong float64, limit int, after string, year int, filter POIFilter, deflator *Deflator) *BoundedTransactionInfo {
 
 	var info BoundedTransactionInfo
 
@@ -247,16 +359,23 @@ func GetPOIFromBounds(db *gorm.DB, NElat, NELong, SWlat, SWLong float64, limit i
 		limit = 500
 	}
 
-	result := db.Where(whereClause).Order("date DESC").Limit(limit).Find(&info.Trans)
+	result := filter.apply(db.Where(whereClause)).Order("date DESC").Limit(limit).Find(&info.Trans)
 
 	if result.Error != nil {
 		log.Errorf("GetPOIFromBounds err: %v\n", result.Error)
 		return nil
 	}
 
-	rows, err := db.Debug().Select("AVG(transactions.price) as avgPrice, AVG(transactions.price_psqm) as avgPricePSQM").
-		Where("lat < ? AND lat > ? AND long < ? AND long > ?", NElat, SWlat, NELong, SWLong).
+	for i, t := range info.Trans {
+		info.Trans[i].Price = deflator.Deflate(t.Price, t.Date.Year())
+		info.Trans[i].PricePSQM = deflator.Deflate(t.PricePSQM, t.Date.Year())
+	}
+
+	factor := deflator.sqlFactor(db)
+	rows, err := filter.apply(db.Debug().Select(fmt.Sprintf("AVG(transactions.price * %s) as avgPrice, AVG(transactions.price_psqm * %s) as avgPricePSQM", factor, factor)).
+		Where("lat < ? AND lat > ? AND long < ? AND long > ?", NElat, SWlat, NELong, SWLong)).
 		Table("transactions").
+		Scopes(withoutOutliers).
 		Rows()
 
 	if err != nil {
@@ -293,13 +412,21 @@ type CityInfo struct {
 	Contour     *geojson.Feature `json:"contour"`
 	Population  int              `json:"population"`
 	Stat        map[int]string   `json:"stat"`
+	// population indicators by year and correlation of price growth with
+	// population growth
+	Indicators          map[int]CityIndicator `json:"indicators"`
+	PopPriceCorrelation float64               `json:"popPriceCorrelation"`
+	// price per m² median, percentiles and dispersion over all years
+	Distribution PriceDistribution `json:"distribution"`
 }
 
 // GetCityDetails fetches city metadata and contour GeoJSON for either a single
 // department (dep != "") or a limited set (default limit 100).
 //
-// It also attaches a per-year summary (from CityYearlyAgg) into the Stat map.
-func GetCityDetails(db *gorm.DB, dep string) []CityInfo {
+// It also attaches a per-year summary (from CityYearlyAgg) into the Stat map
+// and the per-year population indicators into the Indicators map. Prices of
+// the Stat map are in euros of the deflator base year (nominal when nil).
+func GetCityDetails(db *gorm.DB, dep string, deflator *Deflator) []CityInfo {
 	var cities []City
 
 	query := db
@@ -309,7 +436,7 @@ func GetCityDetails(db *gorm.DB, dep string) []CityInfo {
 		query = db.Limit(100)
 	}
 
-	result := query.Select("code, name, zip_code, population, contour, avg_price").Find(&cities)
+	result := query.Select("code, name, zip_code, population, contour, avg_price, pop_price_correlation, median_price_psqm, p10, p25, p75, p90, std_dev, nb_transaction").Find(&cities)
 
 	if result.Error != nil {
 		log.Errorf("GetCityDetails err: %v\n", result.Error)
@@ -324,7 +451,9 @@ func GetCityDetails(db *gorm.DB, dep string) []CityInfo {
 		info.Code = c.Code
 		info.ZipCode = c.ZipCode
 		info.AvgPriceSQM = c.AvgPrice
+		info.Distribution = c.PriceDistribution
 		info.Population = c.Population
+		info.PopPriceCorrelation = c.PopPriceCorrelation
 
 		feat, err := geojson.UnmarshalFeature([]byte(c.Contour))
 		if err != nil {
@@ -335,7 +464,8 @@ func GetCityDetails(db *gorm.DB, dep string) []CityInfo {
 			info.Contour.SetProperty("city", c.Code)
 			info.Contour.SetProperty("population", c.Population)
 
-			info.Stat = getCityStat(db, c.Code)
+			info.Stat = getCityStat(db, c.Code, deflator)
+			info.Indicators = getCityIndicators(db, c.Code)
 
 			cityinfos = append(cityinfos, info)
 		}
@@ -359,10 +489,11 @@ type BoundedCityInfo struct {
 // - db: GORM DB connection
 // - NElat, NELong, SWlat, SWLong: bounding box coordinates
 // - limit: max number of cities to return (defaults/bounded)
+// - deflator: optional, converts yearly stats to real prices
 //
 // Returns:
 // - *BoundedCityInfo populated with city contours, stat maps and averages.
-func GetCitiesFromBounds(db *gorm.DB, NElat, NELong, SWlat, SWLong float64, limit int) *BoundedCityInfo {
+func GetCitiesFromBounds(db *gorm.DB, NElat, NELong, SWlat, SWLong float64, limit int, deflator *Deflator) *BoundedCityInfo {
 
 	var info BoundedCityInfo
 	var cities []City
@@ -375,7 +506,7 @@ func GetCitiesFromBounds(db *gorm.DB, NElat, NELong, SWlat, SWLong float64, limi
 		limit = 500
 	}
 
-	result := db.Where(whereClause).Limit(limit).Select("code, name, zip_code, population, contour, avg_price").Find(&cities)
+	result := db.Where(whereClause).Limit(limit).Select("code, name, zip_code, population, contour, avg_price, pop_price_correlation, median_price_psqm, p10, p25, p75, p90, std_dev, nb_transaction").Find(&cities)
 
 	if result.Error != nil {
 		log.Errorf("GetCitiesFromBounds err: %v\n", result.Error)
@@ -390,7 +521,9 @@ func GetCitiesFromBounds(db *gorm.DB, NElat, NELong, SWlat, SWLong float64, limi
 		current.Code = c.Code
 		current.ZipCode = c.ZipCode
 		current.AvgPriceSQM = c.AvgPrice
+		current.Distribution = c.PriceDistribution
 		current.Population = c.Population
+		current.PopPriceCorrelation = c.PopPriceCorrelation
 
 		feat, err := geojson.UnmarshalFeature([]byte(c.Contour))
 		if err != nil {
@@ -401,15 +534,18 @@ func GetCitiesFromBounds(db *gorm.DB, NElat, NELong, SWlat, SWLong float64, limi
 			current.Contour.SetProperty("city", c.Code)
 			current.Contour.SetProperty("population", c.Population)
 
-			current.Stat = getCityStat(db, c.Code)
+			current.Stat = getCityStat(db, c.Code, deflator)
+			current.Indicators = getCityIndicators(db, c.Code)
 
 			info.Cities = append(info.Cities, current)
 		}
 	}
 
-	rows, err := db.Debug().Select("AVG(transactions.price) as avgPrice, AVG(transactions.price_psqm) as avgPricePSQM").
+	factor := deflator.sqlFactor(db)
+	rows, err := db.Select(fmt.Sprintf("AVG(transactions.price * %s) as avgPrice, AVG(transactions.price_psqm * %s) as avgPricePSQM", factor, factor)).
 		Where("lat < ? AND lat > ? AND long < ? AND long > ?", NElat, SWlat, NELong, SWLong).
 		Table("transactions").
+		Scopes(withoutOutliers).
 		Rows()
 
 	if err != nil {
@@ -435,7 +571,9 @@ func GetCitiesFromBounds(db *gorm.DB, NElat, NELong, SWlat, SWLong float64, limi
 // It reads CityYearlyAgg rows for the given city and formats values like:
 //
 //	"2022": "2500€/m² (3.2%)"
-func getCityStat(db *gorm.DB, s string) map[int]string {
+//
+// Prices and increases are deflated when deflator is not nil.
+func getCityStat(db *gorm.DB, s string, deflator *Deflator) map[int]string {
 	var statMap map[int]string = make(map[int]string)
 
 	var stat []CityYearlyAgg
@@ -446,7 +584,7 @@ func getCityStat(db *gorm.DB, s string) map[int]string {
 		log.Errorf("getCityStat err: %v\n", result.Error)
 	} else {
 		for _, s := range stat {
-			statMap[s.Year] = fmt.Sprintf("%.0f€/m² (%.1f%%)", s.AvgPrice, s.Increase*100)
+			statMap[s.Year] = deflator.stat(s.Year, s.AvgPrice, s.Increase)
 		}
 	}
 
@@ -461,15 +599,18 @@ type RegionInfo struct {
 	AvgPriceSQM float64          `json:"avgprice"`
 	Contour     *geojson.Feature `json:"contour"`
 	Stat        map[int]string   `json:"stat"`
+	// price per m² median, percentiles and dispersion over all years
+	Distribution PriceDistribution `json:"distribution"`
 }
 
 // GetRegionDetails returns all regions with their contour feature and yearly
-// aggregated statistics (from RegionYearlyAgg).
-func GetRegionDetails(db *gorm.DB) []RegionInfo {
+// aggregated statistics (from RegionYearlyAgg), deflated when deflator is
+// not nil.
+func GetRegionDetails(db *gorm.DB, deflator *Deflator) []RegionInfo {
 
 	var regs []Region
 
-	result := db.Select("code, name, contour, avg_price").Find(&regs)
+	result := db.Select("code, name, contour, avg_price, median_price_psqm, p10, p25, p75, p90, std_dev, nb_transaction").Find(&regs)
 
 	if result.Error != nil {
 		log.Errorf("GetRegionDetails err: %v\n", result.Error)
@@ -483,6 +624,7 @@ func GetRegionDetails(db *gorm.DB) []RegionInfo {
 		rinfo.Name = r.Name
 		rinfo.Code = r.Code
 		rinfo.AvgPriceSQM = r.AvgPrice
+		rinfo.Distribution = r.PriceDistribution
 
 		feat, err := geojson.UnmarshalFeature([]byte(r.Contour))
 		if err != nil {
@@ -491,7 +633,7 @@ func GetRegionDetails(db *gorm.DB) []RegionInfo {
 			rinfo.Contour = feat
 			rinfo.Contour.SetProperty("avgprice", rinfo.AvgPriceSQM)
 			rinfo.Contour.SetProperty("name", rinfo.Name)
-			rinfo.Stat = getRegionStat(db, r.Code)
+			rinfo.Stat = getRegionStat(db, r.Code, deflator)
 		}
 
 		reginfos = append(reginfos, rinfo)
@@ -501,7 +643,7 @@ func GetRegionDetails(db *gorm.DB) []RegionInfo {
 }
 
 // getRegionStat returns a map year -> formatted string for region aggregates.
-func getRegionStat(db *gorm.DB, s string) map[int]string {
+func getRegionStat(db *gorm.DB, s string, deflator *Deflator) map[int]string {
 	var statMap map[int]string = make(map[int]string)
 
 	var stat []RegionYearlyAgg
@@ -512,7 +654,7 @@ func getRegionStat(db *gorm.DB, s string) map[int]string {
 		log.Errorf("getRegionStat err: %v\n", result.Error)
 	} else {
 		for _, s := range stat {
-			statMap[s.Year] = fmt.Sprintf("%.0f€/m² (%.1f%%)", s.AvgPrice, s.Increase*100)
+			statMap[s.Year] = deflator.stat(s.Year, s.AvgPrice, s.Increase)
 		}
 	}
 
@@ -526,15 +668,18 @@ type DepartmentInfo struct {
 	AvgPriceSQM float64          `json:"avgprice"`
 	Contour     *geojson.Feature `json:"contour"`
 	Stat        map[int]string   `json:"stat"`
+	// price per m² median, percentiles and dispersion over all years
+	Distribution PriceDistribution `json:"distribution"`
 }
 
 // GetDepartmentDetails returns departments with their contour feature and
-// yearly aggregated statistics (from DepartmentYearlyAgg).
-func GetDepartmentDetails(db *gorm.DB) []DepartmentInfo {
+// yearly aggregated statistics (from DepartmentYearlyAgg), deflated when
+// deflator is not nil.
+func GetDepartmentDetails(db *gorm.DB, deflator *Deflator) []DepartmentInfo {
 
 	var deps []Department
 
-	result := db.Select("code, name, contour, avg_price").Find(&deps)
+	result := db.Select("code, name, contour, avg_price, median_price_psqm, p10, p25, p75, p90, std_dev, nb_transaction").Find(&deps)
 
 	if result.Error != nil {
 		log.Errorf("GetDepartmentDetails err: %v\n", result.Error)
@@ -548,6 +693,7 @@ func GetDepartmentDetails(db *gorm.DB) []DepartmentInfo {
 		dinfo.Name = d.Name
 		dinfo.Code = d.Code
 		dinfo.AvgPriceSQM = d.AvgPrice
+		dinfo.Distribution = d.PriceDistribution
 
 		feat, err := geojson.UnmarshalFeature([]byte(d.Contour))
 		if err != nil {
@@ -556,7 +702,7 @@ func GetDepartmentDetails(db *gorm.DB) []DepartmentInfo {
 			dinfo.Contour = feat
 			dinfo.Contour.SetProperty("avgprice", dinfo.AvgPriceSQM)
 			dinfo.Contour.SetProperty("name", dinfo.Name)
-			dinfo.Stat = getDepartmentStat(db, d.Code)
+			dinfo.Stat = getDepartmentStat(db, d.Code, deflator)
 		}
 
 		depinfos = append(depinfos, dinfo)
@@ -566,7 +712,7 @@ func GetDepartmentDetails(db *gorm.DB) []DepartmentInfo {
 }
 
 // getDepartmentStat returns a map year -> formatted string for department aggregates.
-func getDepartmentStat(db *gorm.DB, s string) map[int]string {
+func getDepartmentStat(db *gorm.DB, s string, deflator *Deflator) map[int]string {
 	var statMap map[int]string = make(map[int]string)
 
 	var stat []DepartmentYearlyAgg
@@ -577,7 +723,216 @@ func getDepartmentStat(db *gorm.DB, s string) map[int]string {
 		log.Errorf("getDepartmentStat err: %v\n", result.Error)
 	} else {
 		for _, s := range stat {
-			statMap[s.Year] = fmt.Sprintf("%.0f€/m² (%.1f%%)", s.AvgPrice, s.Increase*100)
+			statMap[s.Year] = deflator.stat(s.Year, s.AvgPrice, s.Increase)
+		}
+	}
+
+	return statMap
+}
+
+// EpciInfo holds EPCI details returned by GetEpciDetails including contour
+// and yearly stats.
+type EpciInfo struct {
+	Code        string           `json:"code"`
+	Name        string           `json:"name"`
+	Nature      string           `json:"nature"`
+	AvgPriceSQM float64          `json:"avgprice"`
+	Contour     *geojson.Feature `json:"contour"`
+	Stat        map[int]string   `json:"stat"`
+	// price per m² median, percentiles and dispersion over all years
+	Distribution PriceDistribution `json:"distribution"`
+}
+
+// GetEpciDetails returns EPCI with their contour feature and yearly
+// aggregated statistics (from EpciYearlyAgg).
+//
+// When dep is not empty only the EPCI having at least one member city in
+// this department are returned. Yearly stats are deflated when deflator is
+// not nil.
+func GetEpciDetails(db *gorm.DB, dep string, deflator *Deflator) []EpciInfo {
+	if db == nil {
+		return nil
+	}
+
+	var epcis []Epci
+
+	query := db
+	if dep != "" {
+		query = db.Where("code IN (?)", db.Table("cities").Select("code_epci").Where("code_department = ?", dep))
+	}
+
+	result := query.Select("code, name, nature, contour, avg_price, median_price_psqm, p10, p25, p75, p90, std_dev, nb_transaction").Find(&epcis)
+
+	if result.Error != nil {
+		log.Errorf("GetEpciDetails err: %v\n", result.Error)
+		return nil
+	}
+
+	var epciinfos []EpciInfo = make([]EpciInfo, 0, len(epcis))
+
+	for _, e := range epcis {
+		var einfo EpciInfo
+		einfo.Code = e.Code
+		einfo.Name = e.Name
+		einfo.Nature = e.Nature
+		einfo.AvgPriceSQM = e.AvgPrice
+		einfo.Distribution = e.PriceDistribution
+
+		feat, err := geojson.UnmarshalFeature([]byte(e.Contour))
+		if err != nil {
+			log.Errorf("GetEpciDetails err: %v\n", err)
+		} else {
+			einfo.Contour = feat
+			einfo.Contour.SetProperty("avgprice", einfo.AvgPriceSQM)
+			einfo.Contour.SetProperty("name", einfo.Name)
+			einfo.Stat = getEpciStat(db, e.Code, deflator)
+		}
+
+		epciinfos = append(epciinfos, einfo)
+	}
+
+	return epciinfos
+}
+
+// getEpciStat returns a map year -> formatted string for EPCI aggregates.
+func getEpciStat(db *gorm.DB, s string, deflator *Deflator) map[int]string {
+	var statMap map[int]string = make(map[int]string)
+
+	var stat []EpciYearlyAgg
+
+	result := db.Where("code = ?", s).Find(&stat)
+
+	if result.Error != nil {
+		log.Errorf("getEpciStat err: %v\n", result.Error)
+	} else {
+		for _, s := range stat {
+			statMap[s.Year] = deflator.stat(s.Year, s.AvgPrice, s.Increase)
+		}
+	}
+
+	return statMap
+}
+
+// IrisInfo holds IRIS details returned by GetIrisFromBounds including contour
+// and yearly stats.
+type IrisInfo struct {
+	Code        string           `json:"code"`
+	Name        string           `json:"name"`
+	CityCode    string           `json:"city"`
+	AvgPriceSQM float64          `json:"avgprice"`
+	Contour     *geojson.Feature `json:"contour"`
+	Stat        map[int]string   `json:"stat"`
+	// price per m² median, percentiles and dispersion over all years
+	Distribution PriceDistribution `json:"distribution"`
+}
+
+// BoundedIrisInfo returns IRIS zones intersecting a bounding box and aggregate
+// statistics for transactions in that box.
+type BoundedIrisInfo struct {
+	Iris        []IrisInfo `json:"iris"`
+	AvgPrice    float64    `json:"avgprice"`
+	AvgPriceSQM float64    `json:"avgprice_sqm"`
+}
+
+// GetIrisFromBounds returns IRIS zones whose bounding box intersects the
+// provided bounding box, with their contour, price and yearly stats.
+//
+// Parameters:
+// - db: GORM DB connection
+// - NElat, NELong, SWlat, SWLong: bounding box coordinates
+// - limit: max number of IRIS to return (default 500, bounded to 2000)
+// - deflator: optional, converts yearly stats to real prices
+//
+// Returns:
+//   - *BoundedIrisInfo populated with IRIS contours, stat maps and averages,
+//     or nil on DB error.
+func GetIrisFromBounds(db *gorm.DB, NElat, NELong, SWlat, SWLong float64, limit int, deflator *Deflator) *BoundedIrisInfo {
+	if db == nil {
+		return nil
+	}
+
+	var info BoundedIrisInfo
+	var iris []Iris
+
+	if limit <= 0 {
+		limit = 500
+	} else if limit > 2000 {
+		limit = 2000
+	}
+
+	result := db.Where("min_lat < ? AND max_lat > ? AND min_long < ? AND max_long > ?", NElat, SWlat, NELong, SWLong).
+		Limit(limit).
+		Select("code, name, city_code, contour, avg_price, median_price_psqm, p10, p25, p75, p90, std_dev, nb_transaction").
+		Find(&iris)
+
+	if result.Error != nil {
+		log.Errorf("GetIrisFromBounds err: %v\n", result.Error)
+		return nil
+	}
+
+	info.Iris = make([]IrisInfo, 0, len(iris))
+
+	for _, z := range iris {
+		var current IrisInfo
+		current.Code = z.Code
+		current.Name = z.Name
+		current.CityCode = z.CityCode
+		current.AvgPriceSQM = z.AvgPrice
+		current.Distribution = z.PriceDistribution
+
+		feat, err := geojson.UnmarshalFeature([]byte(z.Contour))
+		if err != nil {
+			log.Errorf("GetIrisFromBounds UnmarshalGeometry err: %v\n", err)
+		} else {
+			current.Contour = feat
+			current.Contour.SetProperty("avgprice", z.AvgPrice)
+			current.Contour.SetProperty("iris", z.Code)
+			current.Contour.SetProperty("name", z.Name)
+
+			current.Stat = getIrisStat(db, z.Code, deflator)
+
+			info.Iris = append(info.Iris, current)
+		}
+	}
+
+	factor := deflator.sqlFactor(db)
+	rows, err := db.Select(fmt.Sprintf("AVG(transactions.price * %s) as avgPrice, AVG(transactions.price_psqm * %s) as avgPricePSQM", factor, factor)).
+		Where("lat < ? AND lat > ? AND long < ? AND long > ?", NElat, SWlat, NELong, SWLong).
+		Table("transactions").
+		Scopes(withoutOutliers).
+		Rows()
+
+	if err != nil {
+		log.Errorf("GetIrisFromBounds err: %v\n", err)
+		return nil
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var avgPrice, avgPricePSQM sql.NullFloat64
+
+		rows.Scan(&avgPrice, &avgPricePSQM)
+
+		info.AvgPrice = avgPrice.Float64
+		info.AvgPriceSQM = avgPricePSQM.Float64
+	}
+
+	return &info
+}
+
+// getIrisStat returns a map year -> formatted string for IRIS aggregates.
+func getIrisStat(db *gorm.DB, s string, deflator *Deflator) map[int]string {
+	var statMap map[int]string = make(map[int]string)
+
+	var stat []IrisYearlyAgg
+
+	result := db.Where("code = ?", s).Find(&stat)
+
+	if result.Error != nil {
+		log.Errorf("getIrisStat err: %v\n", result.Error)
+	} else {
+		for _, s := range stat {
+			statMap[s.Year] = deflator.stat(s.Year, s.AvgPrice, s.Increase)
 		}
 	}
 
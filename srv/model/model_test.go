@@ -2,6 +2,7 @@ package model
 
 import (
 	"fmt"
+	"math"
 	"path/filepath"
 	"testing"
 	"time"
@@ -136,6 +137,31 @@ func TestComputeRegionsDepartmentsCities(t *testing.T) {
 	if c.AvgPrice != 2100.0 {
 		t.Fatalf("city avg expect 2100 got %v", c.AvgPrice)
 	}
+
+	// verify distributions
+	for _, d := range []PriceDistribution{reg.PriceDistribution, dep.PriceDistribution, c.PriceDistribution} {
+		if d.NbTransaction != 2 || d.MedianPricePSQM != 2100 || d.P10 != 2020 || d.P90 != 2180 || math.Abs(d.StdDev-141.42) > 0.01 {
+			t.Fatalf("unexpected distribution %+v", d)
+		}
+	}
+
+	// a city whose sales are all flagged keeps no stale distribution
+	if err := db.Omit("Geom").Create(&City{Code: "C2", Name: "City2", CodeDepartment: "D1", CodeRegion: "R1"}).Error; err != nil {
+		t.Fatalf("create city: %v", err)
+	}
+	db.Create(&Transaction{Date: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC), CityCode: "C2", DepartmentCode: "D1",
+		Price: 150000, Area: 50, PricePSQM: 3000, Lat: 0.5, Long: 0.5})
+	ComputeCities(db)
+	var c2 City
+	if db.First(&c2, "code = ?", "C2"); c2.NbTransaction != 1 {
+		t.Fatalf("unexpected C2 distribution %+v", c2.PriceDistribution)
+	}
+	db.Model(&Transaction{}).Where("city_code = ?", "C2").Update("outlier", true)
+	ComputeCities(db)
+	c2 = City{}
+	if db.First(&c2, "code = ?", "C2"); c2.PriceDistribution != (PriceDistribution{}) {
+		t.Fatalf("expected a reset distribution, got %+v", c2.PriceDistribution)
+	}
 }
 
 func TestComputeEmptyDB(t *testing.T) {
@@ -185,7 +211,7 @@ func TestGetPOIAndGetPOIFromBounds(t *testing.T) {
 	}
 
 	// Test GetPOIFromBounds: coords covering (0.4..0.7)
-	info := GetPOIFromBounds(db, 1.0, 1.0, 0.0, 0.0, 10, "", 0)
+	info := GetPOIFromBounds(db, 1.0, 1.0, 0.0, 0.0, 10, "", 0, POIFilter{}, nil)
 	if info == nil {
 		t.Fatalf("GetPOIFromBounds returned nil")
 	}
@@ -199,19 +225,20 @@ func TestGetCityRegionDepartmentDetailsAndStats(t *testing.T) {
 	seedMinimal(db, t)
 
 	// prepare yearly aggs to test getCityStat/getRegionStat/getDepartmentStat
-	db.Create(&CityYearlyAgg{Code: "C1", Year: 2020, Name: "City1", AvgPrice: 2000, Increase: 0.0})
-	db.Create(&CityYearlyAgg{Code: "C1", Year: 2021, Name: "City1", AvgPrice: 2200, Increase: 0.1})
+	increase := 0.1
+	db.Create(&CityYearlyAgg{Code: "C1", Year: 2020, Name: "City1", AvgPrice: 2000})
+	db.Create(&CityYearlyAgg{Code: "C1", Year: 2021, Name: "City1", AvgPrice: 2200, Increase: &increase})
 
-	db.Create(&DepartmentYearlyAgg{Code: "D1", Year: 2020, Name: "Dep1", AvgPrice: 2000, Increase: 0.0})
-	db.Create(&RegionYearlyAgg{Code: "R1", Year: 2021, Name: "Reg1", AvgPrice: 2200, Increase: 0.1})
+	db.Create(&DepartmentYearlyAgg{Code: "D1", Year: 2020, Name: "Dep1", AvgPrice: 2000})
+	db.Create(&RegionYearlyAgg{Code: "R1", Year: 2021, Name: "Reg1", AvgPrice: 2200, Increase: &increase})
 
 	// City details
-	cities := GetCityDetails(db, "")
+	cities := GetCityDetails(db, "", nil)
 	if len(cities) == 0 {
 		t.Fatalf("GetCityDetails returned none")
 	}
 	// getCityStat (unexported) should return formatted map
-	cstat := getCityStat(db, "C1")
+	cstat := getCityStat(db, "C1", nil)
 	if len(cstat) == 0 {
 		t.Fatalf("getCityStat empty")
 	}
@@ -220,21 +247,21 @@ func TestGetCityRegionDepartmentDetailsAndStats(t *testing.T) {
 	}
 
 	// Region details & stat
-	regs := GetRegionDetails(db)
+	regs := GetRegionDetails(db, nil)
 	if len(regs) == 0 {
 		t.Fatalf("GetRegionDetails returned none")
 	}
-	rstat := getRegionStat(db, "R1")
+	rstat := getRegionStat(db, "R1", nil)
 	if len(rstat) == 0 {
 		t.Fatalf("getRegionStat empty")
 	}
 
 	// Department details & stat
-	deps := GetDepartmentDetails(db)
+	deps := GetDepartmentDetails(db, nil)
 	if len(deps) == 0 {
 		t.Fatalf("GetDepartmentDetails returned none")
 	}
-	dstat := getDepartmentStat(db, "D1")
+	dstat := getDepartmentStat(db, "D1", nil)
 	if len(dstat) == 0 {
 		t.Fatalf("getDepartmentStat empty")
 	}
@@ -269,7 +296,1304 @@ func TestAggregateDataCreatesYearlyAggs(t *testing.T) {
 		t.Fatalf("query city_yearly_aggs: %v", err)
 	}
 
-	if len(stat) != 0 {
-		t.Fatalf("expected city_yearly_aggs rows for C1")
+	if len(stat) != 2 {
+		t.Fatalf("expected city_yearly_aggs rows for C1, got %v", len(stat))
+	}
+}
+
+func TestPointInGeometry(t *testing.T) {
+	// square with a hole in the middle
+	contour := `{"type":"Feature","geometry":{"type":"Polygon","coordinates":[[[0,0],[4,0],[4,4],[0,4],[0,0]],[[1,1],[3,1],[3,3],[1,3],[1,1]]]},"properties":{}}`
+
+	g, err := ParseContour(contour)
+	if err != nil {
+		t.Fatalf("ParseContour: %v", err)
+	}
+
+	if !PointInGeometry(g, 0.5, 0.5) {
+		t.Fatalf("expected point inside polygon")
+	}
+	if PointInGeometry(g, 2, 2) {
+		t.Fatalf("expected point in hole outside polygon")
+	}
+	if PointInGeometry(g, 5, 5) {
+		t.Fatalf("expected point outside polygon")
+	}
+
+	b := GeometryBounds(g)
+	if b.MinLat != 0 || b.MaxLat != 4 || b.MinLong != 0 || b.MaxLong != 4 {
+		t.Fatalf("unexpected bounds %v", b)
+	}
+
+	if _, err := ParseContour("not json"); err == nil {
+		t.Fatalf("expected error on bad contour")
+	}
+}
+
+func TestComputeAndAggregateIris(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	feat := `{"type":"Feature","geometry":{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,1],[0,0]]]},"properties":{}}`
+	z := Iris{Code: "I1", Name: "Iris1", CityCode: "C1", Contour: feat, MinLat: 0, MaxLat: 1, MinLong: 0, MaxLong: 1}
+	if err := db.Create(&z).Error; err != nil {
+		t.Fatalf("create iris: %v", err)
+	}
+	db.Model(&Transaction{}).Where("city_code = ?", "C1").Update("iris_code", "I1")
+
+	ComputeIris(db)
+
+	if err := db.First(&z, "code = ?", "I1").Error; err != nil {
+		t.Fatalf("read iris: %v", err)
+	}
+	if z.AvgPrice != 2100.0 {
+		t.Fatalf("iris avg expect 2100 got %v", z.AvgPrice)
+	}
+
+	AggregateData(dsn)
+
+	var stat []IrisYearlyAgg
+	db.Where("code = ?", "I1").Order("year").Find(&stat)
+	if len(stat) != 2 {
+		t.Fatalf("expected 2 iris_yearly_aggs rows got %v", len(stat))
+	}
+	if stat[1].AvgPrice != 2200.0 || stat[1].Name != "Iris1" {
+		t.Fatalf("unexpected iris aggregate %v", stat[1])
+	}
+
+	info := GetIrisFromBounds(db, 0.8, 0.8, 0.2, 0.2, 0, nil)
+	if info == nil || len(info.Iris) != 1 {
+		t.Fatalf("GetIrisFromBounds expected one IRIS")
+	}
+	if len(info.Iris[0].Stat) != 2 {
+		t.Fatalf("GetIrisFromBounds expected 2 years of stat")
+	}
+
+	info = GetIrisFromBounds(db, 5, 5, 4, 4, 0, nil)
+	if info == nil || len(info.Iris) != 0 {
+		t.Fatalf("GetIrisFromBounds expected no IRIS")
+	}
+}
+
+func TestComputeAndAggregateEpci(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	feat := `{"type":"Feature","geometry":{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,1],[0,0]]]},"properties":{}}`
+	if err := db.Create(&Epci{Code: "E1", Name: "Metropole1", Nature: "ME", Contour: feat}).Error; err != nil {
+		t.Fatalf("create epci: %v", err)
+	}
+	db.Model(&City{}).Where("code = ?", "C1").Update("code_epci", "E1")
+
+	ComputeEpcis(db)
+
+	var e Epci
+	if err := db.First(&e, "code = ?", "E1").Error; err != nil {
+		t.Fatalf("read epci: %v", err)
+	}
+	if e.AvgPrice != 2100.0 {
+		t.Fatalf("epci avg expect 2100 got %v", e.AvgPrice)
+	}
+
+	AggregateData(dsn)
+
+	var stat []EpciYearlyAgg
+	db.Where("code = ?", "E1").Order("year").Find(&stat)
+	if len(stat) != 2 {
+		t.Fatalf("expected 2 epci_yearly_aggs rows got %v", len(stat))
+	}
+	if stat[0].Name != "Metropole1" || stat[1].AvgPrice != 2200.0 {
+		t.Fatalf("unexpected epci aggregate %v", stat)
+	}
+
+	infos := GetEpciDetails(db, "D1", nil)
+	if len(infos) != 1 || infos[0].Nature != "ME" || len(infos[0].Stat) != 2 {
+		t.Fatalf("unexpected GetEpciDetails result %v", infos)
+	}
+
+	infos = GetEpciDetails(db, "D2", nil)
+	if len(infos) != 0 {
+		t.Fatalf("expected no EPCI for D2")
+	}
+}
+
+func TestSaveAndAggregateZone(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	if code := ZoneCode("Bassin d'Arcachon"); code != "bassin-d-arcachon" {
+		t.Fatalf("unexpected zone code %v", code)
+	}
+
+	if _, err := SaveZone(db, "bad", []byte(`{"type":"Point","coordinates":[0.5,0.5]}`)); err == nil {
+		t.Fatalf("expected error for a Point zone")
+	}
+
+	// square containing only the 2021 transaction (0.6, 0.6)
+	poly := `{"type":"Polygon","coordinates":[[[0.55,0.55],[0.7,0.55],[0.7,0.7],[0.55,0.7],[0.55,0.55]]]}`
+	info, err := SaveZone(db, "Quartier Gare", []byte(poly))
+	if err != nil {
+		t.Fatalf("SaveZone: %v", err)
+	}
+	if info.Code != "quartier-gare" || info.NbTransaction != 1 || info.AvgPriceSQM != 2200.0 || len(info.Stat) != 1 {
+		t.Fatalf("unexpected zone info %+v", info)
+	}
+
+	// enlarge zone to contain both transactions, as a Feature
+	poly = `{"type":"Feature","geometry":{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,1],[0,0]]]},"properties":{}}`
+	if _, err := SaveZone(db, "Quartier Gare", []byte(poly)); err != nil {
+		t.Fatalf("SaveZone: %v", err)
+	}
+
+	ComputeZones(db)
+	AggregateData(dsn)
+
+	zones := GetZones(db, nil)
+	if len(zones) != 1 || zones[0].NbTransaction != 2 || zones[0].AvgPriceSQM != 2100.0 {
+		t.Fatalf("unexpected zones %+v", zones)
+	}
+
+	var stat []ZoneYearlyAgg
+	db.Where("code = ?", "quartier-gare").Order("year").Find(&stat)
+	if len(stat) != 2 || stat[1].AvgPrice != 2200.0 || stat[0].Increase != nil || math.Abs(*stat[1].Increase-0.1) > 1e-9 {
+		t.Fatalf("unexpected zone aggregate %v", stat)
+	}
+
+	if pois := GetZoneTransactions(db, "quartier-gare", 0); len(pois) != 2 {
+		t.Fatalf("expected 2 zone transactions got %v", len(pois))
+	}
+
+	if err := DeleteZone(db, "quartier-gare"); err != nil {
+		t.Fatalf("DeleteZone: %v", err)
+	}
+	if err := DeleteZone(db, "quartier-gare"); err != ErrZoneNotFound {
+		t.Fatalf("expected ErrZoneNotFound got %v", err)
+	}
+	if _, err := GetZone(db, "quartier-gare", nil); err != ErrZoneNotFound {
+		t.Fatalf("expected ErrZoneNotFound got %v", err)
+	}
+}
+
+func TestAggregateCityPopulation(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	// 2022 transaction so that the city has 2 yearly increases
+	tr := Transaction{Date: time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC), CityCode: "C1", DepartmentCode: "D1",
+		Price: 132000, Area: 50, PricePSQM: 2640}
+	if err := db.Create(&tr).Error; err != nil {
+		t.Fatalf("create tr: %v", err)
+	}
+
+	pops := []CityPopulation{{Code: "C1", Year: 2019, Population: 1000}, {Code: "C1", Year: 2021, Population: 1100}, {Code: "C1", Year: 2022, Population: 1320}}
+	if err := db.Create(&pops).Error; err != nil {
+		t.Fatalf("create populations: %v", err)
+	}
+
+	series := populationSeries(pops)
+	if series.at(2015) != 1000 || series.at(2020) != 1050 || series.at(2030) != 1320 {
+		t.Fatalf("unexpected population interpolation")
+	}
+
+	AggregateData(dsn)
+
+	var stat []CityYearlyAgg
+	db.Where("code = ?", "C1").Order("year").Find(&stat)
+	if len(stat) != 3 {
+		t.Fatalf("expected 3 city_yearly_aggs rows got %v", len(stat))
+	}
+	if stat[0].Population != 1050 || stat[0].NbTransaction != 1 || fmt.Sprintf("%.3f", stat[0].SalesPer1000) != "0.952" {
+		t.Fatalf("unexpected 2020 indicators %+v", stat[0])
+	}
+	if fmt.Sprintf("%.3f", stat[2].PopulationGrowth) != "0.200" {
+		t.Fatalf("unexpected 2022 population growth %+v", stat[2])
+	}
+
+	infos := GetCityDetails(db, "D1", nil)
+	if len(infos) != 1 || len(infos[0].Indicators) != 3 || infos[0].Indicators[2021].Population != 1100 {
+		t.Fatalf("unexpected GetCityDetails indicators %+v", infos)
+	}
+
+	if pearson([]float64{1, 2, 3}, []float64{2, 4, 6}) != 1 || pearson([]float64{1, 2}, []float64{1, 2}) != 0 {
+		t.Fatalf("unexpected pearson correlation")
+	}
+}
+
+func TestGrowth(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	// sales in 2011, 2017, 2020 and 2021: gaps of 6 and 3 years
+	db.Create(&[]Transaction{
+		{Date: time.Date(2011, 6, 1, 0, 0, 0, 0, time.UTC), CityCode: "C1", DepartmentCode: "D1", Price: 50000, Area: 50, PricePSQM: 1000, Lat: 0.5, Long: 0.5},
+		{Date: time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC), CityCode: "C1", DepartmentCode: "D1", Price: 80000, Area: 50, PricePSQM: 1600, Lat: 0.5, Long: 0.5},
+	})
+	AggregateData(dsn)
+
+	var aggs []DepartmentYearlyAgg
+	db.Where("code = ?", "D1").Order("year").Find(&aggs)
+	if len(aggs) != 4 {
+		t.Fatalf("expected 4 years, got %+v", aggs)
+	}
+
+	near := func(v *float64, expected float64) bool { return v != nil && math.Abs(*v-expected) < 1e-9 }
+	if a := aggs[0]; a.Increase != nil || a.Cagr != nil || a.Change3Y != nil || a.Change10Y != nil {
+		t.Fatalf("unexpected 2011 growth %+v", a)
+	}
+	if a := aggs[1]; a.Increase != nil || !near(a.Cagr, math.Pow(1.6, 1.0/6)-1) || a.Change5Y != nil {
+		t.Fatalf("unexpected 2017 growth %+v", a)
+	}
+	if a := aggs[2]; a.Increase != nil || !near(a.Cagr, math.Pow(1.25, 1.0/3)-1) || !near(a.Change3Y, 0.25) || a.Change5Y != nil {
+		t.Fatalf("unexpected 2020 growth %+v", a)
+	}
+	if a := aggs[3]; !near(a.Increase, 0.1) || !near(a.Cagr, 0.1) || a.Change3Y != nil || !near(a.Change10Y, 1.2) {
+		t.Fatalf("unexpected 2021 growth %+v", a)
+	}
+
+	// a zero previous average gives no change
+	if c := growthColumns(2021, 2200, map[int]float64{2020: 0}); c["increase"].(*float64) != nil || c["cagr"].(*float64) != nil {
+		t.Fatalf("unexpected growth from a zero average %+v", c)
+	}
+}
+
+func TestAggregateSince(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	// stale row removed by a full aggregation
+	db.AutoMigrate(&CityYearlyAgg{})
+	db.Create(&CityYearlyAgg{Code: "C1", Year: 1999, AvgPrice: 1000})
+	AggregateData(dsn)
+
+	var aggs []CityYearlyAgg
+	db.Where("code = ?", "C1").Order("year").Find(&aggs)
+	if len(aggs) != 2 || aggs[0].Year != 2020 {
+		t.Fatalf("expected 2020 and 2021 aggregates, got %+v", aggs)
+	}
+
+	// years before since are not aggregated again but still read, the
+	// stale years after since are deleted
+	db.Model(&CityYearlyAgg{}).Where("code = ? AND year = ?", "C1", 2020).Update("avg_price", 9999)
+	db.Create(&CityYearlyAgg{Code: "C1", Year: 2023, AvgPrice: 1000})
+	db.Create(&MonthlyAgg{PeriodAgg{Level: "city", Code: "C1", Period: "2023-01", Year: 2023, Number: 1}})
+	db.Create(&Transaction{Date: time.Date(2022, 1, 15, 0, 0, 0, 0, time.UTC), CityCode: "C1", DepartmentCode: "D1",
+		Price: 125000, Area: 50, PricePSQM: 2500, Lat: 0.5, Long: 0.5})
+	AggregateDataSince(dsn, time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	aggs = nil
+	db.Where("code = ?", "C1").Order("year").Find(&aggs)
+	if len(aggs) != 3 || aggs[0].AvgPrice != 9999 || aggs[1].AvgPrice != 2200 {
+		t.Fatalf("unexpected aggregates %+v", aggs)
+	}
+	if a := aggs[2]; a.Year != 2022 || a.AvgPrice != 2500 || math.Abs(*a.Increase-(2500.0/2200-1)) > 1e-9 || a.NbTransaction != 1 {
+		t.Fatalf("unexpected 2022 aggregate %+v", a)
+	}
+
+	var deps []DepartmentYearlyAgg
+	db.Where("code = ?", "D1").Order("year").Find(&deps)
+	if len(deps) != 3 || deps[2].Year != 2022 {
+		t.Fatalf("unexpected department aggregates %+v", deps)
+	}
+
+	months, _ := GetSeries(db, "city", "C1", GRANULARITY_MONTH)
+	if len(months) != 3 || months[2].Period != "2022-01" || months[2].RollingNbTransaction != 2 {
+		t.Fatalf("unexpected months %+v", months)
+	}
+
+	// a failed step rolls back the whole aggregation
+	db.Exec("CREATE TRIGGER fail_grid BEFORE INSERT ON grid_cell_aggs BEGIN SELECT RAISE(ABORT, 'grid failure'); END")
+	if err := AggregateData(dsn); err == nil {
+		t.Fatalf("expected the grid failure")
+	}
+	aggs = nil
+	db.Where("code = ?", "C1").Order("year").Find(&aggs)
+	if len(aggs) != 3 || aggs[0].AvgPrice != 9999 {
+		t.Fatalf("expected the aggregates kept after a failure, got %+v", aggs)
+	}
+}
+
+func TestLiquidity(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	db.Create(&Transaction{Date: time.Date(2021, 9, 15, 0, 0, 0, 0, time.UTC), CityCode: "C1", DepartmentCode: "D1",
+		Price: 120000, Area: 50, PricePSQM: 2400, Lat: 0.5, Long: 0.5})
+	db.Create(&[]CityPopulation{{Code: "C1", Year: 2020, Population: 1000}, {Code: "C1", Year: 2021, Population: 1100}})
+
+	AggregateData(dsn)
+
+	infos, err := GetLiquidity(db, "department", "D1", 0)
+	if err != nil || len(infos) != 2 {
+		t.Fatalf("expected 2 years, got %+v (%v)", infos, err)
+	}
+	if l := infos[0]; l.Volume != 100000 || l.VolumeIncrease != nil || !l.Weak || l.TurnoverRate != 1 {
+		t.Fatalf("unexpected 2020 liquidity %+v", l)
+	}
+	if l := infos[1]; l.NbTransaction != 2 || l.Volume != 230000 || l.VolumeIncrease == nil || math.Abs(*l.VolumeIncrease-1.3) > 1e-9 ||
+		l.CountIncrease == nil || *l.CountIncrease != 1 || math.Abs(l.TurnoverRate-2000.0/1100) > 1e-9 {
+		t.Fatalf("unexpected 2021 liquidity %+v", l)
+	}
+
+	months, _ := GetSeries(db, "city", "C1", GRANULARITY_MONTH)
+	if last := months[len(months)-1]; last.Period != "2021-09" || last.Volume != 120000 || last.VolumeIncrease != nil || !last.Weak || last.RollingVolume != 230000 {
+		t.Fatalf("unexpected last month %+v", last)
+	}
+	if june := months[1]; june.Period != "2021-06" || june.VolumeIncrease == nil || math.Abs(*june.VolumeIncrease-0.1) > 1e-9 {
+		t.Fatalf("unexpected 2021-06 month %+v", june)
+	}
+
+	if _, err := GetLiquidity(db, "country", "", 0); err != ErrUnknownLevel {
+		t.Fatalf("expected ErrUnknownLevel, got %v", err)
+	}
+
+	steady := []float64{2000, 2010, 1990, 2000, 2005, 1995, 2000, 2002, 1998, 2000}
+	spread := []float64{500, 6000, 800, 5000, 1000, 7000, 600, 4000, 900, 8000}
+	if weakAverage(steady) || !weakAverage(spread) || !weakAverage(steady[:5]) {
+		t.Fatalf("unexpected weak averages")
+	}
+}
+
+func TestAggregateAffordability(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	if median([]float64{3, 1, 2}) != 2 || median([]float64{4, 1, 2, 3}) != 2.5 || median(nil) != 0 {
+		t.Fatalf("unexpected median")
+	}
+
+	incomes := []MedianIncome{
+		{Level: INCOME_LEVEL_CITY, Code: "C1", Year: 2019, Median: 20000},
+		{Level: INCOME_LEVEL_CITY, Code: "C1", Year: 2021, Median: 22000},
+	}
+	if err := SaveMedianIncomes(db, incomes); err != nil {
+		t.Fatalf("save incomes: %v", err)
+	}
+
+	AggregateData(dsn)
+
+	infos, err := GetAffordability(db, "city", "C1", 0)
+	if err != nil || len(infos) != 2 {
+		t.Fatalf("unexpected GetAffordability %v %v", infos, err)
+	}
+	// 2020: income 2019 is used
+	if infos[0].MedianPrice != 100000 || infos[0].MedianIncome != 20000 || infos[0].AffordabilityRatio != 5 || infos[0].YearsOfIncome != 7 {
+		t.Fatalf("unexpected 2020 affordability %+v", infos[0])
+	}
+	if infos[1].MedianIncome != 22000 || infos[1].AffordabilityRatio != 5 || infos[1].YearsOfIncome != 7 {
+		t.Fatalf("unexpected 2021 affordability %+v", infos[1])
+	}
+
+	// department level uses the mean of the city incomes of its transactions
+	infos, err = GetAffordability(db, "department", "", 2021)
+	if err != nil || len(infos) != 1 || infos[0].Name != "Dep1" || infos[0].MedianIncome != 22000 {
+		t.Fatalf("unexpected department affordability %v %v", infos, err)
+	}
+
+	if _, err := GetAffordability(db, "country", "", 0); err != ErrUnknownLevel {
+		t.Fatalf("expected ErrUnknownLevel got %v", err)
+	}
+}
+
+func TestAggregateDpe(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	trans := []Transaction{
+		{Date: time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC), CityCode: "C1", DepartmentCode: "D1", PricePSQM: 2000, DpeClass: "D"},
+		{Date: time.Date(2021, 4, 1, 0, 0, 0, 0, time.UTC), CityCode: "C1", DepartmentCode: "D1", PricePSQM: 2400, DpeClass: "D"},
+		{Date: time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC), CityCode: "C1", DepartmentCode: "D1", PricePSQM: 2420, DpeClass: "B"},
+		{Date: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC), CityCode: "C1", DepartmentCode: "D1", PricePSQM: 1980, DpeClass: "G"},
+	}
+	if err := db.Create(&trans).Error; err != nil {
+		t.Fatalf("create transactions: %v", err)
+	}
+
+	AggregateData(dsn)
+
+	stats := GetDpeStats(db, "D1", 2021)
+	if len(stats) != 3 {
+		t.Fatalf("expected 3 DPE classes got %v", stats)
+	}
+	if stats[0].DpeClass != "B" || fmt.Sprintf("%.2f", stats[0].GreenValue) != "0.10" {
+		t.Fatalf("unexpected class B stats %+v", stats[0])
+	}
+	if stats[1].DpeClass != "D" || stats[1].NbTransaction != 2 || stats[1].MedianPrice != 2200 || stats[1].GreenValue != 0 {
+		t.Fatalf("unexpected class D stats %+v", stats[1])
+	}
+	if stats[2].DpeClass != "G" || fmt.Sprintf("%.2f", stats[2].GreenValue) != "-0.10" {
+		t.Fatalf("unexpected class G stats %+v", stats[2])
+	}
+
+	if len(GetDpeStats(db, "D2", 0)) != 0 {
+		t.Fatalf("expected no DPE stats for D2")
+	}
+}
+
+func TestAggregateRisks(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	feat := `{"type":"Polygon","coordinates":[[[0.55,0.55],[0.7,0.55],[0.7,0.7],[0.55,0.7],[0.55,0.55]]]}`
+	if err := db.Create(&RiskZone{Kind: RISK_FLOOD, Level: "rouge", Contour: feat}).Error; err != nil {
+		t.Fatalf("create risk zone: %v", err)
+	}
+	// tag the 2021 transaction (2200€/m²) as inside the flood zone
+	db.Model(&Transaction{}).Where("price_psqm = ?", 2200.0).Update("flood_risk", "rouge")
+
+	AggregateData(dsn)
+
+	stats := GetRiskStats(db, "D1", "")
+	if len(stats) != 2 {
+		t.Fatalf("expected 2 risk stats got %v", stats)
+	}
+	if stats[0].Level != RISK_NONE || stats[0].MedianPrice != 2000 || stats[0].Discount != 0 {
+		t.Fatalf("unexpected outside stats %+v", stats[0])
+	}
+	if stats[1].Level != "rouge" || stats[1].NbTransaction != 1 || fmt.Sprintf("%.2f", stats[1].Discount) != "0.10" {
+		t.Fatalf("unexpected inside stats %+v", stats[1])
+	}
+
+	if len(GetRiskStats(db, "", "C2")) != 0 {
+		t.Fatalf("expected no risk stats for C2")
+	}
+}
+
+func TestDissolvePolygons(t *testing.T) {
+	square := func(x, y float64) [][][]float64 {
+		return [][][]float64{{{x, y}, {x + 1, y}, {x + 1, y + 1}, {x, y + 1}, {x, y}}}
+	}
+
+	// 8 squares around an empty one: a polygon with a hole
+	var polygons [][][][]float64
+	for x := 0.0; x < 3; x++ {
+		for y := 0.0; y < 3; y++ {
+			if x != 1 || y != 1 {
+				polygons = append(polygons, square(x, y))
+			}
+		}
+	}
+	// a clockwise square apart is kept
+	polygons = append(polygons, [][][]float64{{{5, 5}, {5, 6}, {6, 6}, {6, 5}, {5, 5}}})
+
+	dissolved := DissolvePolygons(polygons)
+	if len(dissolved) != 2 {
+		t.Fatalf("expected 2 polygons, got %v", dissolved)
+	}
+	var holed [][][]float64
+	for _, poly := range dissolved {
+		if len(poly) == 2 {
+			holed = poly
+		}
+	}
+	if holed == nil || math.Abs(ringArea(holed[0])-9) > 1e-9 || math.Abs(ringArea(holed[1])+1) > 1e-9 {
+		t.Fatalf("expected a 3x3 polygon with a hole, got %v", dissolved)
+	}
+	if pointInPolygon(holed, 1.5, 1.5) || !pointInPolygon(holed, 0.5, 1.5) {
+		t.Fatalf("unexpected dissolved polygon %v", holed)
+	}
+}
+
+func TestGridIndex(t *testing.T) {
+	idx := NewGridIndex(0.5)
+	idx.Add(1, Bounds{MinLat: 0, MaxLat: 1.2, MinLong: 0, MaxLong: 0.4})
+	idx.Add(2, Bounds{MinLat: 2, MaxLat: 2.1, MinLong: 2, MaxLong: 2.1})
+
+	if ids := idx.Query(1.1, 0.1); len(ids) != 1 || ids[0] != 1 {
+		t.Fatalf("unexpected query result %v", ids)
+	}
+	if ids := idx.Query(1.1, 1.1); len(ids) != 0 {
+		t.Fatalf("unexpected query result %v", ids)
+	}
+}
+
+func TestDistanceToGeometryAndBand(t *testing.T) {
+	g, err := ParseContour(`{"type":"LineString","coordinates":[[2.0,48.0],[2.2,48.0]]}`)
+	if err != nil {
+		t.Fatalf("ParseContour: %v", err)
+	}
+	if d := DistanceToGeometry(g, 48.0009, 2.1); math.Abs(d-100) > 2 {
+		t.Fatalf("expected ~100m got %v", d)
+	}
+	// beyond the end of the line: distance to the end point
+	if d, want := DistanceToGeometry(g, 48.0, 2.21), DistanceMeters(48.0, 2.2, 48.0, 2.21); math.Abs(d-want) > 2 {
+		t.Fatalf("expected %v got %v", want, d)
+	}
+
+	d := 120.0
+	if band := distanceBand(&d); band != "100-250" {
+		t.Fatalf("unexpected band %v", band)
+	}
+	if band := distanceBand(nil); band != POWERLINE_BAND_FAR {
+		t.Fatalf("unexpected band %v", band)
+	}
+}
+
+func TestAggregatePowerLinesAndFilter(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	line := `{"type":"LineString","coordinates":[[0.6,0.5],[0.6,0.7]]}`
+	if err := db.Create(&PowerLine{Code: "L1", Voltage: 400, Contour: line}).Error; err != nil {
+		t.Fatalf("create power line: %v", err)
+	}
+	// the 2021 transaction (2200€/m²) is 50 m away from the line
+	db.Model(&Transaction{}).Where("price_psqm = ?", 2200.0).Updates(map[string]interface{}{"line_distance": 50.0, "line_voltage": 400})
+
+	AggregateData(dsn)
+
+	stats := GetPowerLineStats(db, "D1")
+	if len(stats) != 2 {
+		t.Fatalf("expected 2 power line stats got %v", stats)
+	}
+	if stats[0].Band != "0-100" || stats[0].NbTransaction != 1 || fmt.Sprintf("%.2f", stats[0].Discount) != "0.10" {
+		t.Fatalf("unexpected near stats %+v", stats[0])
+	}
+	if stats[1].Band != POWERLINE_BAND_FAR || stats[1].MedianPrice != 2000 {
+		t.Fatalf("unexpected far stats %+v", stats[1])
+	}
+
+	info := GetPOIFromBounds(db, 1.0, 1.0, 0.0, 0.0, 10, "", 0, POIFilter{MinLineDistance: 100}, nil)
+	if info == nil || len(info.Trans) != 1 || info.AvgPriceSQM != 2000 {
+		t.Fatalf("unexpected filtered pois %+v", info)
+	}
+}
+
+func TestPOIFilterAmenities(t *testing.T) {
+	db, _ := openTestDB(t)
+	seedMinimal(db, t)
+
+	// only the 2020 transaction (2000€/m²) is 300 m from a station
+	db.Model(&Transaction{}).Where("price_psqm = ?", 2000.0).Update("station_distance", 300.0)
+	db.Model(&Transaction{}).Where("price_psqm = ?", 2200.0).Update("school_distance", 900.0)
+
+	info := GetPOIFromBounds(db, 1.0, 1.0, 0.0, 0.0, 10, "", 0, POIFilter{MaxStationDistance: 800}, nil)
+	if info == nil || len(info.Trans) != 1 || info.AvgPriceSQM != 2000 {
+		t.Fatalf("unexpected station filtered pois %+v", info)
+	}
+
+	info = GetPOIFromBounds(db, 1.0, 1.0, 0.0, 0.0, 10, "", 0, POIFilter{MaxStationDistance: 800, MaxSchoolDistance: 1000}, nil)
+	if info == nil || len(info.Trans) != 0 {
+		t.Fatalf("unexpected combined filtered pois %+v", info)
+	}
+}
+
+func TestDeflatorAndRealAggregates(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	if NewDeflator(db, 0) != nil {
+		t.Fatalf("expected no deflator without index")
+	}
+	var nominal *Deflator
+	increase := 0.1
+	if nominal.Factor(2020) != 1 || nominal.stat(2021, 2200, &increase) != "2200€/m² (10.0%)" || nominal.stat(2021, 2200, nil) != "2200€/m²" {
+		t.Fatalf("unexpected nil deflator behavior")
+	}
+
+	if err := SaveCpis(db, []ConsumerPriceIndex{{Year: 2020, Value: 100}, {Year: 2021, Value: 110}}); err != nil {
+		t.Fatalf("SaveCpis: %v", err)
+	}
+	if NewDeflator(db, 2015) != nil {
+		t.Fatalf("expected no deflator for a base year without index")
+	}
+
+	d := NewDeflator(db, 0)
+	if d == nil || d.Base != 2021 {
+		t.Fatalf("unexpected deflator %+v", d)
+	}
+	// years outside the index use the nearest value
+	if d.Factor(2020) != 1.1 || d.Factor(2024) != 1 || d.Factor(2010) != 1.1 {
+		t.Fatalf("unexpected factors %v %v %v", d.Factor(2020), d.Factor(2024), d.Factor(2010))
+	}
+	// 2000€ in 2020 are 2200€ of 2021: no real increase
+	if s := d.stat(2021, 2200, &increase); s != "2200€/m² (0.0%)" {
+		t.Fatalf("unexpected real stat %v", s)
+	}
+
+	CpiBaseYear = 2020
+	defer func() { CpiBaseYear = 0 }()
+	AggregateData(dsn)
+
+	var aggs []CityYearlyAgg
+	db.Where("code = ?", "C1").Order("year").Find(&aggs)
+	if len(aggs) != 2 {
+		t.Fatalf("expected 2 city aggregates got %v", aggs)
+	}
+	if aggs[0].CpiBase != 2020 || aggs[0].RealAvgPrice != 2000 || aggs[0].AvgTotalPrice != 100000 {
+		t.Fatalf("unexpected 2020 real prices %+v", aggs[0].RealPrice)
+	}
+	if fmt.Sprintf("%.0f %.0f", aggs[1].RealAvgPrice, aggs[1].RealAvgTotalPrice) != "2000 100000" {
+		t.Fatalf("unexpected 2021 real prices %+v", aggs[1].RealPrice)
+	}
+
+	info := GetPOIFromBounds(db, 1.0, 1.0, 0.0, 0.0, 10, "", 0, POIFilter{}, NewDeflator(db, 2020))
+	if info == nil || len(info.Trans) != 2 || math.Abs(info.AvgPriceSQM-2000) > 1e-6 {
+		t.Fatalf("unexpected real pois %+v", info)
+	}
+	for _, tr := range info.Trans {
+		if math.Abs(tr.PricePSQM-2000) > 1e-6 {
+			t.Fatalf("unexpected real transaction price %+v", tr)
+		}
+	}
+
+	iris := GetIrisFromBounds(db, 1.0, 1.0, 0.0, 0.0, 10, NewDeflator(db, 2020))
+	if iris == nil || math.Abs(iris.AvgPriceSQM-2000) > 1e-6 {
+		t.Fatalf("unexpected real IRIS box average %+v", iris)
+	}
+}
+
+func TestPercentileAndStdDev(t *testing.T) {
+	sorted := []float64{1, 2, 3, 4, 5}
+	if percentile(sorted, 0.5) != 3 || percentile(sorted, 0.25) != 2 || percentile(sorted, 0.9) != 4.6 {
+		t.Fatalf("unexpected percentiles %v %v %v", percentile(sorted, 0.5), percentile(sorted, 0.25), percentile(sorted, 0.9))
+	}
+	if percentile(sorted, 1) != 5 || percentile(nil, 0.5) != 0 || percentile([]float64{7}, 0.1) != 7 {
+		t.Fatalf("unexpected percentile bounds")
+	}
+	if math.Abs(stddev(sorted)-1.5811) > 0.0001 || stddev([]float64{7}) != 0 {
+		t.Fatalf("unexpected stddev %v", stddev(sorted))
+	}
+}
+
+func TestAggregateDistribution(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	// two more 2021 sales in C1, one of them a château skewing the average
+	db.Create(&Transaction{Date: time.Date(2021, 9, 1, 0, 0, 0, 0, time.UTC), CityCode: "C1", DepartmentCode: "D1",
+		Price: 120000, Area: 50, PricePSQM: 2400, Lat: 0.5, Long: 0.5})
+	db.Create(&Transaction{Date: time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC), CityCode: "C1", DepartmentCode: "D1",
+		Price: 10000000, Area: 500, PricePSQM: 20000, Lat: 0.5, Long: 0.5})
+
+	AggregateData(dsn)
+
+	var agg CityYearlyAgg
+	if err := db.Where("code = ? AND year = ?", "C1", 2021).First(&agg).Error; err != nil {
+		t.Fatalf("read city aggregate: %v", err)
+	}
+	if agg.NbTransaction != 3 || agg.MedianPricePSQM != 2400 || agg.AvgPrice != 8200 {
+		t.Fatalf("unexpected 2021 distribution %+v", agg)
+	}
+	if agg.P25 != 2300 || agg.P75 != 11200 || agg.StdDev == 0 {
+		t.Fatalf("unexpected 2021 quartiles %+v", agg.PriceDistribution)
+	}
+
+	var dep DepartmentYearlyAgg
+	db.Where("code = ? AND year = ?", "D1", 2020).First(&dep)
+	if dep.NbTransaction != 1 || dep.MedianPricePSQM != 2000 || dep.StdDev != 0 {
+		t.Fatalf("unexpected 2020 department distribution %+v", dep.PriceDistribution)
+	}
+}
+
+func TestRobustZScores(t *testing.T) {
+	scores := robustZScores([]float64{2200, 2300, 2100, 2250, 2150, 9000})
+	if len(scores) != 6 || math.Abs(scores[5]-60.93) > 0.01 || math.Abs(scores[2]+1.124) > 0.01 {
+		t.Fatalf("unexpected robust z-scores %v", scores)
+	}
+	if robustZScores([]float64{2000, 2000, 2000, 3000}) != nil {
+		t.Fatalf("expected no z-scores when the MAD is 0")
+	}
+}
+
+func TestFlagOutliers(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	sale := func(month, day int, price float64, area int) *Transaction {
+		tr := Transaction{Date: time.Date(2021, time.Month(month), day, 0, 0, 0, 0, time.UTC), CityCode: "C1", DepartmentCode: "D1",
+			Price: price, Area: area, PricePSQM: price / float64(area), Lat: 0.5, Long: 0.5}
+		if err := db.Create(&tr).Error; err != nil {
+			t.Fatalf("create transaction: %v", err)
+		}
+		return &tr
+	}
+	sale(2, 1, 115000, 50)
+	sale(3, 1, 105000, 50)
+	sale(4, 1, 112500, 50)
+	sale(5, 1, 107500, 50)
+	sale(7, 1, 1, 50)
+	sale(8, 1, 50000, 1)
+	sale(9, 1, 300000, 60)
+	sale(9, 1, 300000, 60)
+	castle := sale(10, 1, 450000, 50)
+
+	if n := FlagOutliers(db); n != 5 {
+		t.Fatalf("expected 5 outliers, got %d", n)
+	}
+
+	report := GetOutlierReport(db, "D1")
+	if report == nil || report.Total != 11 || report.Excluded != 5 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	reasons := make(map[string]int64)
+	for _, r := range report.Reasons {
+		reasons[r.Reason] = r.Count
+	}
+	if reasons[OUTLIER_PRICE] != 1 || reasons[OUTLIER_AREA] != 1 || reasons[OUTLIER_BULK] != 2 || reasons[OUTLIER_ZSCORE] != 1 {
+		t.Fatalf("unexpected reasons %v", reasons)
+	}
+	if pois := GetOutliers(db, "", OUTLIER_ZSCORE, 0); len(pois) != 1 || pois[0].TrId != castle.TrId || pois[0].OutlierReason != OUTLIER_ZSCORE {
+		t.Fatalf("unexpected z-score outliers %+v", pois)
+	}
+
+	ComputeCities(db)
+	var city City
+	db.Where("code = ?", "C1").First(&city)
+	if math.Abs(city.AvgPrice-13000.0/6) > 0.01 || city.NbTransaction != 6 {
+		t.Fatalf("outliers not excluded from city stats: %v %+v", city.AvgPrice, city.PriceDistribution)
+	}
+
+	AggregateData(dsn)
+	var agg CityYearlyAgg
+	db.Where("code = ? AND year = ?", "C1", 2021).First(&agg)
+	if agg.NbTransaction != 5 || agg.MedianPricePSQM != 2200 {
+		t.Fatalf("outliers not excluded from aggregates %+v", agg.PriceDistribution)
+	}
+	if info := GetIrisFromBounds(db, 1.0, 1.0, 0.0, 0.0, 10, nil); info == nil || math.Abs(info.AvgPriceSQM-13000.0/6) > 0.01 {
+		t.Fatalf("outliers not excluded from the box average %+v", info)
+	}
+
+	IncludeOutliers = true
+	defer func() { IncludeOutliers = false }()
+	ComputeCities(db)
+	db.Where("code = ?", "C1").First(&city)
+	if city.NbTransaction != 11 {
+		t.Fatalf("outliers not included: %+v", city.PriceDistribution)
+	}
+
+	// a corrected price clears the previous flag
+	IncludeOutliers = false
+	db.Model(castle).Updates(map[string]interface{}{"price": 110000, "price_psqm": 2200})
+	if n := FlagOutliers(db); n != 4 {
+		t.Fatalf("expected 4 outliers after correction, got %d", n)
+	}
+}
+
+func TestAggregatePeriods(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	db.Create(&Transaction{Date: time.Date(2020, 12, 15, 0, 0, 0, 0, time.UTC), CityCode: "C1", DepartmentCode: "D1",
+		Price: 90000, Area: 50, PricePSQM: 1800, Lat: 0.5, Long: 0.5})
+	db.Create(&Transaction{Date: time.Date(2021, 5, 15, 0, 0, 0, 0, time.UTC), CityCode: "C1", DepartmentCode: "D1",
+		Price: 120000, Area: 50, PricePSQM: 2400, Lat: 0.5, Long: 0.5})
+
+	AggregateData(dsn)
+
+	months, err := GetSeries(db, "city", "C1", GRANULARITY_MONTH)
+	if err != nil || len(months) != 4 {
+		t.Fatalf("expected 4 months, got %v (%v)", len(months), err)
+	}
+	last := months[3]
+	if last.Period != "2021-06" || last.Name != "City1" || last.AvgPrice != 2200 || last.RollingNbTransaction != 3 ||
+		math.Abs(last.RollingAvgPrice-6400.0/3) > 0.01 {
+		t.Fatalf("unexpected last month %+v", last)
+	}
+	if months[2].Period != "2021-05" || months[2].RollingNbTransaction != 3 || math.Abs(months[2].RollingAvgPrice-6200.0/3) > 0.01 {
+		t.Fatalf("unexpected 2021-05 month %+v", months[2])
+	}
+
+	quarters, _ := GetSeries(db, "department", "D1", GRANULARITY_QUARTER)
+	if len(quarters) != 3 {
+		t.Fatalf("expected 3 quarters, got %+v", quarters)
+	}
+	q := quarters[2]
+	if q.Period != "2021-Q2" || q.Year != 2021 || q.Number != 2 || q.AvgPrice != 2300 || q.NbTransaction != 2 ||
+		q.RollingNbTransaction != 3 || math.Abs(q.RollingAvgPrice-6400.0/3) > 0.01 {
+		t.Fatalf("unexpected 2021-Q2 quarter %+v", q)
+	}
+
+	if _, err := GetSeries(db, "city", "C1", "week"); err != ErrUnknownGranularity {
+		t.Fatalf("expected ErrUnknownGranularity, got %v", err)
+	}
+	if _, err := GetSeries(db, "country", "C1", GRANULARITY_MONTH); err != ErrUnknownLevel {
+		t.Fatalf("expected ErrUnknownLevel, got %v", err)
+	}
+}
+
+func TestIdwEstimate(t *testing.T) {
+	points := []surfacePoint{{0.5, 0.5, 2000}, {0.501, 0.5, 3000}, {0.502, 0.5, 4000}, {1.5, 1.5, 100000}}
+
+	// closer points weigh more and the far point is ignored
+	value, uncertainty, n := idwEstimate(points, 0.5, 0.5, 1000)
+	if n != 3 || value <= 2000 || value >= 3000 || uncertainty <= 0 {
+		t.Fatalf("unexpected estimate %v ± %v (%v samples)", value, uncertainty, n)
+	}
+
+	if value, _, n := idwEstimate(points, 0.5, 0.5, 150); n != 2 || value != 0 {
+		t.Fatalf("expected no estimate with 2 samples, got %v (%v samples)", value, n)
+	}
+}
+
+func TestInterpolateCities(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	feat := `{"type":"Feature","geometry":{"type":"Polygon","coordinates":[[[0.52,0.52],[0.53,0.52],[0.53,0.53],[0.52,0.53],[0.52,0.52]]]},"properties":{}}`
+	if err := db.Omit("Geom").Create(&City{Code: "C2", Name: "City2", Contour: feat, CodeDepartment: "D1", CodeRegion: "R1"}).Error; err != nil {
+		t.Fatalf("create city: %v", err)
+	}
+	for _, s := range []struct{ lat, psqm float64 }{{0.52, 2600}, {0.52, 2800}, {0.53, 3000}} {
+		db.Create(&Transaction{Date: time.Date(2021, 9, 15, 0, 0, 0, 0, time.UTC), CityCode: "C1", DepartmentCode: "D1",
+			Price: s.psqm * 50, Area: 50, PricePSQM: s.psqm, Lat: s.lat, Long: s.lat})
+	}
+	// C3 has a single sale, far from C2, with enough sales around to be interpolated
+	feat = `{"type":"Feature","geometry":{"type":"Polygon","coordinates":[[[0.60,0.60],[0.61,0.60],[0.61,0.61],[0.60,0.61],[0.60,0.60]]]},"properties":{}}`
+	if err := db.Omit("Geom").Create(&City{Code: "C3", Name: "City3", Contour: feat, CodeDepartment: "D1", CodeRegion: "R1"}).Error; err != nil {
+		t.Fatalf("create city: %v", err)
+	}
+	for _, s := range []struct {
+		code      string
+		lat, psqm float64
+	}{{"C3", 0.605, 5000}, {"C1", 0.60, 3000}, {"C1", 0.60, 3000}} {
+		db.Create(&Transaction{Date: time.Date(2021, 9, 15, 0, 0, 0, 0, time.UTC), CityCode: s.code, DepartmentCode: "D1",
+			Price: s.psqm * 50, Area: 50, PricePSQM: s.psqm, Lat: s.lat, Long: s.lat})
+	}
+
+	AggregateData(dsn)
+
+	var aggs []CityYearlyAgg
+	db.Where("code = ?", "C2").Find(&aggs)
+	if len(aggs) != 1 {
+		t.Fatalf("expected one interpolated year for C2, got %+v", aggs)
+	}
+	if a := aggs[0]; a.Year != 2021 || !a.Interpolated || a.NbTransaction != 0 || math.Abs(a.AvgPrice-2800) > 0.01 ||
+		math.Abs(a.Uncertainty-math.Sqrt(80000.0/9)) > 0.01 {
+		t.Fatalf("unexpected C2 aggregate %+v", a)
+	}
+
+	// the average of C3 comes from its own sale, never from the surface
+	var c3 []CityYearlyAgg
+	db.Where("code = ?", "C3").Find(&c3)
+	if len(c3) != 1 || c3[0].Interpolated || c3[0].NbTransaction != 1 || math.Abs(c3[0].AvgPrice-5000) > 0.01 {
+		t.Fatalf("unexpected C3 aggregates %+v", c3)
+	}
+
+	// C1 has sales in 2020 and 2021
+	var c1 []CityYearlyAgg
+	db.Where("code = ? AND interpolated = ?", "C1", true).Find(&c1)
+	if len(c1) != 0 {
+		t.Fatalf("expected no interpolated C1 aggregate, got %+v", c1)
+	}
+
+	estimate, err := EstimateSurface(db, 0, 0, "C2", 0, 0)
+	if err != nil || estimate.Year != 2021 || estimate.NbSample != 3 || math.Abs(estimate.Value-2800) > 0.01 {
+		t.Fatalf("unexpected estimate %+v (%v)", estimate, err)
+	}
+	if _, err := EstimateSurface(db, 0, 0, "", 0, 0); err != ErrBadSurfaceQuery {
+		t.Fatalf("expected ErrBadSurfaceQuery, got %v", err)
+	}
+	if _, err := EstimateSurface(db, 0, 0, "C9", 0, 0); err != ErrUnknownLocation {
+		t.Fatalf("expected ErrUnknownLocation, got %v", err)
+	}
+
+	// an incremental aggregation interpolates C2 again with the new sales
+	db.Create(&Transaction{Date: time.Date(2021, 10, 15, 0, 0, 0, 0, time.UTC), CityCode: "C1", DepartmentCode: "D1",
+		Price: 5000 * 50, Area: 50, PricePSQM: 5000, Lat: 0.525, Long: 0.525})
+	if err := AggregateDataSince(dsn, time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("aggregate since: %v", err)
+	}
+	aggs = nil
+	db.Where("code = ?", "C2").Find(&aggs)
+	if len(aggs) != 1 || !aggs[0].Interpolated || aggs[0].AvgPrice < 2900 {
+		t.Fatalf("expected C2 interpolated again, got %+v", aggs)
+	}
+
+	// an interpolated year is not the reference of the next measured one
+	db.Create(&Transaction{Date: time.Date(2022, 3, 15, 0, 0, 0, 0, time.UTC), CityCode: "C2", DepartmentCode: "D1",
+		Price: 3000 * 50, Area: 50, PricePSQM: 3000, Lat: 0.525, Long: 0.525})
+	if err := AggregateDataSince(dsn, time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("aggregate since: %v", err)
+	}
+	aggs = nil
+	db.Where("code = ?", "C2").Order("year").Find(&aggs)
+	if len(aggs) != 2 || !aggs[0].Interpolated || aggs[1].Interpolated || aggs[1].Increase != nil || aggs[1].Cagr != nil {
+		t.Fatalf("expected no C2 growth from the interpolated year, got %+v", aggs)
+	}
+}
+
+func TestSmoothing(t *testing.T) {
+	values := make([]float64, 48)
+	for i := range values {
+		values[i] = 2000 + 10*float64(i) + 100*math.Sin(2*math.Pi*float64(i)/12)
+	}
+
+	fit := fitSmoothing(values[:36], FORECAST_SEASON)
+	if fit.method() != FORECAST_HOLT_WINTERS {
+		t.Fatalf("expected Holt-Winters, got %v", fit.method())
+	}
+	predicted, lower, upper := fit.predict(12)
+	for i, p := range predicted {
+		if math.Abs(p-values[36+i])/values[36+i] > 0.02 || lower[i] > p || upper[i] < p {
+			t.Fatalf("unexpected forecast %v: %v [%v - %v], expected %v", i, p, lower[i], upper[i], values[36+i])
+		}
+	}
+
+	if mape, _, _ := backtestSmoothing(values, FORECAST_SEASON, 12); mape > 0.02 {
+		t.Fatalf("unexpected backtest MAPE %v", mape)
+	}
+	if fit := fitSmoothing(values[:12], FORECAST_SEASON); fit.method() != FORECAST_HOLT {
+		t.Fatalf("expected Holt on a short series, got %v", fit.method())
+	}
+}
+
+func TestForecasts(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	db.Create(&[]Transaction{
+		{Date: time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC), CityCode: "C1", DepartmentCode: "D1", Price: 90000, Area: 50, PricePSQM: 1800, Lat: 0.5, Long: 0.5},
+		{Date: time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC), CityCode: "C1", DepartmentCode: "D1", Price: 95000, Area: 50, PricePSQM: 1900, Lat: 0.5, Long: 0.5},
+	})
+	AggregateData(dsn)
+
+	if err := ComputeForecasts(dsn, []string{"department", "city"}, GRANULARITY_YEAR); err != nil {
+		t.Fatalf("ComputeForecasts: %v", err)
+	}
+	if err := ComputeForecasts(dsn, []string{"department"}, GRANULARITY_MONTH); err != nil {
+		t.Fatalf("ComputeForecasts: %v", err)
+	}
+
+	info, err := GetForecast(db, "department", "D1", GRANULARITY_YEAR)
+	if err != nil || len(info.Forecasts) != 1 {
+		t.Fatalf("expected 1 forecast, got %+v (%v)", info, err)
+	}
+	if m := info.Model; m.Method != FORECAST_HOLT || m.NbPoint != 4 || m.LastPeriod != "2021" || m.NbBacktest != 0 || m.Trend <= 0 {
+		t.Fatalf("unexpected model %+v", m)
+	}
+	if f := info.Forecasts[0]; f.Period != "2022" || f.Year != 2022 || f.Value <= 2200 || f.Lower > f.Value || f.Upper < f.Value {
+		t.Fatalf("unexpected forecast %+v", f)
+	}
+
+	// months without sales between 2018-06 and 2021-06 are carried forward
+	info, err = GetForecast(db, "department", "D1", GRANULARITY_MONTH)
+	if err != nil || len(info.Forecasts) != 12 || info.Forecasts[0].Period != "2021-07" || info.Forecasts[11].Period != "2022-06" {
+		t.Fatalf("expected 12 monthly forecasts, got %+v (%v)", info, err)
+	}
+	if m := info.Model; m.Method != FORECAST_HOLT_WINTERS || m.NbPoint != 37 || m.NbBacktest != 12 {
+		t.Fatalf("unexpected monthly model %+v", m)
+	}
+
+	if _, err := GetForecast(db, "city", "C1", GRANULARITY_MONTH); err != ErrNoForecast {
+		t.Fatalf("expected ErrNoForecast, got %v", err)
+	}
+	if _, err := GetForecast(db, "country", "D1", GRANULARITY_YEAR); err != ErrUnknownLevel {
+		t.Fatalf("expected ErrUnknownLevel, got %v", err)
+	}
+	if err := ComputeForecasts(dsn, []string{"department"}, GRANULARITY_QUARTER); err != ErrUnknownGranularity {
+		t.Fatalf("expected ErrUnknownGranularity, got %v", err)
+	}
+}
+
+func TestHotSpots(t *testing.T) {
+	// 3x3 grid of square communes A..I, A at the top left
+	cities := make([]City, 0, 9)
+	for i, code := range []string{"A", "B", "C", "D", "E", "F", "G", "H", "I"} {
+		x, y := float64(i%3), float64(2-i/3)
+		contour := fmt.Sprintf(`{"type":"Polygon","coordinates":[[[%v,%v],[%v,%v],[%v,%v],[%v,%v],[%v,%v]]]}`,
+			x, y, x+1, y, x+1, y+1, x, y+1, x, y)
+		cities = append(cities, City{Code: code, Contour: contour})
+	}
+
+	neighbours := cityAdjacency(cities)
+	if len(neighbours["E"]) != 8 || len(neighbours["A"]) != 3 || neighbours["A"][2] != "E" {
+		t.Fatalf("unexpected adjacency %v", neighbours)
+	}
+
+	growths := map[string]float64{"A": 0.3, "B": 0.3, "D": 0.3, "E": 0.1, "C": 0, "F": 0, "G": 0, "H": 0, "I": -0.05}
+	spots := make(map[string]HotSpot)
+	for _, s := range localStatistics(2021, growths, neighbours) {
+		spots[s.Code] = s
+	}
+	if len(spots) != 9 {
+		t.Fatalf("expected 9 spots, got %v", len(spots))
+	}
+	if a := spots["A"]; a.Quadrant != "HH" || a.MoranI <= 0 || a.GiZScore <= spots["E"].GiZScore || a.NbNeighbour != 3 {
+		t.Fatalf("unexpected spot A %+v", a)
+	}
+	if i := spots["I"]; i.Quadrant != "LL" || i.MoranI <= 0 || i.GiZScore >= 0 {
+		t.Fatalf("unexpected spot I %+v", i)
+	}
+
+	for z, class := range map[float64]string{3: HOTSPOT_HOT_99, 2: HOTSPOT_HOT_95, -1.7: HOTSPOT_COLD_90, 1: HOTSPOT_NONE} {
+		if c := hotSpotClass(z); c != class {
+			t.Errorf("class of %v: expected %v, got %v", z, class, c)
+		}
+	}
+}
+
+func TestSegments(t *testing.T) {
+	for value, bucket := range map[int]string{0: "0-59", 59: "0-59", 60: "60-89", 160: "160+", 500: "160+"} {
+		if b := SegmentBucket(SEGMENT_AREA, value); b != bucket {
+			t.Errorf("area %v: expected %v, got %v", value, bucket, b)
+		}
+	}
+	if b := SegmentBucket(SEGMENT_ROOMS, 4); b != "4" {
+		t.Errorf("4 rooms: expected bucket 4, got %v", b)
+	}
+
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	db.Create(&Transaction{Date: time.Date(2021, 9, 15, 0, 0, 0, 0, time.UTC), CityCode: "C1", DepartmentCode: "D1",
+		Price: 300000, Area: 100, NbRoom: 4, FullArea: 500, PricePSQM: 3000, Lat: 0.5, Long: 0.5})
+
+	AggregateData(dsn)
+
+	segments, err := GetSegments(db, "city", "C1", SEGMENT_AREA, "", 2021)
+	if err != nil || len(segments) != 2 {
+		t.Fatalf("expected 2 area segments, got %+v (%v)", segments, err)
+	}
+	if segments[0].Bucket != "0-59" || segments[0].AvgPrice != 2200 || segments[1].Bucket != "90-119" ||
+		segments[1].MedianPricePSQM != 3000 || segments[1].NbTransaction != 1 || segments[1].Name != "City1" {
+		t.Fatalf("unexpected area segments %+v", segments)
+	}
+
+	all, _ := GetSegments(db, "department", "D1", "", "", 0)
+	if len(all) != 3+6 || all[0].Year != 2020 || all[0].Dimension != SEGMENT_AREA || all[len(all)-1].Bucket != "300-799" {
+		t.Fatalf("unexpected department segments %+v", all)
+	}
+
+	if _, err := GetSegments(db, "city", "C1", "floor", "", 0); err != ErrUnknownSegment {
+		t.Fatalf("expected ErrUnknownSegment, got %v", err)
+	}
+}
+
+func TestGeohash(t *testing.T) {
+	if hash := GeohashEncode(57.64911, 10.40744, 11); hash != "u4pruydqqvj" {
+		t.Fatalf("unexpected geohash %v", hash)
+	}
+
+	b, ok := GeohashBounds("u4pruydqqvj")
+	if !ok || !b.Contains(57.64911, 10.40744) || b.MaxLat-b.MinLat > 0.001 {
+		t.Fatalf("unexpected bounds %+v", b)
+	}
+	if _, ok := GeohashBounds("u4a"); ok {
+		t.Fatalf("expected invalid geohash")
+	}
+}
+
+func TestAggregateGrid(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	db.Create(&Transaction{Date: time.Date(2021, 9, 15, 0, 0, 0, 0, time.UTC), CityCode: "C1", DepartmentCode: "D1",
+		Price: 120000, Area: 50, PricePSQM: 2400, Lat: 0.5, Long: 0.5})
+
+	AggregateData(dsn)
+
+	var cells []GridCellAgg
+	db.Where("cell = ?", GeohashEncode(0.5, 0.5, 4)).Order("year").Find(&cells)
+	if len(cells) != 2 {
+		t.Fatalf("expected 2 years for the cell, got %+v", cells)
+	}
+	if cells[0].NbTransaction != 1 || cells[0].MedianPricePSQM != 2000 || cells[0].Increase != nil {
+		t.Fatalf("unexpected 2020 cell %+v", cells[0])
+	}
+	if cells[1].NbTransaction != 1 || cells[1].MedianPricePSQM != 2400 || cells[1].Increase == nil ||
+		math.Abs(*cells[1].Increase-0.2) > 1e-9 {
+		t.Fatalf("unexpected 2021 cell %+v", cells[1])
+	}
+
+	fc, err := GetGridCells(db, 4, Bounds{MinLat: 0, MaxLat: 1, MinLong: 0, MaxLong: 1}, 0)
+	if err != nil || len(fc.Features) != 2 {
+		t.Fatalf("expected 2 cells in 2021, got %v (%v)", fc, err)
+	}
+	for _, f := range fc.Features {
+		if f.Geometry.Type != "Polygon" || f.Properties["year"] != 2021 {
+			t.Fatalf("unexpected feature %+v", f)
+		}
+	}
+
+	fc, _ = GetGridCells(db, 7, Bounds{MinLat: 10, MaxLat: 11, MinLong: 10, MaxLong: 11}, 2021)
+	if len(fc.Features) != 0 {
+		t.Fatalf("expected no cell outside the bounds, got %v", len(fc.Features))
+	}
+	if _, err := GetGridCells(db, 12, Bounds{}, 0); err != ErrUnknownResolution {
+		t.Fatalf("expected ErrUnknownResolution, got %v", err)
+	}
+}
+
+func TestHedonicIndex(t *testing.T) {
+	db, dsn := openTestDB(t)
+
+	// prices grow 5% a year; the sales move towards the expensive commune A
+	premium := map[string]float64{"A": 1.2, "B": 1}
+	growth := map[int]float64{2020: 1, 2021: 1.05, 2022: 1.1}
+	mix := map[int]map[string]int{2020: {"A": 5, "B": 10}, 2021: {"A": 8, "B": 8}, 2022: {"A": 10, "B": 5}}
+	for year, counts := range mix {
+		for city, n := range counts {
+			for i := 0; i < n; i++ {
+				area := 60 + 10*i
+				price := 2000 * float64(area) * premium[city] * growth[year]
+				db.Create(&Transaction{Date: time.Date(year, 3, 1, 0, 0, 0, 0, time.UTC), CityCode: city, DepartmentCode: "D1",
+					Price: price, Area: area, FullArea: 100 * (i % 3), NbRoom: 3 + i%4, PricePSQM: price / float64(area)})
+			}
+		}
+	}
+
+	// flats only in D2: the constant land area keeps the regression solvable
+	for year, g := range growth {
+		for i := 0; i < 8; i++ {
+			area := 40 + 5*i
+			price := 3000 * float64(area) * g
+			db.Create(&Transaction{Date: time.Date(year, 3, 1, 0, 0, 0, 0, time.UTC), CityCode: "F", DepartmentCode: "D2",
+				Price: price, Area: area, NbRoom: 1 + i%3, PricePSQM: price / float64(area)})
+		}
+	}
+
+	ComputeHedonicIndex(dsn)
+
+	if flats := GetHedonicIndex(db, "D2"); len(flats) != 3 || math.Abs(flats[2].Index-110) > 0.1 {
+		t.Fatalf("unexpected flat index %+v", flats)
+	}
+
+	indices := GetHedonicIndex(db, "D1")
+	if len(indices) != 3 {
+		t.Fatalf("expected 3 years, got %+v", indices)
+	}
+	for _, idx := range indices {
+		if math.Abs(idx.Index-100*growth[idx.Year]) > 0.1 || idx.R2 < 0.99 {
+			t.Fatalf("unexpected hedonic index %+v", idx)
+		}
+	}
+	// the raw index is biased by the mix of communes
+	if indices[2].RawIndex < 112 || indices[2].NbTransaction != 15 {
+		t.Fatalf("unexpected raw index %+v", indices[2])
+	}
+
+	if len(GetHedonicIndex(db, "D3")) != 0 {
+		t.Fatalf("expected no index for an unknown department")
+	}
+}
+
+func TestRepeatSalesIndex(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	// houses resold with prices growing 10% a year
+	growth := map[int]float64{2018: 1, 2019: 1.1, 2020: 1.21, 2021: 1.331}
+	sale := func(house int, year int, area int, factor float64) {
+		db.Create(&Transaction{Date: time.Date(year, 4, 1, 0, 0, 0, 0, time.UTC), CityCode: "C1", DepartmentCode: "D1",
+			Address: fmt.Sprintf("%d rue C", house), Cadastre: fmt.Sprintf("C1AB%04d", house),
+			Price: 150000 * growth[year] * factor, Area: area, PricePSQM: 150000 * growth[year] * factor / float64(area)})
+	}
+	for house := 1; house <= 12; house++ {
+		first := 2018 + house%3
+		factor := 1 + float64(house)/10
+		sale(house, first, 80, factor)
+		sale(house, first+1, 82, factor)
+	}
+	// an extension doubling the area is not a resale pair
+	sale(50, 2018, 80, 1)
+	sale(50, 2021, 160, 3)
+
+	ComputeRepeatSalesIndex(dsn)
+
+	indices, err := GetRepeatSalesIndex(db, "department", "D1")
+	if err != nil || len(indices) != 4 {
+		t.Fatalf("expected 4 years, got %+v (%v)", indices, err)
+	}
+	for _, idx := range indices {
+		if math.Abs(idx.Index-100*growth[idx.Year]) > 0.1 {
+			t.Fatalf("unexpected repeat-sales index %+v", idx)
+		}
+	}
+	if indices[0].NbPair != 0 || indices[1].NbPair != 4 {
+		t.Fatalf("unexpected pair counts %+v", indices)
+	}
+
+	regions, _ := GetRepeatSalesIndex(db, "region", "R1")
+	if len(regions) != 4 {
+		t.Fatalf("expected the region index, got %+v", regions)
+	}
+
+	if _, err := GetRepeatSalesIndex(db, "city", ""); err != ErrNoRepeatSalesLevel {
+		t.Fatalf("expected ErrNoRepeatSalesLevel, got %v", err)
+	}
+}
+
+func TestValuationModel(t *testing.T) {
+	db, dsn := openTestDB(t)
+	seedMinimal(db, t)
+
+	for i := 0; i < 40; i++ {
+		area := 60 + 5*(i%10)
+		noise := 1 + 0.05*float64(i%3-1)
+		price := 2200 * float64(area) * noise
+		db.Create(&Transaction{Date: time.Date(2021, time.Month(1+i%12), 1, 0, 0, 0, 0, time.UTC), CityCode: "C1", DepartmentCode: "D1",
+			Price: price, Area: area, FullArea: 300, NbRoom: 3 + i%3, PricePSQM: price / float64(area), Lat: 0.5, Long: 0.5})
+	}
+
+	TrainValuationModels(dsn)
+
+	estimate, err := EstimatePrice(db, ValuationInput{Lat: 0.55, Long: 0.45, Area: 80, LandArea: 300, NbRoom: 4})
+	if err != nil {
+		t.Fatalf("EstimatePrice err: %v", err)
+	}
+	if estimate.CityCode != "C1" || estimate.DepartmentCode != "D1" || estimate.Model == nil || estimate.Model.Year != 2021 {
+		t.Fatalf("unexpected estimate location or model %+v", estimate)
+	}
+	if math.Abs(estimate.PricePSQM-2200) > 100 || estimate.PriceLow >= estimate.Price || estimate.PriceHigh <= estimate.Price {
+		t.Fatalf("unexpected estimate %+v", estimate)
+	}
+	if math.Abs(estimate.Price-80*estimate.PricePSQM) > 0.01 || estimate.PredictionLevel != AVM_PREDICTION_LEVEL {
+		t.Fatalf("inconsistent estimate %+v", estimate)
+	}
+
+	if e, err := EstimatePrice(db, ValuationInput{CityCode: "C1", Area: 80, LandArea: 300, NbRoom: 4}); err != nil || math.Abs(e.Price-estimate.Price) > 0.01 {
+		t.Fatalf("expected the same estimate by commune code, got %+v (%v)", e, err)
+	}
+	if _, err := EstimatePrice(db, ValuationInput{CityCode: "C1"}); err != ErrBadValuationInput {
+		t.Fatalf("expected ErrBadValuationInput, got %v", err)
+	}
+	if _, err := EstimatePrice(db, ValuationInput{Lat: 45, Long: 5, Area: 80}); err != ErrUnknownLocation {
+		t.Fatalf("expected ErrUnknownLocation, got %v", err)
+	}
+
+	db.Where("1 = 1").Delete(&ValuationModel{})
+	if _, err := EstimatePrice(db, ValuationInput{CityCode: "C1", Area: 80}); err != ErrNoValuationModel {
+		t.Fatalf("expected ErrNoValuationModel, got %v", err)
+	}
+}
+
+func TestGetComparables(t *testing.T) {
+	db, _ := openTestDB(t)
+	seedMinimal(db, t)
+
+	sale := func(lat float64, date time.Time, area int, psqm float64, outlier bool) {
+		db.Create(&Transaction{Date: date, CityCode: "C1", DepartmentCode: "D1", Price: psqm * float64(area), Area: area,
+			PricePSQM: psqm, Lat: lat, Long: 0.5, Outlier: outlier})
+	}
+	sale(0.505, time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC), 52, 2100, false)
+	sale(0.51, time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC), 120, 1500, false)
+	sale(0.5, time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC), 50, 1000, false)
+	sale(0.5, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), 50, 90000, true)
+
+	db.AutoMigrate(&HedonicIndex{})
+	db.Create(&[]HedonicIndex{{DepartmentCode: "D1", Year: 2020, Index: 100}, {DepartmentCode: "D1", Year: 2021, Index: 110}})
+
+	info, err := GetComparables(db, ComparableQuery{Lat: 0.5, Long: 0.5, Area: 50, K: 2})
+	if err != nil {
+		t.Fatalf("GetComparables err: %v", err)
+	}
+	if info.NbCandidate != 3 || len(info.Comparables) != 2 {
+		t.Fatalf("expected 2 of 3 candidates, got %+v", info)
+	}
+
+	first, second := info.Comparables[0], info.Comparables[1]
+	if first.Transaction.Area != 50 || first.Score.Distance != 1 || first.Score.Area != 1 || first.AdjustedPricePSQM != 2200 {
+		t.Fatalf("unexpected first comparable %+v", first)
+	}
+	if second.Transaction.Area != 52 || math.Abs(second.Distance-556) > 5 || second.Score.Total >= first.Score.Total {
+		t.Fatalf("unexpected second comparable %+v", second)
+	}
+	expected := (first.Score.Total*2200 + second.Score.Total*2100) / (first.Score.Total + second.Score.Total)
+	if math.Abs(info.AdjustedPricePSQM-expected) > 0.01 || math.Abs(info.AdjustedPrice-50*expected) > 0.01 {
+		t.Fatalf("unexpected adjusted price %+v", info)
+	}
+
+	if _, err := GetComparables(db, ComparableQuery{Lat: 0.5, Long: 0.5}); err != ErrBadComparableQuery {
+		t.Fatalf("expected ErrBadComparableQuery, got %v", err)
 	}
 }
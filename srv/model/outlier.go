@@ -0,0 +1,306 @@
+// Package model provides data models and helpers for the immotep application.
+// This file flags outlier transactions (symbolic prices, tiny areas, bulk
+// sales of several lots, prices far from the commune) so that they are
+// excluded from the computed statistics.
+package model
+
+import (
+	"database/sql"
+	"math"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Reasons of an outlier flag.
+const OUTLIER_PRICE = "price"
+const OUTLIER_AREA = "area"
+const OUTLIER_PSQM = "psqm"
+const OUTLIER_BULK = "bulk"
+const OUTLIER_ZSCORE = "zscore"
+
+// Hard bounds of a plausible house sale.
+const OUTLIER_MIN_PRICE = 1000.0
+const OUTLIER_MIN_AREA = 9
+const OUTLIER_MIN_PSQM = 100.0
+const OUTLIER_MAX_PSQM = 30000.0
+
+// OUTLIER_MAX_ZSCORE is the max absolute robust z-score of the price per m²
+// in the commune and year (Iglewicz and Hoaglin recommend 3.5).
+const OUTLIER_MAX_ZSCORE = 3.5
+
+// OUTLIER_MIN_GROUP is the min number of sales of a commune and year needed
+// to compute robust z-scores.
+const OUTLIER_MIN_GROUP = 5
+
+// IncludeOutliers keeps the transactions flagged as outliers in the computed
+// statistics and aggregates.
+var IncludeOutliers = false
+
+// withoutOutliers is a query scope excluding the flagged transactions unless
+// IncludeOutliers is set.
+func withoutOutliers(db *gorm.DB) *gorm.DB {
+	if IncludeOutliers {
+		return db
+	}
+
+	return db.Where("transactions.outlier = ?", false)
+}
+
+// OutlierCount holds the number of flagged transactions and their average
+// price per m² for one reason.
+type OutlierCount struct {
+	Reason       string  `json:"reason"`
+	Count        int64   `json:"count"`
+	AvgPricePSQM float64 `json:"avgPricePSQM"`
+}
+
+// OutlierReport summarizes the transactions excluded from the statistics.
+type OutlierReport struct {
+	Department string         `json:"department,omitempty"`
+	Total      int64          `json:"total"`
+	Excluded   int64          `json:"excluded"`
+	Reasons    []OutlierCount `json:"reasons"`
+}
+
+// outlierRow holds the columns of a transaction needed to flag it.
+type outlierRow struct {
+	id     uint64
+	date   time.Time
+	price  float64
+	area   int
+	psqm   float64
+	reason string
+}
+
+// hardBoundReason returns the reason why a sale is out of the hard bounds
+// or an empty string.
+func hardBoundReason(price float64, area int, psqm float64) string {
+	switch {
+	case price < OUTLIER_MIN_PRICE:
+		return OUTLIER_PRICE
+	case area < OUTLIER_MIN_AREA:
+		return OUTLIER_AREA
+	case psqm < OUTLIER_MIN_PSQM || psqm > OUTLIER_MAX_PSQM:
+		return OUTLIER_PSQM
+	}
+
+	return ""
+}
+
+// robustZScores returns the robust z-scores 0.6745 * (x - median) / MAD of
+// values, or nil when the median absolute deviation is 0.
+func robustZScores(values []float64) []float64 {
+	m := median(values)
+
+	deviations := make([]float64, len(values))
+	for i, v := range values {
+		deviations[i] = math.Abs(v - m)
+	}
+	mad := median(deviations)
+	if mad == 0 {
+		return nil
+	}
+
+	scores := make([]float64, len(values))
+	for i, v := range values {
+		scores[i] = 0.6745 * (v - m) / mad
+	}
+
+	return scores
+}
+
+/*
+flagCity sets the outlier reason of the sales of one commune.
+
+Behavior:
+  - Hard bounds first (symbolic price, area, price per m²).
+  - Sales sharing date and price are bulk sales of several lots: the price
+    is the total of the lots, so every row is flagged.
+  - The remaining sales are grouped by year and flagged when the absolute
+    robust z-score of their price per m² exceeds OUTLIER_MAX_ZSCORE.
+*/
+func flagCity(trans []outlierRow) {
+	type saleKey struct {
+		date  time.Time
+		price float64
+	}
+	sales := make(map[saleKey]int)
+	for _, t := range trans {
+		sales[saleKey{t.date, t.price}]++
+	}
+
+	years := make(map[int][]int)
+	for i := range trans {
+		t := &trans[i]
+		t.reason = hardBoundReason(t.price, t.area, t.psqm)
+		if t.reason == "" && sales[saleKey{t.date, t.price}] > 1 {
+			t.reason = OUTLIER_BULK
+		}
+		if t.reason == "" {
+			years[t.date.Year()] = append(years[t.date.Year()], i)
+		}
+	}
+
+	for _, idx := range years {
+		if len(idx) < OUTLIER_MIN_GROUP {
+			continue
+		}
+
+		psqms := make([]float64, len(idx))
+		for j, i := range idx {
+			psqms[j] = trans[i].psqm
+		}
+
+		for j, z := range robustZScores(psqms) {
+			if math.Abs(z) > OUTLIER_MAX_ZSCORE {
+				trans[idx[j]].reason = OUTLIER_ZSCORE
+			}
+		}
+	}
+}
+
+/*
+FlagOutliers stores the outlier flag and reason of every transaction.
+
+The transactions are read ordered by commune and flagged by flagCity. All
+the flags are read before updating: SQLite cannot write while rows are open.
+Previous flags are reset, so the step can be run again after loading new
+data.
+
+Returns the number of flagged transactions.
+*/
+func FlagOutliers(db *gorm.DB) int {
+	rows, err := db.Select("tr_id, date, city_code, price, area, price_psqm").
+		Table("transactions").
+		Order("city_code").
+		Rows()
+	if err != nil {
+		log.Errorf("FlagOutliers err: %v\n", err)
+		return 0
+	}
+
+	var tr2update = make([]map[string]interface{}, 0, 1000)
+
+	flush := func(trans []outlierRow) {
+		flagCity(trans)
+		for _, t := range trans {
+			if t.reason != "" {
+				tr2update = append(tr2update, map[string]interface{}{"tr_id": t.id, "outlier": true, "outlier_reason": t.reason})
+			}
+		}
+	}
+
+	city := ""
+	trans := make([]outlierRow, 0, 1000)
+	for rows.Next() {
+		var t outlierRow
+		var code sql.NullString
+
+		rows.Scan(&t.id, &t.date, &code, &t.price, &t.area, &t.psqm)
+		if code.String != city {
+			flush(trans)
+			city = code.String
+			trans = trans[:0]
+		}
+		trans = append(trans, t)
+	}
+	flush(trans)
+	rows.Close()
+
+	updresult := db.Model(&Transaction{}).Where("outlier = ?", true).
+		Updates(map[string]interface{}{"outlier": false, "outlier_reason": ""})
+	if updresult.Error != nil {
+		log.Errorf("Error FlagOutliers reset: %v\n", updresult.Error)
+		return 0
+	}
+
+	if len(tr2update) > 0 {
+		updresult = db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "tr_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"outlier", "outlier_reason"}),
+		}).Table("transactions").CreateInBatches(&tr2update, 500)
+
+		if updresult.Error != nil {
+			log.Errorf("Error FlagOutliers update: %v\n", updresult.Error)
+			return 0
+		}
+	}
+
+	log.Infof("%v outlier transactions flagged.\n", len(tr2update))
+
+	return len(tr2update)
+}
+
+// GetOutlierReport returns the number of flagged transactions by reason,
+// for one department or for all of them when dep is empty.
+func GetOutlierReport(db *gorm.DB, dep string) *OutlierReport {
+	if db == nil {
+		return nil
+	}
+
+	report := OutlierReport{Department: dep, Reasons: make([]OutlierCount, 0, 5)}
+
+	query := db.Model(&Transaction{})
+	if dep != "" {
+		query = query.Where("department_code = ?", dep)
+	}
+	result := query.Count(&report.Total)
+	if result.Error != nil {
+		log.Errorf("GetOutlierReport err: %v\n", result.Error)
+		return nil
+	}
+
+	query = db.Select("outlier_reason as reason, COUNT(*) as count, AVG(price_psqm) as avg_price_psqm").
+		Table("transactions").
+		Where("outlier = ?", true)
+	if dep != "" {
+		query = query.Where("department_code = ?", dep)
+	}
+	result = query.Group("outlier_reason").Order("count DESC").Scan(&report.Reasons)
+	if result.Error != nil {
+		log.Errorf("GetOutlierReport err: %v\n", result.Error)
+		return nil
+	}
+
+	for _, r := range report.Reasons {
+		report.Excluded += r.Count
+	}
+
+	return &report
+}
+
+// GetOutliers returns the most recent flagged transactions of a department
+// (all when empty), optionally for one reason (limit default 100, bounded
+// to 500).
+func GetOutliers(db *gorm.DB, dep string, reason string, limit int) []TransactionPOI {
+	if db == nil {
+		return nil
+	}
+
+	if limit <= 0 {
+		limit = 100
+	} else if limit > 500 {
+		limit = 500
+	}
+
+	query := db.Where("outlier = ?", true)
+	if dep != "" {
+		query = query.Where("department_code = ?", dep)
+	}
+	if reason != "" {
+		query = query.Where("outlier_reason = ?", reason)
+	}
+
+	var pois []TransactionPOI
+
+	result := query.Order("date DESC").Limit(limit).Find(&pois)
+	if result.Error != nil {
+		log.Errorf("GetOutliers err: %v\n", result.Error)
+		return nil
+	}
+
+	return pois
+}
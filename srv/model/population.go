@@ -0,0 +1,243 @@
+// Package model provides data models and helpers for the immotep application.
+// This file handles the population time series of cities (INSEE historical
+// population tables) and the indicators derived from it: transactions per
+// 1,000 inhabitants, population growth and the correlation between price
+// growth and population growth.
+package model
+
+import (
+	"math"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// CityPopulation stores the population of a city for one census year.
+// Primary key is (Code, Year).
+type CityPopulation struct {
+	Code       string `gorm:"primaryKey" json:"code"`
+	Year       int    `gorm:"primaryKey" json:"year"`
+	Population int    `json:"population"`
+}
+
+// CityIndicator holds the population indicators of a city for one year, its
+// volume of sales and whether its average price is interpolated (see
+// interpolateCities) or statistically weak (see weakAverage).
+type CityIndicator struct {
+	Population       int      `json:"population"`
+	NbTransaction    int      `json:"nbtransaction"`
+	SalesPer1000     float64  `json:"salesPer1000"`
+	PopulationGrowth float64  `json:"populationGrowth"`
+	Increase         *float64 `json:"increase"`
+	Interpolated     bool     `json:"interpolated"`
+	Uncertainty      float64  `json:"uncertainty"`
+	Volume           float64  `json:"volume"`
+	Weak             bool     `json:"weak"`
+}
+
+// populationSeries is the sorted list of census points of a city.
+type populationSeries []CityPopulation
+
+// at returns the population for year: census values are interpolated
+// linearly between census years and the nearest census is used outside the
+// covered range.
+func (s populationSeries) at(year int) float64 {
+	if len(s) == 0 {
+		return 0
+	}
+	if year <= s[0].Year {
+		return float64(s[0].Population)
+	}
+
+	for i := 1; i < len(s); i++ {
+		if year <= s[i].Year {
+			prev, next := s[i-1], s[i]
+			ratio := float64(year-prev.Year) / float64(next.Year-prev.Year)
+			return float64(prev.Population) + ratio*float64(next.Population-prev.Population)
+		}
+	}
+
+	return float64(s[len(s)-1].Population)
+}
+
+// loadPopulationSeries returns the census points of all cities keyed by city
+// code. Cities without census points fall back on cities.population.
+func loadPopulationSeries(db *gorm.DB) map[string]populationSeries {
+	series := make(map[string]populationSeries)
+
+	var pops []CityPopulation
+	result := db.Order("code, year").Find(&pops)
+	if result.Error != nil {
+		log.Errorf("loadPopulationSeries err: %v\n", result.Error)
+	}
+	for _, p := range pops {
+		series[p.Code] = append(series[p.Code], p)
+	}
+
+	var cities []City
+	db.Select("code, population").Where("population > 0").Find(&cities)
+	for _, c := range cities {
+		if _, ok := series[c.Code]; !ok {
+			series[c.Code] = populationSeries{{Code: c.Code, Population: c.Population}}
+		}
+	}
+
+	for _, s := range series {
+		sort.Slice(s, func(i, j int) bool { return s[i].Year < s[j].Year })
+	}
+
+	return series
+}
+
+/*
+aggregateCityPopulation completes city_yearly_aggs with population
+indicators and sets cities.pop_price_correlation.
+
+Behavior:
+  - Counts transactions per city and year.
+  - Sets population (interpolated from census years), transactions per 1,000
+    inhabitants and population growth compared to the previous year.
+  - Computes, per city, the Pearson correlation between the yearly price
+    increase and the population growth (0 when fewer than 3 years).
+*/
+func aggregateCityPopulation(db *gorm.DB) error {
+	series := loadPopulationSeries(db)
+	if len(series) == 0 {
+		log.Infof("No population data for cities.\n")
+		return nil
+	}
+
+	rows, err := db.Select(yearExtract(db) + " as year, city_code, COUNT(*)").
+		Table("transactions").
+		Scopes(withoutOutliers).
+		Group("year").Group("city_code").
+		Rows()
+	if err != nil {
+		log.Errorf("aggregateCityPopulation err: %v\n", err)
+		return err
+	}
+
+	counts := make(map[string]map[int]int)
+	for rows.Next() {
+		var year, count int
+		var code string
+
+		rows.Scan(&year, &code, &count)
+		if counts[code] == nil {
+			counts[code] = make(map[int]int)
+		}
+		counts[code][year] = count
+	}
+	rows.Close()
+
+	var aggs []CityYearlyAgg
+	result := db.Order("code, year").Find(&aggs)
+	if result.Error != nil {
+		log.Errorf("aggregateCityPopulation err: %v\n", result.Error)
+		return result.Error
+	}
+
+	correlations := make(map[string]float64)
+	var priceGrowth, popGrowth []float64
+	prevCode := ""
+	prevYear := 0
+
+	flush := func(code string) {
+		if code != "" {
+			correlations[code] = pearson(priceGrowth, popGrowth)
+		}
+		priceGrowth, popGrowth = nil, nil
+	}
+
+	for _, a := range aggs {
+		if a.Code != prevCode {
+			flush(prevCode)
+		}
+
+		s := series[a.Code]
+		pop := s.at(a.Year)
+		count := counts[a.Code][a.Year]
+
+		upd := map[string]interface{}{"population": int(math.Round(pop)), "nb_transaction": count,
+			"sales_per1000": 0.0, "population_growth": 0.0}
+		if pop > 0 {
+			upd["sales_per1000"] = float64(count) * 1000 / pop
+			if prev := s.at(a.Year - 1); prev > 0 {
+				upd["population_growth"] = (pop - prev) / prev
+			}
+		}
+
+		// first year of a city has no price increase
+		if a.Code == prevCode && a.Year == prevYear+1 && a.Increase != nil {
+			priceGrowth = append(priceGrowth, *a.Increase)
+			popGrowth = append(popGrowth, upd["population_growth"].(float64))
+		}
+		prevCode = a.Code
+		prevYear = a.Year
+
+		updresult := db.Model(&CityYearlyAgg{}).Where("code = ? AND year = ?", a.Code, a.Year).Updates(upd)
+		if updresult.Error != nil {
+			log.Errorf("Error aggregateCityPopulation update: %v\n", updresult.Error)
+			return updresult.Error
+		}
+	}
+	flush(prevCode)
+
+	for code, corr := range correlations {
+		db.Model(&City{}).Where("code = ?", code).Update("pop_price_correlation", corr)
+	}
+
+	return nil
+}
+
+// pearson returns the Pearson correlation coefficient of x and y, or 0 when
+// there are fewer than 3 points or one of the series is constant.
+func pearson(x, y []float64) float64 {
+	n := len(x)
+	if n < 3 || n != len(y) {
+		return 0
+	}
+
+	var mx, my float64
+	for i := 0; i < n; i++ {
+		mx += x[i]
+		my += y[i]
+	}
+	mx /= float64(n)
+	my /= float64(n)
+
+	var sxy, sxx, syy float64
+	for i := 0; i < n; i++ {
+		sxy += (x[i] - mx) * (y[i] - my)
+		sxx += (x[i] - mx) * (x[i] - mx)
+		syy += (y[i] - my) * (y[i] - my)
+	}
+
+	if sxx == 0 || syy == 0 {
+		return 0
+	}
+
+	return sxy / math.Sqrt(sxx*syy)
+}
+
+// getCityIndicators returns a map year -> population indicators for a city.
+func getCityIndicators(db *gorm.DB, code string) map[int]CityIndicator {
+	indicators := make(map[int]CityIndicator)
+
+	var stat []CityYearlyAgg
+
+	result := db.Where("code = ?", code).Find(&stat)
+	if result.Error != nil {
+		log.Errorf("getCityIndicators err: %v\n", result.Error)
+		return indicators
+	}
+
+	for _, s := range stat {
+		indicators[s.Year] = CityIndicator{Population: s.Population, NbTransaction: s.NbTransaction,
+			SalesPer1000: s.SalesPer1000, PopulationGrowth: s.PopulationGrowth, Increase: s.Increase,
+			Interpolated: s.Interpolated, Uncertainty: s.Uncertainty, Volume: s.Volume, Weak: s.Weak}
+	}
+
+	return indicators
+}
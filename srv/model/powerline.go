@@ -0,0 +1,171 @@
+// Package model provides data models and helpers for the immotep application.
+// This file stores high-voltage overhead power lines (RTE open data) and
+// computes price statistics by distance band to the nearest line.
+package model
+
+import (
+	"fmt"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// POWERLINE_SEARCH_RADIUS is the max distance (m) at which a power line is
+// searched around a transaction; farther transactions have no line distance.
+const POWERLINE_SEARCH_RADIUS = 2000.0
+
+// POWERLINE_BANDS are the upper limits (m) of the distance bands used in
+// statistics.
+var POWERLINE_BANDS = []float64{100, 250, 500, 1000, POWERLINE_SEARCH_RADIUS}
+
+// POWERLINE_BAND_FAR is the band of transactions without line within
+// POWERLINE_SEARCH_RADIUS.
+const POWERLINE_BAND_FAR = "far"
+
+// PowerLine stores an overhead power line geometry, its voltage (kV) and the
+// bounding box of the geometry.
+type PowerLine struct {
+	Id      uint64  `gorm:"primaryKey;autoIncrement" json:"id"`
+	Code    string  `json:"code"`
+	Voltage int     `json:"voltage"`
+	Contour string  `json:"contour"`
+	MinLat  float64 `json:"-"`
+	MaxLat  float64 `json:"-"`
+	MinLong float64 `json:"-"`
+	MaxLong float64 `json:"-"`
+}
+
+// PowerLineAgg stores price statistics of a department for a distance band
+// to the nearest power line. Discount is the relative difference between the
+// median price per m² of the band and the one of POWERLINE_BAND_FAR.
+// Primary key is (DepartmentCode, Band).
+type PowerLineAgg struct {
+	DepartmentCode string  `gorm:"primaryKey" json:"dep"`
+	Band           string  `gorm:"primaryKey" json:"band"`
+	NbTransaction  int     `json:"nb_transaction"`
+	AvgPrice       float64 `json:"avg_price"`
+	MedianPrice    float64 `json:"median_price"`
+	Discount       float64 `json:"discount"`
+}
+
+// distanceBand returns the band label of a line distance ("0-100",
+// "100-250"... or POWERLINE_BAND_FAR when distance is nil).
+func distanceBand(distance *float64) string {
+	if distance == nil {
+		return POWERLINE_BAND_FAR
+	}
+
+	lower := 0.0
+	for _, upper := range POWERLINE_BANDS {
+		if *distance < upper {
+			return fmt.Sprintf("%.0f-%.0f", lower, upper)
+		}
+		lower = upper
+	}
+
+	return POWERLINE_BAND_FAR
+}
+
+/*
+aggregatePowerLines computes the price per m² statistics by distance band
+to the nearest power line for each department and stores them in
+power_line_aggs.
+
+Behavior:
+  - Only geocoded transactions are used.
+  - Nothing is stored when no power line is loaded.
+*/
+func aggregatePowerLines(db *gorm.DB) error {
+	var count int64
+	db.Model(&PowerLine{}).Count(&count)
+	if count == 0 {
+		log.Infof("No power line loaded.\n")
+		return nil
+	}
+
+	rows, err := db.Select("department_code, line_distance, price_psqm").
+		Table("transactions").
+		Scopes(withoutOutliers).
+		Where("lat <> 0").
+		Rows()
+	if err != nil {
+		log.Errorf("aggregatePowerLines err: %v\n", err)
+		return err
+	}
+
+	type key struct{ dep, band string }
+	prices := make(map[key][]float64)
+
+	for rows.Next() {
+		var dep string
+		var distance *float64
+		var psqm float64
+
+		rows.Scan(&dep, &distance, &psqm)
+		k := key{dep, distanceBand(distance)}
+		prices[k] = append(prices[k], psqm)
+	}
+	rows.Close()
+
+	aggs := make([]PowerLineAgg, 0, len(prices))
+	for k, values := range prices {
+		agg := PowerLineAgg{DepartmentCode: k.dep, Band: k.band,
+			NbTransaction: len(values), AvgPrice: mean(values), MedianPrice: median(values)}
+
+		if k.band != POWERLINE_BAND_FAR {
+			if far := median(prices[key{k.dep, POWERLINE_BAND_FAR}]); far > 0 {
+				agg.Discount = agg.MedianPrice/far - 1
+			}
+		}
+
+		aggs = append(aggs, agg)
+	}
+
+	result := db.CreateInBatches(&aggs, 200)
+	if result.Error != nil {
+		log.Errorf("Error insert power_line_aggs: %v\n", result.Error)
+		return result.Error
+	}
+
+	return nil
+}
+
+// GetPowerLineStats returns the statistics by distance band, optionally
+// filtered by department (dep != "").
+func GetPowerLineStats(db *gorm.DB, dep string) []PowerLineAgg {
+	if db == nil {
+		return nil
+	}
+
+	stats := make([]PowerLineAgg, 0)
+	if !db.Migrator().HasTable(&PowerLineAgg{}) {
+		return stats
+	}
+
+	query := db.Model(&PowerLineAgg{})
+	if dep != "" {
+		query = query.Where("department_code = ?", dep)
+	}
+
+	result := query.Order("department_code").Find(&stats)
+	if result.Error != nil {
+		log.Errorf("GetPowerLineStats err: %v\n", result.Error)
+		return nil
+	}
+
+	// order bands by distance
+	rank := make(map[string]int)
+	for i := range POWERLINE_BANDS {
+		rank[distanceBand(&POWERLINE_BANDS[i])] = i
+	}
+	rank[POWERLINE_BAND_FAR] = len(POWERLINE_BANDS)
+	sort.SliceStable(stats, func(i, j int) bool {
+		if stats[i].DepartmentCode != stats[j].DepartmentCode {
+			return stats[i].DepartmentCode < stats[j].DepartmentCode
+		}
+		return rank[stats[i].Band] < rank[stats[j].Band]
+	})
+
+	return stats
+}
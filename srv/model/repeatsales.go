@@ -0,0 +1,288 @@
+// Package model provides data models and helpers for the immotep application.
+// This file computes a Case-Shiller style repeat-sales price index per
+// department and region from the houses sold more than once.
+//
+// A house is identified by its commune, cadastral parcel and address. Each
+// two consecutive sales of a house form a pair; the log price ratio of a
+// pair is regressed on year dummies (-1 for the first sale, +1 for the
+// second) with the three-stage weighting of Case and Shiller (pairs with a
+// long holding period are noisier).
+package model
+
+import (
+	"errors"
+	"math"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// REPEAT_SALES_MAX_AREA_CHANGE is the max relative change of the area
+// between two sales of a house; beyond it the house was substantially
+// modified (extension, split) and the pair is ignored.
+const REPEAT_SALES_MAX_AREA_CHANGE = 0.1
+
+// REPEAT_SALES_MIN_PAIRS is the min number of pairs needed to compute the
+// index of a department or region.
+const REPEAT_SALES_MIN_PAIRS = 10
+
+// REPEAT_SALES_RIDGE is the small ridge penalty keeping the regression
+// solvable when a year has almost no pairs.
+const REPEAT_SALES_RIDGE = 1e-6
+
+// ErrNoRepeatSalesLevel is returned for levels without repeat-sales index.
+var ErrNoRepeatSalesLevel = errors.New("repeat-sales index is computed for departments and regions only")
+
+// RepeatSalesIndex stores the yearly repeat-sales index of a department or
+// region (first year = 100). NbPair is the number of pairs whose second
+// sale happened during the year. Primary key is (Level, Code, Year).
+type RepeatSalesIndex struct {
+	Level  string  `gorm:"primaryKey" json:"level"`
+	Code   string  `gorm:"primaryKey" json:"code"`
+	Year   int     `gorm:"primaryKey" json:"year"`
+	Index  float64 `gorm:"column:rs_index" json:"index"`
+	NbPair int     `json:"nb_pair"`
+}
+
+// salePair holds two consecutive sales of the same house.
+type salePair struct {
+	dep    string
+	region string
+	year1  int
+	year2  int
+	ratio  float64 // log(price2 / price1)
+}
+
+// repeatSalesLevels lists the levels of the repeat-sales index.
+var repeatSalesLevels = []string{"department", "region"}
+
+/*
+ComputeRepeatSalesIndex finds the resale pairs, fits the index of every
+department and region and replaces the repeat_sales_indices table.
+
+Behavior:
+  - Outliers are excluded unless IncludeOutliers is set.
+  - Pairs within the same year or with an area change beyond
+    REPEAT_SALES_MAX_AREA_CHANGE are ignored.
+*/
+func ComputeRepeatSalesIndex(dsn string) {
+	db := ConnectToDB(dsn)
+	db.AutoMigrate(&RepeatSalesIndex{})
+
+	pairs := findSalePairs(db)
+	log.Infof("%v resale pairs found.\n", len(pairs))
+
+	groups := map[string]map[string][]salePair{"department": {}, "region": {}}
+	for _, p := range pairs {
+		groups["department"][p.dep] = append(groups["department"][p.dep], p)
+		if p.region != "" {
+			groups["region"][p.region] = append(groups["region"][p.region], p)
+		}
+	}
+
+	indices := make([]RepeatSalesIndex, 0, 1000)
+	for _, level := range repeatSalesLevels {
+		for code, ps := range groups[level] {
+			indices = append(indices, fitRepeatSalesIndex(level, code, ps)...)
+		}
+	}
+
+	db.Where("1 = 1").Delete(&RepeatSalesIndex{})
+	if len(indices) > 0 {
+		if result := db.CreateInBatches(&indices, 500); result.Error != nil {
+			log.Errorf("Error ComputeRepeatSalesIndex insert: %v\n", result.Error)
+			return
+		}
+	}
+
+	log.Infof("Repeat-sales index computed: %v rows.\n", len(indices))
+}
+
+// findSalePairs reads the sales ordered by house and date and returns the
+// pairs of consecutive sales of the same house.
+func findSalePairs(db *gorm.DB) []salePair {
+	rows, err := db.Select(yearExtract(db) + " as year, transactions.city_code, transactions.cadastre, transactions.address, transactions.price, transactions.area, transactions.department_code, cities.code_region").
+		Table("transactions").
+		Joins("LEFT JOIN cities ON cities.code = transactions.city_code").
+		Scopes(withoutOutliers).
+		Where("transactions.cadastre <> '' AND transactions.price > 0 AND transactions.area > 0").
+		Order("transactions.city_code").Order("transactions.cadastre").Order("transactions.address").Order("transactions.date").
+		Rows()
+	if err != nil {
+		log.Errorf("findSalePairs err: %v\n", err)
+		return nil
+	}
+	defer rows.Close()
+
+	type sale struct {
+		year                 int
+		city, cadastre, addr string
+		price                float64
+		area                 int
+		dep                  string
+		region               string
+	}
+
+	pairs := make([]salePair, 0, 1000)
+	var prev *sale
+	for rows.Next() {
+		var s sale
+		var region *string
+
+		rows.Scan(&s.year, &s.city, &s.cadastre, &s.addr, &s.price, &s.area, &s.dep, &region)
+		if region != nil {
+			s.region = *region
+		}
+
+		if prev != nil && prev.city == s.city && prev.cadastre == s.cadastre && prev.addr == s.addr &&
+			s.year > prev.year && math.Abs(float64(s.area-prev.area))/float64(prev.area) <= REPEAT_SALES_MAX_AREA_CHANGE {
+			pairs = append(pairs, salePair{dep: s.dep, region: s.region, year1: prev.year, year2: s.year,
+				ratio: math.Log(s.price / prev.price)})
+		}
+		prev = &s
+	}
+
+	return pairs
+}
+
+/*
+fitRepeatSalesIndex estimates the yearly index of one department or region
+with the three stages of Case and Shiller:
+
+ 1. OLS of the log price ratios on the year dummies.
+ 2. OLS of the squared residuals on the holding period (years).
+ 3. Weighted least squares with the inverse of the fitted variances.
+
+Returns nil with less than REPEAT_SALES_MIN_PAIRS pairs or two years.
+*/
+func fitRepeatSalesIndex(level string, code string, pairs []salePair) []RepeatSalesIndex {
+	if len(pairs) < REPEAT_SALES_MIN_PAIRS {
+		return nil
+	}
+
+	yearSet := make(map[int]bool)
+	for _, p := range pairs {
+		yearSet[p.year1], yearSet[p.year2] = true, true
+	}
+	years := make([]int, 0, len(yearSet))
+	for y := range yearSet {
+		years = append(years, y)
+	}
+	sort.Ints(years)
+
+	// one column per year except the first one (base 100)
+	yearCol := make(map[int]int)
+	for i, y := range years[1:] {
+		yearCol[y] = i
+	}
+
+	features := func(p salePair) ([]int, []float64) {
+		cols, values := make([]int, 0, 2), make([]float64, 0, 2)
+		if c, ok := yearCol[p.year1]; ok {
+			cols, values = append(cols, c), append(values, -1)
+		}
+		if c, ok := yearCol[p.year2]; ok {
+			cols, values = append(cols, c), append(values, 1)
+		}
+		return cols, values
+	}
+
+	fit := func(weights []float64) ([]float64, bool) {
+		ne := newNormalEquations(len(yearCol))
+		for i, p := range pairs {
+			cols, values := features(p)
+			w := math.Sqrt(weights[i])
+			for j := range values {
+				values[j] *= w
+			}
+			ne.add(cols, values, p.ratio*w)
+		}
+		// no intercept: every column gets the ridge penalty
+		for i := range ne.xtx {
+			ne.xtx[i][i] += REPEAT_SALES_RIDGE
+		}
+		return ne.solve(nil)
+	}
+
+	weights := make([]float64, len(pairs))
+	for i := range weights {
+		weights[i] = 1
+	}
+	beta, ok := fit(weights)
+	if !ok {
+		log.Errorf("%v %v: repeat-sales regression is singular\n", level, code)
+		return nil
+	}
+
+	// squared residuals against the holding period
+	variance := newNormalEquations(2)
+	for _, p := range pairs {
+		cols, values := features(p)
+		residual := p.ratio
+		for j, c := range cols {
+			residual -= beta[c] * values[j]
+		}
+		variance.add([]int{0, 1}, []float64{1, float64(p.year2 - p.year1)}, residual*residual)
+	}
+	if v, ok := variance.solve(nil); ok {
+		for i, p := range pairs {
+			weights[i] = 1 / math.Max(v[0]+v[1]*float64(p.year2-p.year1), 1e-4)
+		}
+		if weighted, ok := fit(weights); ok {
+			beta = weighted
+		}
+	}
+
+	nbPairs := make(map[int]int)
+	for _, p := range pairs {
+		nbPairs[p.year2]++
+	}
+
+	indices := make([]RepeatSalesIndex, 0, len(years))
+	for _, y := range years {
+		index := 100.0
+		if c, ok := yearCol[y]; ok {
+			index = 100 * math.Exp(beta[c])
+		}
+		indices = append(indices, RepeatSalesIndex{Level: level, Code: code, Year: y, Index: index, NbPair: nbPairs[y]})
+	}
+
+	return indices
+}
+
+// GetRepeatSalesIndex returns the yearly repeat-sales index of a department
+// or region level (all codes when code is empty) ordered by code and year.
+//
+// Returns ErrNoRepeatSalesLevel for other levels.
+func GetRepeatSalesIndex(db *gorm.DB, level string, code string) ([]RepeatSalesIndex, error) {
+	if db == nil {
+		return nil, errors.New("no database")
+	}
+
+	known := false
+	for _, l := range repeatSalesLevels {
+		known = known || l == level
+	}
+	if !known {
+		return nil, ErrNoRepeatSalesLevel
+	}
+
+	indices := make([]RepeatSalesIndex, 0)
+	if !db.Migrator().HasTable(&RepeatSalesIndex{}) {
+		return indices, nil
+	}
+
+	query := db.Where("level = ?", level)
+	if code != "" {
+		query = query.Where("code = ?", code)
+	}
+
+	result := query.Order("code").Order("year").Find(&indices)
+	if result.Error != nil {
+		log.Errorf("GetRepeatSalesIndex err: %v\n", result.Error)
+		return nil, result.Error
+	}
+
+	return indices, nil
+}
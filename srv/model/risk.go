@@ -0,0 +1,147 @@
+// Package model provides data models and helpers for the immotep application.
+// This file stores natural risk zones (Géorisques flood zones and clay
+// shrink-swell exposure) and compares prices inside and outside risk zones
+// per commune.
+package model
+
+import (
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Kinds of risk zones.
+const RISK_FLOOD = "flood"
+const RISK_CLAY = "clay"
+
+// RISK_NONE is the level used for transactions outside any zone of a kind.
+const RISK_NONE = "none"
+
+// RiskZone stores one risk polygon, its level (for example "fort" for clay
+// exposure or the PPRI zone type) and the bounding box of its contour.
+type RiskZone struct {
+	Id      uint64  `gorm:"primaryKey;autoIncrement" json:"id"`
+	Kind    string  `gorm:"index" json:"kind"`
+	Level   string  `json:"level"`
+	Name    string  `json:"name"`
+	Contour string  `json:"contour"`
+	MinLat  float64 `json:"-"`
+	MaxLat  float64 `json:"-"`
+	MinLong float64 `json:"-"`
+	MaxLong float64 `json:"-"`
+}
+
+// RiskCityAgg stores price statistics of a commune for one risk kind and
+// level (RISK_NONE for transactions outside the zones). Discount is the
+// relative difference between the median price per m² of the level and the
+// one outside the zones.
+// Primary key is (CityCode, Kind, Level).
+type RiskCityAgg struct {
+	CityCode       string  `gorm:"primaryKey" json:"city"`
+	Kind           string  `gorm:"primaryKey" json:"kind"`
+	Level          string  `gorm:"primaryKey" json:"level"`
+	DepartmentCode string  `gorm:"index" json:"dep"`
+	NbTransaction  int     `json:"nb_transaction"`
+	AvgPrice       float64 `json:"avg_price"`
+	MedianPrice    float64 `json:"median_price"`
+	Discount       float64 `json:"discount"`
+}
+
+// riskColumns maps risk kinds to their transactions column.
+var riskColumns = map[string]string{RISK_FLOOD: "flood_risk", RISK_CLAY: "clay_risk"}
+
+/*
+aggregateRisks compares prices inside and outside risk zones per commune
+and stores the results in risk_city_aggs.
+
+Behavior:
+  - Only geocoded transactions are used.
+  - Nothing is stored for a kind when no zone of that kind is loaded.
+*/
+func aggregateRisks(db *gorm.DB) error {
+	for kind, column := range riskColumns {
+		var count int64
+		db.Model(&RiskZone{}).Where("kind = ?", kind).Count(&count)
+		if count == 0 {
+			log.Infof("No %v risk zone loaded.\n", kind)
+			continue
+		}
+
+		rows, err := db.Select("city_code, department_code, " + column + ", price_psqm").
+			Table("transactions").
+			Scopes(withoutOutliers).
+			Where("lat <> 0").
+			Rows()
+		if err != nil {
+			log.Errorf("aggregateRisks err: %v\n", err)
+			return err
+		}
+
+		type key struct{ city, level string }
+		prices := make(map[key][]float64)
+		deps := make(map[string]string)
+
+		for rows.Next() {
+			var city, dep, level string
+			var psqm float64
+
+			rows.Scan(&city, &dep, &level, &psqm)
+			if level == "" {
+				level = RISK_NONE
+			}
+			prices[key{city, level}] = append(prices[key{city, level}], psqm)
+			deps[city] = dep
+		}
+		rows.Close()
+
+		aggs := make([]RiskCityAgg, 0, len(prices))
+		for k, values := range prices {
+			agg := RiskCityAgg{CityCode: k.city, Kind: kind, Level: k.level, DepartmentCode: deps[k.city],
+				NbTransaction: len(values), AvgPrice: mean(values), MedianPrice: median(values)}
+
+			if k.level != RISK_NONE {
+				if outside := median(prices[key{k.city, RISK_NONE}]); outside > 0 {
+					agg.Discount = agg.MedianPrice/outside - 1
+				}
+			}
+
+			aggs = append(aggs, agg)
+		}
+
+		result := db.CreateInBatches(&aggs, 200)
+		if result.Error != nil {
+			log.Errorf("Error insert risk_city_aggs: %v\n", result.Error)
+			return result.Error
+		}
+	}
+
+	return nil
+}
+
+// GetRiskStats returns risk price comparisons, optionally filtered by
+// department (dep != "") and commune (city != "").
+func GetRiskStats(db *gorm.DB, dep string, city string) []RiskCityAgg {
+	if db == nil {
+		return nil
+	}
+
+	stats := make([]RiskCityAgg, 0)
+	if !db.Migrator().HasTable(&RiskCityAgg{}) {
+		return stats
+	}
+
+	query := db.Model(&RiskCityAgg{})
+	if dep != "" {
+		query = query.Where("department_code = ?", dep)
+	}
+	if city != "" {
+		query = query.Where("city_code = ?", city)
+	}
+
+	result := query.Order("city_code, kind, level").Limit(10000).Find(&stats)
+	if result.Error != nil {
+		log.Errorf("GetRiskStats err: %v\n", result.Error)
+		return nil
+	}
+
+	return stats
+}
@@ -0,0 +1,224 @@
+// Package model provides data models and helpers for the immotep application.
+// This file breaks the yearly aggregates of every level down by market
+// segment: buckets of built area, number of rooms and land area, so that a
+// commune can be compared like for like (a 60 m² and a 200 m² house do not
+// share a price per m²).
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Segment dimensions.
+const SEGMENT_AREA = "area"
+const SEGMENT_ROOMS = "rooms"
+const SEGMENT_LAND = "land"
+
+// SegmentBuckets are the lower bounds of the buckets of each dimension
+// (after the first bucket starting at 0). A value belongs to the bucket
+// [bound, next bound). They are set by the CLI (aggregate --area-buckets,
+// --room-buckets and --land-buckets).
+var SegmentBuckets = map[string][]int{
+	SEGMENT_AREA:  {60, 90, 120, 160},
+	SEGMENT_ROOMS: {3, 4, 5, 6},
+	SEGMENT_LAND:  {300, 800, 2000},
+}
+
+// segmentDimensions lists the dimensions in insertion order.
+var segmentDimensions = []string{SEGMENT_AREA, SEGMENT_ROOMS, SEGMENT_LAND}
+
+// ErrUnknownSegment is returned when a segment dimension is unknown.
+var ErrUnknownSegment = errors.New("unknown segment")
+
+// SegmentAgg stores the statistics of one bucket of a segment dimension for
+// a code of a level and a year. Bucket is the label of the bucket ("60-89",
+// "4", "160+"...). Primary key is (Level, Code, Year, Dimension, Bucket).
+type SegmentAgg struct {
+	Level     string  `gorm:"primaryKey" json:"level"`
+	Code      string  `gorm:"primaryKey" json:"code"`
+	Year      int     `gorm:"primaryKey" json:"year"`
+	Dimension string  `gorm:"primaryKey" json:"dimension"`
+	Bucket    string  `gorm:"primaryKey" json:"bucket"`
+	Name      string  `json:"nom"`
+	AvgPrice  float64 `json:"avg_price"`
+	PriceDistribution
+}
+
+// SegmentBucket returns the label of the bucket of value in a dimension:
+// "lower-upper" (inclusive), "lower" for one value buckets and "lower+" for
+// the last one.
+func SegmentBucket(dimension string, value int) string {
+	lower := 0
+	for _, upper := range SegmentBuckets[dimension] {
+		if value < upper {
+			if upper-1 == lower {
+				return fmt.Sprint(lower)
+			}
+			return fmt.Sprintf("%d-%d", lower, upper-1)
+		}
+		lower = upper
+	}
+
+	return fmt.Sprintf("%d+", lower)
+}
+
+/*
+aggregateSegments computes the yearly statistics of each bucket of every
+segment dimension for each code of the level and inserts them into
+segment_aggs.
+
+Behavior:
+  - key is the level name stored in the Level column (city, iris...).
+  - Transactions without area are ignored.
+  - Statistics are computed in Go like aggregateLevel, from level.fromYear.
+*/
+func aggregateSegments(db *gorm.DB, key string, level aggLevel) error {
+	if err := level.clearSince(db, "segment_aggs", "level = ?", key); err != nil {
+		return err
+	}
+
+	colList := fmt.Sprintf("%s as year, %s as code, %s as name, transactions.price_psqm, transactions.area, transactions.nb_room, transactions.full_area",
+		yearExtract(db), level.code, level.name)
+
+	query := db.Select(colList).Table("transactions").Scopes(withoutOutliers).Where("transactions.area > 0")
+	for _, j := range level.joins {
+		query = query.Joins(j)
+	}
+	if level.where != "" {
+		query = query.Where(level.where, level.args...)
+	}
+
+	rows, err := query.Rows()
+	if err != nil {
+		log.Errorf("aggregateSegments %v err: %v\n", level.label, err)
+		return err
+	}
+
+	type segment struct {
+		code      string
+		year      int
+		dimension string
+		bucket    string
+	}
+
+	names := make(map[string]string)
+	psqms := make(map[segment][]float64)
+	for rows.Next() {
+		var code, name sql.NullString
+		var year, area, nbRoom, fullArea int
+		var psqm float64
+
+		rows.Scan(&year, &code, &name, &psqm, &area, &nbRoom, &fullArea)
+		if year < level.fromYear {
+			continue
+		}
+		if name.String != "" {
+			names[code.String] = name.String
+		}
+
+		values := map[string]int{SEGMENT_AREA: area, SEGMENT_ROOMS: nbRoom, SEGMENT_LAND: fullArea}
+		for _, dimension := range segmentDimensions {
+			s := segment{code.String, year, dimension, SegmentBucket(dimension, values[dimension])}
+			psqms[s] = append(psqms[s], psqm)
+		}
+	}
+	rows.Close()
+
+	var agg2update = make([]map[string]interface{}, 0, len(psqms))
+	for s, values := range psqms {
+		agg := newPriceDistribution(values).columns()
+		agg["level"], agg["code"], agg["name"], agg["year"] = key, s.code, names[s.code], s.year
+		agg["dimension"], agg["bucket"], agg["avg_price"] = s.dimension, s.bucket, mean(values)
+		agg2update = append(agg2update, agg)
+	}
+
+	if len(agg2update) <= 0 {
+		log.Infof("Nothing to aggregate by segment for %v.\n", level.label)
+		return nil
+	}
+
+	return insertAggregates(db, "segment_aggs", []string{"level", "code", "year", "dimension", "bucket"}, agg2update)
+}
+
+/*
+GetSegments returns the segment statistics of a code of an aggregation level
+(city, iris, epci, department, region or zone) ordered by year, dimension
+and bucket.
+
+Behavior:
+  - dimension and bucket are optional filters.
+  - year 0 returns every year.
+
+Returns ErrUnknownLevel or ErrUnknownSegment for unknown names and an empty
+slice when the segments are not aggregated yet.
+*/
+func GetSegments(db *gorm.DB, level string, code string, dimension string, bucket string, year int) ([]SegmentAgg, error) {
+	if db == nil {
+		return nil, errors.New("no database")
+	}
+
+	if _, ok := aggLevels[level]; !ok {
+		return nil, ErrUnknownLevel
+	}
+	if _, ok := SegmentBuckets[dimension]; dimension != "" && !ok {
+		return nil, ErrUnknownSegment
+	}
+
+	segments := make([]SegmentAgg, 0)
+	if !db.Migrator().HasTable(&SegmentAgg{}) {
+		return segments, nil
+	}
+
+	query := db.Where("level = ? AND code = ?", level, code)
+	if dimension != "" {
+		query = query.Where("dimension = ?", dimension)
+	}
+	if bucket != "" {
+		query = query.Where("bucket = ?", bucket)
+	}
+	if year > 0 {
+		query = query.Where("year = ?", year)
+	}
+
+	result := query.Find(&segments)
+	if result.Error != nil {
+		log.Errorf("GetSegments err: %v\n", result.Error)
+		return nil, result.Error
+	}
+
+	// buckets in the order of their lower bound
+	order := make(map[string]int)
+	for i, d := range segmentDimensions {
+		order[d] = i
+	}
+	lower := func(bucket string) int {
+		var l int
+		fmt.Sscanf(bucket, "%d", &l)
+		return l
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		a, b := segments[i], segments[j]
+		if a.Year != b.Year {
+			return a.Year < b.Year
+		}
+		if a.Dimension != b.Dimension {
+			return order[a.Dimension] < order[b.Dimension]
+		}
+		return lower(a.Bucket) < lower(b.Bucket)
+	})
+
+	return segments, nil
+}
+
+// deleteSegments removes the segment statistics of a code.
+func deleteSegments(db *gorm.DB, level string, code string) {
+	if db.Migrator().HasTable(&SegmentAgg{}) {
+		db.Where("level = ? AND code = ?", level, code).Delete(&SegmentAgg{})
+	}
+}
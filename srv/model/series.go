@@ -0,0 +1,244 @@
+// Package model provides data models and helpers for the immotep application.
+// This file computes monthly and quarterly aggregates of every level with
+// rolling 12-month averages and counts, so that trends are visible between
+// two yearly aggregates (DVF is published every six months).
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Granularities of the time series.
+const GRANULARITY_MONTH = "month"
+const GRANULARITY_QUARTER = "quarter"
+const GRANULARITY_YEAR = "year"
+
+const SQLITE_QUERY_MONTH_EXTRACT = "strftime('%m', transactions.date)"
+const POSTGRES_QUERY_MONTH_EXTRACT = "EXTRACT(month FROM transactions.date)"
+
+// ErrUnknownGranularity is returned when a series granularity is unknown.
+var ErrUnknownGranularity = errors.New("unknown granularity")
+
+// PeriodAgg stores the statistics of one code of a level over a month or a
+// quarter. Number is the month (1-12) or quarter (1-4) of Year and Period
+// its label ("2023-05" or "2023-Q2"). Volume is the sum of the sale prices
+// and VolumeIncrease its relative change compared to the same period of the
+// previous year (nil without sales then); Weak is set with less than LIQUIDITY_MIN_SALES sales. The
+// rolling columns cover the 12 months ending with the period.
+// Primary key is (Level, Code, Period).
+type PeriodAgg struct {
+	Level                string   `gorm:"primaryKey" json:"level"`
+	Code                 string   `gorm:"primaryKey" json:"code"`
+	Period               string   `gorm:"primaryKey" json:"period"`
+	Name                 string   `json:"nom"`
+	Year                 int      `json:"year"`
+	Number               int      `json:"number"`
+	AvgPrice             float64  `json:"avg_price"`
+	NbTransaction        int      `json:"nb_transaction"`
+	Volume               float64  `json:"volume"`
+	VolumeIncrease       *float64 `json:"volume_increase"`
+	Weak                 bool     `gorm:"default:false" json:"weak"`
+	RollingAvgPrice      float64  `json:"rolling_avg_price"`
+	RollingNbTransaction int      `json:"rolling_nb_transaction"`
+	RollingVolume        float64  `json:"rolling_volume"`
+}
+
+// MonthlyAgg stores monthly aggregates (table monthly_aggs).
+type MonthlyAgg struct {
+	PeriodAgg
+}
+
+// QuarterlyAgg stores quarterly aggregates (table quarterly_aggs).
+type QuarterlyAgg struct {
+	PeriodAgg
+}
+
+// periodGranularity describes how months are grouped into periods.
+type periodGranularity struct {
+	table  string
+	months int // number of months of a period
+	label  func(year, number int) string
+}
+
+var periodGranularities = map[string]periodGranularity{
+	GRANULARITY_MONTH: {table: "monthly_aggs", months: 1,
+		label: func(year, number int) string { return fmt.Sprintf("%d-%02d", year, number) }},
+	GRANULARITY_QUARTER: {table: "quarterly_aggs", months: 3,
+		label: func(year, number int) string { return fmt.Sprintf("%d-Q%d", year, number) }},
+}
+
+// monthExtract returns the SQL expression extracting the month of a
+// transaction for the current DB dialect.
+func monthExtract(db *gorm.DB) string {
+	if db.Dialector.Name() == "sqlite" {
+		return SQLITE_QUERY_MONTH_EXTRACT
+	}
+
+	return POSTGRES_QUERY_MONTH_EXTRACT
+}
+
+// periodSum holds the sum of the prices per sqm, the number of sales and the
+// sum of the sale prices of a period.
+type periodSum struct {
+	sum    float64
+	count  int
+	volume float64
+}
+
+/*
+aggregatePeriods computes the monthly and quarterly aggregates of each code
+of the level and inserts them into monthly_aggs and quarterly_aggs.
+
+Behavior:
+  - Sums the price per sqm by code, year and month in SQL.
+  - Groups months into periods in Go and computes, for every period with
+    sales, the average, the volume and its change over a year and the
+    rolling average, count and volume over the 12 months ending with the
+    period.
+  - key is the level name stored in the Level column (city, iris...).
+  - Writes only the periods from level.fromYear, after deleting the
+    previous rows of the codes aggregated again; the previous periods are
+    still read for the rolling values and the volume changes.
+*/
+func aggregatePeriods(db *gorm.DB, key string, level aggLevel) error {
+	for _, g := range periodGranularities {
+		if err := level.clearSince(db, g.table, "level = ?", key); err != nil {
+			return err
+		}
+	}
+
+	colList := fmt.Sprintf("%s as code, %s as name, %s as year, %s as month, SUM(transactions.price_psqm), COUNT(*), SUM(transactions.price)",
+		level.code, level.name, yearExtract(db), monthExtract(db))
+
+	query := db.Select(colList).Table("transactions").Scopes(withoutOutliers)
+	for _, j := range level.joins {
+		query = query.Joins(j)
+	}
+	if level.where != "" {
+		query = query.Where(level.where, level.args...)
+	}
+
+	rows, err := query.Group(level.code).Group(level.name).Group(yearExtract(db)).Group(monthExtract(db)).Rows()
+	if err != nil {
+		log.Errorf("aggregatePeriods %v err: %v\n", level.label, err)
+		return err
+	}
+
+	// sums by code and month index (year * 12 + month - 1)
+	names := make(map[string]string)
+	months := make(map[string]map[int]periodSum)
+
+	for rows.Next() {
+		var code, name sql.NullString
+		var year, month, count int
+		var sum, volume float64
+
+		rows.Scan(&code, &name, &year, &month, &sum, &count, &volume)
+		if months[code.String] == nil {
+			months[code.String] = make(map[int]periodSum)
+		}
+		s := months[code.String][year*12+month-1]
+		months[code.String][year*12+month-1] = periodSum{s.sum + sum, s.count + count, s.volume + volume}
+		if name.String != "" {
+			names[code.String] = name.String
+		}
+	}
+	rows.Close()
+
+	for _, granularity := range []string{GRANULARITY_MONTH, GRANULARITY_QUARTER} {
+		g := periodGranularities[granularity]
+		window := 12 / g.months
+
+		var agg2update = make([]map[string]interface{}, 0, 1000)
+		for code, sums := range months {
+			periods := make(map[int]periodSum)
+			for m, s := range sums {
+				p := periods[m/g.months]
+				periods[m/g.months] = periodSum{p.sum + s.sum, p.count + s.count, p.volume + s.volume}
+			}
+
+			for p, s := range periods {
+				rolling := periodSum{}
+				for i := p - window + 1; i <= p; i++ {
+					rolling.sum += periods[i].sum
+					rolling.count += periods[i].count
+					rolling.volume += periods[i].volume
+				}
+
+				year, number := p*g.months/12, p%window+1
+				if year < level.fromYear {
+					continue
+				}
+				agg2update = append(agg2update, map[string]interface{}{
+					"level": key, "code": code, "name": names[code],
+					"period": g.label(year, number), "year": year, "number": number,
+					"avg_price": s.sum / float64(s.count), "nb_transaction": s.count,
+					"volume": s.volume, "volume_increase": relativeChange(s.volume, periods[p-window].volume), "weak": s.count < LIQUIDITY_MIN_SALES,
+					"rolling_avg_price": rolling.sum / float64(rolling.count), "rolling_nb_transaction": rolling.count,
+					"rolling_volume": rolling.volume,
+				})
+			}
+		}
+
+		if len(agg2update) <= 0 {
+			log.Infof("Nothing to aggregate by %v for %v.\n", granularity, level.label)
+			continue
+		}
+
+		if err := insertAggregates(db, g.table, []string{"level", "code", "period"}, agg2update); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+GetSeries returns the monthly or quarterly aggregates of a code of an
+aggregation level (city, iris, epci, department, region or zone), ordered by
+period.
+
+Returns ErrUnknownLevel or ErrUnknownGranularity for unknown names and an
+empty slice when the series are not aggregated yet.
+*/
+func GetSeries(db *gorm.DB, level string, code string, granularity string) ([]PeriodAgg, error) {
+	if db == nil {
+		return nil, errors.New("no database")
+	}
+
+	if _, ok := aggLevels[level]; !ok {
+		return nil, ErrUnknownLevel
+	}
+	g, ok := periodGranularities[granularity]
+	if !ok {
+		return nil, ErrUnknownGranularity
+	}
+
+	series := make([]PeriodAgg, 0)
+	if !db.Migrator().HasTable(g.table) {
+		return series, nil
+	}
+
+	result := db.Table(g.table).Where("level = ? AND code = ?", level, code).
+		Order("year").Order("number").Find(&series)
+	if result.Error != nil {
+		log.Errorf("GetSeries err: %v\n", result.Error)
+		return nil, result.Error
+	}
+
+	return series, nil
+}
+
+// deletePeriods removes the monthly and quarterly aggregates of a code.
+func deletePeriods(db *gorm.DB, level string, code string) {
+	for _, g := range periodGranularities {
+		if db.Migrator().HasTable(g.table) {
+			db.Table(g.table).Where("level = ? AND code = ?", level, code).Delete(&PeriodAgg{})
+		}
+	}
+}
@@ -0,0 +1,187 @@
+// Package model provides data models and helpers for the immotep application.
+// This file contains small statistics helpers computed in Go so that they
+// work the same way on every database.
+package model
+
+import (
+	"math"
+	"sort"
+)
+
+// median returns the median of values (0 for an empty slice). values is not
+// modified.
+func median(values []float64) float64 {
+	n := len(values)
+	if n == 0 {
+		return 0
+	}
+
+	sorted := make([]float64, n)
+	copy(sorted, values)
+	sort.Float64s(sorted)
+
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// percentile returns the p (0..1) percentile of sorted values using linear
+// interpolation between closest ranks, like PostgreSQL percentile_cont (0 for
+// an empty slice).
+func percentile(sorted []float64, p float64) float64 {
+	n := len(sorted)
+	if n == 0 {
+		return 0
+	}
+
+	rank := p * float64(n-1)
+	lower := int(math.Floor(rank))
+	if lower >= n-1 {
+		return sorted[n-1]
+	}
+
+	return sorted[lower] + (rank-float64(lower))*(sorted[lower+1]-sorted[lower])
+}
+
+// stddev returns the sample standard deviation of values (0 for less than
+// two values).
+func stddev(values []float64) float64 {
+	n := len(values)
+	if n < 2 {
+		return 0
+	}
+
+	m := mean(values)
+	sum := 0.0
+	for _, v := range values {
+		sum += (v - m) * (v - m)
+	}
+
+	return math.Sqrt(sum / float64(n-1))
+}
+
+// PriceDistribution describes the distribution of the price per m² of a set
+// of transactions: median, percentiles, standard deviation and count.
+type PriceDistribution struct {
+	MedianPricePSQM float64 `json:"median_price_psqm"`
+	P10             float64 `json:"p10"`
+	P25             float64 `json:"p25"`
+	P75             float64 `json:"p75"`
+	P90             float64 `json:"p90"`
+	StdDev          float64 `json:"stddev"`
+	NbTransaction   int     `json:"nb_transaction"`
+}
+
+// newPriceDistribution computes the distribution of psqms. psqms is not
+// modified.
+func newPriceDistribution(psqms []float64) PriceDistribution {
+	sorted := make([]float64, len(psqms))
+	copy(sorted, psqms)
+	sort.Float64s(sorted)
+
+	return PriceDistribution{
+		MedianPricePSQM: percentile(sorted, 0.5),
+		P10:             percentile(sorted, 0.1),
+		P25:             percentile(sorted, 0.25),
+		P75:             percentile(sorted, 0.75),
+		P90:             percentile(sorted, 0.9),
+		StdDev:          stddev(sorted),
+		NbTransaction:   len(sorted),
+	}
+}
+
+// columns returns the distribution as a column map for updates.
+func (d PriceDistribution) columns() map[string]interface{} {
+	return map[string]interface{}{"median_price_psqm": d.MedianPricePSQM, "p10": d.P10, "p25": d.P25,
+		"p75": d.P75, "p90": d.P90, "std_dev": d.StdDev, "nb_transaction": d.NbTransaction}
+}
+
+// solveLinear solves a x = b by Gaussian elimination with partial pivoting.
+// a and b are modified. Returns false when the system is singular.
+func solveLinear(a [][]float64, b []float64) ([]float64, bool) {
+	n := len(b)
+
+	for col := 0; col < n; col++ {
+		pivot := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(a[row][col]) > math.Abs(a[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(a[pivot][col]) < 1e-12 {
+			return nil, false
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		b[col], b[pivot] = b[pivot], b[col]
+
+		for row := col + 1; row < n; row++ {
+			f := a[row][col] / a[col][col]
+			if f == 0 {
+				continue
+			}
+			for k := col; k < n; k++ {
+				a[row][k] -= f * a[col][k]
+			}
+			b[row] -= f * b[col]
+		}
+	}
+
+	x := make([]float64, n)
+	for row := n - 1; row >= 0; row-- {
+		sum := b[row]
+		for k := row + 1; k < n; k++ {
+			sum -= a[row][k] * x[k]
+		}
+		x[row] = sum / a[row][row]
+	}
+
+	return x, true
+}
+
+// normalEquations accumulates the normal equations X'X b = X'y of a least
+// squares regression whose rows are sparse (dummy variables).
+type normalEquations struct {
+	xtx [][]float64
+	xty []float64
+}
+
+// newNormalEquations returns empty normal equations of k coefficients.
+func newNormalEquations(k int) *normalEquations {
+	ne := &normalEquations{xtx: make([][]float64, k), xty: make([]float64, k)}
+	for i := range ne.xtx {
+		ne.xtx[i] = make([]float64, k)
+	}
+	return ne
+}
+
+// add accumulates one observation: values of the non zero columns cols
+// and the response y.
+func (ne *normalEquations) add(cols []int, values []float64, y float64) {
+	for i, ci := range cols {
+		ne.xty[ci] += values[i] * y
+		for j, cj := range cols {
+			ne.xtx[ci][cj] += values[i] * values[j]
+		}
+	}
+}
+
+// solve returns the coefficients. ridge[i] is added to the diagonal of
+// column i (no penalty when nil) to shrink its coefficient towards 0 and
+// keep nearly collinear systems solvable.
+func (ne *normalEquations) solve(ridge []float64) ([]float64, bool) {
+	k := len(ne.xty)
+	a := make([][]float64, k)
+	for i := range a {
+		a[i] = make([]float64, k)
+		copy(a[i], ne.xtx[i])
+		if i < len(ridge) {
+			a[i][i] += ridge[i]
+		}
+	}
+	b := make([]float64, k)
+	copy(b, ne.xty)
+
+	return solveLinear(a, b)
+}
@@ -0,0 +1,376 @@
+// Package model provides data models and helpers for the immotep application.
+// This file builds a smoothed price surface from the geocoded transactions by
+// inverse-distance weighting (IDW): the price per m² at a point is the
+// average of the sales within a bandwidth weighted by 1/distance².
+//
+// The surface estimates a value and its uncertainty for any point or commune
+// and fills the missing yearly averages of the communes without sales (rural
+// communes often have no sale in a year); such averages are flagged as
+// interpolated in city_yearly_aggs.
+package model
+
+import (
+	"errors"
+	"math"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// SURFACE_DEFAULT_BANDWIDTH is the default radius (m) of the sales used to
+// estimate the surface at a point.
+const SURFACE_DEFAULT_BANDWIDTH = 5000.0
+
+// SURFACE_MIN_DISTANCE is the distance (m) under which sales get the same
+// weight, so that a sale at the point does not take all the weight.
+const SURFACE_MIN_DISTANCE = 100.0
+
+// SURFACE_MIN_SAMPLES is the min number of sales within the bandwidth needed
+// to estimate the surface at a point.
+const SURFACE_MIN_SAMPLES = 3
+
+// SurfaceBandwidth is the bandwidth (m) used by AggregateData to fill the
+// commune averages. It is set by the CLI (aggregate --bandwidth).
+var SurfaceBandwidth = SURFACE_DEFAULT_BANDWIDTH
+
+// ErrBadSurfaceQuery is returned when neither a location nor a commune is
+// given.
+var ErrBadSurfaceQuery = errors.New("lat and lng or city are required")
+
+// SurfaceEstimate holds the interpolated price per m² at a point for a year.
+// Uncertainty is the standard error of the weighted average and NbSample
+// the number of sales within Bandwidth (Value is 0 with less than
+// SURFACE_MIN_SAMPLES sales).
+type SurfaceEstimate struct {
+	Lat         float64 `json:"lat"`
+	Long        float64 `json:"lng"`
+	CityCode    string  `json:"city,omitempty"`
+	Year        int     `json:"year"`
+	Bandwidth   float64 `json:"bandwidth"`
+	Value       float64 `json:"value"`
+	Uncertainty float64 `json:"uncertainty"`
+	NbSample    int     `json:"nb_sample"`
+}
+
+// surfacePoint is a geocoded sale used by the surface.
+type surfacePoint struct {
+	lat, long, psqm float64
+}
+
+// idwEstimate returns the IDW average of the points within bandwidth of
+// (lat, long) with the standard error of the weighted average (weighted
+// standard deviation over the square root of the effective sample size).
+func idwEstimate(points []surfacePoint, lat, long float64, bandwidth float64) (value, uncertainty float64, n int) {
+	sumW, sumW2, sum := 0.0, 0.0, 0.0
+	weights := make([]float64, len(points))
+	for i, p := range points {
+		d := DistanceMeters(lat, long, p.lat, p.long)
+		if d > bandwidth {
+			continue
+		}
+		d = math.Max(d, SURFACE_MIN_DISTANCE)
+		weights[i] = 1 / (d * d)
+		sumW += weights[i]
+		sumW2 += weights[i] * weights[i]
+		sum += weights[i] * p.psqm
+		n++
+	}
+	if n < SURFACE_MIN_SAMPLES {
+		return 0, 0, n
+	}
+
+	value = sum / sumW
+	variance := 0.0
+	for i, p := range points {
+		variance += weights[i] * (p.psqm - value) * (p.psqm - value)
+	}
+	variance /= sumW
+
+	// effective sample size of the weights
+	nEff := sumW * sumW / sumW2
+
+	return value, math.Sqrt(variance / nEff), n
+}
+
+// radiusBounds returns the bounding box of the circle of radius (m) around
+// (lat, long).
+func radiusBounds(lat, long float64, radius float64) Bounds {
+	dLat := radius / 111000
+	dLong := dLat / math.Max(math.Cos(lat*math.Pi/180), 0.1)
+
+	return Bounds{MinLat: lat - dLat, MaxLat: lat + dLat, MinLong: long - dLong, MaxLong: long + dLong}
+}
+
+// loadSurfacePoints reads the geocoded sales of a year (outliers excluded
+// unless IncludeOutliers is set), within b when b is not nil.
+func loadSurfacePoints(db *gorm.DB, year int, b *Bounds) []surfacePoint {
+	query := db.Select("transactions.lat, transactions.long, transactions.price_psqm").
+		Table("transactions").
+		Scopes(withoutOutliers).
+		Where("transactions.lat <> 0 AND transactions.price_psqm > 0").
+		Where("CAST("+yearExtract(db)+" AS INTEGER) = ?", year)
+	if b != nil {
+		query = query.Where("transactions.lat >= ? AND transactions.lat <= ? AND transactions.long >= ? AND transactions.long <= ?",
+			b.MinLat, b.MaxLat, b.MinLong, b.MaxLong)
+	}
+
+	rows, err := query.Rows()
+	if err != nil {
+		log.Errorf("loadSurfacePoints err: %v\n", err)
+		return nil
+	}
+	defer rows.Close()
+
+	points := make([]surfacePoint, 0, 1000)
+	for rows.Next() {
+		var p surfacePoint
+
+		rows.Scan(&p.lat, &p.long, &p.psqm)
+		points = append(points, p)
+	}
+
+	return points
+}
+
+// cityCenter returns the center of the bounding box of a commune contour.
+func cityCenter(contour string) (lat, long float64, ok bool) {
+	geom, err := ParseContour(contour)
+	if err != nil {
+		return 0, 0, false
+	}
+	b := GeometryBounds(geom)
+	if b.MinLat > b.MaxLat {
+		return 0, 0, false
+	}
+
+	return (b.MinLat + b.MaxLat) / 2, (b.MinLong + b.MaxLong) / 2, true
+}
+
+/*
+EstimateSurface returns the interpolated price per m² at a point, or at the
+center of a commune when cityCode is given.
+
+Behavior:
+  - year 0 selects the most recent year with sales.
+  - bandwidth <= 0 uses SURFACE_DEFAULT_BANDWIDTH.
+
+Returns ErrBadSurfaceQuery without location and ErrUnknownLocation when the
+commune has no contour.
+*/
+func EstimateSurface(db *gorm.DB, lat, long float64, cityCode string, year int, bandwidth float64) (*SurfaceEstimate, error) {
+	if db == nil {
+		return nil, errors.New("no database")
+	}
+	if bandwidth <= 0 {
+		bandwidth = SURFACE_DEFAULT_BANDWIDTH
+	}
+
+	if cityCode != "" {
+		var city City
+		if result := db.Select("code, contour").Where("code = ?", cityCode).Limit(1).Find(&city); result.Error != nil {
+			log.Errorf("EstimateSurface err: %v\n", result.Error)
+			return nil, result.Error
+		}
+		var ok bool
+		if lat, long, ok = cityCenter(city.Contour); !ok {
+			return nil, ErrUnknownLocation
+		}
+	} else if lat == 0 && long == 0 {
+		return nil, ErrBadSurfaceQuery
+	}
+
+	if year == 0 {
+		var latest *int
+		db.Model(&Transaction{}).Select("MAX(CAST(" + yearExtract(db) + " AS INTEGER))").Scan(&latest)
+		if latest != nil {
+			year = *latest
+		}
+	}
+
+	b := radiusBounds(lat, long, bandwidth)
+	points := loadSurfacePoints(db, year, &b)
+
+	estimate := SurfaceEstimate{Lat: lat, Long: long, CityCode: cityCode, Year: year, Bandwidth: bandwidth}
+	estimate.Value, estimate.Uncertainty, estimate.NbSample = idwEstimate(points, lat, long, bandwidth)
+
+	return &estimate, nil
+}
+
+/*
+interpolateCities fills the yearly averages of the communes without sales
+with the price surface at their center, within SurfaceBandwidth.
+
+Behavior:
+  - Only missing years are inserted in city_yearly_aggs, flagged interpolated
+    with their uncertainty; the averages computed from sales are never
+    overwritten.
+  - Communes without contour or without enough sales around keep their
+    values.
+  - Averages interpolated by a previous aggregation are no longer flagged
+    once the commune has sales; the other ones are deleted and interpolated
+    again from all the current sales.
+  - The yearly increase, CAGR and multi-year changes of the interpolated
+    averages are computed afterwards against the averages computed from
+    sales only (see updateCityIncreases).
+*/
+func interpolateCities(db *gorm.DB) error {
+	bandwidth := SurfaceBandwidth
+	if bandwidth <= 0 {
+		bandwidth = SURFACE_DEFAULT_BANDWIDTH
+	}
+
+	result := db.Model(&CityYearlyAgg{}).Where("interpolated = ? AND nb_transaction > 0", true).
+		Updates(map[string]interface{}{"interpolated": false, "uncertainty": 0.0})
+	if result.Error != nil {
+		log.Errorf("interpolateCities err: %v\n", result.Error)
+		return result.Error
+	}
+	result = db.Where("interpolated = ? AND nb_transaction = 0", true).Delete(&CityYearlyAgg{})
+	if result.Error != nil {
+		log.Errorf("interpolateCities err: %v\n", result.Error)
+		return result.Error
+	}
+
+	var cities []City
+	if result := db.Select("code, name, contour").Find(&cities); result.Error != nil {
+		log.Errorf("interpolateCities err: %v\n", result.Error)
+		return result.Error
+	}
+
+	rows, err := db.Select(yearExtract(db) + " as year, city_code, COUNT(*)").
+		Table("transactions").
+		Scopes(withoutOutliers).
+		Group("year").Group("city_code").
+		Rows()
+	if err != nil {
+		log.Errorf("interpolateCities err: %v\n", err)
+		return err
+	}
+
+	counts := make(map[int]map[string]int)
+	for rows.Next() {
+		var year, count int
+		var code string
+
+		rows.Scan(&year, &code, &count)
+		if counts[year] == nil {
+			counts[year] = make(map[string]int)
+		}
+		counts[year][code] = count
+	}
+	rows.Close()
+
+	deflator := NewDeflator(db, CpiBaseYear)
+	cpiBase := 0
+	if deflator != nil {
+		cpiBase = deflator.Base
+	}
+
+	// 1° of latitude is about 111 km: cells of the size of the bandwidth
+	cell := bandwidth / 111000
+
+	var agg2update = make([]map[string]interface{}, 0, 1000)
+	for year, yearCounts := range counts {
+		points := loadSurfacePoints(db, year, nil)
+		index := NewGridIndex(cell)
+		for i, p := range points {
+			index.Add(i, radiusBounds(p.lat, p.long, bandwidth))
+		}
+
+		for _, c := range cities {
+			if yearCounts[c.Code] > 0 {
+				continue
+			}
+			lat, long, ok := cityCenter(c.Contour)
+			if !ok {
+				continue
+			}
+
+			ids := index.Query(lat, long)
+			near := make([]surfacePoint, len(ids))
+			for i, id := range ids {
+				near[i] = points[id]
+			}
+
+			value, uncertainty, n := idwEstimate(near, lat, long, bandwidth)
+			if n < SURFACE_MIN_SAMPLES {
+				continue
+			}
+
+			agg := newPriceDistribution(nil).columns()
+			agg["code"], agg["year"], agg["name"], agg["nb_transaction"] = c.Code, year, c.Name, 0
+			agg["avg_price"], agg["interpolated"], agg["uncertainty"], agg["weak"] = value, true, uncertainty, true
+			agg["cpi_base"], agg["real_avg_price"] = cpiBase, 0.0
+			if deflator != nil {
+				agg["real_avg_price"] = deflator.Deflate(value, year)
+			}
+			agg2update = append(agg2update, agg)
+		}
+	}
+
+	if len(agg2update) <= 0 {
+		log.Infof("No commune average to interpolate.\n")
+		return nil
+	}
+
+	for start := 0; start < len(agg2update); start += 200 {
+		end := min(start+200, len(agg2update))
+		batch := agg2update[start:end]
+
+		result := db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "code"}, {Name: "year"}},
+			DoNothing: true,
+		}).Table("city_yearly_aggs").Create(&batch)
+		if result.Error != nil {
+			log.Errorf("Error interpolateCities: %v\n", result.Error)
+			return result.Error
+		}
+	}
+
+	codes := make(map[string]bool)
+	for _, agg := range agg2update {
+		codes[agg["code"].(string)] = true
+	}
+	if err := updateCityIncreases(db, codes); err != nil {
+		return err
+	}
+	log.Infof("%v commune averages interpolated.\n", len(agg2update))
+
+	return nil
+}
+
+// updateCityIncreases computes the growth columns (increase, CAGR and
+// multi-year changes, see growthColumns) of the interpolated averages of the
+// communes of codes. Only the averages computed from sales are used as
+// previous years, so the growth of the other averages is left unchanged.
+func updateCityIncreases(db *gorm.DB, codes map[string]bool) error {
+	var aggs []CityYearlyAgg
+	if result := db.Select("code, year, avg_price, interpolated").Order("code, year").Find(&aggs); result.Error != nil {
+		log.Errorf("updateCityIncreases err: %v\n", result.Error)
+		return result.Error
+	}
+
+	prevCode := ""
+	averages := make(map[int]float64)
+	for _, a := range aggs {
+		if a.Code != prevCode {
+			prevCode, averages = a.Code, make(map[int]float64)
+		}
+		if !a.Interpolated {
+			averages[a.Year] = a.AvgPrice
+			continue
+		}
+
+		if codes[a.Code] {
+			growth := growthColumns(a.Year, a.AvgPrice, averages)
+			result := db.Model(&CityYearlyAgg{}).Where("code = ? AND year = ?", a.Code, a.Year).Updates(growth)
+			if result.Error != nil {
+				log.Errorf("Error updateCityIncreases: %v\n", result.Error)
+				return result.Error
+			}
+		}
+	}
+
+	return nil
+}
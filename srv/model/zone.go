@@ -0,0 +1,369 @@
+// Package model provides data models and helpers for the immotep application.
+// This file manages user-defined zones: named GeoJSON polygons (for example a
+// project catchment area) that get the same statistics as cities.
+//
+// The transactions located inside a zone are stored in the zone_transactions
+// table. Membership is computed when a zone is saved and refreshed by
+// LocateZones (called by ComputeStat and AggregateData).
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	geojson "github.com/paulmach/go.geojson"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+	"gorm.io/gorm"
+)
+
+// Zone stores a user-defined named polygon, its contour GeoJSON feature and
+// the bounding box of the contour.
+type Zone struct {
+	Code      string    `gorm:"primaryKey" json:"code"`
+	Name      string    `json:"nom"`
+	Contour   string    `json:"contour"`
+	AvgPrice  float64   `json:"avgPrice"`
+	MinLat    float64   `json:"-"`
+	MaxLat    float64   `json:"-"`
+	MinLong   float64   `json:"-"`
+	MaxLong   float64   `json:"-"`
+	CreatedAt time.Time `json:"createdAt"`
+	PriceDistribution
+}
+
+// ZoneTransaction links a zone to a transaction located inside it.
+// Primary key is (ZoneCode, TrId).
+type ZoneTransaction struct {
+	ZoneCode string `gorm:"primaryKey"`
+	TrId     uint64 `gorm:"primaryKey;autoIncrement:false"`
+}
+
+// ZoneInfo holds zone details returned by the zone helpers including contour
+// and yearly stats.
+type ZoneInfo struct {
+	Code          string           `json:"code"`
+	Name          string           `json:"name"`
+	AvgPriceSQM   float64          `json:"avgprice"`
+	NbTransaction int64            `json:"nbtransaction"`
+	Contour       *geojson.Feature `json:"contour"`
+	Stat          map[int]string   `json:"stat"`
+}
+
+// ErrZoneNotFound is returned when a zone code does not exist.
+var ErrZoneNotFound = errors.New("zone not found")
+
+// ErrInvalidZone is returned by SaveZone when the zone name or polygon is
+// invalid.
+var ErrInvalidZone = errors.New("invalid zone")
+
+var zoneCodeCleaner = regexp.MustCompile(`[^a-z0-9]+`)
+
+// ZoneCode builds the zone code from its name: lower case ASCII words
+// separated by '-' (e.g. "Bassin d'Arcachon" -> "bassin-d-arcachon").
+func ZoneCode(name string) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	ascii, _, _ := transform.String(t, strings.ToLower(name))
+
+	return strings.Trim(zoneCodeCleaner.ReplaceAllString(ascii, "-"), "-")
+}
+
+// parseZoneGeometry decodes a GeoJSON Feature, FeatureCollection (first
+// feature) or bare geometry and checks it is a Polygon or MultiPolygon.
+func parseZoneGeometry(data []byte) (*geojson.Geometry, error) {
+	var geom *geojson.Geometry
+
+	if fc, err := geojson.UnmarshalFeatureCollection(data); err == nil && len(fc.Features) > 0 {
+		geom = fc.Features[0].Geometry
+	} else if g, err := ParseContour(string(data)); err == nil {
+		geom = g
+	}
+
+	if geom == nil || !(geom.IsPolygon() || geom.IsMultiPolygon()) {
+		return nil, fmt.Errorf("%w: it must be a GeoJSON Polygon or MultiPolygon", ErrInvalidZone)
+	}
+
+	return geom, nil
+}
+
+// SaveZone creates or replaces the zone called name with the GeoJSON
+// polygon in data, locates the transactions inside it and computes its
+// average price, yearly aggregates and monthly and quarterly series.
+//
+// Returns the saved zone details, ErrInvalidZone if the name or polygon is
+// invalid or the database error.
+func SaveZone(db *gorm.DB, name string, data []byte) (*ZoneInfo, error) {
+	if db == nil {
+		return nil, errors.New("no database")
+	}
+
+	code := ZoneCode(name)
+	if code == "" {
+		return nil, fmt.Errorf("%w: the name is empty", ErrInvalidZone)
+	}
+
+	geom, err := parseZoneGeometry(data)
+	if err != nil {
+		return nil, err
+	}
+
+	feature := geojson.NewFeature(geom)
+	feature.SetProperty("code", code)
+	feature.SetProperty("nom", name)
+	contour, err := json.Marshal(feature)
+	if err != nil {
+		return nil, err
+	}
+
+	b := GeometryBounds(geom)
+	zone := Zone{Code: code, Name: name, Contour: string(contour),
+		MinLat: b.MinLat, MaxLat: b.MaxLat, MinLong: b.MinLong, MaxLong: b.MaxLong, CreatedAt: time.Now()}
+
+	result := db.Save(&zone)
+	if result.Error != nil {
+		log.Errorf("SaveZone err: %v\n", result.Error)
+		return nil, result.Error
+	}
+
+	if err := locateZone(db, zone); err != nil {
+		return nil, err
+	}
+	computeZone(db, code)
+
+	level := zoneLevel.forCode(code)
+	db.AutoMigrate(&ZoneYearlyAgg{})
+	db.Where("code = ?", code).Delete(&ZoneYearlyAgg{})
+	if err := aggregateLevel(db, level); err != nil {
+		return nil, err
+	}
+	if err := aggregateAffordability(db, level); err != nil {
+		return nil, err
+	}
+	db.AutoMigrate(&MonthlyAgg{}, &QuarterlyAgg{})
+	deletePeriods(db, "zone", code)
+	if err := aggregatePeriods(db, "zone", level); err != nil {
+		return nil, err
+	}
+	db.AutoMigrate(&SegmentAgg{})
+	deleteSegments(db, "zone", code)
+	if err := aggregateSegments(db, "zone", level); err != nil {
+		return nil, err
+	}
+	deleteForecasts(db, "zone", code)
+
+	return GetZone(db, code, nil)
+}
+
+// DeleteZone removes a zone, its transaction links and its aggregates.
+func DeleteZone(db *gorm.DB, code string) error {
+	if db == nil {
+		return errors.New("no database")
+	}
+
+	result := db.Where("code = ?", code).Delete(&Zone{})
+	if result.Error != nil {
+		log.Errorf("DeleteZone err: %v\n", result.Error)
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrZoneNotFound
+	}
+
+	db.Where("zone_code = ?", code).Delete(&ZoneTransaction{})
+	if db.Migrator().HasTable(&ZoneYearlyAgg{}) {
+		db.Where("code = ?", code).Delete(&ZoneYearlyAgg{})
+	}
+	deletePeriods(db, "zone", code)
+	deleteSegments(db, "zone", code)
+	deleteForecasts(db, "zone", code)
+
+	return nil
+}
+
+// GetZones returns all zones with their contour and yearly stats (in real
+// euros when deflator is not nil).
+func GetZones(db *gorm.DB, deflator *Deflator) []ZoneInfo {
+	if db == nil {
+		return nil
+	}
+
+	var zones []Zone
+
+	result := db.Order("code").Find(&zones)
+	if result.Error != nil {
+		log.Errorf("GetZones err: %v\n", result.Error)
+		return nil
+	}
+
+	infos := make([]ZoneInfo, 0, len(zones))
+	for _, z := range zones {
+		infos = append(infos, zoneInfo(db, z, deflator))
+	}
+
+	return infos
+}
+
+// GetZone returns the details of one zone or ErrZoneNotFound. Yearly stats
+// are deflated when deflator is not nil.
+func GetZone(db *gorm.DB, code string, deflator *Deflator) (*ZoneInfo, error) {
+	if db == nil {
+		return nil, errors.New("no database")
+	}
+
+	var zones []Zone
+
+	result := db.Where("code = ?", code).Find(&zones)
+	if result.Error != nil {
+		log.Errorf("GetZone err: %v\n", result.Error)
+		return nil, result.Error
+	}
+	if len(zones) == 0 {
+		return nil, ErrZoneNotFound
+	}
+
+	info := zoneInfo(db, zones[0], deflator)
+
+	return &info, nil
+}
+
+// GetZoneTransactions returns the most recent transactions located inside a
+// zone (limit default 100, bounded to 500).
+func GetZoneTransactions(db *gorm.DB, code string, limit int) []TransactionPOI {
+	if db == nil {
+		return nil
+	}
+
+	if limit <= 0 {
+		limit = 100
+	} else if limit > 500 {
+		limit = 500
+	}
+
+	var pois []TransactionPOI
+
+	result := db.Joins("JOIN zone_transactions ON zone_transactions.tr_id = transactions.tr_id").
+		Where("zone_transactions.zone_code = ?", code).
+		Order("date DESC").
+		Limit(limit).
+		Find(&pois)
+
+	if result.Error != nil {
+		log.Errorf("GetZoneTransactions err: %v\n", result.Error)
+		return nil
+	}
+
+	return pois
+}
+
+// zoneInfo converts a zone row into a ZoneInfo with contour and stats.
+func zoneInfo(db *gorm.DB, z Zone, deflator *Deflator) ZoneInfo {
+	info := ZoneInfo{Code: z.Code, Name: z.Name, AvgPriceSQM: z.AvgPrice}
+
+	db.Model(&ZoneTransaction{}).Where("zone_code = ?", z.Code).Count(&info.NbTransaction)
+
+	feat, err := geojson.UnmarshalFeature([]byte(z.Contour))
+	if err != nil {
+		log.Errorf("zoneInfo UnmarshalGeometry err: %v\n", err)
+	} else {
+		info.Contour = feat
+		info.Contour.SetProperty("avgprice", z.AvgPrice)
+	}
+
+	info.Stat = getZoneStat(db, z.Code, deflator)
+
+	return info
+}
+
+// getZoneStat returns a map year -> formatted string for zone aggregates.
+func getZoneStat(db *gorm.DB, s string, deflator *Deflator) map[int]string {
+	var statMap map[int]string = make(map[int]string)
+
+	if !db.Migrator().HasTable(&ZoneYearlyAgg{}) {
+		return statMap
+	}
+
+	var stat []ZoneYearlyAgg
+
+	result := db.Where("code = ?", s).Find(&stat)
+
+	if result.Error != nil {
+		log.Errorf("getZoneStat err: %v\n", result.Error)
+	} else {
+		for _, s := range stat {
+			statMap[s.Year] = deflator.stat(s.Year, s.AvgPrice, s.Increase)
+		}
+	}
+
+	return statMap
+}
+
+// LocateZones refreshes the transactions located inside every zone.
+func LocateZones(db *gorm.DB) error {
+	var zones []Zone
+
+	result := db.Find(&zones)
+	if result.Error != nil {
+		log.Errorf("LocateZones err: %v\n", result.Error)
+		return result.Error
+	}
+
+	for _, z := range zones {
+		if err := locateZone(db, z); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// locateZone replaces the zone_transactions rows of zone z with the geocoded
+// transactions inside its contour.
+func locateZone(db *gorm.DB, z Zone) error {
+	geom, err := ParseContour(z.Contour)
+	if err != nil {
+		log.Errorf("locateZone cannot decode contour of %v: %v\n", z.Code, err)
+		return err
+	}
+
+	var trans []Transaction
+
+	result := db.Select("tr_id, lat, long").
+		Where("lat <> 0 AND lat >= ? AND lat <= ? AND long >= ? AND long <= ?", z.MinLat, z.MaxLat, z.MinLong, z.MaxLong).
+		Find(&trans)
+
+	if result.Error != nil {
+		log.Errorf("locateZone err: %v\n", result.Error)
+		return result.Error
+	}
+
+	links := make([]ZoneTransaction, 0, len(trans))
+	for _, t := range trans {
+		if PointInGeometry(geom, t.Lat, t.Long) {
+			links = append(links, ZoneTransaction{ZoneCode: z.Code, TrId: t.TrId})
+		}
+	}
+
+	result = db.Where("zone_code = ?", z.Code).Delete(&ZoneTransaction{})
+	if result.Error != nil {
+		log.Errorf("locateZone err: %v\n", result.Error)
+		return result.Error
+	}
+	if len(links) > 0 {
+		result = db.CreateInBatches(&links, 1000)
+		if result.Error != nil {
+			log.Errorf("locateZone insert err: %v\n", result.Error)
+			return result.Error
+		}
+	}
+
+	log.Debugf("Zone %v: %v transactions\n", z.Code, len(links))
+
+	return nil
+}